@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yellowman/GoPieNg/internal/db"
+	"github.com/yellowman/GoPieNg/internal/dhcp"
+	"github.com/yellowman/GoPieNg/internal/dns"
+	"github.com/yellowman/GoPieNg/internal/export"
+	"github.com/yellowman/GoPieNg/internal/importer"
+	"github.com/yellowman/GoPieNg/internal/migrate"
+	"github.com/yellowman/GoPieNg/internal/neighbors"
+	"github.com/yellowman/GoPieNg/internal/routercfg"
+)
+
+// Subcommands run once against the database and exit,
+// e.g. "gopieng reverse-zone -network 12 > 2.0.192.in-addr.arpa.zone"
+type command struct {
+	usage string
+	run   func(database *db.DB, args []string) error
+}
+
+var commands = map[string]command{
+	"reverse-zone":   {"generate the PTR zone for a network", cmdReverseZone},
+	"dhcp":           {"generate ISC dhcpd or Kea config for a leaf network", cmdDHCP},
+	"leases":         {"reconcile a DHCP lease file against recorded hosts", cmdLeases},
+	"import":         {"bulk import networks and hosts from CSV or JSON", cmdImport},
+	"export":         {"export the networks tree with hosts as JSON, CSV or YAML", cmdExport},
+	"router-configs": {"compare router configs with IPAM and create missing records", cmdRouterConfigs},
+	"neighbors":      {"record ARP/NDP neighbor or switch MAC tables", cmdNeighbors},
+	"check":          {"audit hosts and networks for broken containment and overlaps", cmdCheck},
+	"migrate":        {"apply or roll back schema migrations (up|down|status)", cmdMigrate},
+}
+
+func runCommand(dsn string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q; available commands:\n", args[0])
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+		}
+		return 2
+	}
+	database, err := db.Open(dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "db open: %v\n", err)
+		return 1
+	}
+	defer database.Close()
+	if err := cmd.run(database, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// Zone flags shared by the DNS commands; empty values fall back to the environment
+func zoneFlags(fs *flag.FlagSet) func() (dns.Options, error) {
+	ns := fs.String("ns", "", "Comma-separated nameservers (default $PIENG_DNS_NS)")
+	rname := fs.String("rname", "", "SOA responsible mailbox (default $PIENG_DNS_RNAME)")
+	ttl := fs.Int("ttl", 0, "Default TTL (default 3600)")
+	tmpl := fs.String("template", "", "Hostname template for hosts without one (default $PIENG_PTR_TEMPLATE)")
+	return func() (dns.Options, error) {
+		opts, err := db.DNSOptions()
+		if err != nil {
+			return opts, err
+		}
+		if *ns != "" {
+			opts.NS = nil
+			for _, n := range strings.Split(*ns, ",") {
+				if n = strings.TrimSpace(n); !dns.ValidHostname(n) {
+					return opts, fmt.Errorf("-ns: invalid nameserver %q", n)
+				}
+				opts.NS = append(opts.NS, n)
+			}
+		}
+		if *rname != "" {
+			if !dns.ValidMailbox(*rname) {
+				return opts, fmt.Errorf("-rname: invalid mailbox %q", *rname)
+			}
+			opts.RName = *rname
+		}
+		opts.TTL = *ttl
+		if *tmpl != "" {
+			if opts.Template, err = dns.ParseNameTemplate(*tmpl); err != nil {
+				return opts, err
+			}
+		}
+		return opts, nil
+	}
+}
+
+func cmdReverseZone(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("reverse-zone", flag.ExitOnError)
+	network := fs.Int64("network", 0, "Network ID")
+	options := zoneFlags(fs)
+	fs.Parse(args)
+	if *network == 0 {
+		return fmt.Errorf("-network required")
+	}
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+	z, err := db.ReverseZone(database.DB, *network, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Print(z.String())
+	return nil
+}
+
+func cmdDHCP(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("dhcp", flag.ExitOnError)
+	network := fs.Int64("network", 0, "Leaf network ID")
+	format := fs.String("format", "isc", "Output format: isc or kea")
+	servers := fs.String("dns", "", "Comma-separated DNS servers to hand out")
+	domain := fs.String("domain", "", "Domain name to hand out")
+	fs.Parse(args)
+	if *network == 0 {
+		return fmt.Errorf("-network required")
+	}
+	var dnsServers []string
+	if *servers != "" {
+		dnsServers = strings.Split(*servers, ",")
+	}
+	out, err := db.DHCPConfig(database.DB, *network, *format, dnsServers, *domain)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func cmdLeases(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("leases", flag.ExitOnError)
+	file := fs.String("file", "", "Lease file (dhcpd.leases or Kea lease CSV)")
+	format := fs.String("format", "", "Lease file format: isc or kea (default: guess)")
+	create := fs.Bool("create", false, "Add hosts for unrecorded leases")
+	update := fs.Bool("update", false, "Set host MACs from their leases")
+	user := fs.String("user", "", "Username recorded in the change log")
+	fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("-file required")
+	}
+	if (*create || *update) && *user == "" {
+		return fmt.Errorf("-user required with -create or -update")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	leases, err := dhcp.ParseLeases(f, *format)
+	if err != nil {
+		return err
+	}
+	rep, err := db.ReconcileLeases(database.DB, leases, db.LeaseOptions{Create: *create, Update: *update, Record: true, Username: *user})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func cmdNeighbors(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("neighbors", flag.ExitOnError)
+	file := fs.String("file", "", "arp -an, ndp -an or ip neigh output, SNMP ipNetToMedia CSV, or a MAC address table")
+	format := fs.String("format", "", "Table format: "+strings.Join(neighbors.Formats, ", ")+" (default: guess)")
+	device := fs.String("device", "", "Router or switch the table was taken from")
+	seen := fs.String("seen", "", "RFC 3339 time the table was taken (default now)")
+	fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("-file required")
+	}
+	at := time.Now().UTC()
+	if *seen != "" {
+		t, err := time.Parse(time.RFC3339, *seen)
+		if err != nil {
+			return fmt.Errorf("-seen: %v", err)
+		}
+		at = t.UTC()
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := neighbors.Parse(f, *format)
+	if err != nil {
+		return err
+	}
+	rep, err := db.RecordNeighbors(database.DB, entries, *device, at)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func cmdImport(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "CSV or JSON rows, or for -source a JSON object of tables")
+	format := fs.String("format", "", "Input format: csv or json (default: guess)")
+	source := fs.String("source", "", "Read a netbox or phpipam dump; extra arguments are table=path")
+	vrf := fs.String("vrf", "", "With -source, import only this VRF (\"global\" for none)")
+	commit := fs.Bool("commit", false, "Apply the import (default is a dry run)")
+	user := fs.String("user", "", "Username recorded in the change log")
+	fs.Parse(args)
+	if *file == "" && fs.NArg() == 0 {
+		return fmt.Errorf("-file required")
+	}
+	if *commit && *user == "" {
+		return fmt.Errorf("-user required with -commit")
+	}
+	var rows []importer.Row
+	var err error
+	if *source == "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		rows, err = importer.Parse(f, *format)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		tables := importer.Tables{}
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			tables, err = importer.ParseTables(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		for _, arg := range fs.Args() {
+			name, path, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("bad table argument %q, want name=path", arg)
+			}
+			if tables[name], err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		switch *source {
+		case "netbox":
+			rows, err = importer.NetBox(tables, *vrf)
+		case "phpipam":
+			rows, err = importer.PHPIPAM(tables, *vrf)
+		default:
+			return fmt.Errorf("-source must be netbox or phpipam")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	res, err := db.ImportRows(database.DB, rows, db.ImportOptions{Commit: *commit, AllowTopLevel: true, Username: *user})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return err
+	}
+	if *commit && !res.Committed {
+		return fmt.Errorf("%d conflicts, nothing imported", res.Conflicts)
+	}
+	return nil
+}
+
+func cmdCheck(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "Move misplaced hosts into the leaf network that contains them")
+	user := fs.String("user", "", "Username recorded in the change log")
+	fs.Parse(args)
+	if *fix && *user == "" {
+		return fmt.Errorf("-user required with -fix")
+	}
+	rep, err := db.CheckDatabase(database.DB, *fix, *user)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		return err
+	}
+	// exit non-zero so cron mails the report
+	if open := len(rep.Violations) - rep.Fixed; open > 0 {
+		return fmt.Errorf("%d violations", open)
+	}
+	return nil
+}
+
+func cmdMigrate(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", 0, "up: stop after this version (default: latest)")
+	steps := fs.Int("steps", 1, "down: number of migrations to roll back")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gopieng migrate [flags] up|down|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	migs := migrate.For(database.Driver)
+	switch fs.Arg(0) {
+	case "up":
+		done, err := migrate.Up(database.DB, migs, *to)
+		for _, m := range done {
+			fmt.Printf("applied %s\n", m)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Printf("schema is at version %d, nothing to do\n", migrate.Latest(migs))
+		}
+		return err
+	case "down":
+		done, err := migrate.Down(database.DB, migs, *steps)
+		for _, m := range done {
+			fmt.Printf("reverted %s\n", m)
+		}
+		return err
+	case "status":
+		list, err := migrate.List(database.DB, migs)
+		if err != nil {
+			return err
+		}
+		for _, st := range list {
+			applied := "pending"
+			if st.Applied != nil {
+				applied = st.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%-28s %s\n", st.Migration, applied)
+		}
+		return nil
+	}
+	fs.Usage()
+	os.Exit(2)
+	return nil
+}
+
+func cmdExport(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	root := fs.Int64("root", 0, "Network ID of the subtree to export (default: whole tree)")
+	format := fs.String("format", "json", "Output format: json, csv or yaml")
+	fs.Parse(args)
+	w, err := export.NewWriter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+	if err := db.ExportTree(database.DB, *root, w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func cmdRouterConfigs(database *db.DB, args []string) error {
+	fs := flag.NewFlagSet("router-configs", flag.ExitOnError)
+	format := fs.String("format", "", "Config format: ios, junos or openbsd (default: guess per file)")
+	root := fs.Int64("root", 0, "Only report stale networks under this network ID")
+	commit := fs.Bool("commit", false, "Create the missing networks and hosts")
+	user := fs.String("user", "", "Username recorded in the change log")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("config files required")
+	}
+	if *commit && *user == "" {
+		return fmt.Errorf("-user required with -commit")
+	}
+	var ifaces []routercfg.Interface
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		found, err := routercfg.Parse(f, *format, name)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		ifaces = append(ifaces, found...)
+	}
+	rep, err := db.CompareConfigs(database.DB, ifaces, *root, db.ImportOptions{Commit: *commit, AllowTopLevel: true, Username: *user})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		return err
+	}
+	if *commit && len(rep.Failed) > 0 {
+		return fmt.Errorf("%d of %d missing records not created", len(rep.Failed), len(rep.Import.Rows))
+	}
+	return nil
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +10,7 @@ import (
 	"net/http/fcgi"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +18,11 @@ import (
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/yellowman/GoPieNg/internal/apierr"
 	"github.com/yellowman/GoPieNg/internal/auth"
 	"github.com/yellowman/GoPieNg/internal/db"
 	"github.com/yellowman/GoPieNg/internal/middleware"
+	"github.com/yellowman/GoPieNg/internal/migrate"
 )
 
 var (
@@ -32,6 +34,7 @@ var (
 	flagVerbose   = flag.Bool("v", false, "Verbose logging (always enabled in -web mode)")
 	flagDebug     = flag.Bool("d", false, "Debug mode - run in foreground, don't daemonize")
 	flagPidFile   = flag.String("P", "", "Write PID to file (for rc.d scripts)")
+	flagSkipSchema = flag.Bool("skip-schema-check", false, "Start even if schema migrations are pending")
 )
 
 func main() {
@@ -43,6 +46,11 @@ func main() {
 		log.Fatal("PIENG_DSN is required")
 	}
 
+	// Subcommands (e.g. "gopieng reverse-zone -network 12") run once and exit
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(dsn, flag.Args()))
+	}
+
 	secret := os.Getenv("PIENG_JWT_SECRET")
 	if secret == "" {
 		log.Fatal("PIENG_JWT_SECRET is required in production")
@@ -75,6 +83,13 @@ func main() {
 	if err := testDB.Ping(); err != nil {
 		log.Fatalf("db ping: %v", err)
 	}
+	// Refuse to serve against a schema the handlers don't match
+	if err := migrate.Check(testDB.DB, migrate.For(testDB.Driver)); err != nil {
+		if !*flagSkipSchema {
+			log.Fatalf("%v (run \"gopieng migrate up\" or start with -skip-schema-check)", err)
+		}
+		log.Printf("WARNING: %v", err)
+	}
 	testDB.Close()
 
 	// Daemonize unless -d (debug) or -web mode
@@ -136,6 +151,15 @@ func main() {
 	// Pledge on OpenBSD (no-op on other systems)
 	pledge()
 
+	// The background jobs need PostgreSQL
+	if database.Driver == "postgres" {
+		// Send queued dynamic DNS updates in the background
+		go db.RunDNSUpdates(context.Background(), database.DB)
+
+		// Sweep networks marked for discovery on a schedule
+		go db.RunDiscovery(context.Background(), database.DB)
+	}
+
 	// Run server
 	if *flagWeb {
 		runHTTP(r, addr)
@@ -199,25 +223,22 @@ func buildRouter(database *db.DB, jwt *auth.Manager, noStatic bool, webRoot stri
 	r.Route("/api/pieng", func(api chi.Router) {
 		// Unauthenticated
 		api.Post("/auth/login", auth.MakeLoginHandler(database.DB, jwt))
-		api.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			var lastID sql.NullInt64
-			database.DB.QueryRow(`SELECT id FROM changelog ORDER BY id DESC LIMIT 1`).Scan(&lastID)
-			if lastID.Valid {
-				json.NewEncoder(w).Encode(map[string]any{"status": "ok", "last_change": lastID.Int64})
-			} else {
-				json.NewEncoder(w).Encode(map[string]any{"status": "ok", "last_change": 0})
-			}
-		})
+		api.Get("/openapi.json", db.OpenAPIHandler(r, "/api/pieng"))
+		api.Get("/ping", db.PingHandler(database.DB))
 
 		// Authenticated
 		api.Group(func(priv chi.Router) {
 			priv.Use(middleware.JWT(jwt))
 			priv.Get("/me", auth.MeHandler(database.DB, jwt))
-			priv.Mount("/", db.API(database.DB, jwt))
+			priv.Mount("/", database.Handler(jwt))
 		})
 	})
 
+	// Every route should be in the OpenAPI document
+	for _, route := range db.UndocumentedRoutes(r, "/api/pieng") {
+		log.Printf("openapi: %s is not documented", route)
+	}
+
 	return r
 }
 
@@ -335,10 +356,12 @@ func rateLimiter(limit int, window time.Duration) func(http.Handler) http.Handle
 			}
 			c.count++
 			count := c.count
+			resetAt := c.resetAt
 			mu.Unlock()
 
 			if count > limit {
-				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+				apierr.Write(w, r, apierr.RateLimited, "rate limit exceeded")
 				return
 			}
 
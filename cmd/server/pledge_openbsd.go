@@ -13,11 +13,12 @@ func pledge() {
 	// unix - Unix sockets (for FastCGI)
 	// cpath - create/delete files (for socket creation)
 	// fattr - file attributes (chmod on socket)
+	// route - read the ARP/NDP table for check-ip
 	//
 	// Note: unveil should also be used to restrict filesystem access
 	// but that requires knowing paths at compile time
 	
-	if err := unix.Pledge("stdio rpath cpath fattr inet dns unix", ""); err != nil {
+	if err := unix.Pledge("stdio rpath cpath fattr inet dns unix route", ""); err != nil {
 		// Log but don't fail - pledge may not be available
 		// in chroot or other restricted environments
 	}
@@ -9,3 +9,5 @@ require (
 	github.com/lib/pq v1.10.9
 	golang.org/x/sys v0.20.0
 )
+
+require github.com/mattn/go-sqlite3 v1.14.22
@@ -0,0 +1,89 @@
+// Package apierr writes API errors as one JSON envelope:
+//
+//	{"code": "NOT_FOUND", "message": "network not found", "request_id": "host/abc-000042"}
+//
+// Code is stable and meant for programs; message is for people and may
+// change. Details, when present, say more about the error, e.g. which
+// fields were rejected.
+package apierr
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Error codes
+const (
+	BadRequest     = "BAD_REQUEST"     // malformed request: bad JSON, unknown format
+	Invalid        = "INVALID"         // a value was rejected, e.g. not an IP address
+	Unauthorized   = "UNAUTHORIZED"    // missing or bad token, or wrong credentials
+	UserDisabled   = "USER_DISABLED"   // the account is disabled
+	Forbidden      = "FORBIDDEN"       // the user's roles don't allow it
+	NotFound       = "NOT_FOUND"       // no such network, host or user
+	Exists         = "EXISTS"          // the address, network or username is taken
+	Overlap        = "OVERLAP"         // the network overlaps a sibling
+	OutsideNetwork = "OUTSIDE_NETWORK" // not inside the parent network or the host's network
+	NoSpace        = "NO_SPACE"        // no free address or subnet left
+	Conflict       = "CONFLICT"        // the request clashes with the current state
+	RateLimited    = "RATE_LIMITED"
+	Internal       = "INTERNAL" // logged on the server, never echoed
+)
+
+var statuses = map[string]int{
+	BadRequest:     http.StatusBadRequest,
+	Invalid:        http.StatusBadRequest,
+	Unauthorized:   http.StatusUnauthorized,
+	UserDisabled:   http.StatusForbidden,
+	Forbidden:      http.StatusForbidden,
+	NotFound:       http.StatusNotFound,
+	Exists:         http.StatusConflict,
+	Overlap:        http.StatusConflict,
+	OutsideNetwork: http.StatusConflict,
+	NoSpace:        http.StatusConflict,
+	Conflict:       http.StatusConflict,
+	RateLimited:    http.StatusTooManyRequests,
+	Internal:       http.StatusInternalServerError,
+}
+
+// Status is the HTTP status sent for code
+func Status(code string) int {
+	if s, ok := statuses[code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is the envelope
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Write answers with code and message
+func Write(w http.ResponseWriter, r *http.Request, code, message string) {
+	WriteDetails(w, r, code, message, nil)
+}
+
+// WriteDetails answers with code, message and details
+func WriteDetails(w http.ResponseWriter, r *http.Request, code, message string, details any) {
+	e := Error{Code: code, Message: message, Details: details, RequestID: middleware.GetReqID(r.Context())}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(Status(code))
+	json.NewEncoder(w).Encode(e)
+}
+
+// InternalError logs err with the request ID and answers 500 without
+// passing err on, as it may carry SQL or paths
+func InternalError(w http.ResponseWriter, r *http.Request, err error) {
+	id := middleware.GetReqID(r.Context())
+	log.Printf("%s %s: %v (request %s)", r.Method, r.URL.Path, err, id)
+	Write(w, r, Internal, "internal error")
+}
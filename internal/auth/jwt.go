@@ -10,6 +10,7 @@ import (
 	time "time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
 )
 
 type Manager struct{ secret []byte }
@@ -41,11 +42,11 @@ type loginResp struct{ Token string `json:"token"`; User struct{ ID int64 `json:
 func MakeLoginHandler(db *sql.DB, jwtm *Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request){
 		var req loginReq
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "bad json", 400); return }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apierr.Write(w, r, apierr.BadRequest, "bad json"); return }
 		var id int64; var username, passhash string; var status int
-		if err := db.QueryRowContext(r.Context(), `SELECT id, username, password, status FROM users WHERE username=$1`, req.Username).Scan(&id,&username,&passhash,&status); err != nil { http.Error(w, "invalid credentials", 401); return }
-		if status == 0 { http.Error(w, "user disabled", 403); return }
-		if !CheckRFC2307SSHA(passhash, req.Password) { http.Error(w, "invalid credentials", 401); return }
+		if err := db.QueryRowContext(r.Context(), `SELECT id, username, password, status FROM users WHERE username=$1`, req.Username).Scan(&id,&username,&passhash,&status); err != nil { apierr.Write(w, r, apierr.Unauthorized, "invalid credentials"); return }
+		if status == 0 { apierr.Write(w, r, apierr.UserDisabled, "user disabled"); return }
+		if !CheckRFC2307SSHA(passhash, req.Password) { apierr.Write(w, r, apierr.Unauthorized, "invalid credentials"); return }
 		rows, _ := db.QueryContext(r.Context(), `SELECT r.name FROM roles r JOIN user_roles ur ON ur.role=r.id WHERE ur."user"=$1`, id)
 		defer rows.Close()
 		var roles []string
@@ -61,10 +62,10 @@ func MeHandler(db *sql.DB, jwtm *Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request){
 		authz := r.Header.Get("Authorization")
 		parts := strings.SplitN(authz, " ", 2)
-		if len(parts) != 2 { http.Error(w, "no token", 401); return }
-		claims, err := jwtm.Parse(parts[1]); if err != nil { http.Error(w, "invalid token", 401); return }
+		if len(parts) != 2 { apierr.Write(w, r, apierr.Unauthorized, "no token"); return }
+		claims, err := jwtm.Parse(parts[1]); if err != nil { apierr.Write(w, r, apierr.Unauthorized, "invalid token"); return }
 		var username string
-		if err := db.QueryRowContext(context.Background(), `SELECT username FROM users WHERE id=$1`, claims.UserID).Scan(&username); err != nil { http.Error(w, "user missing", 401); return }
+		if err := db.QueryRowContext(context.Background(), `SELECT username FROM users WHERE id=$1`, claims.UserID).Scan(&username); err != nil { apierr.Write(w, r, apierr.Unauthorized, "user missing"); return }
 		w.Header().Set("Content-Type","application/json")
 		json.NewEncoder(w).Encode(map[string]any{"id": claims.UserID, "username": username, "roles": claims.Roles})
 	}
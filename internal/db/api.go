@@ -3,24 +3,24 @@ package db
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/yellowman/GoPieNg/internal/auth"
+	"github.com/lib/pq"
+	"github.com/yellowman/GoPieNg/internal/apierr"
 	"github.com/yellowman/GoPieNg/internal/ipam"
 	"github.com/yellowman/GoPieNg/internal/middleware"
 )
 
-type Network struct{ ID int64; Parent sql.NullInt64; AddressRange string; Description sql.NullString; Subdivide bool; ValidMasks []int16; Owner, Account sql.NullString; Service sql.NullInt64 }
+type Network struct{ ID int64; Parent sql.NullInt64; AddressRange string; Description sql.NullString; Subdivide bool; ValidMasks []int16; Owner, Account sql.NullString; Service sql.NullInt64; Gateway, DHCPPools sql.NullString; Discover bool; LastSwept sql.NullTime }
 
-type Host struct{ Address string; NetworkID int64; Description string }
+type Host struct{ Address string; NetworkID int64; Description string; Hostname, MAC sql.NullString; LastSeen sql.NullTime }
 
-type Change struct{ Time string; Prefix string; Change string }
+type Change struct{ ID int64; Time time.Time; Prefix string; Change string; User string }
 
 // Helper to write JSON response with proper Content-Type
 func writeJSON(w http.ResponseWriter, v any) {
@@ -30,12 +30,15 @@ func writeJSON(w http.ResponseWriter, v any) {
 
 // Get username from request context
 func getUsername(r *http.Request, db *sql.DB) string {
+	return requestUsername(r, NewPostgresStore(db))
+}
+
+func requestUsername(r *http.Request, s Store) string {
 	claims := middleware.GetClaims(r)
 	if claims == nil { return "unknown" }
-	var username string
-	db.QueryRow(`SELECT username FROM users WHERE id=$1`, claims.UserID).Scan(&username)
-	if username == "" { return "unknown" }
-	return username
+	u, err := s.User(claims.UserID)
+	if err != nil || u.Username == "" { return "unknown" }
+	return u.Username
 }
 
 // Check if user has admin role
@@ -68,8 +71,20 @@ func isEditor(r *http.Request) bool {
 	return false
 }
 
+// Check if the request is from user id
+func isSelf(r *http.Request, id int64) bool {
+	claims := middleware.GetClaims(r)
+	return claims != nil && claims.UserID == id
+}
+
+// Satisfied by *sql.DB and *sql.Tx, so changes made in a transaction are logged in it
+type queryExecer interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 // Log a change - requires user FK (matches original PieNg schema)
-func logChange(db *sql.DB, prefix, action, username string) {
+func logChange(db queryExecer, prefix, action, username string) {
 	var userID int64
 	err := db.QueryRow(`SELECT id FROM users WHERE username=$1`, username).Scan(&userID)
 	if err != nil {
@@ -148,35 +163,120 @@ func formatChangeLog(change, user string) string {
 
 func API(db *sql.DB, jwt any) http.Handler {
 	r := chi.NewRouter()
+	s := NewPostgresStore(db)
+	ddns := pgDNSQueue(db)
+	storeRoutes(r, s, ddns)
+	r.Route("/v2", func(r chi.Router) { v2Routes(r, s, ddns) })
 
-	// Ping check endpoint - checks if IP responds
-	// Uses TCP connect since ICMP requires setuid which pledge disables
-	r.Get("/check-ip/{ip}", func(w http.ResponseWriter, rq *http.Request) {
-		ip := chi.URLParam(rq, "ip")
-		// Validate IP format to prevent abuse
-		if strings.ContainsAny(ip, ";|&$`\\\"' \t\n") {
-			http.Error(w, "invalid IP", 400)
-			return
-		}
-		// Try common ports to see if host is up
-		// Both SYN-ACK (open) and RST (closed) mean host is alive
-		responds := false
-		for _, port := range []string{"22", "80", "443", "23"} {
-			conn, err := net.DialTimeout("tcp", ip+":"+port, 1*time.Second)
-			if err == nil {
-				conn.Close()
-				responds = true
-				break
-			}
-			// "connection refused" = RST received = host is up
-			if strings.Contains(err.Error(), "refused") {
-				responds = true
-				break
-			}
-		}
-		writeJSON(w, map[string]any{"ip": ip, "responds": responds})
-	})
+	rpslRoutes(r, db)
+	dnsRoutes(r, db)
+	dnsUpdateRoutes(r, db)
+	dhcpRoutes(r, db)
+	leaseRoutes(r, db)
+	importRoutes(r, db)
+	exportRoutes(r, db)
+	routerConfigRoutes(r, db)
+	discoveryRoutes(r, db)
+	neighborRoutes(r, db)
+	staleRoutes(r, db)
+	checkRoutes(r, db)
+
+	return r
+}
+
+// Handler serves the API for the database: everything on PostgreSQL, the
+// core API only on SQLite, as the other endpoints query PostgreSQL
+func (d *DB) Handler(jwt any) http.Handler {
+	if d.Driver == "sqlite3" {
+		return StoreAPI(d.Store)
+	}
+	return API(d.DB, jwt)
+}
+
+// PingHandler answers that the server is up, with the ID of the latest
+// change log entry (0 for none) so clients can tell when to reload
+func PingHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var lastID sql.NullInt64
+		db.QueryRow(`SELECT id FROM changelog ORDER BY id DESC LIMIT 1`).Scan(&lastID)
+		writeJSON(w, map[string]any{"status": "ok", "last_change": lastID.Int64})
+	}
+}
 
+// StoreAPI serves the core API (networks, hosts, users and the change
+// log), v1 and v2, from any Store, e.g. a MemStore in handler tests.
+// Mount it behind middleware.JWT as the server does with API.
+func StoreAPI(s Store) http.Handler {
+	r := chi.NewRouter()
+	storeRoutes(r, s, nil)
+	r.Route("/v2", func(r chi.Router) { v2Routes(r, s, nil) })
+	return r
+}
+
+func networkJSON(n Network) map[string]any {
+	return map[string]any{
+		"id": n.ID, "parent": n.Parent.Int64, "address_range": n.AddressRange,
+		"description": n.Description.String, "subdivide": n.Subdivide, "valid_masks": n.ValidMasks,
+		"owner": n.Owner.String, "account": n.Account.String, "service": n.Service.Int64,
+		"gateway": n.Gateway.String, "dhcp_pools": n.DHCPPools.String,
+		"discover": n.Discover, "last_swept": nullTime(n.LastSwept),
+	}
+}
+
+// Answer the error of a Store call or one of the writes in ops.go: bad
+// fields are INVALID, conflicts carry their own code, and anything else
+// is logged as internal
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var conflict *ConflictError
+	var invalid *ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		apierr.WriteDetails(w, r, apierr.Invalid, invalid.Error(), invalid.Fields)
+	case errors.As(err, &conflict) && conflict.Field != "":
+		apierr.WriteDetails(w, r, conflict.Code, conflict.Msg, []FieldError{{conflict.Field, conflict.Msg}})
+	case errors.As(err, &conflict):
+		apierr.Write(w, r, conflict.Code, conflict.Msg)
+	case errors.Is(err, ErrNotFound):
+		apierr.Write(w, r, apierr.NotFound, err.Error())
+	case errors.Is(err, ErrExists):
+		apierr.Write(w, r, apierr.Exists, err.Error())
+	case errors.Is(err, errAdminOnly):
+		apierr.Write(w, r, apierr.Forbidden, err.Error())
+	default:
+		apierr.InternalError(w, r, err)
+	}
+}
+
+// Answer an error that is either about the request, e.g. a rejected field
+// or a network that can't be rendered, or from the database, which is
+// logged instead
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	var pqErr *pq.Error
+	var invalid *ValidationError
+	switch {
+	case errors.As(err, &pqErr):
+		apierr.InternalError(w, r, err)
+	case errors.As(err, &invalid):
+		apierr.WriteDetails(w, r, apierr.Invalid, invalid.Error(), invalid.Fields)
+	default:
+		apierr.Write(w, r, apierr.BadRequest, err.Error())
+	}
+}
+
+// Address ranges of a network's children
+func childRanges(s Store, id int64) ([]string, error) {
+	nets, err := s.Networks(id, "")
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, n := range nets {
+		out = append(out, n.AddressRange)
+	}
+	return out, nil
+}
+
+func storeRoutes(r chi.Router, s Store, ddns dnsQueue) {
 	// Search endpoint - searches networks or hosts based on mode
 	r.Get("/search", func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query().Get("q")
@@ -184,707 +284,453 @@ func API(db *sql.DB, jwt any) http.Handler {
 		if mode == "" {
 			mode = "hosts"
 		}
-		
+		if mode != "hosts" && mode != "networks" {
+			writeRequestError(w, r, invalidField("mode", "must be hosts or networks"))
+			return
+		}
+
 		if q == "" {
 			writeJSON(w, map[string]any{"results": []any{}})
 			return
 		}
-		
+
 		// Helper to get ancestry path (from root to parent)
 		getAncestry := func(netId int64) []int64 {
 			path := []int64{}
 			currentId := netId
 			for i := 0; i < 20; i++ { // safety limit
-				var parentId sql.NullInt64
-				err := db.QueryRow(`SELECT parent FROM networks WHERE id = $1`, currentId).Scan(&parentId)
-				if err != nil || !parentId.Valid {
+				n, err := s.Network(currentId)
+				if err != nil || !n.Parent.Valid {
 					break
 				}
-				path = append([]int64{parentId.Int64}, path...) // prepend
-				currentId = parentId.Int64
+				path = append([]int64{n.Parent.Int64}, path...) // prepend
+				currentId = n.Parent.Int64
 			}
 			return path
 		}
-		
+
 		results := []map[string]any{}
-		
+
 		if mode == "networks" {
 			// Search networks - account is EXACT match, others are fuzzy
-			pattern := "%" + q + "%"
-			rows, err := db.Query(`
-				SELECT id, address_range::text, description, owner, account 
-				FROM networks 
-				WHERE address_range::text ILIKE $1 
-				   OR description ILIKE $1 
-				   OR owner ILIKE $1 
-				   OR account = $2
-				ORDER BY address_range
-				LIMIT 100`, pattern, q)
+			nets, err := s.SearchNetworks(q, 100)
 			if err == nil {
-				defer rows.Close()
-				for rows.Next() {
-					var id int64
-					var addr string
-					var desc, owner, account sql.NullString
-					rows.Scan(&id, &addr, &desc, &owner, &account)
+				for _, n := range nets {
 					results = append(results, map[string]any{
 						"type":          "network",
-						"id":            id,
-						"address_range": addr,
-						"description":   desc.String,
-						"owner":         owner.String,
-						"account":       account.String,
-						"ancestry":      getAncestry(id),
+						"id":            n.ID,
+						"address_range": n.AddressRange,
+						"description":   n.Description.String,
+						"owner":         n.Owner.String,
+						"account":       n.Account.String,
+						"ancestry":      getAncestry(n.ID),
 					})
 				}
 			}
 		} else {
 			// Search hosts (default)
-			pattern := "%" + q + "%"
-			rows, err := db.Query(`
-				SELECT host(h.address), h.network, h.description, n.address_range::text
-				FROM hosts h
-				JOIN networks n ON h.network = n.id
-				WHERE host(h.address) ILIKE $1 
-				   OR h.description ILIKE $1
-				ORDER BY h.address
-				LIMIT 100`, pattern)
+			hosts, err := s.SearchHosts(q, 100)
 			if err == nil {
-				defer rows.Close()
-				for rows.Next() {
-					var addr string
-					var netId int64
-					var desc, netRange string
-					rows.Scan(&addr, &netId, &desc, &netRange)
-					ancestry := getAncestry(netId)
-					ancestry = append(ancestry, netId) // include the network itself
+				ranges := map[int64]string{}
+				for _, h := range hosts {
+					netRange, ok := ranges[h.NetworkID]
+					if !ok {
+						n, _ := s.Network(h.NetworkID)
+						netRange = n.AddressRange
+						ranges[h.NetworkID] = netRange
+					}
+					ancestry := getAncestry(h.NetworkID)
+					ancestry = append(ancestry, h.NetworkID) // include the network itself
 					results = append(results, map[string]any{
 						"type":          "host",
-						"address":       addr,
-						"network_id":    netId,
-						"description":   desc,
+						"address":       h.Address,
+						"network_id":    h.NetworkID,
+						"description":   h.Description,
+						"hostname":      h.Hostname.String,
 						"network_range": netRange,
 						"ancestry":      ancestry,
 					})
 				}
 			}
 		}
-		
+
 		writeJSON(w, map[string]any{"results": results})
 	})
 
-	r.Get("/networks", func(w http.ResponseWriter, r *http.Request){
-		q := r.URL.Query().Get("q")
-		parent := r.URL.Query().Get("parent_id")
-		where := ""
-		args := []any{}
-		if parent != "" { 
-			where = "WHERE parent=$1"
-			pid, _ := strconv.ParseInt(parent,10,64)
-			args = append(args, pid) 
-		} else { 
-			where = "WHERE parent IS NULL" 
-		}
-		if q != "" { 
-			if len(args)>0 { 
-				where += " AND " 
-			} else { 
-				where = "WHERE " 
-			}
-			where += "(address_range::text ILIKE '%'||$"+fmt.Sprint(len(args)+1)+"||'%' OR coalesce(description,'') ILIKE '%'||$"+fmt.Sprint(len(args)+1)+"||'%' OR coalesce(owner,'') ILIKE '%'||$"+fmt.Sprint(len(args)+1)+"||'%')"
-			args = append(args, q) 
+	r.Get("/networks", func(w http.ResponseWriter, r *http.Request) {
+		var invalid ValidationError
+		parent := queryID(&invalid, r, "parent_id")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
 		}
-		rows, err := db.Query("SELECT id, parent, address_range::text, description, subdivide, valid_masks, owner, account, service FROM networks "+where+" ORDER BY address_range", args...)
-		if err != nil { 
-			http.Error(w, err.Error(), 500)
-			return 
+		nets, err := s.Networks(parent, r.URL.Query().Get("q"))
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
 		}
-		defer rows.Close()
-		
 		out := []map[string]any{}
-		for rows.Next() { 
-			var n Network
-			var vm sql.NullString
-			if err := rows.Scan(&n.ID,&n.Parent,&n.AddressRange,&n.Description,&n.Subdivide,&vm,&n.Owner,&n.Account,&n.Service); err != nil {
-				continue
-			}
-			if vm.Valid { 
-				n.ValidMasks = ipam.ParseSmallIntArray(vm.String) 
-			}
-			out = append(out, map[string]any{
-				"id":n.ID, "parent":n.Parent.Int64, "address_range":n.AddressRange,
-				"description":n.Description.String, "subdivide":n.Subdivide, "valid_masks":n.ValidMasks,
-				"owner":n.Owner.String, "account":n.Account.String, "service":n.Service.Int64,
-			})
+		for _, n := range nets {
+			out = append(out, networkJSON(n))
 		}
 		writeJSON(w, out)
 	})
 
-	r.Get("/networks/{id}", func(w http.ResponseWriter, r *http.Request){ 
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		var n Network
-		var vm sql.NullString
-		err := db.QueryRow(`SELECT id,parent,address_range::text,description,subdivide,valid_masks,owner,account,service FROM networks WHERE id=$1`, id).Scan(&n.ID,&n.Parent,&n.AddressRange,&n.Description,&n.Subdivide,&vm,&n.Owner,&n.Account,&n.Service)
-		if err != nil { 
-			http.Error(w, "not found", 404)
-			return 
-		}
-		if vm.Valid { 
-			n.ValidMasks = ipam.ParseSmallIntArray(vm.String) 
-		}
-		writeJSON(w, map[string]any{"network": map[string]any{
-			"id": n.ID, "parent": n.Parent.Int64, "address_range": n.AddressRange,
-			"description": n.Description.String, "subdivide": n.Subdivide, "valid_masks": n.ValidMasks,
-			"owner": n.Owner.String, "account": n.Account.String, "service": n.Service.Int64,
-		}})
+	r.Get("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		n, err := s.Network(id)
+		if err != nil {
+			writeError(w, r, notFound("network", err))
+			return
+		}
+		writeJSON(w, map[string]any{"network": networkJSON(n)})
 	})
 
-	r.Patch("/networks/{id}", func(w http.ResponseWriter, r *http.Request){ 
-		if !isEditor(r) { http.Error(w, "forbidden", 403); return }
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		username := getUsername(r, db)
-		var req map[string]any
-		json.NewDecoder(r.Body).Decode(&req)
-		fields := []string{}
-		vals := []any{}
-		i := 1
-		if v, ok := req["description"].(string); ok { 
-			fields = append(fields, fmt.Sprintf("description=$%d", i))
-			vals = append(vals, v)
-			i++ 
-		}
-		if v, ok := req["owner"].(string); ok { 
-			fields = append(fields, fmt.Sprintf("owner=$%d", i))
-			vals = append(vals, v)
-			i++ 
-		}
-		if v, ok := req["account"].(string); ok { 
-			fields = append(fields, fmt.Sprintf("account=$%d", i))
-			vals = append(vals, v)
-			i++ 
-		}
-		if v, ok := req["subdivide"].(bool); ok { 
-			// subdivide is admin-only (structural change)
-			if !isAdmin(r) { http.Error(w, "forbidden: admin only", 403); return }
-			fields = append(fields, fmt.Sprintf("subdivide=$%d", i))
-			vals = append(vals, v)
-			i++ 
-		}
-		if v, ok := req["service"].(float64); ok { 
-			fields = append(fields, fmt.Sprintf("service=$%d", i))
-			vals = append(vals, int64(v))
-			i++ 
-		}
-		if v, ok := req["valid_masks"]; ok { 
-			// valid_masks is admin-only
-			if !isAdmin(r) { http.Error(w, "forbidden: admin only", 403); return }
-			arr := ipam.InterfaceToSmallIntSlice(v)
-			fields = append(fields, fmt.Sprintf("valid_masks=$%d::smallint[]", i))
-			vals = append(vals, ipam.FormatSmallIntArray(arr))
-			i++ 
-		}
-		vals = append(vals, id)
-		if len(fields) == 0 { 
-			writeJSON(w, map[string]string{"status":"no change"})
-			return 
-		}
-		q := fmt.Sprintf("UPDATE networks SET %s WHERE id=$%d", strings.Join(fields,","), i)
-		_, err := db.Exec(q, vals...)
-		if err != nil { 
-			http.Error(w, err.Error(), 500)
-			return 
-		}
-		var cidr string
-		db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&cidr)
-		logChange(db, cidr, fmt.Sprintf("updated by %s", username), username)
-		writeJSON(w, map[string]string{"status":"ok"}) 
+	r.Patch("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req networkPatch
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		_, changed, err := patchNetwork(s, id, req, isAdmin(r), requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !changed {
+			writeJSON(w, map[string]string{"status": "no change"})
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
 	})
 
-	r.Delete("/networks/{id}", func(w http.ResponseWriter, r *http.Request){ 
-		if !isCreator(r) { http.Error(w, "forbidden", 403); return }
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		username := getUsername(r, db)
-		var cidr string
-		db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&cidr)
-		_, err := db.Exec(`DELETE FROM networks WHERE id=$1`, id)
-		if err != nil { 
-			http.Error(w, err.Error(), 500)
-			return 
-		}
-		logChange(db, cidr, fmt.Sprintf("deleted by %s", username), username)
-		writeJSON(w, map[string]string{"status":"ok"}) 
+	r.Delete("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := deleteNetwork(s, id, requestUsername(r, s)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
 	})
 
-	r.Get("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request){ 
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		rows, err := db.Query(`SELECT host(address), network, description FROM hosts WHERE network=$1 ORDER BY address`, id)
+	r.Get("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		hosts, err := s.Hosts(id)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			apierr.InternalError(w, r, err)
 			return
 		}
-		defer rows.Close()
-		
 		out := []map[string]any{}
-		for rows.Next() { 
-			var a string
-			var nid int64
-			var d string
-			if err := rows.Scan(&a, &nid, &d); err != nil {
-				continue
-			}
-			out = append(out, map[string]any{"address": a, "network": nid, "description": d}) 
+		for _, h := range hosts {
+			out = append(out, map[string]any{"address": h.Address, "network": h.NetworkID, "description": h.Description,
+				"hostname": h.Hostname.String, "mac": h.MAC.String, "last_seen": nullTime(h.LastSeen)})
 		}
-		writeJSON(w, out) 
+		writeJSON(w, out)
 	})
-	
+
 	// Get all possible hosts in a network (for edit mode)
-	r.Get("/networks/{id}/hosts/all", func(w http.ResponseWriter, r *http.Request){ 
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		var cidr string
-		if err := db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&cidr); err != nil { 
-			http.Error(w, "network not found", 404)
-			return 
-		}
-		// Get existing hosts
-		rows, err := db.Query(`SELECT host(address), description FROM hosts WHERE network=$1`, id)
+	r.Get("/networks/{id}/hosts/all", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		n, err := s.Network(id)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			writeError(w, r, notFound("network", err))
+			return
+		}
+		hosts, err := s.Hosts(id)
+		if err != nil {
+			apierr.InternalError(w, r, err)
 			return
 		}
 		existing := map[string]string{}
-		for rows.Next() { 
-			var a, d string
-			if err := rows.Scan(&a, &d); err != nil {
-				continue
-			}
-			existing[a] = d
+		for _, h := range hosts {
+			existing[h.Address] = h.Description
 		}
-		rows.Close()
-		
+
 		// Generate all hosts
-		allHosts := ipam.AllHostsStr(cidr)
 		out := []map[string]any{}
-		for _, addr := range allHosts {
+		for _, addr := range ipam.AllHostsStr(n.AddressRange) {
 			desc, used := existing[addr]
 			out = append(out, map[string]any{"address": addr, "description": desc, "used": used})
 		}
-		writeJSON(w, out) 
+		writeJSON(w, out)
 	})
-	
-	r.Post("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request){ 
-		if !isEditor(r) { http.Error(w, "forbidden", 403); return }
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		username := getUsername(r, db)
-		var req struct{ Address, Description string; Update bool }
-		json.NewDecoder(r.Body).Decode(&req)
-		
-		if req.Update {
-			// Update existing host description
-			_, err := db.Exec(`UPDATE hosts SET description=$1 WHERE address=$2::inet`, req.Description, req.Address)
-			if err != nil { 
-				http.Error(w, err.Error(), 500)
-				return 
-			}
-			logChange(db, req.Address+"/32", fmt.Sprintf("host updated: %s by %s", req.Description, username), username)
-		} else {
-			// Insert new host - fail if exists
-			_, err := db.Exec(`INSERT INTO hosts(address,network,description) VALUES($1::inet,$2,$3)`, req.Address, id, req.Description)
-			if err != nil { 
-				if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "unique") {
-					http.Error(w, "IP already exists", 409)
-					return
-				}
-				http.Error(w, err.Error(), 500)
-				return 
-			}
-			logChange(db, req.Address+"/32", fmt.Sprintf("host added: %s by %s", req.Description, username), username)
+
+	r.Post("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
 		}
-		writeJSON(w, map[string]any{"status":"ok"}) 
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req hostRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := putHost(s, ddns, id, req, requestUsername(r, s)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok"})
 	})
-	
-	r.Delete("/hosts/{ip}", func(w http.ResponseWriter, r *http.Request){ 
-		if !isEditor(r) { http.Error(w, "forbidden", 403); return }
-		ip := chi.URLParam(r, "ip")
-		username := getUsername(r, db)
-		_, err := db.Exec(`DELETE FROM hosts WHERE address=$1::inet`, ip)
-		if err != nil { 
-			http.Error(w, err.Error(), 500)
-			return 
-		}
-		logChange(db, ip+"/32", fmt.Sprintf("host deleted by %s", username), username)
-		writeJSON(w, map[string]any{"status":"ok"}) 
+
+	r.Delete("/hosts/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		var invalid ValidationError
+		ip := checkIP(&invalid, "ip", chi.URLParam(r, "ip"))
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := deleteHost(s, ddns, ip, requestUsername(r, s)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok"})
 	})
 
-	r.Post("/networks/{id}/allocate-host", func(w http.ResponseWriter, r *http.Request){ 
-		if !isEditor(r) { http.Error(w, "forbidden", 403); return }
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		username := getUsername(r, db)
-		var req struct{ Description string `json:"description"` }
-		json.NewDecoder(r.Body).Decode(&req)
-		desc := req.Description
-		if desc == "" { 
-			desc = "auto" 
-		}
-		
-		var cidr string
-		if err := db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&cidr); err != nil { 
-			http.Error(w, "network not found", 404)
-			return 
-		}
-		rows, err := db.Query(`SELECT host(address) FROM hosts WHERE network=$1`, id)
+	r.Post("/networks/{id}/allocate-host", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		used := map[string]bool{}
-		for rows.Next() { 
-			var a string
-			rows.Scan(&a)
-			used[a] = true 
-		}
-		rows.Close()
-		
-		a := ipam.NextFreeHostStr(cidr, used)
-		if a == "" { 
-			http.Error(w, "no free host", 409)
-			return 
-		}
-		if _, err := db.Exec(`INSERT INTO hosts(address,network,description) VALUES($1::inet,$2,$3)`, a, id, desc); err != nil { 
-			// Check if it's a duplicate key error (race condition - another user allocated it first)
-			if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "unique") {
-				http.Error(w, "address already allocated, please retry", 409)
-				return
-			}
-			http.Error(w, err.Error(), 500)
-			return 
+			writeRequestError(w, r, err)
+			return
+		}
+		var req hostAllocation
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		h, err := allocateHost(s, id, req.Description, requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
-		logChange(db, a+"/32", fmt.Sprintf("host allocated: %s by %s", desc, username), username)
-		writeJSON(w, map[string]any{"address": a}) 
+		writeJSON(w, map[string]any{"address": h.Address})
 	})
 
-	r.Post("/networks/{id}/allocate-subnet", func(w http.ResponseWriter, r *http.Request){ 
-		if !isCreator(r) { http.Error(w, "forbidden", 403); return }
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		username := getUsername(r, db)
-		var req struct{ 
-			Mask int `json:"mask"`
-			Cidr string `json:"cidr"`
-			Description string `json:"description"`
-			Subdivide bool `json:"subdivide"`
-		}
-		json.NewDecoder(r.Body).Decode(&req)
-		
-		desc := req.Description
-		if desc == "" { 
-			desc = "auto" 
-		}
-		
-		var parent string
-		if err := db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&parent); err != nil { 
-			http.Error(w, "network not found", 404)
-			return 
-		}
-		
-		var cand string
-		if req.Cidr != "" {
-			// Specific CIDR requested - verify it's available
-			rows, err := db.Query(`SELECT address_range::text FROM networks WHERE parent=$1`, id)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			var children []string
-			for rows.Next() { 
-				var c string
-				rows.Scan(&c)
-				children = append(children, c) 
-			}
-			rows.Close()
-			
-			// Check if requested CIDR overlaps with existing
-			for _, child := range children {
-				if ipam.OverlapStr(req.Cidr, child) {
-					http.Error(w, "subnet overlaps with existing allocation", 409)
-					return
-				}
-			}
-			// Check if requested CIDR is within parent
-			if !ipam.ContainsStr(parent, req.Cidr) {
-				http.Error(w, "subnet not within parent network", 400)
-				return
-			}
-			cand = req.Cidr
-		} else if req.Mask > 0 {
-			// Legacy: auto-allocate by mask
-			rows, err := db.Query(`SELECT address_range::text FROM networks WHERE parent=$1`, id)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			var children []string
-			for rows.Next() { 
-				var c string
-				rows.Scan(&c)
-				children = append(children, c) 
-			}
-			rows.Close()
-			
-			var allocErr error
-			cand, allocErr = ipam.NextFreeSubnetStr(parent, children, req.Mask)
-			if allocErr != nil { 
-				http.Error(w, allocErr.Error(), 409)
-				return 
-			}
-		} else {
-			http.Error(w, "mask or cidr required", 400)
+	r.Post("/networks/{id}/allocate-subnet", func(w http.ResponseWriter, r *http.Request) {
+		if !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
 			return
 		}
-		
-		var nid int64
-		if err := db.QueryRow(`INSERT INTO networks(parent,address_range,description,subdivide) VALUES($1,$2::cidr,$3,$4) RETURNING id`, id, cand, desc, req.Subdivide).Scan(&nid); err != nil { 
-			// Check if it's a duplicate key error (race condition - another user allocated it first)
-			if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "unique") {
-				http.Error(w, "subnet already allocated, please retry", 409)
-				return
-			}
-			http.Error(w, err.Error(), 500)
-			return 
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req subnetRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
 		}
-		action := "assigned"
-		if req.Subdivide {
-			action = "allocated for subdivision"
+		n, err := allocateSubnet(s, id, req, isAdmin(r), requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
-		logChange(db, cand, fmt.Sprintf("subnet %s: %s by %s", action, desc, username), username)
-		writeJSON(w, map[string]any{"id": nid, "address_range": cand, "subdivide": req.Subdivide}) 
+		writeJSON(w, map[string]any{"id": n.ID, "address_range": n.AddressRange, "subdivide": n.Subdivide})
 	})
 
 	// Get available subnets for a network (for edit mode)
-	r.Get("/networks/{id}/available-subnets", func(w http.ResponseWriter, rq *http.Request){ 
-		id, _ := strconv.ParseInt(chi.URLParam(rq,"id"),10,64)
-		var parent string
-		var validMasksStr sql.NullString
-		if err := db.QueryRow(`SELECT address_range::text, valid_masks FROM networks WHERE id=$1`, id).Scan(&parent, &validMasksStr); err != nil { 
-			http.Error(w, "network not found", 404)
-			return 
-		}
-		// Get existing children
-		rows, err := db.Query(`SELECT address_range::text FROM networks WHERE parent=$1`, id)
+	r.Get("/networks/{id}/available-subnets", func(w http.ResponseWriter, rq *http.Request) {
+		id, err := pathID(rq, "id")
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			writeRequestError(w, rq, err)
 			return
 		}
-		var children []string
-		for rows.Next() { 
-			var c string
-			rows.Scan(&c)
-			children = append(children, c) 
+		parent, err := s.Network(id)
+		if err != nil {
+			writeError(w, rq, notFound("network", err))
+			return
+		}
+		children, err := childRanges(s, id)
+		if err != nil {
+			apierr.InternalError(w, rq, err)
+			return
 		}
-		rows.Close()
-		
+
 		// Use mask from query param if provided
-		mask := 0
-		if maskStr := rq.URL.Query().Get("mask"); maskStr != "" {
-			mask, _ = strconv.Atoi(maskStr)
+		var invalid ValidationError
+		mask := queryInt(&invalid, rq, "mask", 0, 0, 128)
+		if mask != 0 {
+			checkSubnetMask(&invalid, "mask", mask, parent.AddressRange)
 		}
-		
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, rq, err)
+			return
+		}
+
 		// If no mask specified, determine default
 		if mask == 0 {
 			// Use largest existing child, or largest valid mask, or parent+1
 			for _, c := range children {
 				m := ipam.GetMask(c)
-				if mask == 0 || m < mask { 
-					mask = m 
+				if mask == 0 || m < mask {
+					mask = m
 				}
 			}
+			if mask == 0 && len(parent.ValidMasks) > 0 {
+				mask = int(parent.ValidMasks[0])
+			}
 			if mask == 0 {
-				if validMasksStr.Valid {
-					validMasks := ipam.ParseSmallIntArray(validMasksStr.String)
-					if len(validMasks) > 0 {
-						mask = int(validMasks[0])
-					}
-				}
-				if mask == 0 {
-					mask = ipam.GetMask(parent) + 1
-				}
+				mask = ipam.GetMask(parent.AddressRange) + 1
 			}
 		}
-		
+
 		// Get all possible subnets at this mask
-		available := ipam.AvailableSubnetsStr(parent, children, mask)
 		out := []map[string]any{}
-		for _, cidr := range available {
+		for _, cidr := range ipam.AvailableSubnetsStr(parent.AddressRange, children, mask) {
 			out = append(out, map[string]any{"address_range": cidr, "mask": mask})
 		}
-		writeJSON(w, out) 
+		writeJSON(w, out)
 	})
 
-	r.Get("/logs", func(w http.ResponseWriter, r *http.Request){ 
-		limit := 50
-		if s := r.URL.Query().Get("limit"); s != "" { 
-			if v, err := strconv.Atoi(s); err == nil { 
-				limit = v 
-			} 
-		}
-		rows, err := db.Query(`
-			SELECT c.change_time::text, c.prefix::text, c.change, u.username 
-			FROM changelog c 
-			JOIN users u ON c."user" = u.id 
-			ORDER BY c.change_time DESC LIMIT $1`, limit)
+	r.Get("/logs", func(w http.ResponseWriter, r *http.Request) {
+		var invalid ValidationError
+		limit := queryInt(&invalid, r, "limit", 50, 1, 10000)
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		changes, err := s.Changes(0, limit)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			apierr.InternalError(w, r, err)
 			return
 		}
-		defer rows.Close()
-		
 		out := []map[string]any{}
-		for rows.Next() { 
-			var ctime, prefix, change, changedBy string
-			if err := rows.Scan(&ctime, &prefix, &change, &changedBy); err != nil {
-				continue
-			}
-			action := formatChangeLog(change, changedBy)
-			out = append(out, map[string]any{"created_at": ctime, "prefix": prefix, "action": action, "user": changedBy})
+		for _, c := range changes {
+			// as Postgres prints a timestamp, in local time
+			created := c.Time.Local().Format("2006-01-02 15:04:05.999999")
+			out = append(out, map[string]any{"created_at": created, "prefix": c.Prefix, "action": formatChangeLog(c.Change, c.User), "user": c.User})
 		}
-		writeJSON(w, out) 
+		writeJSON(w, out)
 	})
 
 	// User management endpoints (admin only)
-	r.Get("/users", func(w http.ResponseWriter, r *http.Request){
-		if !isAdmin(r) { 
-			http.Error(w, "admin required", 403)
-			return 
+	r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
 		}
-		rows, err := db.Query(`SELECT u.id, u.username, u.status, COALESCE(array_agg(r.name) FILTER (WHERE r.name IS NOT NULL), '{}') as roles FROM users u LEFT JOIN user_roles ur ON ur."user"=u.id LEFT JOIN roles r ON r.id=ur.role GROUP BY u.id ORDER BY u.username`)
+		users, err := s.Users()
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			apierr.InternalError(w, r, err)
 			return
 		}
-		defer rows.Close()
-		
 		out := []map[string]any{}
-		for rows.Next() {
-			var id int64
-			var username string
-			var status int
-			var roles string
-			if err := rows.Scan(&id, &username, &status, &roles); err != nil {
-				continue
-			}
-			roleList := []string{}
-			if roles != "{}" && roles != "" {
-				roles = strings.Trim(roles, "{}")
-				if roles != "" { 
-					roleList = strings.Split(roles, ",") 
-				}
-			}
-			out = append(out, map[string]any{"id": id, "username": username, "status": status, "roles": roleList})
+		for _, u := range users {
+			out = append(out, map[string]any{"id": u.ID, "username": u.Username, "status": u.Status, "roles": u.Roles})
 		}
 		writeJSON(w, out)
 	})
 
-	r.Post("/users", func(w http.ResponseWriter, r *http.Request){
-		if !isAdmin(r) { 
-			http.Error(w, "admin required", 403)
-			return 
-		}
-		var req struct{ Username, Password string; Roles []string }
-		json.NewDecoder(r.Body).Decode(&req)
-		if req.Username == "" || req.Password == "" { 
-			http.Error(w, "username and password required", 400)
-			return 
-		}
-		hash := auth.MakeRFC2307SSHA(req.Password)
-		var id int64
-		err := db.QueryRow(`INSERT INTO users(username, password, status) VALUES($1, $2, 1) RETURNING id`, req.Username, hash).Scan(&id)
-		if err != nil { 
-			http.Error(w, err.Error(), 500)
-			return 
-		}
-		// Add roles
-		for _, role := range req.Roles {
-			var rid int64
-			if err := db.QueryRow(`SELECT id FROM roles WHERE name=$1`, role).Scan(&rid); err == nil {
-				db.Exec(`INSERT INTO user_roles("user", role) VALUES($1, $2) ON CONFLICT DO NOTHING`, id, rid)
-			}
+	r.Post("/users", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		var req userRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		u, err := createUser(s, req)
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
-		writeJSON(w, map[string]any{"id": id, "username": req.Username})
+		writeJSON(w, map[string]any{"id": u.ID, "username": u.Username})
 	})
 
-	r.Patch("/users/{id}", func(w http.ResponseWriter, r *http.Request){
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		claims := r.Context().Value(middleware.ClaimsKey).(*auth.Claims)
-		isSelf := claims.UserID == id
-		isAdm := isAdmin(r)
-		
+	r.Patch("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
 		// Must be admin OR updating own record
-		if !isAdm && !isSelf {
-			http.Error(w, "forbidden", 403)
-			return
-		}
-		
-		var req struct{ Password string; Status *int; Roles []string }
-		json.NewDecoder(r.Body).Decode(&req)
-		
-		// Password: admin can change anyone, users can change own
-		if req.Password != "" {
-			hash := auth.MakeRFC2307SSHA(req.Password)
-			db.Exec(`UPDATE users SET password=$1 WHERE id=$2`, hash, id)
-		}
-		
-		// Status and Roles: admin only
-		if isAdm {
-			if req.Status != nil {
-				db.Exec(`UPDATE users SET status=$1 WHERE id=$2`, *req.Status, id)
-			}
-			if req.Roles != nil {
-				db.Exec(`DELETE FROM user_roles WHERE "user"=$1`, id)
-				for _, role := range req.Roles {
-					var rid int64
-					if err := db.QueryRow(`SELECT id FROM roles WHERE name=$1`, role).Scan(&rid); err == nil {
-						db.Exec(`INSERT INTO user_roles("user", role) VALUES($1, $2)`, id, rid)
-					}
-				}
-			}
+		if !isAdmin(r) && !isSelf(r, id) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		var req userPatch
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := patchUser(s, id, req, isAdmin(r)); err != nil {
+			writeError(w, r, err)
+			return
 		}
 		writeJSON(w, map[string]any{"status": "ok"})
 	})
 
-	r.Delete("/users/{id}", func(w http.ResponseWriter, r *http.Request){
-		if !isAdmin(r) { 
-			http.Error(w, "admin required", 403)
-			return 
+	r.Delete("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
 		}
-		id, _ := strconv.ParseInt(chi.URLParam(r,"id"),10,64)
-		// Clear changelog references (preserve audit history with NULL user)
-		db.Exec(`UPDATE changelog SET "user"=NULL WHERE "user"=$1`, id)
-		db.Exec(`DELETE FROM user_roles WHERE "user"=$1`, id)
-		_, err := db.Exec(`DELETE FROM users WHERE id=$1`, id)
+		id, err := pathID(r, "id")
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			writeRequestError(w, r, err)
+			return
+		}
+		if err := s.DeleteUser(id); err != nil {
+			writeError(w, r, notFound("user", err))
 			return
 		}
 		writeJSON(w, map[string]any{"status": "ok"})
 	})
 
-	r.Get("/roles", func(w http.ResponseWriter, r *http.Request){
-		rows, err := db.Query(`SELECT id, name FROM roles ORDER BY name`)
+	r.Get("/roles", func(w http.ResponseWriter, r *http.Request) {
+		roles, err := s.Roles()
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			apierr.InternalError(w, r, err)
 			return
 		}
-		defer rows.Close()
-		
 		out := []map[string]any{}
-		for rows.Next() {
-			var id int64
-			var name string
-			if err := rows.Scan(&id, &name); err != nil {
-				continue
-			}
-			out = append(out, map[string]any{"id": id, "name": name})
+		for _, role := range roles {
+			out = append(out, map[string]any{"id": role.ID, "name": role.Name})
 		}
 		writeJSON(w, out)
 	})
-
-	return r
 }
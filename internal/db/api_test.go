@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/auth"
+	"github.com/yellowman/GoPieNg/internal/middleware"
+)
+
+// apiFixture is the API over a MemStore holding 10.0.0.0/16, open for
+// subdivision, with a user of each role
+type apiFixture struct {
+	t     *testing.T
+	store *MemStore
+	api   http.Handler
+	root  int64
+	users map[string]*auth.Claims
+}
+
+func newAPIFixture(t *testing.T) *apiFixture {
+	t.Helper()
+	s := NewMemStore()
+	root, err := s.CreateNetwork(Network{AddressRange: "10.0.0.0/16", Subdivide: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &apiFixture{t: t, store: s, api: StoreAPI(s), root: root, users: map[string]*auth.Claims{}}
+	for _, role := range []string{"administrator", "creator", "editor", "reader"} {
+		id, err := s.CreateUser(role, "secret", []string{role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.users[role] = &auth.Claims{UserID: id, Roles: []string{role}}
+	}
+	return f
+}
+
+// do sends a request as the user of role and decodes the answer into out
+func (f *apiFixture) do(role, method, path, body string, out any) int {
+	f.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.ClaimsKey, f.users[role]))
+	rec := httptest.NewRecorder()
+	f.api.ServeHTTP(rec, req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			f.t.Fatalf("%s %s: %v\n%s", method, path, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+// expectError sends a request that must fail with code
+func (f *apiFixture) expectError(role, method, path, body, code string) {
+	f.t.Helper()
+	var e apierr.Error
+	status := f.do(role, method, path, body, &e)
+	if status != apierr.Status(code) || e.Code != code {
+		f.t.Errorf("%s %s %s: %d %s %q, want %s", role, method, path, status, e.Code, e.Message, code)
+	}
+}
+
+func (f *apiFixture) path(format string) string {
+	return strings.ReplaceAll(format, "{root}", itoa(f.root))
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func TestAllocate(t *testing.T) {
+	f := newAPIFixture(t)
+
+	var subnet struct {
+		ID           int64  `json:"id"`
+		AddressRange string `json:"address_range"`
+	}
+	if code := f.do("creator", "POST", f.path("/networks/{root}/allocate-subnet"), `{"mask":24}`, &subnet); code != http.StatusOK {
+		t.Fatalf("v1 allocate-subnet: %d", code)
+	}
+	if subnet.AddressRange != "10.0.0.0/24" {
+		t.Errorf("v1 allocate-subnet: %s", subnet.AddressRange)
+	}
+
+	var v2subnet struct {
+		Data struct {
+			ID           int64  `json:"id"`
+			Parent       *int64 `json:"parent"`
+			AddressRange string `json:"address_range"`
+		} `json:"data"`
+	}
+	if code := f.do("creator", "POST", f.path("/v2/networks/{root}/allocate-subnet"), `{"cidr":"10.0.8.0/24"}`, &v2subnet); code != http.StatusCreated {
+		t.Fatalf("v2 allocate-subnet: %d", code)
+	}
+	if d := v2subnet.Data; d.AddressRange != "10.0.8.0/24" || d.Parent == nil || *d.Parent != f.root {
+		t.Errorf("v2 allocate-subnet: %+v", d)
+	}
+
+	var host struct {
+		Address string `json:"address"`
+	}
+	hostPath := "/networks/" + itoa(subnet.ID) + "/allocate-host"
+	if code := f.do("editor", "POST", hostPath, `{"description":"web"}`, &host); code != http.StatusOK {
+		t.Fatalf("v1 allocate-host: %d", code)
+	}
+	if host.Address != "10.0.0.1" {
+		t.Errorf("v1 allocate-host: %s", host.Address)
+	}
+	var v2host struct {
+		Data struct {
+			Address     string `json:"address"`
+			Description string `json:"description"`
+		} `json:"data"`
+	}
+	if code := f.do("editor", "POST", "/v2"+hostPath, `{}`, &v2host); code != http.StatusCreated {
+		t.Fatalf("v2 allocate-host: %d", code)
+	}
+	if d := v2host.Data; d.Address != "10.0.0.2" || d.Description != "auto" {
+		t.Errorf("v2 allocate-host: %+v", d)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	f := newAPIFixture(t)
+	sub, err := f.store.CreateNetwork(Network{Parent: sql.NullInt64{Int64: f.root, Valid: true}, AddressRange: "10.0.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subHosts := "/networks/" + itoa(sub) + "/hosts"
+
+	for _, prefix := range []string{"", "/v2"} {
+		f.expectError("creator", "POST", prefix+f.path("/networks/{root}/allocate-subnet"), `{"cidr":"10.0.0.0/23"}`, apierr.Overlap)
+		f.expectError("creator", "POST", prefix+f.path("/networks/{root}/allocate-subnet"), `{"cidr":"10.9.0.0/24"}`, apierr.OutsideNetwork)
+		f.expectError("editor", "POST", prefix+subHosts, `{"address":"10.0.2.1"}`, apierr.OutsideNetwork)
+	}
+
+	if code := f.do("editor", "POST", subHosts, `{"address":"10.0.1.5"}`, nil); code != http.StatusOK {
+		t.Fatalf("add host: %d", code)
+	}
+	f.expectError("editor", "POST", "/v2"+subHosts, `{"address":"10.0.1.5"}`, apierr.Exists)
+
+	// A network in use stays; a missing one is not found
+	for _, prefix := range []string{"", "/v2"} {
+		f.expectError("creator", "DELETE", prefix+f.path("/networks/{root}"), "", apierr.Conflict)
+		f.expectError("creator", "DELETE", prefix+"/networks/"+itoa(sub), "", apierr.Conflict)
+		f.expectError("creator", "DELETE", prefix+"/networks/9999", "", apierr.NotFound)
+	}
+	f.expectError("editor", "PATCH", "/v2/hosts/10.0.1.99", `{"description":"x"}`, apierr.NotFound)
+
+	if code := f.do("editor", "DELETE", "/v2/hosts/10.0.1.5", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete host: %d", code)
+	}
+	if code := f.do("creator", "DELETE", "/v2/networks/"+itoa(sub), "", nil); code != http.StatusNoContent {
+		t.Errorf("delete emptied network: %d", code)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	f := newAPIFixture(t)
+	sub, err := f.store.CreateNetwork(Network{Parent: sql.NullInt64{Int64: f.root, Valid: true}, AddressRange: "10.0.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subHosts := "/networks/" + itoa(sub) + "/hosts"
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{"POST", f.path("/networks/{root}/allocate-subnet"), `{}`},
+		{"POST", f.path("/networks/{root}/allocate-subnet"), `{"mask":8}`},
+		{"POST", f.path("/networks/{root}/allocate-subnet"), `{"mask":"24"}`},
+		{"POST", f.path("/networks/{root}/allocate-subnet"), `{"cidr":"10.0.4.1/24"}`},
+		{"POST", f.path("/networks/{root}/allocate-subnet"), `{"size":24}`},
+		{"POST", subHosts, `{"address":"10.0.1.6","mac":"00:11:22:33:44:55:66:77"}`},
+		{"POST", subHosts, `{"address":"not-an-address"}`},
+		{"PATCH", f.path("/networks/{root}"), `{"gateway":"10.9.9.9"}`},
+	}
+	for _, prefix := range []string{"", "/v2"} {
+		for _, tt := range tests {
+			f.expectError("administrator", tt.method, prefix+tt.path, tt.body, apierr.Invalid)
+		}
+	}
+	f.expectError("reader", "GET", "/v2/networks/abc", "", apierr.Invalid)
+}
+
+func TestRoles(t *testing.T) {
+	f := newAPIFixture(t)
+	tests := []struct {
+		role, method, path, body string
+	}{
+		{"reader", "POST", "/networks/{root}/allocate-host", `{}`},
+		{"reader", "POST", "/networks/{root}/hosts", `{"address":"10.0.0.9"}`},
+		{"reader", "PATCH", "/networks/{root}", `{"description":"x"}`},
+		{"reader", "DELETE", "/hosts/10.0.0.9", ""},
+		{"editor", "POST", "/networks/{root}/allocate-subnet", `{"mask":24}`},
+		{"editor", "DELETE", "/networks/{root}", ""},
+		{"creator", "POST", "/networks/{root}/allocate-subnet", `{"mask":20,"force":true}`},
+		{"creator", "PATCH", "/networks/{root}", `{"subdivide":false}`},
+		{"creator", "PATCH", "/networks/{root}", `{"valid_masks":[24]}`},
+	}
+	for _, prefix := range []string{"", "/v2"} {
+		for _, tt := range tests {
+			f.expectError(tt.role, tt.method, prefix+f.path(tt.path), tt.body, apierr.Forbidden)
+		}
+	}
+
+	// What the creator may not do, the administrator may
+	if code := f.do("administrator", "PATCH", f.path("/networks/{root}"), `{"valid_masks":[24]}`, nil); code != http.StatusOK {
+		t.Errorf("admin valid_masks: %d", code)
+	}
+	if code := f.do("administrator", "POST", f.path("/v2/networks/{root}/allocate-subnet"), `{"mask":20,"force":true}`, nil); code != http.StatusCreated {
+		t.Errorf("admin forced allocation: %d", code)
+	}
+	n, _ := f.store.Network(f.root)
+	if len(n.ValidMasks) != 1 || n.ValidMasks[0] != 24 {
+		t.Errorf("valid_masks %v", n.ValidMasks)
+	}
+}
+
+// A bad fields param is refused before the request changes anything
+func TestFieldsBeforeWrite(t *testing.T) {
+	f := newAPIFixture(t)
+	sub, err := f.store.CreateNetwork(Network{Parent: sql.NullInt64{Int64: f.root, Valid: true}, AddressRange: "10.0.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.store.CreateHost(Host{Address: "10.0.1.5", NetworkID: sub, Description: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		role, method, path, body string
+	}{
+		{"creator", "POST", f.path("/v2/networks/{root}/allocate-subnet"), `{"mask":24}`},
+		{"editor", "POST", "/v2/networks/" + itoa(sub) + "/allocate-host", `{}`},
+		{"editor", "POST", "/v2/networks/" + itoa(sub) + "/hosts", `{"address":"10.0.1.6"}`},
+		{"editor", "PATCH", "/v2/hosts/10.0.1.5", `{"description":"changed"}`},
+		{"editor", "PATCH", f.path("/v2/networks/{root}"), `{"description":"changed"}`},
+		{"administrator", "POST", "/v2/users", `{"username":"new","password":"secret123"}`},
+		{"administrator", "PATCH", "/v2/users/" + itoa(f.users["reader"].UserID), `{"status":0}`},
+	}
+	for _, tt := range tests {
+		f.expectError(tt.role, tt.method, tt.path+"?fields=bogus", tt.body, apierr.Invalid)
+	}
+
+	nets, _ := f.store.Networks(f.root, "")
+	hosts, _ := f.store.Hosts(sub)
+	users, _ := f.store.Users()
+	root, _ := f.store.Network(f.root)
+	h, _ := f.store.Host("10.0.1.5")
+	reader, _ := f.store.User(f.users["reader"].UserID)
+	if len(nets) != 1 || len(hosts) != 1 || len(users) != 4 || root.Description.Valid ||
+		h.Description != "web" || reader.Status != 1 {
+		t.Errorf("store changed: %d subnets, %d hosts, %d users, root %q, host %q, reader status %d",
+			len(nets), len(hosts), len(users), root.Description.String, h.Description, reader.Status)
+	}
+}
+
+func TestSearchTruncated(t *testing.T) {
+	f := newAPIFixture(t)
+	sub, err := f.store.CreateNetwork(Network{Parent: sql.NullInt64{Int64: f.root, Valid: true}, AddressRange: "10.0.0.0/22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= v2SearchLimit+1; i++ {
+		addr := "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		if err := f.store.CreateHost(Host{Address: addr, NetworkID: sub, Description: "bulk"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var page struct {
+		Data       []map[string]any `json:"data"`
+		NextCursor *string          `json:"next_cursor"`
+		Truncated  bool             `json:"truncated"`
+	}
+	for q, want := range map[string]bool{"bulk": true, "10.0.3.": false} {
+		page.Truncated = !want
+		if code := f.do("reader", "GET", "/v2/search?limit=1000&q="+q, "", &page); code != http.StatusOK {
+			t.Fatalf("search %s: %d", q, code)
+		}
+		if page.Truncated != want {
+			t.Errorf("search %s: truncated %t, %d results", q, page.Truncated, len(page.Data))
+		}
+	}
+}
+
+// The host handlers queue dynamic DNS updates whichever store they use
+func TestHostDNSQueue(t *testing.T) {
+	f := newAPIFixture(t)
+	var queued []string
+	ddns := func(action, address, hostname string) {
+		queued = append(queued, action+" "+address+" "+hostname)
+	}
+	r := chi.NewRouter()
+	storeRoutes(r, f.store, ddns)
+	r.Route("/v2", func(r chi.Router) { v2Routes(r, f.store, ddns) })
+	f.api = r
+
+	steps := []struct {
+		method, path, body string
+	}{
+		{"POST", "/networks/{root}/hosts", `{"address":"10.0.0.5","hostname":"web.example.com"}`},
+		{"POST", "/networks/{root}/hosts", `{"address":"10.0.0.5","hostname":"www.example.com","update":true}`},
+		{"POST", "/networks/{root}/hosts", `{"address":"10.0.0.5","description":"same name","update":true}`},
+		{"DELETE", "/hosts/10.0.0.5", ""},
+		{"POST", "/v2/networks/{root}/hosts", `{"address":"10.0.0.6","hostname":"db.example.com"}`},
+		{"PATCH", "/v2/hosts/10.0.0.6", `{"hostname":""}`},
+		{"DELETE", "/v2/hosts/10.0.0.6", ""},
+		{"POST", "/v2/networks/{root}/hosts", `{"address":"10.0.0.7"}`},
+	}
+	for _, s := range steps {
+		if code := f.do("editor", s.method, f.path(s.path), s.body, nil); code >= 300 {
+			t.Fatalf("%s %s: %d", s.method, s.path, code)
+		}
+	}
+	want := []string{
+		"add 10.0.0.5 web.example.com",
+		"delete 10.0.0.5 web.example.com",
+		"add 10.0.0.5 www.example.com",
+		"delete 10.0.0.5 www.example.com",
+		"add 10.0.0.6 db.example.com",
+		"delete 10.0.0.6 db.example.com",
+		"add 10.0.0.6 ",
+		"delete 10.0.0.6 ",
+		"add 10.0.0.7 ",
+	}
+	if !reflect.DeepEqual(queued, want) {
+		t.Errorf("queued\n%q\nwant\n%q", queued, want)
+	}
+}
+
+// brokenStore fails every network lookup as a lost connection would
+type brokenStore struct{ Store }
+
+func (brokenStore) Network(int64) (Network, error) {
+	return Network{}, errors.New("connection refused")
+}
+
+func TestStoreErrors(t *testing.T) {
+	f := newAPIFixture(t)
+	for _, path := range []string{"/users/9999", "/v2/users/9999"} {
+		f.expectError("administrator", "DELETE", path, "", apierr.NotFound)
+	}
+	f.expectError("administrator", "PATCH", "/v2/users/9999", `{"status":0}`, apierr.NotFound)
+
+	// Only a missing network is NOT_FOUND
+	f.api = StoreAPI(brokenStore{f.store})
+	for _, path := range []string{"/networks/{root}", "/networks/{root}/hosts/all", "/v2/networks/{root}"} {
+		f.expectError("reader", "GET", f.path(path), "", apierr.Internal)
+	}
+	f.api = StoreAPI(f.store)
+	f.expectError("reader", "GET", "/networks/9999", "", apierr.NotFound)
+}
+
+// Every store gives the change time as an instant: v2 has it in RFC 3339
+// and v1 keeps printing local time as Postgres prints a timestamp
+func TestChangeTimes(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			id, err := s.CreateUser("alice", "secret", []string{"administrator"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := time.Now().Add(-time.Second)
+			if err := s.LogChange("10.0.0.0/16", "network added", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now().Add(time.Second)
+			get := func(path string, out any) {
+				t.Helper()
+				req := httptest.NewRequest("GET", path, nil)
+				claims := &auth.Claims{UserID: id, Roles: []string{"administrator"}}
+				req = req.WithContext(context.WithValue(req.Context(), middleware.ClaimsKey, claims))
+				rec := httptest.NewRecorder()
+				StoreAPI(s).ServeHTTP(rec, req)
+				if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+					t.Fatalf("%s: %v\n%s", path, err, rec.Body)
+				}
+			}
+
+			var v2 struct {
+				Data []struct {
+					Time time.Time `json:"time"`
+				} `json:"data"`
+			}
+			get("/v2/changes", &v2)
+			if len(v2.Data) != 1 {
+				t.Fatalf("v2 changes: %+v", v2.Data)
+			}
+			if got := v2.Data[0].Time; got.Before(before.Truncate(time.Second)) || got.After(after) {
+				t.Errorf("v2 change time %v, want between %v and %v", got, before, after)
+			}
+
+			var v1 []struct {
+				CreatedAt string `json:"created_at"`
+			}
+			get("/logs", &v1)
+			if len(v1) != 1 {
+				t.Fatalf("v1 logs: %+v", v1)
+			}
+			got, err := time.ParseInLocation("2006-01-02 15:04:05.999999", v1[0].CreatedAt, time.Local)
+			if err != nil || got.Before(before.Truncate(time.Second)) || got.After(after) {
+				t.Errorf("v1 created_at %q, want local time between %v and %v", v1[0].CreatedAt, before, after)
+			}
+		})
+	}
+}
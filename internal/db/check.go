@@ -0,0 +1,253 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// Consistency check: the Go handlers keep the tree in shape, but rows
+// written by hand in SQL are not checked by anything. CheckDatabase audits
+// the invariants the handlers rely on.
+
+// Violation kinds
+const (
+	ViolationHostOutside      = "host_outside_network"   // host not inside its network
+	ViolationHostMisplaced    = "host_not_in_leaf"       // a more specific leaf network contains the host
+	ViolationHostOnSubdivided = "host_on_subdivided"     // host on a subdivided network with no leaf for it
+	ViolationChildOutside     = "network_outside_parent" // network not inside its parent
+	ViolationSiblingOverlap   = "sibling_overlap"        // networks with the same parent overlap
+	ViolationLeafChildren     = "leaf_with_children"     // network not marked subdivide has children
+)
+
+// Violation is one broken invariant. Network is the network at fault (or
+// the host's network); FixNetwork is the leaf a misplaced host belongs in.
+type Violation struct {
+	Kind       string `json:"kind"`
+	Network    int64  `json:"network"`
+	CIDR       string `json:"cidr"`
+	Address    string `json:"address,omitempty"`
+	Other      string `json:"other,omitempty"`
+	FixNetwork int64  `json:"fix_network,omitempty"`
+	Fixed      bool   `json:"fixed,omitempty"`
+}
+
+// CheckReport is the result of CheckDatabase
+type CheckReport struct {
+	Networks   int         `json:"networks"`
+	Hosts      int         `json:"hosts"`
+	Violations []Violation `json:"violations"`
+	Fixed      int         `json:"fixed"`
+}
+
+type checkNet struct {
+	Network
+	ipnet       *net.IPNet
+	first, last []byte
+}
+
+// By mask length, as IP.To4 also accepts IPv4-mapped IPv6 ranges
+func (n *checkNet) ipv4() bool {
+	_, bits := n.ipnet.Mask.Size()
+	return bits == 32
+}
+
+// Most specific network containing ip, or nil
+func containingNetwork(nets []*checkNet, ip net.IP) *checkNet {
+	var best *checkNet
+	bestLen := -1
+	for _, n := range nets {
+		if n.ipnet.Contains(ip) {
+			if l, _ := n.ipnet.Mask.Size(); l > bestLen {
+				best, bestLen = n, l
+			}
+		}
+	}
+	return best
+}
+
+// Parse networks for checking; ones with an unparseable range are left out
+func newCheckNets(networks []Network) []*checkNet {
+	var out []*checkNet
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.AddressRange)
+		if err != nil {
+			continue
+		}
+		first, last := ipam.FirstLastStr(n.AddressRange)
+		out = append(out, &checkNet{Network: n, ipnet: ipnet, first: net.ParseIP(first).To16(), last: net.ParseIP(last).To16()})
+	}
+	return out
+}
+
+// Order siblings for the overlap sweep: IPv4 before IPv6, then by first
+// address, wider first
+func sortSiblings(nets []*checkNet) {
+	sort.SliceStable(nets, func(i, j int) bool {
+		a, b := nets[i], nets[j]
+		if v4a, v4b := a.ipv4(), b.ipv4(); v4a != v4b {
+			return v4a
+		}
+		if c := bytes.Compare(a.first, b.first); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.last, b.last) > 0
+	})
+}
+
+// checkNetworks audits loaded networks and hosts. moves indexes the host
+// violations that moving the host to FixNetwork would fix.
+func checkNetworks(all []*checkNet, hosts []Host) (violations []Violation, moves []int) {
+	violations = []Violation{}
+	byID := map[int64]*checkNet{}
+	children := map[int64][]*checkNet{} // parent 0 holds the roots
+	for _, n := range all {
+		byID[n.ID] = n
+		children[n.Parent.Int64] = append(children[n.Parent.Int64], n)
+	}
+
+	for _, n := range all {
+		if p, ok := byID[n.Parent.Int64]; ok {
+			if !ipam.ContainsStr(p.AddressRange, n.AddressRange) || p.AddressRange == n.AddressRange {
+				violations = append(violations, Violation{Kind: ViolationChildOutside, Network: n.ID, CIDR: n.AddressRange, Other: p.AddressRange})
+			}
+		}
+		if !n.Subdivide && len(children[n.ID]) > 0 {
+			violations = append(violations, Violation{Kind: ViolationLeafChildren, Network: n.ID, CIDR: n.AddressRange})
+		}
+	}
+
+	// With siblings in address order, each one only needs comparing with
+	// the one reaching furthest among those before it
+	parents := make([]int64, 0, len(children))
+	for id := range children {
+		parents = append(parents, id)
+	}
+	sort.Slice(parents, func(i, j int) bool { return parents[i] < parents[j] })
+	for _, id := range parents {
+		siblings := append([]*checkNet(nil), children[id]...)
+		sortSiblings(siblings)
+		var reach *checkNet
+		for _, n := range siblings {
+			if reach != nil && n.ipv4() == reach.ipv4() && bytes.Compare(n.first, reach.last) <= 0 &&
+				ipam.OverlapStr(reach.AddressRange, n.AddressRange) {
+				violations = append(violations, Violation{Kind: ViolationSiblingOverlap, Network: n.ID, CIDR: n.AddressRange, Other: reach.AddressRange})
+			}
+			if reach == nil || n.ipv4() != reach.ipv4() || bytes.Compare(n.last, reach.last) > 0 {
+				reach = n
+			}
+		}
+	}
+
+	for _, h := range hosts {
+		ip := net.ParseIP(h.Address)
+		n, ok := byID[h.NetworkID]
+		if ip == nil || !ok {
+			continue
+		}
+		if n.ipnet.Contains(ip) && !n.Subdivide && len(children[n.ID]) == 0 {
+			continue
+		}
+		v := Violation{Network: n.ID, CIDR: n.AddressRange, Address: h.Address}
+		best := containingNetwork(all, ip)
+		switch {
+		case !n.ipnet.Contains(ip):
+			v.Kind = ViolationHostOutside
+		case best != n || n.Subdivide:
+			v.Kind = ViolationHostMisplaced
+		default:
+			continue
+		}
+		if best != nil && best != n && !best.Subdivide {
+			v.FixNetwork, v.Other = best.ID, best.AddressRange
+		} else if v.Kind == ViolationHostMisplaced {
+			v.Kind = ViolationHostOnSubdivided
+		}
+		violations = append(violations, v)
+		if v.FixNetwork != 0 {
+			moves = append(moves, len(violations)-1)
+		}
+	}
+	return violations, moves
+}
+
+// CheckDatabase audits hosts and networks. With fix, hosts whose leaf
+// network can be found are moved to it, each move logged as username.
+func CheckDatabase(db *sql.DB, fix bool, username string) (CheckReport, error) {
+	rep := CheckReport{Violations: []Violation{}}
+	networks, err := SubtreeNetworks(db, 0)
+	if err != nil {
+		return rep, err
+	}
+	hosts, err := SubtreeHosts(db, 0)
+	if err != nil {
+		return rep, err
+	}
+	rep.Networks, rep.Hosts = len(networks), len(hosts)
+
+	var moves []int // indexes into rep.Violations
+	rep.Violations, moves = checkNetworks(newCheckNets(networks), hosts)
+	if !fix || len(moves) == 0 {
+		return rep, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback()
+	for _, i := range moves {
+		v := &rep.Violations[i]
+		if _, err := tx.Exec(`UPDATE hosts SET network=$2 WHERE address=$1::inet`, v.Address, v.FixNetwork); err != nil {
+			return rep, err
+		}
+		logChange(tx, ipam.HostCIDR(v.Address), fmt.Sprintf("host moved from %s to %s by consistency check by %s", v.CIDR, v.Other, username), username)
+		v.Fixed = true
+		rep.Fixed++
+	}
+	if err := tx.Commit(); err != nil {
+		for _, i := range moves {
+			rep.Violations[i].Fixed = false
+		}
+		rep.Fixed = 0
+		return rep, err
+	}
+	return rep, nil
+}
+
+func checkRoutes(r chi.Router, db *sql.DB) {
+	// Audit the tree and hosts (administrator)
+	r.Get("/check", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		rep, err := CheckDatabase(db, false, "")
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rep)
+	})
+
+	// Audit and move misplaced hosts into their leaf network (administrator)
+	r.Post("/check/fix", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		rep, err := CheckDatabase(db, true, getUsername(r, db))
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rep)
+	})
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func checkNetwork(id, parent int64, cidr string, subdivide bool) Network {
+	return Network{ID: id, Parent: sql.NullInt64{Int64: parent, Valid: parent != 0}, AddressRange: cidr, Subdivide: subdivide}
+}
+
+func TestCheckNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []Network
+		hosts    []Host
+		want     []Violation
+		moves    []int
+	}{
+		{
+			name: "consistent",
+			networks: []Network{
+				checkNetwork(1, 0, "10.0.0.0/8", true),
+				checkNetwork(2, 1, "10.1.0.0/16", false),
+				checkNetwork(3, 1, "10.2.0.0/16", false),
+				checkNetwork(4, 0, "2001:db8::/32", false),
+			},
+			hosts: []Host{{Address: "10.1.0.5", NetworkID: 2}, {Address: "2001:db8::5", NetworkID: 4}},
+			want:  []Violation{},
+		},
+		{
+			name: "nested sibling overlaps",
+			networks: []Network{
+				checkNetwork(1, 0, "10.0.0.0/8", true),
+				checkNetwork(4, 1, "10.0.9.0/24", false),
+				checkNetwork(5, 1, "10.1.0.0/16", false),
+				checkNetwork(2, 1, "10.0.0.0/16", false),
+				checkNetwork(3, 1, "10.0.5.0/24", false),
+				checkNetwork(6, 1, "10.1.0.0/16", false),
+			},
+			want: []Violation{
+				{Kind: ViolationSiblingOverlap, Network: 3, CIDR: "10.0.5.0/24", Other: "10.0.0.0/16"},
+				{Kind: ViolationSiblingOverlap, Network: 4, CIDR: "10.0.9.0/24", Other: "10.0.0.0/16"},
+				{Kind: ViolationSiblingOverlap, Network: 6, CIDR: "10.1.0.0/16", Other: "10.1.0.0/16"},
+			},
+		},
+		{
+			name: "mixed families",
+			networks: []Network{
+				checkNetwork(1, 0, "2001:db8::/32", true),
+				checkNetwork(2, 0, "10.0.0.0/8", true),
+				checkNetwork(3, 0, "::/0", true),
+				checkNetwork(4, 0, "192.0.2.0/24", true),
+				checkNetwork(5, 0, "::ffff:0:0/96", true),
+			},
+			want: []Violation{
+				{Kind: ViolationSiblingOverlap, Network: 5, CIDR: "::ffff:0:0/96", Other: "::/0"},
+				{Kind: ViolationSiblingOverlap, Network: 1, CIDR: "2001:db8::/32", Other: "::/0"},
+			},
+		},
+		{
+			name: "children outside parents and of leaves",
+			networks: []Network{
+				checkNetwork(1, 0, "10.0.0.0/16", true),
+				checkNetwork(2, 1, "10.1.0.0/24", false),
+				checkNetwork(3, 1, "10.0.0.0/16", false),
+				checkNetwork(4, 1, "10.0.4.0/24", false),
+				checkNetwork(5, 4, "10.0.4.0/25", false),
+				checkNetwork(6, 1, "2001:db8::/64", false),
+			},
+			want: []Violation{
+				{Kind: ViolationChildOutside, Network: 2, CIDR: "10.1.0.0/24", Other: "10.0.0.0/16"},
+				{Kind: ViolationChildOutside, Network: 3, CIDR: "10.0.0.0/16", Other: "10.0.0.0/16"},
+				{Kind: ViolationLeafChildren, Network: 4, CIDR: "10.0.4.0/24"},
+				{Kind: ViolationChildOutside, Network: 6, CIDR: "2001:db8::/64", Other: "10.0.0.0/16"},
+				{Kind: ViolationSiblingOverlap, Network: 4, CIDR: "10.0.4.0/24", Other: "10.0.0.0/16"},
+			},
+		},
+		{
+			name: "hosts",
+			networks: []Network{
+				checkNetwork(1, 0, "10.0.0.0/16", true),
+				checkNetwork(2, 1, "10.0.1.0/24", false),
+				checkNetwork(3, 1, "10.0.2.0/24", true),
+				checkNetwork(4, 0, "2001:db8::/32", true),
+				checkNetwork(5, 4, "2001:db8:1::/48", false),
+				checkNetwork(6, 1, "10.0.4.0/24", false),
+				checkNetwork(7, 6, "10.0.4.128/25", false),
+			},
+			hosts: []Host{
+				{Address: "10.0.1.5", NetworkID: 2},
+				{Address: "10.0.1.6", NetworkID: 1},
+				{Address: "10.0.2.7", NetworkID: 3},
+				{Address: "10.0.3.8", NetworkID: 1},
+				{Address: "10.0.1.9", NetworkID: 5},
+				{Address: "192.0.2.1", NetworkID: 2},
+				{Address: "2001:db8:1::10", NetworkID: 4},
+				{Address: "10.0.1.10", NetworkID: 99},
+				{Address: "10.0.4.129", NetworkID: 6},
+				{Address: "10.0.4.1", NetworkID: 6},
+			},
+			want: []Violation{
+				{Kind: ViolationLeafChildren, Network: 6, CIDR: "10.0.4.0/24"},
+				{Kind: ViolationHostMisplaced, Network: 1, CIDR: "10.0.0.0/16", Address: "10.0.1.6", Other: "10.0.1.0/24", FixNetwork: 2},
+				{Kind: ViolationHostOnSubdivided, Network: 3, CIDR: "10.0.2.0/24", Address: "10.0.2.7"},
+				{Kind: ViolationHostOnSubdivided, Network: 1, CIDR: "10.0.0.0/16", Address: "10.0.3.8"},
+				{Kind: ViolationHostOutside, Network: 5, CIDR: "2001:db8:1::/48", Address: "10.0.1.9", Other: "10.0.1.0/24", FixNetwork: 2},
+				{Kind: ViolationHostOutside, Network: 2, CIDR: "10.0.1.0/24", Address: "192.0.2.1"},
+				{Kind: ViolationHostMisplaced, Network: 4, CIDR: "2001:db8::/32", Address: "2001:db8:1::10", Other: "2001:db8:1::/48", FixNetwork: 5},
+				{Kind: ViolationHostMisplaced, Network: 6, CIDR: "10.0.4.0/24", Address: "10.0.4.129", Other: "10.0.4.128/25", FixNetwork: 7},
+			},
+			moves: []int{1, 4, 6, 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, moves := checkNetworks(newCheckNets(tt.networks), tt.hosts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("violations\n%+v\nwant\n%+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(moves, tt.moves) {
+				t.Errorf("moves %v, want %v", moves, tt.moves)
+			}
+		})
+	}
+}
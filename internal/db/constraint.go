@@ -0,0 +1,31 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+)
+
+// The schema enforces network containment and sibling overlap itself (see
+// schema.sql); this turns those violations into a ConflictError for a 409.
+// It returns nil for any other error.
+func constraintConflict(err error) *ConflictError {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+	switch pqErr.Code {
+	case "23P01": // exclusion_violation
+		return &ConflictError{Code: apierr.Overlap, Msg: "overlaps an existing network"}
+	case "23514": // check_violation, raised by the containment triggers
+		return &ConflictError{Code: apierr.OutsideNetwork, Msg: pqErr.Message}
+	}
+	return nil
+}
+
+// A delete refused because other rows still reference the row
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
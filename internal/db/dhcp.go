@@ -0,0 +1,132 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/dhcp"
+	"github.com/yellowman/GoPieNg/internal/dns"
+)
+
+// ErrNotLeaf is returned for DHCP exports of subdivided networks
+var ErrNotLeaf = errors.New("network is subdivided; DHCP config is generated for leaf networks")
+
+// DHCPSubnet gathers a leaf network, its gateway and pools, and the
+// hosts that have a MAC as static reservations
+func DHCPSubnet(db *sql.DB, networkID int64) (dhcp.Subnet, error) {
+	n, err := scanNetwork(db.QueryRow(`SELECT `+networkColumns+` FROM networks WHERE id=$1`, networkID))
+	if err != nil {
+		return dhcp.Subnet{}, err
+	}
+	if n.Subdivide {
+		return dhcp.Subnet{}, ErrNotLeaf
+	}
+	s := dhcp.Subnet{
+		ID:          n.ID,
+		CIDR:        n.AddressRange,
+		Description: n.Description.String,
+		Gateway:     n.Gateway.String,
+	}
+	if n.DHCPPools.Valid {
+		if s.Pools, err = dhcp.ParsePools(n.DHCPPools.String, n.AddressRange); err != nil {
+			return s, err
+		}
+	}
+	rows, err := db.Query(`SELECT host(address), mac::text, coalesce(hostname,'') FROM hosts WHERE network=$1 AND mac IS NOT NULL ORDER BY address`, networkID)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r dhcp.Reservation
+		if err := rows.Scan(&r.Address, &r.MAC, &r.Hostname); err != nil {
+			return s, err
+		}
+		s.Reservations = append(s.Reservations, r)
+	}
+	return s, rows.Err()
+}
+
+// DHCPConfig renders a leaf network as ISC dhcpd ("isc") or Kea ("kea") config
+func DHCPConfig(db *sql.DB, networkID int64, format string, dnsServers []string, domain string) (string, error) {
+	s, err := DHCPSubnet(db, networkID)
+	if err != nil {
+		return "", err
+	}
+	if s.DNS, err = dhcpOptions(s.CIDR, dnsServers, domain); err != nil {
+		return "", err
+	}
+	s.Domain = domain
+	switch format {
+	case "", "isc":
+		return dhcp.ISC(s)
+	case "kea":
+		b, err := dhcp.Kea(s)
+		return string(b) + "\n", err
+	}
+	return "", errors.New("format must be isc or kea")
+}
+
+// Check the name servers and domain handed to clients; both are written
+// into the config as they are. Servers must be addresses of the
+// network's family and are returned in canonical form.
+func dhcpOptions(cidr string, servers []string, domain string) ([]string, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	v4 := n.IP.To4() != nil
+	var invalid ValidationError
+	var out []string
+	for _, v := range servers {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		switch {
+		case ip == nil:
+			invalid.Add("dns", "invalid address %q", v)
+		case (ip.To4() != nil) != v4:
+			invalid.Add("dns", "%s is not in the address family of %s", ip, cidr)
+		default:
+			out = append(out, ip.String())
+		}
+	}
+	if domain != "" && !dns.ValidHostname(domain) {
+		invalid.Add("domain", "invalid domain %q", domain)
+	}
+	return out, invalid.Err()
+}
+
+func dhcpRoutes(r chi.Router, db *sql.DB) {
+	// DHCP server config for a leaf network (query params: format, dns, domain)
+	r.Get("/networks/{id}/dhcp", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		q := r.URL.Query()
+		var servers []string
+		if v := q.Get("dns"); v != "" {
+			servers = strings.Split(v, ",")
+		}
+		out, err := DHCPConfig(db, id, q.Get("format"), servers, q.Get("domain"))
+		if err == sql.ErrNoRows {
+			apierr.Write(w, r, apierr.NotFound, "network not found")
+			return
+		}
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if q.Get("format") == "kea" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Write([]byte(out))
+	})
+}
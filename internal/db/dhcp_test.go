@@ -0,0 +1,43 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDHCPOptions(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		servers []string
+		domain  string
+		want    []string
+		fields  string
+	}{
+		{cidr: "10.0.0.0/24"},
+		{cidr: "10.0.0.0/24", servers: []string{"10.0.0.53", " 192.0.2.53 "}, domain: "example.com", want: []string{"10.0.0.53", "192.0.2.53"}},
+		{cidr: "2001:db8::/64", servers: []string{"2001:DB8::0053"}, domain: "lab.example.com.", want: []string{"2001:db8::53"}},
+		{cidr: "10.0.0.0/24", servers: []string{"10.0.0.53; }\nsubnet 0.0.0.0 netmask 0.0.0.0 {"},
+			fields: `dns: invalid address "10.0.0.53; }\nsubnet 0.0.0.0 netmask 0.0.0.0 {"`},
+		{cidr: "10.0.0.0/24", servers: []string{"10.0.0.53", "2001:db8::53"}, fields: "dns: 2001:db8::53 is not in the address family of 10.0.0.0/24"},
+		{cidr: "2001:db8::/64", servers: []string{"192.0.2.53"}, fields: "dns: 192.0.2.53 is not in the address family of 2001:db8::/64"},
+		{cidr: "10.0.0.0/24", servers: []string{""}, fields: `dns: invalid address ""`},
+		{cidr: "10.0.0.0/24", domain: `example.com";` + "\n" + `option routers 10.0.0.66`,
+			fields: `domain: invalid domain "example.com\";\noption routers 10.0.0.66"`},
+		{cidr: "10.0.0.0/24", servers: []string{"ns1"}, domain: "a b",
+			fields: `dns: invalid address "ns1"; domain: invalid domain "a b"`},
+	}
+	for _, tt := range tests {
+		got, err := dhcpOptions(tt.cidr, tt.servers, tt.domain)
+		if tt.fields != "" {
+			if err == nil || err.Error() != tt.fields {
+				t.Errorf("%q %q: error %v, want %q", tt.servers, tt.domain, err, tt.fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.servers, tt.domain, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.servers, got, tt.want)
+		}
+	}
+}
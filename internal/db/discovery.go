@@ -0,0 +1,382 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/discovery"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// Discovery: leaf networks with discover set are swept on a schedule and
+// every address that answers is recorded with the ports that accepted.
+
+var errSweepRunning = errors.New("sweep already running for this network")
+
+// Networks being swept, so a manual sweep can't overlap the scheduled one
+var sweeping sync.Map
+
+func nullTime(t sql.NullTime) any {
+	if !t.Valid {
+		return nil
+	}
+	return t.Time
+}
+
+// DiscoveryOptions reads PIENG_DISCOVERY_PORTS and PIENG_DISCOVERY_CONCURRENCY
+func DiscoveryOptions() (discovery.Options, error) {
+	var opts discovery.Options
+	if v := os.Getenv("PIENG_DISCOVERY_PORTS"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || port < 1 || port > 65535 {
+				return opts, fmt.Errorf("PIENG_DISCOVERY_PORTS: bad port %q", p)
+			}
+			opts.Ports = append(opts.Ports, port)
+		}
+	}
+	if v := os.Getenv("PIENG_DISCOVERY_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("PIENG_DISCOVERY_CONCURRENCY: bad value %q", v)
+		}
+		opts.Concurrency = n
+	}
+	return opts, nil
+}
+
+// Probers reads PIENG_CHECK_PROBES (default neighbor,icmp,tcp),
+// PIENG_CHECK_PORTS (default PIENG_DISCOVERY_PORTS) and PIENG_CHECK_TIMEOUT
+func Probers() ([]discovery.Prober, error) {
+	opts, err := DiscoveryOptions()
+	if err != nil {
+		return nil, err
+	}
+	ports := opts.Ports
+	if v := os.Getenv("PIENG_CHECK_PORTS"); v != "" {
+		ports = nil
+		for _, p := range strings.Split(v, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("PIENG_CHECK_PORTS: bad port %q", p)
+			}
+			ports = append(ports, port)
+		}
+	}
+	timeout := time.Second
+	if v := os.Getenv("PIENG_CHECK_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("PIENG_CHECK_TIMEOUT: bad duration %q", v)
+		}
+		timeout = d
+	}
+	names := os.Getenv("PIENG_CHECK_PROBES")
+	if names == "" {
+		names = strings.Join(discovery.ProberNames, ",")
+	}
+	probers, err := discovery.NewProbers(names, ports, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("PIENG_CHECK_PROBES: %v", err)
+	}
+	return probers, nil
+}
+
+func formatPorts(ports []int) string {
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = strconv.Itoa(p)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func parsePorts(pg string) []int {
+	out := []int{}
+	for _, p := range strings.Split(strings.Trim(pg, "{} "), ",") {
+		if v, err := strconv.Atoi(strings.TrimSpace(p)); err == nil {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// SweepSummary is the outcome of sweeping one network
+type SweepSummary struct {
+	Network   int64  `json:"network"`
+	CIDR      string `json:"cidr"`
+	Addresses int    `json:"addresses"`
+	Alive     int    `json:"alive"`
+}
+
+// SweepNetwork probes every address of a leaf network and records the
+// ones that answer. Networks with more than 4096 addresses are refused.
+func SweepNetwork(ctx context.Context, db *sql.DB, networkID int64, opts discovery.Options) (SweepSummary, error) {
+	sum := SweepSummary{Network: networkID}
+	var subdivide bool
+	if err := db.QueryRow(`SELECT address_range::text, subdivide FROM networks WHERE id=$1`, networkID).Scan(&sum.CIDR, &subdivide); err != nil {
+		return sum, err
+	}
+	if subdivide {
+		return sum, ErrNotLeaf
+	}
+	addrs := ipam.AllHostsStr(sum.CIDR)
+	if addrs == nil {
+		return sum, fmt.Errorf("%s is too large to sweep (more than 4096 addresses)", sum.CIDR)
+	}
+	if _, running := sweeping.LoadOrStore(networkID, true); running {
+		return sum, errSweepRunning
+	}
+	defer sweeping.Delete(networkID)
+
+	sum.Addresses = len(addrs)
+	var dberr error
+	discovery.Sweep(ctx, addrs, opts, func(res discovery.Result) {
+		if !res.Alive || dberr != nil {
+			return
+		}
+		sum.Alive++
+		_, dberr = db.Exec(`INSERT INTO discovery(address, network, ports) VALUES($1::inet, $2, $3::integer[])
+			ON CONFLICT (address) DO UPDATE SET network=EXCLUDED.network, ports=EXCLUDED.ports, last_seen=NOW()`,
+			res.Address, networkID, formatPorts(res.Ports))
+	})
+	if dberr != nil {
+		return sum, dberr
+	}
+	if ctx.Err() != nil {
+		return sum, ctx.Err()
+	}
+	_, err := db.Exec(`UPDATE networks SET last_swept=NOW() WHERE id=$1`, networkID)
+	return sum, err
+}
+
+// RunDiscovery sweeps networks marked for discovery once they are
+// PIENG_DISCOVERY_INTERVAL (default 1h, 0 disables) past their last
+// sweep, one network at a time, until ctx is cancelled
+func RunDiscovery(ctx context.Context, db *sql.DB) {
+	interval := time.Hour
+	if v := os.Getenv("PIENG_DISCOVERY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("discovery: PIENG_DISCOVERY_INTERVAL: %v", err)
+			return
+		}
+		interval = d
+	}
+	if interval <= 0 {
+		return
+	}
+	opts, err := DiscoveryOptions()
+	if err != nil {
+		log.Printf("discovery: %v", err)
+		return
+	}
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		rows, err := db.Query(`SELECT id FROM networks WHERE discover AND NOT subdivide
+			AND (last_swept IS NULL OR last_swept < NOW() - $1 * interval '1 second')
+			ORDER BY last_swept NULLS FIRST`, int64(interval.Seconds()))
+		if err != nil {
+			log.Printf("discovery: %v", err)
+		} else {
+			var due []int64
+			for rows.Next() {
+				var id int64
+				if rows.Scan(&id) == nil {
+					due = append(due, id)
+				}
+			}
+			rows.Close()
+			for _, id := range due {
+				if _, err := SweepNetwork(ctx, db, id, opts); err != nil && err != errSweepRunning {
+					log.Printf("discovery: network %d: %v", id, err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func staleDays(v *ValidationError, r *http.Request) int {
+	days := 30
+	if s := os.Getenv("PIENG_DISCOVERY_STALE_DAYS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			days = n
+		}
+	}
+	return queryInt(v, r, "days", days, 1, 36500)
+}
+
+func discoveryRoutes(r chi.Router, db *sql.DB) {
+	// Check whether an address answers before it is handed out. Only
+	// addresses inside managed networks are probed, so this can't be used
+	// to scan arbitrary hosts.
+	r.Get("/check-ip/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(chi.URLParam(r, "ip"))
+		if ip == nil {
+			writeRequestError(w, r, invalidField("ip", "%q is not an IP address", chi.URLParam(r, "ip")))
+			return
+		}
+		var managed bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM networks WHERE address_range >>= $1::inet)`, ip.String()).Scan(&managed); err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		if !managed {
+			apierr.Write(w, r, apierr.Forbidden, "address is not in a managed network")
+			return
+		}
+		probers, err := Probers()
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, discovery.Check(r.Context(), ip, probers))
+	})
+
+	// Sweep results for a network, including addresses not recorded as hosts
+	r.Get("/networks/{id}/discovery", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		rows, err := db.Query(`SELECT host(d.address), d.first_seen, d.last_seen, d.ports::text, h.address IS NOT NULL
+			FROM discovery d LEFT JOIN hosts h ON h.address = d.address
+			WHERE d.network=$1 ORDER BY d.address`, id)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var addr, ports string
+			var first, last time.Time
+			var recorded bool
+			if err := rows.Scan(&addr, &first, &last, &ports, &recorded); err != nil {
+				continue
+			}
+			out = append(out, map[string]any{"address": addr, "first_seen": first, "last_seen": last, "ports": parsePorts(ports), "recorded": recorded})
+		}
+		writeJSON(w, out)
+	})
+
+	// Start a sweep now; it runs in the background
+	r.Post("/networks/{id}/sweep", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var cidr string
+		var subdivide bool
+		if err := db.QueryRow(`SELECT address_range::text, subdivide FROM networks WHERE id=$1`, id).Scan(&cidr, &subdivide); err != nil {
+			apierr.Write(w, r, apierr.NotFound, "network not found")
+			return
+		}
+		if subdivide {
+			apierr.Write(w, r, apierr.BadRequest, "network is subdivided; sweeps run on leaf networks")
+			return
+		}
+		if ipam.AllHostsStr(cidr) == nil {
+			apierr.Write(w, r, apierr.BadRequest, cidr+" is too large to sweep (more than 4096 addresses)")
+			return
+		}
+		if _, running := sweeping.Load(id); running {
+			apierr.Write(w, r, apierr.Conflict, errSweepRunning.Error())
+			return
+		}
+		opts, err := DiscoveryOptions()
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		go func() {
+			if _, err := SweepNetwork(context.Background(), db, id, opts); err != nil && err != errSweepRunning {
+				log.Printf("discovery: network %d: %v", id, err)
+			}
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(map[string]any{"status": "started", "network": id, "cidr": cidr})
+	})
+
+	// Addresses that answer but are not recorded as hosts
+	r.Get("/discovery/unknown", func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT host(d.address), d.network, n.address_range::text, d.first_seen, d.last_seen, d.ports::text
+			FROM discovery d JOIN networks n ON n.id = d.network
+			LEFT JOIN hosts h ON h.address = d.address
+			WHERE h.address IS NULL ORDER BY d.address`)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var addr, cidr, ports string
+			var nid int64
+			var first, last time.Time
+			if err := rows.Scan(&addr, &nid, &cidr, &first, &last, &ports); err != nil {
+				continue
+			}
+			out = append(out, map[string]any{"address": addr, "network": nid, "address_range": cidr, "first_seen": first, "last_seen": last, "ports": parsePorts(ports)})
+		}
+		writeJSON(w, out)
+	})
+
+	// Hosts in swept networks that have not answered for days (default
+	// PIENG_DISCOVERY_STALE_DAYS or 30); never seen hosts have no last_seen
+	r.Get("/discovery/stale", func(w http.ResponseWriter, r *http.Request) {
+		var invalid ValidationError
+		days := staleDays(&invalid, r)
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		rows, err := db.Query(`SELECT host(h.address), h.network, n.address_range::text, h.description, coalesce(h.hostname,''), d.last_seen
+			FROM hosts h JOIN networks n ON n.id = h.network
+			LEFT JOIN discovery d ON d.address = h.address
+			WHERE n.discover AND n.last_swept IS NOT NULL
+			  AND (d.last_seen IS NULL OR d.last_seen < NOW() - $1 * interval '1 day')
+			ORDER BY h.address`, days)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var addr, cidr, desc, hostname string
+			var nid int64
+			var seen sql.NullTime
+			if err := rows.Scan(&addr, &nid, &cidr, &desc, &hostname, &seen); err != nil {
+				continue
+			}
+			out = append(out, map[string]any{"address": addr, "network": nid, "address_range": cidr, "description": desc, "hostname": hostname, "last_seen": nullTime(seen)})
+		}
+		writeJSON(w, map[string]any{"days": days, "hosts": out})
+	})
+}
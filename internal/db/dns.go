@@ -0,0 +1,249 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/dns"
+)
+
+// DNSOptions returns zone settings from PIENG_DNS_NS, PIENG_DNS_RNAME
+// and PIENG_PTR_TEMPLATE
+func DNSOptions() (dns.Options, error) {
+	var opts dns.Options
+	opts.NS = splitNames(os.Getenv("PIENG_DNS_NS"))
+	for _, ns := range opts.NS {
+		if !dns.ValidHostname(ns) {
+			return opts, fmt.Errorf("PIENG_DNS_NS: invalid nameserver %q", ns)
+		}
+	}
+	opts.RName = strings.TrimSpace(os.Getenv("PIENG_DNS_RNAME"))
+	if opts.RName != "" && !dns.ValidMailbox(opts.RName) {
+		return opts, fmt.Errorf("PIENG_DNS_RNAME: invalid mailbox %q", opts.RName)
+	}
+	if t := os.Getenv("PIENG_PTR_TEMPLATE"); t != "" {
+		nt, err := dns.ParseNameTemplate(t)
+		if err != nil {
+			return opts, fmt.Errorf("PIENG_PTR_TEMPLATE: %w", err)
+		}
+		opts.Template = nt
+	}
+	return opts, nil
+}
+
+// Comma-separated names, trimmed, without empty entries
+func splitNames(v string) []string {
+	var out []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Override zone settings from query params ns, rname, ttl and template.
+// Nameservers and the mailbox are written into the zone as they are, so
+// they must be hostnames.
+func dnsQueryOptions(r *http.Request, base dns.Options) (dns.Options, error) {
+	q := r.URL.Query()
+	opts := base
+	var invalid ValidationError
+	if v := q.Get("ns"); v != "" {
+		opts.NS = splitNames(v)
+		for _, ns := range opts.NS {
+			if !dns.ValidHostname(ns) {
+				invalid.Add("ns", "invalid nameserver %q", ns)
+			}
+		}
+	}
+	if v := strings.TrimSpace(q.Get("rname")); v != "" {
+		if !dns.ValidMailbox(v) {
+			invalid.Add("rname", "invalid mailbox %q", v)
+		}
+		opts.RName = v
+	}
+	opts.TTL = queryInt(&invalid, r, "ttl", opts.TTL, 1, 1<<31-1)
+	if v := q.Get("template"); v != "" {
+		nt, err := dns.ParseNameTemplate(v)
+		if err != nil {
+			invalid.Add("template", "%v", err)
+		}
+		opts.Template = nt
+	}
+	return opts, invalid.Err()
+}
+
+// Latest changelog entry within a prefix, for zone serials and cache validators
+func lastChange(db *sql.DB, cidr string) (int64, time.Time) {
+	var id sql.NullInt64
+	var t sql.NullTime
+	db.QueryRow(`SELECT max(id), max(change_time) FROM changelog WHERE prefix <<= $1::cidr`, cidr).Scan(&id, &t)
+	return id.Int64, t.Time
+}
+
+// Zone serial: time of the latest logged change within a prefix
+func changeSerial(db *sql.DB, cidr string) uint32 {
+	_, t := lastChange(db, cidr)
+	if t.IsZero() {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+// Answer a conditional GET from the changelog-derived validators.
+// Returns true if a 304 was written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, mod time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !mod.IsZero() {
+		w.Header().Set("Last-Modified", mod.UTC().Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			if t = strings.TrimSpace(t); t == etag || t == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !mod.IsZero() {
+		if !mod.Truncate(time.Second).After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts with addresses inside a prefix, in address order
+func hostsWithin(db *sql.DB, cidr string) ([]dns.Host, error) {
+	rows, err := db.Query(`SELECT host(address), coalesce(hostname,''), description FROM hosts WHERE address <<= $1::cidr ORDER BY address`, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dns.Host
+	for rows.Next() {
+		var h dns.Host
+		if err := rows.Scan(&h.Address, &h.Hostname, &h.Description); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// ReverseZone generates the in-addr.arpa or ip6.arpa zone for a network
+func ReverseZone(db *sql.DB, networkID int64, opts dns.Options) (dns.Zone, error) {
+	var cidr string
+	if err := db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, networkID).Scan(&cidr); err != nil {
+		return dns.Zone{}, err
+	}
+	hosts, err := hostsWithin(db, cidr)
+	if err != nil {
+		return dns.Zone{}, err
+	}
+	return dns.BuildReverse(cidr, hosts, changeSerial(db, cidr), opts)
+}
+
+func dnsRoutes(r chi.Router, db *sql.DB) {
+	// Reverse zone (PTR records) for a network in BIND format
+	r.Get("/networks/{id}/reverse-zone", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		base, err := DNSOptions()
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		opts, err := dnsQueryOptions(r, base)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		z, err := ReverseZone(db, id, opts)
+		if err == sql.ErrNoRows {
+			apierr.Write(w, r, apierr.NotFound, "network not found")
+			return
+		}
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(z.String()))
+	})
+
+	// Forward A/AAAA records for hosts with an FQDN, grouped by domain.
+	// Supports ETag/If-Modified-Since so DNS builds only rerun on change.
+	r.Get("/networks/{id}/forward-records", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		q := r.URL.Query()
+		format := q.Get("format") // "bind" (default) or "json"
+		if format == "" {
+			format = "bind"
+		}
+		if format != "bind" && format != "json" {
+			apierr.Write(w, r, apierr.BadRequest, "format must be bind or json")
+			return
+		}
+		var invalid ValidationError
+		ttl := queryInt(&invalid, r, "ttl", 0, 1, 1<<31-1)
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		domain := dns.Fqdn(strings.ToLower(q.Get("domain")))
+
+		var cidr string
+		if err := db.QueryRow(`SELECT address_range::text FROM networks WHERE id=$1`, id).Scan(&cidr); err != nil {
+			apierr.Write(w, r, apierr.NotFound, "network not found")
+			return
+		}
+		changeID, mod := lastChange(db, cidr)
+		etag := fmt.Sprintf(`"fwd-%d-%d-%08x"`, id, changeID, crc32.ChecksumIEEE([]byte(r.URL.RawQuery)))
+		if notModified(w, r, etag, mod) {
+			return
+		}
+
+		hosts, err := hostsWithin(db, cidr)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		domains := dns.BuildForward(hosts, ttl)
+		if domain != "" {
+			filtered := []dns.Domain{}
+			for _, d := range domains {
+				if d.Name == domain {
+					filtered = append(filtered, d)
+				}
+			}
+			domains = filtered
+		}
+		if format == "json" {
+			if domains == nil {
+				domains = []dns.Domain{}
+			}
+			writeJSON(w, map[string]any{"network": cidr, "serial": changeSerial(db, cidr), "domains": domains})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(dns.FormatForward(domains)))
+	})
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/yellowman/GoPieNg/internal/dns"
+)
+
+func TestDNSQueryOptions(t *testing.T) {
+	base := dns.Options{NS: []string{"ns1.example.com"}, RName: "hostmaster.example.com"}
+	tests := []struct {
+		query  string
+		ns     []string
+		rname  string
+		fields string
+	}{
+		{query: "", ns: base.NS, rname: base.RName},
+		{query: "ns=a.example.net,%20b.example.net%20,,&rname=%20dns@example.net", ns: []string{"a.example.net", "b.example.net"}, rname: "dns@example.net"},
+		{query: "ns=a.example.net.%0A@%20IN%20A%20192.0.2.1", fields: `ns: invalid nameserver "a.example.net.\n@ IN A 192.0.2.1"`},
+		{query: "ns=a.example.net,b%20c", fields: `ns: invalid nameserver "b c"`},
+		{query: "rname=x.example.net.%0A@%20IN%20NS%20evil.", fields: `rname: invalid mailbox "x.example.net.\n@ IN NS evil."`},
+		{query: "rname=(hostmaster)", fields: `rname: invalid mailbox "(hostmaster)"`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/networks/1/reverse-zone?"+tt.query, nil)
+		opts, err := dnsQueryOptions(r, base)
+		if tt.fields != "" {
+			if err == nil || err.Error() != tt.fields {
+				t.Errorf("%q: error %v, want %q", tt.query, err, tt.fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+		} else if !reflect.DeepEqual(opts.NS, tt.ns) || opts.RName != tt.rname {
+			t.Errorf("%q: ns %q rname %q, want %q %q", tt.query, opts.NS, opts.RName, tt.ns, tt.rname)
+		}
+	}
+}
+
+func TestDNSOptions(t *testing.T) {
+	tests := []struct {
+		ns, rname, template string
+		want                []string
+		err                 string
+	}{
+		{ns: " ns1.example.com , ns2.example.com.,", rname: "hostmaster@example.com", want: []string{"ns1.example.com", "ns2.example.com."}},
+		{ns: "ns1.example.com,ns2.example.com\n@ IN A 192.0.2.1", err: `PIENG_DNS_NS: invalid nameserver "ns2.example.com\n@ IN A 192.0.2.1"`},
+		{ns: "ns1.example.com", rname: "a b", err: `PIENG_DNS_RNAME: invalid mailbox "a b"`},
+		{ns: "ns1.example.com", template: "{{.Nope", err: `PIENG_PTR_TEMPLATE: template: name:1: unclosed action`},
+	}
+	for _, tt := range tests {
+		t.Setenv("PIENG_DNS_NS", tt.ns)
+		t.Setenv("PIENG_DNS_RNAME", tt.rname)
+		t.Setenv("PIENG_PTR_TEMPLATE", tt.template)
+		opts, err := DNSOptions()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error %v, want %q", tt.ns, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.ns, err)
+		} else if !reflect.DeepEqual(opts.NS, tt.want) || opts.RName != tt.rname {
+			t.Errorf("%q: ns %q rname %q", tt.ns, opts.NS, opts.RName)
+		}
+	}
+}
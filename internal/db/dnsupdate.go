@@ -0,0 +1,435 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/dns"
+)
+
+// Dynamic DNS: host changes queue RFC 2136 updates for the targets
+// configured on the most specific enclosing network. A background worker
+// sends them and retries failures with backoff.
+
+const dnsMaxAttempts = 20
+
+var dnsWake = make(chan struct{}, 1)
+
+func wakeDNSUpdates() {
+	select {
+	case dnsWake <- struct{}{}:
+	default:
+	}
+}
+
+// dnsQueue queues an add or delete of a host's records. The host handlers
+// call it after a write, whichever Store made it; it is nil where there
+// is no queue, as on SQLite.
+type dnsQueue func(action, address, hostname string)
+
+func (q dnsQueue) queue(action, address, hostname string) {
+	if q != nil {
+		q(action, address, hostname)
+	}
+}
+
+// pgDNSQueue queues updates in the dns_update_queue table of db
+func pgDNSQueue(db *sql.DB) dnsQueue {
+	return func(action, address, hostname string) {
+		queueDNSUpdate(db, action, address, hostname)
+	}
+}
+
+// Queue an add or delete of a host's records for every matching target
+func queueDNSUpdate(db *sql.DB, action, address, hostname string) {
+	if hostname == "" {
+		return
+	}
+	res, err := db.Exec(`
+		INSERT INTO dns_update_queue(target, action, address, hostname)
+		SELECT t.id, $1, $2::inet, $3
+		FROM dns_update_targets t JOIN networks n ON t.network = n.id
+		WHERE $2::inet <<= n.address_range
+		  AND masklen(n.address_range) = (
+			SELECT max(masklen(n2.address_range))
+			FROM dns_update_targets t2 JOIN networks n2 ON t2.network = n2.id
+			WHERE $2::inet <<= n2.address_range)`, action, address, hostname)
+	if err != nil {
+		log.Printf("dns update: queue %s %s: %v", action, address, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		wakeDNSUpdates()
+	}
+}
+
+type dnsTarget struct {
+	ID                         int64
+	Server                     string
+	Forward, Reverse           bool
+	ForwardZone, ReverseZone   sql.NullString
+	KeyName, KeyAlg, KeySecret sql.NullString
+	TTL                        int
+}
+
+type dnsJob struct {
+	ID       int64
+	Action   string
+	Address  string
+	Hostname string
+	Attempts int
+	Target   dnsTarget
+}
+
+// Send the forward and reverse updates for one queued change
+func applyDNSJob(ctx context.Context, c *dns.Client, j dnsJob) error {
+	t := j.Target
+	ip := net.ParseIP(j.Address)
+	if ip == nil {
+		return fmt.Errorf("bad address %q", j.Address)
+	}
+	var key *dns.Key
+	if t.KeyName.Valid && t.KeyName.String != "" {
+		var err error
+		if key, err = dns.ParseKey(t.KeyName.String, t.KeyAlg.String, t.KeySecret.String); err != nil {
+			return err
+		}
+	}
+	fqdn := dns.Fqdn(j.Hostname)
+	ttl := uint32(t.TTL)
+
+	if t.Forward {
+		zone := t.ForwardZone.String
+		if zone == "" {
+			var err error
+			if zone, err = c.FindZone(ctx, t.Server, fqdn); err != nil {
+				return fmt.Errorf("forward zone: %w", err)
+			}
+		}
+		typ, data := dns.AddressData(ip)
+		rr := dns.AddRR(fqdn, typ, ttl, data)
+		if j.Action == "delete" {
+			rr = dns.DeleteRR(fqdn, typ, data)
+		}
+		if err := c.Update(ctx, t.Server, dns.Fqdn(zone), []dns.RR{rr}, key); err != nil {
+			return fmt.Errorf("forward %s: %w", zone, err)
+		}
+	}
+
+	if t.Reverse {
+		name := dns.ReverseName(ip)
+		zone := t.ReverseZone.String
+		if zone == "" {
+			var err error
+			if zone, err = c.FindZone(ctx, t.Server, name); err != nil {
+				return fmt.Errorf("reverse zone: %w", err)
+			}
+		}
+		updates := []dns.RR{dns.DeleteRRset(name, dns.TypePTR)}
+		if j.Action == "add" {
+			data, err := dns.DomainData(fqdn)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, dns.AddRR(name, dns.TypePTR, ttl, data))
+		}
+		if err := c.Update(ctx, t.Server, dns.Fqdn(zone), updates, key); err != nil {
+			return fmt.Errorf("reverse %s: %w", zone, err)
+		}
+	}
+	return nil
+}
+
+// How long a job that failed after attempts earlier tries waits: 30s,
+// doubling each time up to an hour
+func dnsRetryDelay(attempts int) time.Duration {
+	return min(time.Duration(1<<min(attempts, 7))*30*time.Second, time.Hour)
+}
+
+// Work through due queue entries in order. A failed entry holds back
+// later entries for the same target and address so they apply in order.
+func processDNSQueue(ctx context.Context, db *sql.DB, c *dns.Client) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT q.id, q.action, host(q.address), q.hostname, q.attempts, q.next_attempt <= NOW(),
+		       t.id, t.server, t.forward, t.reverse, t.forward_zone, t.reverse_zone,
+		       t.key_name, t.key_algorithm, t.key_secret, t.ttl
+		FROM dns_update_queue q JOIN dns_update_targets t ON q.target = t.id
+		WHERE q.attempts < $1
+		ORDER BY q.id LIMIT 500`, dnsMaxAttempts)
+	if err != nil {
+		log.Printf("dns update: %v", err)
+		return
+	}
+	var jobs []dnsJob
+	var due []bool
+	for rows.Next() {
+		var j dnsJob
+		var isDue bool
+		t := &j.Target
+		if err := rows.Scan(&j.ID, &j.Action, &j.Address, &j.Hostname, &j.Attempts, &isDue,
+			&t.ID, &t.Server, &t.Forward, &t.Reverse, &t.ForwardZone, &t.ReverseZone,
+			&t.KeyName, &t.KeyAlg, &t.KeySecret, &t.TTL); err != nil {
+			// Skipping the entry would let later ones for its host
+			// overtake it, so leave the queue for the next pass
+			log.Printf("dns update: read queue: %v", err)
+			rows.Close()
+			return
+		}
+		jobs = append(jobs, j)
+		due = append(due, isDue)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("dns update: read queue: %v", err)
+		return
+	}
+
+	blocked := map[string]bool{}
+	for i, j := range jobs {
+		k := fmt.Sprintf("%d/%s", j.Target.ID, j.Address)
+		if blocked[k] {
+			continue
+		}
+		if !due[i] {
+			blocked[k] = true
+			continue
+		}
+		if err := applyDNSJob(ctx, c, j); err != nil {
+			blocked[k] = true
+			db.ExecContext(ctx, `UPDATE dns_update_queue SET attempts=attempts+1, last_error=$2, next_attempt=NOW()+$3*interval '1 second' WHERE id=$1`,
+				j.ID, err.Error(), int(dnsRetryDelay(j.Attempts).Seconds()))
+			log.Printf("dns update: %s %s (%s): %v", j.Action, j.Hostname, j.Address, err)
+			continue
+		}
+		db.ExecContext(ctx, `DELETE FROM dns_update_queue WHERE id=$1`, j.ID)
+	}
+}
+
+// RunDNSUpdates sends queued dynamic DNS updates until ctx is cancelled
+func RunDNSUpdates(ctx context.Context, db *sql.DB) {
+	c := &dns.Client{}
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		processDNSQueue(ctx, db, c)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-dnsWake:
+		}
+	}
+}
+
+// dnsTargetRequest is the body of POST /dns-updates/targets
+type dnsTargetRequest struct {
+	Network      int64  `json:"network"`
+	Server       string `json:"server"`
+	Forward      *bool  `json:"forward"`
+	Reverse      *bool  `json:"reverse"`
+	ForwardZone  string `json:"forward_zone"`
+	ReverseZone  string `json:"reverse_zone"`
+	KeyName      string `json:"key_name"`
+	KeyAlgorithm string `json:"key_algorithm"`
+	KeySecret    string `json:"key_secret"`
+	TTL          int    `json:"ttl"`
+}
+
+func dnsUpdateRoutes(r chi.Router, db *sql.DB) {
+	// Status of dynamic DNS: configured targets (without secrets) and the queue
+	r.Get("/dns-updates", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		targets := []map[string]any{}
+		rows, err := db.Query(`
+			SELECT t.id, t.network, n.address_range::text, t.server, t.forward, t.reverse,
+			       coalesce(t.forward_zone,''), coalesce(t.reverse_zone,''),
+			       coalesce(t.key_name,''), t.key_algorithm, t.ttl
+			FROM dns_update_targets t JOIN networks n ON t.network = n.id
+			ORDER BY n.address_range, t.id`)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		for rows.Next() {
+			var id, network int64
+			var cidr, server, fz, rz, keyName, keyAlg string
+			var fwd, rev bool
+			var ttl int
+			if err := rows.Scan(&id, &network, &cidr, &server, &fwd, &rev, &fz, &rz, &keyName, &keyAlg, &ttl); err != nil {
+				continue
+			}
+			targets = append(targets, map[string]any{
+				"id": id, "network": network, "address_range": cidr, "server": server,
+				"forward": fwd, "reverse": rev, "forward_zone": fz, "reverse_zone": rz,
+				"key_name": keyName, "key_algorithm": keyAlg, "ttl": ttl,
+			})
+		}
+		rows.Close()
+
+		queue := []map[string]any{}
+		rows, err = db.Query(`
+			SELECT id, target, action, host(address), hostname, attempts, coalesce(last_error,''),
+			       created::text, next_attempt::text
+			FROM dns_update_queue ORDER BY id LIMIT 1000`)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		pending, failed := 0, 0
+		for rows.Next() {
+			var id, target int64
+			var action, addr, hostname, lastErr, created, next string
+			var attempts int
+			if err := rows.Scan(&id, &target, &action, &addr, &hostname, &attempts, &lastErr, &created, &next); err != nil {
+				continue
+			}
+			status := "pending"
+			if attempts >= dnsMaxAttempts {
+				status = "failed"
+				failed++
+			} else {
+				pending++
+			}
+			queue = append(queue, map[string]any{
+				"id": id, "target": target, "action": action, "address": addr, "hostname": hostname,
+				"attempts": attempts, "last_error": lastErr, "created": created, "next_attempt": next, "status": status,
+			})
+		}
+		writeJSON(w, map[string]any{"targets": targets, "queue": queue, "pending": pending, "failed": failed})
+	})
+
+	// Configure a target for a network subtree
+	r.Post("/dns-updates/targets", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		var req dnsTargetRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var invalid ValidationError
+		if req.Network < 1 {
+			invalid.Add("network", "required")
+		}
+		if req.Server == "" {
+			invalid.Add("server", "required")
+		}
+		if req.KeyAlgorithm == "" {
+			req.KeyAlgorithm = "hmac-sha256"
+		}
+		if req.KeyName != "" {
+			if _, err := dns.ParseKey(req.KeyName, req.KeyAlgorithm, req.KeySecret); err != nil {
+				field := "key_algorithm"
+				if errors.As(err, new(base64.CorruptInputError)) {
+					field = "key_secret"
+				}
+				invalid.Add(field, "%v", err)
+			}
+		}
+		if req.TTL < 0 {
+			invalid.Add("ttl", "must not be negative")
+		}
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if req.TTL == 0 {
+			req.TTL = 3600
+		}
+		fwd, rev := true, true
+		if req.Forward != nil {
+			fwd = *req.Forward
+		}
+		if req.Reverse != nil {
+			rev = *req.Reverse
+		}
+		nullable := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+		var id int64
+		err := db.QueryRow(`
+			INSERT INTO dns_update_targets(network, server, forward, reverse, forward_zone, reverse_zone,
+			                               key_name, key_algorithm, key_secret, ttl)
+			VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id`,
+			req.Network, req.Server, fwd, rev, nullable(req.ForwardZone), nullable(req.ReverseZone),
+			nullable(req.KeyName), req.KeyAlgorithm, nullable(req.KeySecret), req.TTL).Scan(&id)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, map[string]any{"id": id})
+	})
+
+	r.Delete("/dns-updates/targets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM dns_update_targets WHERE id=$1`, id)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierr.Write(w, r, apierr.NotFound, "target not found")
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok"})
+	})
+
+	// Retry everything queued now, including entries that gave up
+	r.Post("/dns-updates/retry", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		res, err := db.Exec(`UPDATE dns_update_queue SET attempts=0, next_attempt=NOW()`)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		n, _ := res.RowsAffected()
+		wakeDNSUpdates()
+		writeJSON(w, map[string]any{"status": "ok", "requeued": n})
+	})
+
+	r.Delete("/dns-updates/queue/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM dns_update_queue WHERE id=$1`, id)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierr.Write(w, r, apierr.NotFound, "queued update not found")
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok"})
+	})
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yellowman/GoPieNg/internal/dns"
+)
+
+// A server refusing every update: with rcode, or when badsig is set with
+// an unsigned NOTAUTH carrying TSIG error BADSIG, as a server does for a
+// wrong key
+func refusingServer(t *testing.T, rcode int, badsig bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Echo the header and zone section
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += 1 + int(buf[end])
+			}
+			resp := append([]byte(nil), buf[:end+5]...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8000|5<<11|uint16(rcode))
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if badsig {
+				resp[3] = resp[3]&0xf0 | 9
+				resp = append(resp, 10, 'u', 'p', 'd', 'a', 't', 'e', '-', 'k', 'e', 'y', 0)
+				resp = binary.BigEndian.AppendUint16(resp, dns.TypeTSIG)
+				resp = binary.BigEndian.AppendUint16(resp, dns.ClassANY)
+				resp = binary.BigEndian.AppendUint32(resp, 0)
+				rdata := append([]byte{11}, "hmac-sha256"...)
+				rdata = append(rdata, 0, 0, 0, 0, 0, 0, 0, 1, 44, 0, 0) // time, fudge, no MAC
+				rdata = append(rdata, buf[0], buf[1], 0, 16, 0, 0)      // original ID, BADSIG
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+				resp = append(resp, rdata...)
+				binary.BigEndian.PutUint16(resp[10:], 1)
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestApplyDNSJobRefused(t *testing.T) {
+	key := func(name string) sql.NullString { return sql.NullString{String: name, Valid: name != ""} }
+	tests := []struct {
+		name    string
+		rcode   int
+		badsig  bool
+		keyName string
+		want    dns.RcodeError
+	}{
+		{"refused", 5, false, "", 5},
+		{"badsig", 0, true, "update-key", 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := dnsJob{
+				ID: 1, Action: "add", Address: "192.0.2.1", Hostname: "host.example.com",
+				Target: dnsTarget{
+					Server: refusingServer(t, tt.rcode, tt.badsig), Forward: true,
+					ForwardZone: key("example.com"), KeyName: key(tt.keyName),
+					KeyAlg: key("hmac-sha256"), KeySecret: key("c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="),
+					TTL: 3600,
+				},
+			}
+			err := applyDNSJob(context.Background(), &dns.Client{Timeout: 2 * time.Second}, j)
+			var rc dns.RcodeError
+			if !errors.As(err, &rc) || rc != tt.want {
+				t.Fatalf("apply: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSRetryDelay(t *testing.T) {
+	want := []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour,
+	}
+	for attempts, d := range want {
+		if got := dnsRetryDelay(attempts); got != d {
+			t.Errorf("attempt %d: %v, want %v", attempts, got, d)
+		}
+	}
+	if got := dnsRetryDelay(dnsMaxAttempts); got != time.Hour {
+		t.Errorf("attempt %d: %v, want 1h", dnsMaxAttempts, got)
+	}
+}
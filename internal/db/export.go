@@ -0,0 +1,139 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/export"
+)
+
+// ExportTree writes the networks below rootID (or the whole tree for 0)
+// with their hosts to w as they are read, returning sql.ErrNoRows before
+// writing anything if rootID doesn't exist. Users, roles and other
+// credentials are not part of the export.
+func ExportTree(db *sql.DB, rootID int64, w *export.Writer) error {
+	with, where := "", ""
+	var args []any
+	if rootID != 0 {
+		with = `WITH RECURSIVE tree AS (
+				SELECT id FROM networks WHERE id = $1
+				UNION ALL
+				SELECT c.id FROM networks c JOIN tree t ON c.parent = t.id
+			) `
+		where = ` WHERE n.id IN (SELECT id FROM tree)`
+		args = append(args, rootID)
+	}
+	nets, err := db.Query(with+`SELECT `+networkColumns+` FROM networks n`+where+` ORDER BY address_range`, args...)
+	if err != nil {
+		return err
+	}
+	defer nets.Close()
+	// Hosts in the same order as their networks, so each network's hosts
+	// are next in line when it is read
+	hosts, err := db.Query(with+`SELECT host(h.address), h.network, h.description, h.hostname, h.mac::text
+		FROM hosts h JOIN networks n ON h.network = n.id`+where+` ORDER BY n.address_range, h.address`, args...)
+	if err != nil {
+		return err
+	}
+	defer hosts.Close()
+
+	var next *Host
+	for nets.Next() {
+		n, err := scanNetwork(nets)
+		if err != nil {
+			return err
+		}
+		en := &export.Network{
+			ID:          n.ID,
+			Parent:      n.Parent.Int64,
+			CIDR:        n.AddressRange,
+			Description: n.Description.String,
+			Subdivide:   n.Subdivide,
+			ValidMasks:  n.ValidMasks,
+			Owner:       n.Owner.String,
+			Account:     n.Account.String,
+			Service:     n.Service.Int64,
+			Gateway:     n.Gateway.String,
+			DHCPPools:   n.DHCPPools.String,
+			Discover:    n.Discover,
+		}
+		for {
+			if next == nil {
+				if !hosts.Next() {
+					break
+				}
+				next = &Host{}
+				if err := hosts.Scan(&next.Address, &next.NetworkID, &next.Description, &next.Hostname, &next.MAC); err != nil {
+					return err
+				}
+			}
+			if next.NetworkID != n.ID {
+				break
+			}
+			en.Hosts = append(en.Hosts, export.Host{
+				Address:     next.Address,
+				Description: next.Description,
+				Hostname:    next.Hostname.String,
+				MAC:         next.MAC.String,
+			})
+			next = nil
+		}
+		if err := w.Network(en); err != nil {
+			return err
+		}
+	}
+	if err := nets.Err(); err != nil {
+		return err
+	}
+	if err := hosts.Err(); err != nil {
+		return err
+	}
+	if rootID != 0 && !w.Started() {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func exportRoutes(r chi.Router, db *sql.DB) {
+	// Whole tree or subtree with hosts nested (query params: root, format=json|csv|yaml)
+	r.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var invalid ValidationError
+		root := queryID(&invalid, r, "root")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		format := q.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" && format != "yaml" {
+			apierr.Write(w, r, apierr.BadRequest, "format must be json, csv or yaml")
+			return
+		}
+		w.Header().Set("Content-Type", export.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gopieng-export.%s"`, format))
+		ew, _ := export.NewWriter(w, format)
+		err := ExportTree(db, root, ew)
+		if err == nil {
+			err = ew.Close()
+		}
+		switch {
+		case err == nil:
+		case ew.Started():
+			// the answer is under way; all that's left is to cut it short
+			log.Printf("export: %v", err)
+		case err == sql.ErrNoRows:
+			w.Header().Del("Content-Disposition")
+			apierr.Write(w, r, apierr.NotFound, "network not found")
+		default:
+			w.Header().Del("Content-Disposition")
+			apierr.InternalError(w, r, err)
+		}
+	})
+}
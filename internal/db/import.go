@@ -0,0 +1,322 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/dhcp"
+	"github.com/yellowman/GoPieNg/internal/dns"
+	"github.com/yellowman/GoPieNg/internal/importer"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// ImportOptions control a bulk import
+type ImportOptions struct {
+	Commit        bool   // keep the changes; otherwise everything is rolled back
+	Partial       bool   // with Commit, keep the rows that fit even if others conflict
+	AllowTopLevel bool   // networks with no containing network become roots
+	Username      string // changelog user
+}
+
+// ImportRowResult is the outcome for one row: where it goes, or why it can't
+type ImportRowResult struct {
+	importer.Row
+	Parent  string `json:"parent,omitempty"` // containing network
+	Status  string `json:"status"`           // "create" or "conflict"
+	Problem string `json:"problem,omitempty"`
+}
+
+// ImportResult reports what an import did, or would do in a dry run
+type ImportResult struct {
+	Committed bool              `json:"committed"`
+	Networks  int               `json:"networks"`
+	Hosts     int               `json:"hosts"`
+	Conflicts int               `json:"conflicts"`
+	Rows      []ImportRowResult `json:"rows"`
+}
+
+// ImportRows places each row under the most specific containing network,
+// parents first, inside one transaction. Rows that conflict are rolled
+// back individually and reported; the transaction is only committed if
+// opts.Commit is set and there were no conflicts, or with opts.Partial
+// regardless.
+func ImportRows(db *sql.DB, rows []importer.Row, opts ImportOptions) (ImportResult, error) {
+	res := ImportResult{Rows: []ImportRowResult{}}
+	good, bad := importer.Prepare(rows)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var dnsAdds []importer.Row
+	for _, row := range good {
+		if _, err := tx.Exec(`SAVEPOINT import_row`); err != nil {
+			return res, err
+		}
+		var parent, problem string
+		if row.Type == "network" {
+			parent, problem = importNetwork(tx, row, opts)
+		} else {
+			parent, problem = importHost(tx, row, opts)
+		}
+		out := ImportRowResult{Row: row, Parent: parent, Status: "create"}
+		if problem != "" {
+			if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT import_row`); err != nil {
+				return res, err
+			}
+			out.Status, out.Problem = "conflict", problem
+			res.Conflicts++
+		} else if row.Type == "network" {
+			res.Networks++
+		} else {
+			res.Hosts++
+			if row.Hostname != "" {
+				dnsAdds = append(dnsAdds, row)
+			}
+		}
+		res.Rows = append(res.Rows, out)
+	}
+	for _, p := range bad {
+		res.Rows = append(res.Rows, ImportRowResult{Row: p.Row, Status: "conflict", Problem: p.Problem})
+		res.Conflicts++
+	}
+
+	if !opts.Commit || res.Conflicts > 0 && !opts.Partial {
+		return res, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	res.Committed = true
+	for _, h := range dnsAdds {
+		queueDNSUpdate(db, "add", h.Address, h.Hostname)
+	}
+	return res, nil
+}
+
+// Insert one network row; returns the parent CIDR and a problem if it can't be placed
+func importNetwork(tx *sql.Tx, row importer.Row, opts ImportOptions) (string, string) {
+	var id int64
+	if tx.QueryRow(`SELECT id FROM networks WHERE address_range=$1::cidr`, row.CIDR).Scan(&id) == nil {
+		return "", "network already exists"
+	}
+	var parentID sql.NullInt64
+	var parent string
+	var subdivide bool
+	err := tx.QueryRow(`SELECT id, address_range::text, subdivide FROM networks WHERE address_range >> $1::cidr
+		ORDER BY masklen(address_range) DESC LIMIT 1`, row.CIDR).Scan(&parentID, &parent, &subdivide)
+	switch {
+	case err == sql.ErrNoRows:
+		if !opts.AllowTopLevel {
+			return "", "no containing network (top-level networks need an administrator)"
+		}
+	case err != nil:
+		return "", importProblem(row, err)
+	case !subdivide:
+		return parent, "inside " + parent + ", which is not subdivided"
+	}
+	if problem := misplaced(row, parent); problem != "" {
+		return parent, problem
+	}
+	var inner string
+	if tx.QueryRow(`SELECT address_range::text FROM networks WHERE address_range << $1::cidr LIMIT 1`, row.CIDR).Scan(&inner) == nil {
+		return parent, "overlaps existing network " + inner
+	}
+	if len(row.Account) > 32 {
+		return parent, "account longer than 32 characters"
+	}
+	var pools string
+	if row.DHCPPools != "" {
+		p, err := dhcp.ParsePools(row.DHCPPools, row.CIDR)
+		if err != nil {
+			return parent, "dhcp_pools: " + err.Error()
+		}
+		pools = dhcp.FormatPools(p)
+	}
+	var masks sql.NullString
+	if len(row.ValidMasks) > 0 {
+		masks = sql.NullString{String: ipam.FormatSmallIntArray(row.ValidMasks), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO networks(parent,address_range,description,subdivide,owner,account,
+			valid_masks,service,gateway,dhcp_pools,discover)
+		VALUES($1,$2::cidr,NULLIF($3,''),$4,NULLIF($5,''),NULLIF($6,''),
+			$7::smallint[],NULLIF($8,0),NULLIF($9,'')::inet,NULLIF($10,''),$11)`,
+		parentID, row.CIDR, row.Description, row.Subdivide, row.Owner, row.Account,
+		masks, row.Service, row.Gateway, pools, row.Discover)
+	if err != nil {
+		return parent, importProblem(row, err)
+	}
+	logChange(tx, row.CIDR, fmt.Sprintf("network imported: %s by %s", row.Description, opts.Username), opts.Username)
+	return parent, ""
+}
+
+// The problem reported for a row the database refused. The report goes
+// back to the client, so anything but a known conflict is logged and
+// reported only as a database error.
+func importProblem(row importer.Row, err error) string {
+	err = pgWriteError(err)
+	var conflict *ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		return conflict.Msg
+	case errors.Is(err, ErrExists):
+		return err.Error()
+	}
+	log.Printf("import: %s: %v", row.Key(), err)
+	return "database error"
+}
+
+// A row exported with its parent must land under the same network again
+func misplaced(row importer.Row, parent string) string {
+	switch {
+	case row.Parent == "" || row.Parent == parent:
+		return ""
+	case parent == "":
+		return "parent " + row.Parent + " does not exist"
+	}
+	return "would go under " + parent + ", not " + row.Parent
+}
+
+// Insert one host row into the most specific (leaf) network containing it
+func importHost(tx *sql.Tx, row importer.Row, opts ImportOptions) (string, string) {
+	var n int64
+	if tx.QueryRow(`SELECT network FROM hosts WHERE address=$1::inet`, row.Address).Scan(&n) == nil {
+		return "", "host already recorded"
+	}
+	var id int64
+	var parent string
+	var subdivide bool
+	err := tx.QueryRow(`SELECT id, address_range::text, subdivide FROM networks WHERE address_range >>= $1::inet
+		ORDER BY masklen(address_range) DESC LIMIT 1`, row.Address).Scan(&id, &parent, &subdivide)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", "no network contains this address"
+	case err != nil:
+		return "", importProblem(row, err)
+	case subdivide:
+		return parent, "most specific network " + parent + " is subdivided"
+	}
+	if problem := misplaced(row, parent); problem != "" {
+		return parent, problem
+	}
+	if ip := net.ParseIP(row.Address); ip.To4() != nil && ipam.GetMask(parent) < 31 {
+		if first, last := ipam.FirstLastStr(parent); row.Address == first || row.Address == last {
+			return parent, "network or broadcast address of " + parent
+		}
+	}
+	if row.Hostname != "" && !dns.ValidHostname(row.Hostname) {
+		return parent, "invalid hostname"
+	}
+	_, err = tx.Exec(`INSERT INTO hosts(address,network,description,hostname,mac)
+		VALUES($1::inet,$2,$3,NULLIF($4,''),NULLIF($5,'')::macaddr)`,
+		row.Address, id, row.Description, row.Hostname, row.MAC)
+	if err != nil {
+		return parent, importProblem(row, err)
+	}
+	logChange(tx, ipam.HostCIDR(row.Address), fmt.Sprintf("host imported: %s by %s", row.Description, opts.Username), opts.Username)
+	return parent, ""
+}
+
+// Dump tables from a JSON object body, or one multipart/form-data part per table
+func readTables(r *http.Request) (importer.Tables, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return importer.ParseTables(r.Body)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	t := importer.Tables{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		t[part.FormName()] = data
+	}
+}
+
+func importRoutes(r chi.Router, db *sql.DB) {
+	// Shared by the importers: run the rows and answer 409 if a commit was refused
+	run := func(w http.ResponseWriter, r *http.Request, rows []importer.Row) {
+		opts := ImportOptions{AllowTopLevel: isAdmin(r), Username: getUsername(r, db)}
+		var invalid ValidationError
+		opts.Commit = queryBool(&invalid, r, "commit")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		res, err := ImportRows(db, rows, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		if opts.Commit && !res.Committed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		writeJSON(w, res)
+	}
+
+	// Bulk import of networks and hosts (body: CSV or JSON rows; query params:
+	// format=csv|json, commit). Without commit=true this is a dry run.
+	r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+		if !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		rows, err := importer.Parse(http.MaxBytesReader(w, r.Body, 64<<20), r.URL.Query().Get("format"))
+		if err != nil {
+			apierr.Write(w, r, apierr.BadRequest, "import: "+err.Error())
+			return
+		}
+		run(w, r, rows)
+	})
+
+	// Imports from other IPAMs (body: JSON object of tables or multipart
+	// parts named after them; query params: vrf, commit)
+	for name, conv := range map[string]func(importer.Tables, string) ([]importer.Row, error){
+		"netbox":  importer.NetBox,
+		"phpipam": importer.PHPIPAM,
+	} {
+		conv := conv
+		r.Post("/import/"+name, func(w http.ResponseWriter, r *http.Request) {
+			if !isCreator(r) {
+				apierr.Write(w, r, apierr.Forbidden, "forbidden")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, 256<<20)
+			tables, err := readTables(r)
+			if err != nil {
+				apierr.Write(w, r, apierr.BadRequest, "import: "+err.Error())
+				return
+			}
+			rows, err := conv(tables, r.URL.Query().Get("vrf"))
+			if err != nil {
+				apierr.Write(w, r, apierr.BadRequest, "import: "+err.Error())
+				return
+			}
+			run(w, r, rows)
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/yellowman/GoPieNg/internal/importer"
+)
+
+func TestImportProblem(t *testing.T) {
+	row := importer.Row{Type: "network", CIDR: "10.0.0.0/24"}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&pq.Error{Code: "23P01", Message: `conflicting key value violates exclusion constraint "networks_no_overlap"`}, "overlaps an existing network"},
+		{&pq.Error{Code: "23505", Message: `duplicate key value violates unique constraint "hosts_pkey"`}, "already exists"},
+		{&pq.Error{Code: "22P02", Message: `invalid input syntax for type macaddr: "x"`}, "database error"},
+		{errors.New("pq: connection reset at 10.1.1.1:5432"), "database error"},
+	}
+	for _, tt := range tests {
+		if got := importProblem(row, tt.err); got != tt.want {
+			t.Errorf("%v: %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
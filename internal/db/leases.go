@@ -0,0 +1,259 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/dhcp"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// LeaseHost is a recorded host referenced by a lease report
+type LeaseHost struct {
+	Address     string `json:"address"`
+	Network     int64  `json:"network"`
+	Description string `json:"description,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+}
+
+// LeaseMismatch is a host whose recorded MAC differs from its lease
+type LeaseMismatch struct {
+	LeaseHost
+	LeaseMAC string `json:"lease_mac"`
+}
+
+// LeaseUnrecorded is an active lease with no host; Network is the leaf
+// network it would be created in, or 0 if no leaf network contains it
+type LeaseUnrecorded struct {
+	dhcp.Lease
+	Network int64 `json:"network"`
+}
+
+// LeaseReport is the result of reconciling a lease file with the hosts table
+type LeaseReport struct {
+	Leases      int               `json:"leases"`
+	Active      int               `json:"active"`
+	Unrecorded  []LeaseUnrecorded `json:"unrecorded"`
+	NoLease     []LeaseHost       `json:"no_lease"`
+	MACMismatch []LeaseMismatch   `json:"mac_mismatch"`
+	Created     []string          `json:"created"`
+	Updated     []string          `json:"updated"`
+}
+
+// LeaseOptions control whether reconciliation changes the hosts table
+type LeaseOptions struct {
+	Create   bool   // add hosts for unrecorded leases
+	Update   bool   // set the MAC of recorded hosts from their lease
+	Record   bool   // keep the leases for the stale report
+	Username string // changelog user
+}
+
+// Most specific leaf network containing addr, or 0
+func leafNetworkFor(db *sql.DB, addr string) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM networks WHERE address_range >>= $1::inet AND NOT subdivide
+		ORDER BY masklen(address_range) DESC LIMIT 1`, addr).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Store the latest state of each lease in dhcp_leases
+func recordLeases(db *sql.DB, leases []dhcp.Lease) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, l := range leases {
+		var mac, hostname sql.NullString
+		var ends sql.NullTime
+		if l.MAC != "" {
+			mac = sql.NullString{String: l.MAC, Valid: true}
+		}
+		if l.Hostname != "" {
+			hostname = sql.NullString{String: l.Hostname, Valid: true}
+		}
+		if l.Ends != nil {
+			ends = sql.NullTime{Time: *l.Ends, Valid: true}
+		}
+		if _, err := tx.Exec(`INSERT INTO dhcp_leases(address, mac, hostname, ends, active) VALUES($1::inet, $2::macaddr, $3, $4, $5)
+			ON CONFLICT (address) DO UPDATE SET mac=EXCLUDED.mac, hostname=EXCLUDED.hostname, ends=EXCLUDED.ends,
+				active=EXCLUDED.active, imported=NOW()`, l.Address, mac, hostname, ends, l.Active); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReconcileLeases compares active leases with the hosts table. Hosts
+// without a lease are only reported for leaf networks that hold at
+// least one lease, so statically addressed networks stay out of the report.
+func ReconcileLeases(db *sql.DB, leases []dhcp.Lease, opts LeaseOptions) (LeaseReport, error) {
+	rep := LeaseReport{
+		Leases:      len(leases),
+		Unrecorded:  []LeaseUnrecorded{},
+		NoLease:     []LeaseHost{},
+		MACMismatch: []LeaseMismatch{},
+		Created:     []string{},
+		Updated:     []string{},
+	}
+	if opts.Record {
+		if err := recordLeases(db, leases); err != nil {
+			return rep, err
+		}
+	}
+	active := map[string]dhcp.Lease{}
+	networks := map[int64]bool{}
+	for _, l := range leases {
+		if !l.Active {
+			continue
+		}
+		rep.Active++
+		active[l.Address] = l
+
+		var h LeaseHost
+		var desc, mac sql.NullString
+		err := db.QueryRow(`SELECT host(address), network, description, mac::text FROM hosts WHERE address=$1::inet`, l.Address).
+			Scan(&h.Address, &h.Network, &desc, &mac)
+		h.Description, h.MAC = desc.String, mac.String
+		switch {
+		case err == sql.ErrNoRows:
+			leaf, err := leafNetworkFor(db, l.Address)
+			if err != nil {
+				return rep, err
+			}
+			if leaf != 0 {
+				networks[leaf] = true
+			}
+			rep.Unrecorded = append(rep.Unrecorded, LeaseUnrecorded{Lease: l, Network: leaf})
+		case err != nil:
+			return rep, err
+		default:
+			networks[h.Network] = true
+			if l.MAC != "" && h.MAC != l.MAC {
+				rep.MACMismatch = append(rep.MACMismatch, LeaseMismatch{LeaseHost: h, LeaseMAC: l.MAC})
+			}
+		}
+	}
+
+	ids := make([]int64, 0, len(networks))
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		rows, err := db.Query(`SELECT host(address), network, description, mac::text FROM hosts WHERE network=$1 ORDER BY address`, id)
+		if err != nil {
+			return rep, err
+		}
+		for rows.Next() {
+			var h LeaseHost
+			var desc, mac sql.NullString
+			if err := rows.Scan(&h.Address, &h.Network, &desc, &mac); err != nil {
+				rows.Close()
+				return rep, err
+			}
+			h.Description, h.MAC = desc.String, mac.String
+			if _, ok := active[h.Address]; !ok {
+				rep.NoLease = append(rep.NoLease, h)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rep, err
+		}
+	}
+
+	if !opts.Create && !opts.Update {
+		return rep, nil
+	}
+	// The changes go in together, so a failure leaves the hosts as they were
+	tx, err := db.Begin()
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback()
+	var created, updated []string
+	if opts.Create {
+		for _, u := range rep.Unrecorded {
+			if u.Network == 0 {
+				continue
+			}
+			desc := "dhcp lease"
+			if u.Hostname != "" {
+				desc += ": " + u.Hostname
+			}
+			var mac sql.NullString
+			if u.MAC != "" {
+				mac = sql.NullString{String: u.MAC, Valid: true}
+			}
+			res, err := tx.Exec(`INSERT INTO hosts(address,network,description,mac) VALUES($1::inet,$2,$3,$4::macaddr)
+				ON CONFLICT DO NOTHING`, u.Address, u.Network, desc, mac)
+			if err != nil {
+				return rep, err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue // added concurrently
+			}
+			logChange(tx, ipam.HostCIDR(u.Address), fmt.Sprintf("host added from dhcp lease: %s by %s", desc, opts.Username), opts.Username)
+			created = append(created, u.Address)
+		}
+	}
+	if opts.Update {
+		for _, m := range rep.MACMismatch {
+			if _, err := tx.Exec(`UPDATE hosts SET mac=$2::macaddr WHERE address=$1::inet`, m.Address, m.LeaseMAC); err != nil {
+				return rep, err
+			}
+			old := m.MAC
+			if old == "" {
+				old = "none"
+			}
+			logChange(tx, ipam.HostCIDR(m.Address), fmt.Sprintf("host mac updated from dhcp lease: %s -> %s by %s", old, m.LeaseMAC, opts.Username), opts.Username)
+			updated = append(updated, m.Address)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rep, err
+	}
+	rep.Created = append(rep.Created, created...)
+	rep.Updated = append(rep.Updated, updated...)
+	return rep, nil
+}
+
+func leaseRoutes(r chi.Router, db *sql.DB) {
+	// Reconcile an uploaded lease file (query params: format=isc|kea, create, update)
+	r.Post("/import/leases", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var opts LeaseOptions
+		var invalid ValidationError
+		opts.Create = queryBool(&invalid, r, "create")
+		opts.Update = queryBool(&invalid, r, "update")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		opts.Record = isEditor(r)
+		if (opts.Create || opts.Update) && !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		leases, err := dhcp.ParseLeases(http.MaxBytesReader(w, r.Body, 64<<20), q.Get("format"))
+		if err != nil {
+			apierr.Write(w, r, apierr.BadRequest, "lease file: "+err.Error())
+			return
+		}
+		opts.Username = getUsername(r, db)
+		rep, err := ReconcileLeases(db, leases, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rep)
+	})
+}
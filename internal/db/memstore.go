@@ -0,0 +1,447 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// MemStore is a Store kept in memory, for handler tests and trying out
+// the API without a database. It enforces the same tree rules as the
+// Postgres schema.
+type MemStore struct {
+	mu       sync.Mutex
+	networks map[int64]*memNetwork
+	hosts    map[string]*Host
+	users    map[int64]*User
+	roles    []Role
+	changes  []Change
+	lastID   int64
+}
+
+type memNetwork struct {
+	Network
+	staleDays sql.NullInt64
+}
+
+// NewMemStore returns an empty store with the default roles
+func NewMemStore() *MemStore {
+	s := &MemStore{
+		networks: map[int64]*memNetwork{},
+		hosts:    map[string]*Host{},
+		users:    map[int64]*User{},
+	}
+	for _, name := range []string{"administrator", "creator", "editor", "reader"} {
+		s.roles = append(s.roles, Role{ID: s.nextID(), Name: name})
+	}
+	return s
+}
+
+func (s *MemStore) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+// Order like Postgres orders inet: IPv4 first, then address, then mask
+func lessCIDR(a, b string) bool {
+	ia, na, _ := net.ParseCIDR(a)
+	ib, nb, _ := net.ParseCIDR(b)
+	if na == nil || nb == nil {
+		return a < b
+	}
+	if v4a, v4b := ia.To4() != nil, ib.To4() != nil; v4a != v4b {
+		return v4a
+	}
+	if c := bytes.Compare(na.IP.To16(), nb.IP.To16()); c != 0 {
+		return c < 0
+	}
+	return ipam.GetMask(a) < ipam.GetMask(b)
+}
+
+func lessAddr(a, b string) bool {
+	return lessCIDR(ipam.HostCIDR(a), ipam.HostCIDR(b))
+}
+
+func sameFamily(a, b string) bool {
+	ia, _, _ := net.ParseCIDR(a)
+	ib, _, _ := net.ParseCIDR(b)
+	return ia != nil && ib != nil && (ia.To4() != nil) == (ib.To4() != nil)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func (s *MemStore) sortedNetworks(match func(*memNetwork) bool, limit int) []Network {
+	out := []Network{}
+	for _, n := range s.networks {
+		if match(n) {
+			n := n.Network
+			n.ValidMasks = append([]int16(nil), n.ValidMasks...)
+			out = append(out, n)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return lessCIDR(out[i].AddressRange, out[j].AddressRange) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (s *MemStore) Networks(parent int64, q string) ([]Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedNetworks(func(n *memNetwork) bool {
+		return n.Parent.Int64 == parent && (q == "" || containsFold(n.AddressRange, q) ||
+			containsFold(n.Description.String, q) || containsFold(n.Owner.String, q))
+	}, 0), nil
+}
+
+func (s *MemStore) SearchNetworks(q string, limit int) ([]Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedNetworks(func(n *memNetwork) bool {
+		return containsFold(n.AddressRange, q) || containsFold(n.Description.String, q) ||
+			containsFold(n.Owner.String, q) || n.Account.String == q
+	}, limit), nil
+}
+
+func (s *MemStore) Network(id int64) (Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.networks[id]
+	if !ok {
+		return Network{}, ErrNotFound
+	}
+	out := n.Network
+	out.ValidMasks = append([]int16(nil), n.ValidMasks...)
+	return out, nil
+}
+
+func (s *MemStore) CreateNetwork(n Network) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ipnet, err := net.ParseCIDR(n.AddressRange)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cidr %q", n.AddressRange)
+	}
+	n.AddressRange = ipnet.String()
+	var parent string
+	if n.Parent.Valid {
+		p, ok := s.networks[n.Parent.Int64]
+		if !ok {
+			return 0, ErrNotFound
+		}
+		parent = p.AddressRange
+	}
+	var siblings []string
+	for _, o := range s.networks {
+		if o.AddressRange == n.AddressRange {
+			return 0, ErrExists
+		}
+		if o.Parent.Int64 == n.Parent.Int64 {
+			siblings = append(siblings, o.AddressRange)
+		}
+	}
+	if err := placeNetwork(n.AddressRange, parent, siblings); err != nil {
+		return 0, err
+	}
+	n.ID = s.nextID()
+	n.ValidMasks = append([]int16(nil), n.ValidMasks...)
+	s.networks[n.ID] = &memNetwork{Network: n}
+	return n.ID, nil
+}
+
+func (s *MemStore) UpdateNetwork(id int64, u NetworkUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.networks[id]
+	if !ok {
+		return ErrNotFound
+	}
+	str := func(v *string) sql.NullString { return sql.NullString{String: *v, Valid: *v != ""} }
+	if u.Description != nil {
+		n.Description = sql.NullString{String: *u.Description, Valid: true}
+	}
+	if u.Owner != nil {
+		n.Owner = sql.NullString{String: *u.Owner, Valid: true}
+	}
+	if u.Account != nil {
+		n.Account = sql.NullString{String: *u.Account, Valid: true}
+	}
+	if u.Subdivide != nil {
+		n.Subdivide = *u.Subdivide
+	}
+	if u.Service != nil {
+		n.Service = sql.NullInt64{Int64: *u.Service, Valid: true}
+	}
+	if u.Gateway != nil {
+		n.Gateway = str(u.Gateway)
+	}
+	if u.DHCPPools != nil {
+		n.DHCPPools = str(u.DHCPPools)
+	}
+	if u.Discover != nil {
+		n.Discover = *u.Discover
+	}
+	if u.StaleDays != nil {
+		n.staleDays = *u.StaleDays
+	}
+	if u.ValidMasks != nil {
+		n.ValidMasks = append([]int16(nil), *u.ValidMasks...)
+	}
+	return nil
+}
+
+// Like the foreign keys, refuse to delete a network still in use
+func (s *MemStore) DeleteNetwork(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.networks[id]; !ok {
+		return ErrNotFound
+	}
+	for _, n := range s.networks {
+		if n.Parent.Valid && n.Parent.Int64 == id {
+			return errNetworkInUse
+		}
+	}
+	for _, h := range s.hosts {
+		if h.NetworkID == id {
+			return errNetworkInUse
+		}
+	}
+	delete(s.networks, id)
+	return nil
+}
+
+func (s *MemStore) sortedHosts(match func(*Host) bool, limit int) []Host {
+	out := []Host{}
+	for _, h := range s.hosts {
+		if match(h) {
+			out = append(out, *h)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return lessAddr(out[i].Address, out[j].Address) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (s *MemStore) Hosts(network int64) ([]Host, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedHosts(func(h *Host) bool { return h.NetworkID == network }, 0), nil
+}
+
+func (s *MemStore) SearchHosts(q string, limit int) ([]Host, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedHosts(func(h *Host) bool {
+		return containsFold(h.Address, q) || containsFold(h.Description, q) || containsFold(h.Hostname.String, q)
+	}, limit), nil
+}
+
+// Addresses are keyed in canonical form, as inet prints them
+func canonicalAddr(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+func (s *MemStore) Host(address string) (Host, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[canonicalAddr(address)]
+	if !ok {
+		return Host{}, ErrNotFound
+	}
+	return *h, nil
+}
+
+func (s *MemStore) CreateHost(h Host) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ip := net.ParseIP(h.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", h.Address)
+	}
+	h.Address = ip.String()
+	n, ok := s.networks[h.NetworkID]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.hosts[h.Address]; ok {
+		return ErrExists
+	}
+	if err := placeHost(h.Address, n.AddressRange); err != nil {
+		return err
+	}
+	h.LastSeen = sql.NullTime{}
+	s.hosts[h.Address] = &h
+	return nil
+}
+
+func (s *MemStore) UpdateHost(address string, u HostUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[canonicalAddr(address)]
+	if !ok {
+		return ErrNotFound
+	}
+	h.Description = u.Description
+	if u.Hostname != nil {
+		h.Hostname = *u.Hostname
+	}
+	if u.MAC != nil {
+		h.MAC = *u.MAC
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteHost(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := canonicalAddr(address)
+	if _, ok := s.hosts[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.hosts, key)
+	return nil
+}
+
+func copyUser(u *User) User {
+	out := *u
+	out.Roles = append([]string{}, u.Roles...)
+	return out
+}
+
+func (s *MemStore) Users() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []User{}
+	for _, u := range s.users {
+		out = append(out, copyUser(u))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out, nil
+}
+
+func (s *MemStore) User(id int64) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return copyUser(u), nil
+}
+
+// Unknown role names are skipped
+func (s *MemStore) knownRoles(roles []string) []string {
+	out := []string{}
+	for _, name := range roles {
+		for _, r := range s.roles {
+			if r.Name == name {
+				out = append(out, name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (s *MemStore) CreateUser(username, password string, roles []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == username {
+			return 0, ErrExists
+		}
+	}
+	u := &User{ID: s.nextID(), Username: username, Password: password, Status: 1, Roles: s.knownRoles(roles)}
+	s.users[u.ID] = u
+	return u.ID, nil
+}
+
+func (s *MemStore) UpdateUser(id int64, upd UserUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if upd.Password != nil {
+		u.Password = *upd.Password
+	}
+	if upd.Status != nil {
+		u.Status = *upd.Status
+	}
+	if upd.Roles != nil {
+		u.Roles = s.knownRoles(upd.Roles)
+	}
+	return nil
+}
+
+// The user's changes stay in the log without a user
+func (s *MemStore) DeleteUser(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for i := range s.changes {
+		if s.changes[i].User == u.Username {
+			s.changes[i].User = ""
+		}
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemStore) Roles() ([]Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]Role(nil), s.roles...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (s *MemStore) LogChange(prefix, action, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == username {
+			s.changes = append(s.changes, Change{
+				ID:     int64(len(s.changes) + 1),
+				Time:   time.Now(),
+				Prefix: prefix, Change: action, User: username,
+			})
+			return nil
+		}
+	}
+	return nil
+}
+
+// Newest first; changes by deleted users are listed without a user
+func (s *MemStore) Changes(before int64, limit int) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Change{}
+	for i := len(s.changes) - 1; i >= 0 && len(out) < limit; i-- {
+		if before != 0 && s.changes[i].ID >= before {
+			continue
+		}
+		out = append(out, s.changes[i])
+	}
+	return out, nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/neighbors"
+)
+
+// NeighborConflict is a recorded host whose MAC differs from the one
+// seen at its address
+type NeighborConflict struct {
+	Address     string    `json:"address"`
+	Network     int64     `json:"network"`
+	Description string    `json:"description,omitempty"`
+	MAC         string    `json:"mac"`
+	SeenMAC     string    `json:"seen_mac"`
+	Device      string    `json:"device,omitempty"`
+	Interface   string    `json:"interface,omitempty"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// NeighborUnrecorded is an observed address with no host; Network is the
+// leaf network it would be created in, or 0 if no leaf network contains it
+type NeighborUnrecorded struct {
+	Address string `json:"address"`
+	MAC     string `json:"mac"`
+	Network int64  `json:"network"`
+}
+
+// NeighborReport is the result of recording an uploaded table
+type NeighborReport struct {
+	Entries      int                  `json:"entries"`
+	Neighbors    int                  `json:"neighbors"`
+	MACLocations int                  `json:"mac_locations"`
+	New          int                  `json:"new"`
+	Conflicts    []NeighborConflict   `json:"conflicts"`
+	Unrecorded   []NeighborUnrecorded `json:"unrecorded"`
+}
+
+// RecordNeighbors stores the entries of a neighbor or MAC table taken from
+// device at seen. An observation already recorded for the same address,
+// MAC and device has its time window widened, so the table keeps one row
+// per pairing and a changed MAC shows up as a new row in the history.
+func RecordNeighbors(db *sql.DB, entries []neighbors.Entry, device string, seen time.Time) (NeighborReport, error) {
+	rep := NeighborReport{Entries: len(entries), Conflicts: []NeighborConflict{}, Unrecorded: []NeighborUnrecorded{}}
+	tx, err := db.Begin()
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback()
+	var observed []neighbors.Entry
+	for _, e := range entries {
+		var inserted bool
+		if e.Address != "" {
+			err = tx.QueryRow(`INSERT INTO neighbors(address, mac, device, interface, first_seen, last_seen)
+				VALUES($1::inet, $2::macaddr, $3, $4, $5, $5)
+				ON CONFLICT (address, mac, device) DO UPDATE SET interface=EXCLUDED.interface,
+					first_seen=LEAST(neighbors.first_seen, EXCLUDED.first_seen),
+					last_seen=GREATEST(neighbors.last_seen, EXCLUDED.last_seen)
+				RETURNING xmax = 0`, e.Address, e.MAC, device, e.Interface, seen).Scan(&inserted)
+			rep.Neighbors++
+			observed = append(observed, e)
+		} else {
+			err = tx.QueryRow(`INSERT INTO mac_locations(mac, device, port, vlan, first_seen, last_seen)
+				VALUES($1::macaddr, $2, $3, $4, $5, $5)
+				ON CONFLICT (mac, device, port, vlan) DO UPDATE SET
+					first_seen=LEAST(mac_locations.first_seen, EXCLUDED.first_seen),
+					last_seen=GREATEST(mac_locations.last_seen, EXCLUDED.last_seen)
+				RETURNING xmax = 0`, e.MAC, device, e.Port, e.VLAN, seen).Scan(&inserted)
+			rep.MACLocations++
+		}
+		if err != nil {
+			return rep, err
+		}
+		if inserted {
+			rep.New++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rep, err
+	}
+
+	for _, e := range observed {
+		var c NeighborConflict
+		var desc, mac sql.NullString
+		err := db.QueryRow(`SELECT host(address), network, description, mac::text FROM hosts WHERE address=$1::inet`, e.Address).
+			Scan(&c.Address, &c.Network, &desc, &mac)
+		switch {
+		case err == sql.ErrNoRows:
+			leaf, err := leafNetworkFor(db, e.Address)
+			if err != nil {
+				return rep, err
+			}
+			rep.Unrecorded = append(rep.Unrecorded, NeighborUnrecorded{Address: e.Address, MAC: e.MAC, Network: leaf})
+		case err != nil:
+			return rep, err
+		case mac.Valid && mac.String != e.MAC:
+			c.Description, c.MAC = desc.String, mac.String
+			c.SeenMAC, c.Device, c.Interface, c.LastSeen = e.MAC, device, e.Interface, seen
+			rep.Conflicts = append(rep.Conflicts, c)
+		}
+	}
+	return rep, nil
+}
+
+func neighborRoutes(r chi.Router, db *sql.DB) {
+	// Record an uploaded neighbor or MAC table
+	// (query params: format, device, seen=RFC 3339 time the table was taken)
+	r.Post("/import/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		q := r.URL.Query()
+		seen := time.Now().UTC()
+		if v := q.Get("seen"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeRequestError(w, r, invalidField("seen", "must be an RFC 3339 time"))
+				return
+			}
+			seen = t.UTC()
+		}
+		entries, err := neighbors.Parse(http.MaxBytesReader(w, r.Body, 64<<20), q.Get("format"))
+		if err != nil {
+			apierr.Write(w, r, apierr.BadRequest, "neighbor table: "+err.Error())
+			return
+		}
+		rep, err := RecordNeighbors(db, entries, q.Get("device"), seen)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rep)
+	})
+
+	// Observation history for one address, newest first, with the switch
+	// ports its MACs were learned on
+	r.Get("/hosts/{ip}/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(chi.URLParam(r, "ip"))
+		if ip == nil {
+			writeRequestError(w, r, invalidField("ip", "%q is not an IP address", chi.URLParam(r, "ip")))
+			return
+		}
+		var recorded sql.NullString
+		db.QueryRow(`SELECT mac::text FROM hosts WHERE address=$1::inet`, ip.String()).Scan(&recorded)
+
+		rows, err := db.Query(`SELECT mac::text, device, interface, first_seen, last_seen
+			FROM neighbors WHERE address=$1::inet ORDER BY last_seen DESC`, ip.String())
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		observations := []map[string]any{}
+		for rows.Next() {
+			var mac, device, iface string
+			var first, last time.Time
+			if err := rows.Scan(&mac, &device, &iface, &first, &last); err != nil {
+				continue
+			}
+			observations = append(observations, map[string]any{"mac": mac, "device": device, "interface": iface,
+				"first_seen": first, "last_seen": last, "conflict": recorded.Valid && recorded.String != mac})
+		}
+		rows.Close()
+
+		rows, err = db.Query(`SELECT mac::text, device, port, vlan, first_seen, last_seen
+			FROM mac_locations WHERE mac IN (
+				SELECT mac FROM neighbors WHERE address=$1::inet
+				UNION SELECT mac FROM hosts WHERE address=$1::inet AND mac IS NOT NULL)
+			ORDER BY last_seen DESC`, ip.String())
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		locations := []map[string]any{}
+		for rows.Next() {
+			var mac, device, port string
+			var vlan int
+			var first, last time.Time
+			if err := rows.Scan(&mac, &device, &port, &vlan, &first, &last); err != nil {
+				continue
+			}
+			locations = append(locations, map[string]any{"mac": mac, "device": device, "port": port, "vlan": vlan,
+				"first_seen": first, "last_seen": last})
+		}
+		writeJSON(w, map[string]any{"address": ip.String(), "mac": recorded.String, "observations": observations, "locations": locations})
+	})
+
+	// Hosts whose recorded MAC differs from the latest one seen at their address
+	r.Get("/neighbors/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT * FROM (
+				SELECT DISTINCT ON (h.address) host(h.address), h.network, h.description, h.mac::text AS mac,
+					n.mac::text AS seen_mac, n.device, n.interface, n.last_seen
+				FROM hosts h JOIN neighbors n ON n.address = h.address
+				WHERE h.mac IS NOT NULL
+				ORDER BY h.address, n.last_seen DESC) latest
+			WHERE mac <> seen_mac`)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		out := []NeighborConflict{}
+		for rows.Next() {
+			var c NeighborConflict
+			if err := rows.Scan(&c.Address, &c.Network, &c.Description, &c.MAC, &c.SeenMAC, &c.Device, &c.Interface, &c.LastSeen); err != nil {
+				continue
+			}
+			out = append(out, c)
+		}
+		writeJSON(w, out)
+	})
+}
@@ -2,20 +2,47 @@ package db
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // DB wraps sql.DB to add helper methods
 type DB struct {
 	*sql.DB
+	Driver string // "postgres" or "sqlite3"
+	Store  Store
 }
 
+// Open connects to dsn. A "sqlite:" DSN such as sqlite:/var/db/pieng.db
+// opens a SQLite file; anything else is a PostgreSQL connection string.
 func Open(dsn string) (*DB, error) {
-	db, err := sql.Open("postgres", dsn)
+	driver, source := "postgres", dsn
+	if path, ok := strings.CutPrefix(dsn, "sqlite:"); ok {
+		driver, source = "sqlite3", sqliteSource(path)
+	}
+	db, err := sql.Open(driver, source)
 	if err != nil { return nil, err }
 	if err := db.Ping(); err != nil { return nil, err }
-	return &DB{db}, nil
+	d := &DB{DB: db, Driver: driver}
+	if driver == "sqlite3" {
+		d.Store = NewSQLiteStore(db)
+	} else {
+		d.Store = NewPostgresStore(db)
+	}
+	return d, nil
+}
+
+// Foreign keys on, wait for locks instead of failing, and take the write
+// lock when a transaction begins so the Go-side tree checks can't race
+func sqliteSource(path string) string {
+	path = strings.TrimPrefix(path, "//")
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_foreign_keys=on&_busy_timeout=5000&_txlock=immediate"
 }
 
 // SetMaxOpenConns delegates to underlying DB
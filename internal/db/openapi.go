@@ -0,0 +1,572 @@
+package db
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/discovery"
+	"github.com/yellowman/GoPieNg/internal/export"
+	"github.com/yellowman/GoPieNg/internal/rpsl"
+)
+
+// The OpenAPI 3.1 document for the API. Its paths and methods come from
+// walking the router, so it lists exactly the routes that are served;
+// apiOperations says what each takes and returns. Bodies and responses
+// that handlers decode or encode as Go types are described by reflecting
+// on those types, so the schemas follow the code.
+
+type schema = map[string]any
+
+// One operation: query params, a body and the success response. A nil
+// schema with a content type means a body or response that isn't JSON.
+type apiOp struct {
+	summary  string
+	tag      string
+	public   bool // served without a token
+	query    []apiParam
+	body     schema
+	bodyType string
+	status   int // success status; 200 when 0
+	resp     schema
+	respType string
+}
+
+type apiParam struct {
+	name, typ, desc string
+	enum            []string
+}
+
+func param(name, typ, desc string, enum ...string) apiParam {
+	return apiParam{name, typ, desc, enum}
+}
+
+func sType(t string) schema      { return schema{"type": t} }
+func sArray(items schema) schema { return schema{"type": "array", "items": items} }
+
+func sNullable(t string) schema { return schema{"type": []string{t, "null"}} }
+
+// Object schema from name, schema pairs. Every property is required, as
+// the handlers build these objects with fixed keys; see optional.
+func sObject(props ...any) schema {
+	p := schema{}
+	var required []string
+	for i := 0; i < len(props); i += 2 {
+		p[props[i].(string)] = props[i+1]
+		required = append(required, props[i].(string))
+	}
+	return schema{"type": "object", "properties": p, "required": required}
+}
+
+// Object schema s with names taken out of its required properties
+func optional(s schema, names ...string) schema {
+	required := slices.DeleteFunc(slices.Clone(s["required"].([]string)), func(n string) bool {
+		return slices.Contains(names, n)
+	})
+	s["required"] = required
+	return s
+}
+
+// apiSpec collects the component schemas while the operations are built
+type apiSpec struct {
+	schemas map[string]schema
+	request bool // reflecting a request body, whose fields may be absent
+}
+
+// Define a named component schema and refer to it
+func (b *apiSpec) define(name string, s schema) schema {
+	b.schemas[name] = s
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+// Schema of the JSON encoding of v's type; named structs become
+// components. Fields without omitempty are always encoded, so they are
+// required.
+func (b *apiSpec) of(v any) schema {
+	return b.schemaOf(reflect.TypeOf(v))
+}
+
+// Schema of a request body decoded into v's type. Nothing is required:
+// the handlers take an absent field as empty or unchanged, and check
+// the ones they need themselves.
+func (b *apiSpec) in(v any) schema {
+	b.request = true
+	defer func() { b.request = false }()
+	return b.of(v)
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	nullIntType       = reflect.TypeOf(nullInt{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (b *apiSpec) schemaOf(t reflect.Type) schema {
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == nullIntType:
+		return sNullable("integer")
+	case t.Kind() == reflect.Pointer:
+		s := b.schemaOf(t.Elem())
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+			return s
+		}
+		return schema{"anyOf": []schema{s, sType("null")}}
+	case t.Implements(jsonMarshalerType):
+		return schema{}
+	case t.Implements(textMarshalerType):
+		return sType("string")
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return sType("string")
+	case reflect.Bool:
+		return sType("boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sType("integer")
+	case reflect.Float32, reflect.Float64:
+		return sType("number")
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return sArray(b.schemaOf(t.Elem()))
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := b.schemas[name]; !ok {
+			b.schemas[name] = schema{} // placeholder for recursive types
+			b.schemas[name] = b.structSchema(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + name}
+	}
+	return schema{}
+}
+
+func (b *apiSpec) structSchema(t reflect.Type) schema {
+	props := schema{}
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = b.schemaOf(f.Type)
+			if !b.request && !slices.Contains(strings.Split(opts, ","), "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	s := schema{"type": "object", "properties": props}
+	if required != nil {
+		s["required"] = required
+	}
+	return s
+}
+
+// Component name of a Go type: db types by their own name, others with
+// their package in front
+func componentName(t reflect.Type) string {
+	name := t.Name()
+	if pkg := path.Base(t.PkgPath()); pkg != "db" {
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + strings.ToUpper(name[:1]) + name[1:]
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// The sort, limit, cursor and fields params of a v2 list of T
+func v2ListParams[T any](cols v2Columns[T], def string) []apiParam {
+	return []apiParam{
+		param("sort", "string", fmt.Sprintf("Column to sort on, with a leading - for descending: %s (default %s)",
+			strings.Join(cols.names(), ", "), def)),
+		param("limit", "integer", "Page size, 1 to 1000 (default 100)"),
+		param("cursor", "string", "next_cursor of the previous page, taken with the same sort"),
+		v2FieldsParam[T](),
+	}
+}
+
+func v2FieldsParam[T any]() apiParam {
+	return param("fields", "string", "Comma-separated fields to return: "+
+		strings.Join(jsonNames(reflect.TypeFor[T]()), ", "))
+}
+
+// v2 envelope of one T
+func (b *apiSpec) v2One(v any) schema {
+	return sObject("data", b.of(v))
+}
+
+// v2 envelope of a page of T
+func (b *apiSpec) v2Page(v any) schema {
+	return sObject("data", sArray(b.of(v)), "next_cursor", sNullable("string"))
+}
+
+// Operations by method and path under the API base
+func apiOperations(b *apiSpec) map[string]apiOp {
+	status := b.define("Status", sObject("status", sType("string")))
+	network := b.define("NetworkV1", sObject(
+		"id", sType("integer"), "parent", schema{"type": "integer", "description": "0 for a top-level network"},
+		"address_range", sType("string"), "description", sType("string"), "subdivide", sType("boolean"),
+		"valid_masks", schema{"type": []string{"array", "null"}, "items": sType("integer")},
+		"owner", sType("string"), "account", sType("string"), "service", sType("integer"),
+		"gateway", sType("string"), "dhcp_pools", sType("string"), "discover", sType("boolean"),
+		"last_swept", sNullable("string")))
+	host := b.define("HostV1", sObject(
+		"address", sType("string"), "network", sType("integer"), "description", sType("string"),
+		"hostname", sType("string"), "mac", sType("string"), "last_seen", sNullable("string")))
+	user := b.define("UserV1", sObject(
+		"id", sType("integer"), "username", sType("string"), "status", sType("integer"), "roles", sArray(sType("string"))))
+	role := b.define("Role", sObject("id", sType("integer"), "name", sType("string")))
+	textBody := func(desc string) schema { return schema{"type": "string", "description": desc} }
+
+	staleQuery := []apiParam{
+		param("root", "integer", "Only the subtree under this network"),
+		param("days", "integer", "Age at which a source counts in full (default PIENG_DISCOVERY_STALE_DAYS)"),
+		param("min_score", "integer", "Leave out items scoring less, 0 to 100 (default 50)"),
+		param("kind", "string", "Only hosts or only networks", "hosts", "networks"),
+		param("review", "string", "Only items marked for review, or none of them", "only", "exclude"),
+	}
+	rpslQuery := []apiParam{
+		param("root", "integer", "Only the subtree under this network"),
+		param("max_mask4", "integer", "Longest IPv4 prefix exported (default 29)"),
+		param("max_mask6", "integer", "Longest IPv6 prefix exported (default 48)"),
+		param("mnt", "string", "mnt-by of the objects"),
+		param("source", "string", "source of the objects"),
+		param("country", "string", "country of the objects"),
+	}
+	importQuery := []apiParam{
+		param("vrf", "string", "Only this VRF, by name or RD (global for none)"),
+		param("commit", "boolean", "Commit the import instead of a dry run"),
+	}
+	tables := "JSON object of tables, or multipart/form-data with one part per table"
+
+	return map[string]apiOp{
+		// Served by the server itself
+		"POST /auth/login": {summary: "Log in and get a token", tag: "auth", public: true,
+			body: sObject("username", sType("string"), "password", sType("string")),
+			resp: sObject("token", sType("string"), "user", sObject("id", sType("integer"),
+				"username", sType("string"), "roles", sArray(sType("string"))))},
+		"GET /me": {summary: "The logged in user", tag: "auth",
+			resp: sObject("id", sType("integer"), "username", sType("string"), "roles", sArray(sType("string")))},
+		"GET /ping": {summary: "Liveness and the latest change log ID", tag: "system", public: true,
+			resp: sObject("status", sType("string"), "last_change", sType("integer"))},
+		"GET /openapi.json": {summary: "This document", tag: "system", public: true, resp: sType("object")},
+
+		// Core API
+		"GET /networks": {summary: "Children of parent_id, or the top-level networks", tag: "networks",
+			query: []apiParam{param("parent_id", "integer", "Parent network; 0 or absent for the top level"),
+				param("q", "string", "Only children matching this")},
+			resp: sArray(network)},
+		"GET /networks/{id}":    {summary: "One network", tag: "networks", resp: sObject("network", network)},
+		"PATCH /networks/{id}":  {summary: "Change a network", tag: "networks", body: b.in(networkPatch{}), resp: status},
+		"DELETE /networks/{id}": {summary: "Delete a network without subnets", tag: "networks", resp: status},
+		"POST /networks/{id}/allocate-subnet": {summary: "Allocate a subnet by mask or CIDR", tag: "networks",
+			body: b.in(subnetRequest{}),
+			resp: sObject("id", sType("integer"), "address_range", sType("string"), "subdivide", sType("boolean"))},
+		"GET /networks/{id}/available-subnets": {summary: "Free subnets of a size", tag: "networks",
+			query: []apiParam{param("mask", "integer", "Prefix length (default: the largest child's, else the first valid mask)")},
+			resp:  sArray(sObject("address_range", sType("string"), "mask", sType("integer")))},
+		"GET /networks/{id}/hosts": {summary: "Hosts in a network", tag: "hosts", resp: sArray(host)},
+		"GET /networks/{id}/hosts/all": {summary: "Every address in a network with its description", tag: "hosts",
+			resp: sArray(sObject("address", sType("string"), "description", sType("string"), "used", sType("boolean")))},
+		"POST /networks/{id}/hosts":         {summary: "Add or update a host", tag: "hosts", body: b.in(hostRequest{}), resp: status},
+		"POST /networks/{id}/allocate-host": {summary: "Allocate the next free address", tag: "hosts", body: b.in(hostAllocation{}), resp: sObject("address", sType("string"))},
+		"DELETE /hosts/{ip}":                {summary: "Delete a host", tag: "hosts", resp: status},
+		"GET /search": {summary: "Hosts or networks matching q, with their ancestry", tag: "search",
+			query: []apiParam{param("q", "string", "Search text"), param("mode", "string", "What to search", "hosts", "networks")},
+			resp: sObject("results", sArray(optional(sObject("type", sType("string"), "id", sType("integer"),
+				"address", sType("string"), "address_range", sType("string"), "network_id", sType("integer"),
+				"network_range", sType("string"), "description", sType("string"), "hostname", sType("string"),
+				"owner", sType("string"), "account", sType("string"), "ancestry", sArray(sType("integer"))),
+				// the fields of only hosts, then of only networks
+				"address", "network_id", "network_range", "hostname", "id", "address_range", "owner", "account")))},
+		"GET /logs": {summary: "The change log, newest first", tag: "logs",
+			query: []apiParam{param("limit", "integer", "Entries, 1 to 10000 (default 50)")},
+			resp: sArray(sObject("created_at", sType("string"), "prefix", sType("string"),
+				"action", sType("string"), "user", sType("string")))},
+		"GET /users":         {summary: "Users with their roles", tag: "users", resp: sArray(user)},
+		"POST /users":        {summary: "Create a user", tag: "users", body: b.in(userRequest{}), resp: sObject("id", sType("integer"), "username", sType("string"))},
+		"PATCH /users/{id}":  {summary: "Change a user; others than administrators may only change their own password", tag: "users", body: b.in(userPatch{}), resp: status},
+		"DELETE /users/{id}": {summary: "Delete a user", tag: "users", resp: status},
+		"GET /roles":         {summary: "Role names", tag: "users", resp: sArray(role)},
+
+		// DNS and DHCP
+		"GET /networks/{id}/reverse-zone": {summary: "BIND reverse zone of a network", tag: "dns",
+			query: []apiParam{param("ns", "string", "Name server hostnames, comma-separated"), param("rname", "string", "SOA contact mailbox, e.g. hostmaster@example.com"),
+				param("ttl", "integer", "Default TTL"), param("template", "string", "PTR target template for hosts without a hostname")},
+			respType: "text/plain"},
+		"GET /networks/{id}/forward-records": {summary: "A/AAAA records of named hosts by domain", tag: "dns",
+			query: []apiParam{param("format", "string", "Output format", "bind", "json"),
+				param("domain", "string", "Only this domain"), param("ttl", "integer", "Record TTL")},
+			resp: sObject("network", sType("string"), "serial", sType("integer"), "domains", sType("object")), respType: "text/plain"},
+		"GET /networks/{id}/dhcp": {summary: "DHCP server config for a leaf network", tag: "dhcp",
+			query: []apiParam{param("format", "string", "Server", "isc", "kea"),
+				param("dns", "string", "DNS servers, comma-separated"), param("domain", "string", "Domain name")},
+			resp: sType("object"), respType: "text/plain"},
+		"POST /import/leases": {summary: "Reconcile a lease file against the hosts", tag: "dhcp",
+			query: []apiParam{param("format", "string", "Lease file format", "isc", "kea"),
+				param("create", "boolean", "Add hosts for unrecorded leases (editor)"),
+				param("update", "boolean", "Take MACs from the leases (editor)")},
+			body: textBody("dhcpd.leases or Kea lease CSV"), bodyType: "text/plain", resp: b.of(LeaseReport{})},
+		"GET /dns-updates":                 {summary: "Dynamic DNS targets and the update queue", tag: "dns-updates", resp: sObject("targets", sArray(sType("object")), "queue", sArray(sType("object")), "pending", sType("integer"), "failed", sType("integer"))},
+		"POST /dns-updates/targets":        {summary: "Add a dynamic DNS target", tag: "dns-updates", body: b.in(dnsTargetRequest{}), resp: sObject("id", sType("integer"))},
+		"DELETE /dns-updates/targets/{id}": {summary: "Remove a dynamic DNS target", tag: "dns-updates", resp: status},
+		"POST /dns-updates/retry":          {summary: "Retry queued updates now", tag: "dns-updates", resp: sObject("status", sType("string"), "requeued", sType("integer"))},
+		"DELETE /dns-updates/queue/{id}":   {summary: "Drop a queued update", tag: "dns-updates", resp: status},
+
+		// Import and export
+		"POST /import": {summary: "Import networks and hosts", tag: "import",
+			query: []apiParam{param("format", "string", "Body format", "csv", "json"), param("commit", "boolean", "Commit instead of a dry run")},
+			body:  textBody("CSV with a header line, or JSON"), bodyType: "text/plain", resp: b.of(ImportResult{})},
+		"POST /import/netbox":  {summary: "Import a NetBox dump", tag: "import", query: importQuery, body: textBody(tables), bodyType: "application/json", resp: b.of(ImportResult{})},
+		"POST /import/phpipam": {summary: "Import a phpIPAM dump", tag: "import", query: importQuery, body: textBody(tables), bodyType: "application/json", resp: b.of(ImportResult{})},
+		"POST /import/router-configs": {summary: "Compare router configs with IPAM", tag: "import",
+			query: []apiParam{param("format", "string", "Config format", "ios", "junos", "openbsd"),
+				param("name", "string", "File name of a single config"), param("root", "integer", "Subtree to compare"),
+				param("commit", "boolean", "Create the missing records (creator)")},
+			body: textBody("One config, or multipart/form-data with one file per part"), bodyType: "text/plain", resp: b.of(ConfigReport{})},
+		"GET /export": {summary: "The networks tree with hosts", tag: "export",
+			query: []apiParam{param("root", "integer", "Only the subtree under this network"),
+				param("format", "string", "Output format", "json", "csv", "yaml")},
+			resp: sObject("networks", sArray(b.of(export.Network{}))), respType: "text/csv"},
+		"GET /export/rpsl": {summary: "RPSL objects for leaf networks", tag: "export", query: rpslQuery, respType: "text/plain"},
+		"POST /export/rpsl/diff": {summary: "Compare the RPSL export with a previous one", tag: "export", query: rpslQuery,
+			body: textBody("Previous export"), bodyType: "text/plain", resp: b.of(rpsl.DiffResult{})},
+
+		// Discovery
+		"GET /check-ip/{ip}": {summary: "Whether an address answers", tag: "discovery", resp: b.of(discovery.CheckResult{})},
+		"GET /networks/{id}/discovery": {summary: "Addresses that answered in the network's sweeps", tag: "discovery",
+			resp: sArray(sObject("address", sType("string"), "first_seen", sType("string"), "last_seen", sType("string"),
+				"ports", sArray(sType("integer")), "recorded", sType("boolean")))},
+		"POST /networks/{id}/sweep": {summary: "Sweep a leaf network in the background", tag: "discovery", status: http.StatusAccepted,
+			resp: sObject("status", sType("string"), "network", sType("integer"), "cidr", sType("string"))},
+		"GET /discovery/unknown": {summary: "Addresses that answer but are not recorded", tag: "discovery",
+			resp: sArray(sObject("address", sType("string"), "network", sType("integer"), "address_range", sType("string"),
+				"first_seen", sType("string"), "last_seen", sType("string"), "ports", sArray(sType("integer"))))},
+		"GET /discovery/stale": {summary: "Hosts in swept networks not seen for days", tag: "discovery",
+			query: []apiParam{param("days", "integer", "Days unseen (default PIENG_DISCOVERY_STALE_DAYS)")},
+			resp:  sObject("days", sType("integer"), "hosts", sArray(sType("object")))},
+		"POST /import/neighbors": {summary: "Record a neighbor or MAC table", tag: "neighbors",
+			query: []apiParam{param("format", "string", "Table format", "arp", "ndp", "ip", "snmp", "mac-table"),
+				param("device", "string", "Router or switch the table came from"), param("seen", "string", "When it was taken, RFC 3339")},
+			body: textBody("The table"), bodyType: "text/plain", resp: b.of(NeighborReport{})},
+		"GET /hosts/{ip}/neighbors": {summary: "MACs seen at an address and where", tag: "neighbors",
+			resp: sObject("address", sType("string"), "mac", sType("string"), "observations", sArray(sType("object")), "locations", sArray(sType("object")))},
+		"GET /neighbors/conflicts": {summary: "Hosts whose MAC differs from the latest seen", tag: "neighbors", resp: sArray(b.of(NeighborConflict{}))},
+
+		// Reports
+		"GET /reports/stale": {summary: "Hosts and leaf networks ranked by staleness", tag: "reports",
+			query: append(slices.Clone(staleQuery), param("format", "string", "Output format", "json", "csv")),
+			resp:  sObject("days", sType("integer"), "min_score", sType("integer"), "items", sArray(b.of(StaleItem{}))), respType: "text/csv"},
+		"POST /reports/stale/review": {summary: "Mark or clear items for review", tag: "reports", query: staleQuery,
+			body: b.in(staleReview{}), resp: sObject("status", sType("string"), "marked", sType("integer"))},
+		"GET /check":      {summary: "Audit hosts and networks", tag: "check", resp: b.of(CheckReport{})},
+		"POST /check/fix": {summary: "Audit and move misplaced hosts", tag: "check", resp: b.of(CheckReport{})},
+
+		// v2
+		"GET /v2/networks": {summary: "Children of parent_id, or the top-level networks", tag: "v2",
+			query: append([]apiParam{param("parent_id", "integer", "Parent network; absent for the top level"),
+				param("q", "string", "Only children matching this")}, v2ListParams(v2NetworkColumns, "address_range")...),
+			resp: b.v2Page(v2Network{})},
+		"GET /v2/networks/{id}": {summary: "One network", tag: "v2", query: []apiParam{v2FieldsParam[v2Network]()}, resp: b.v2One(v2Network{})},
+		"PATCH /v2/networks/{id}": {summary: "Change a network", tag: "v2", query: []apiParam{v2FieldsParam[v2Network]()},
+			body: b.in(networkPatch{}), resp: b.v2One(v2Network{})},
+		"DELETE /v2/networks/{id}": {summary: "Delete a network without subnets", tag: "v2", status: http.StatusNoContent},
+		"POST /v2/networks/{id}/allocate-subnet": {summary: "Allocate a subnet by mask or CIDR", tag: "v2", status: http.StatusCreated,
+			query: []apiParam{v2FieldsParam[v2Network]()}, body: b.in(subnetRequest{}), resp: b.v2One(v2Network{})},
+		"GET /v2/networks/{id}/hosts": {summary: "Hosts in a network", tag: "v2",
+			query: v2ListParams(v2HostColumns, "address"), resp: b.v2Page(v2Host{})},
+		"POST /v2/networks/{id}/hosts": {summary: "Add a host", tag: "v2", status: http.StatusCreated,
+			query: []apiParam{v2FieldsParam[v2Host]()}, body: b.in(v2HostCreate{}), resp: b.v2One(v2Host{})},
+		"POST /v2/networks/{id}/allocate-host": {summary: "Allocate the next free address", tag: "v2", status: http.StatusCreated,
+			query: []apiParam{v2FieldsParam[v2Host]()}, body: b.in(hostAllocation{}), resp: b.v2One(v2Host{})},
+		"GET /v2/hosts/{ip}": {summary: "One host", tag: "v2", query: []apiParam{v2FieldsParam[v2Host]()}, resp: b.v2One(v2Host{})},
+		"PATCH /v2/hosts/{ip}": {summary: "Change a host; absent fields are kept", tag: "v2",
+			query: []apiParam{v2FieldsParam[v2Host]()}, body: b.in(v2HostPatch{}), resp: b.v2One(v2Host{})},
+		"DELETE /v2/hosts/{ip}": {summary: "Delete a host", tag: "v2", status: http.StatusNoContent},
+		"GET /v2/search": {summary: "Hosts or networks matching q anywhere, up to 1000; items are hosts or networks by type, and truncated is set when more matched", tag: "v2",
+			query: append([]apiParam{param("q", "string", "Search text"), param("type", "string", "What to search", "hosts", "networks")},
+				v2ListParams(v2HostColumns, "address")...),
+			resp: sObject("data", sArray(schema{"oneOf": []schema{b.of(v2Host{}), b.of(v2Network{})}}), "next_cursor", sNullable("string"),
+				"truncated", sType("boolean"))},
+		"GET /v2/changes": {summary: "The change log, newest first", tag: "v2",
+			query: []apiParam{param("limit", "integer", "Page size, 1 to 1000 (default 100)"),
+				param("cursor", "string", "next_cursor of the previous page"), v2FieldsParam[v2Change]()},
+			resp: b.v2Page(v2Change{})},
+		"GET /v2/users": {summary: "Users", tag: "v2", query: v2ListParams(v2UserColumns, "username"), resp: b.v2Page(v2User{})},
+		"POST /v2/users": {summary: "Create a user", tag: "v2", status: http.StatusCreated,
+			query: []apiParam{v2FieldsParam[v2User]()}, body: b.in(userRequest{}), resp: b.v2One(v2User{})},
+		"GET /v2/users/{id}": {summary: "One user", tag: "v2", query: []apiParam{v2FieldsParam[v2User]()}, resp: b.v2One(v2User{})},
+		"PATCH /v2/users/{id}": {summary: "Change a user; others than administrators may only change their own password", tag: "v2",
+			query: []apiParam{v2FieldsParam[v2User]()}, body: b.in(userPatch{}), resp: b.v2One(v2User{})},
+		"DELETE /v2/users/{id}": {summary: "Delete a user", tag: "v2", status: http.StatusNoContent},
+		"GET /v2/roles":         {summary: "Roles", tag: "v2", query: v2ListParams(v2RoleColumns, "name"), resp: b.v2Page(v2Role{})},
+	}
+}
+
+var pathParamRE = regexp.MustCompile(`\{(\w+)\}`)
+
+// Routes of routes under base, as "METHOD /path" relative to base
+func apiRoutes(routes chi.Routes, base string) []string {
+	var out []string
+	chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.ReplaceAll(route, "/*/", "/")
+		if p, ok := strings.CutPrefix(route, base+"/"); ok {
+			out = append(out, method+" /"+strings.TrimPrefix(p, "/"))
+		}
+		return nil
+	})
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// OpenAPI is the OpenAPI document of the routes served under base
+func OpenAPI(routes chi.Routes, base string) map[string]any {
+	b := &apiSpec{schemas: map[string]schema{}}
+	ops := apiOperations(b)
+	errResp := b.define("Error", optional(sObject("code", sType("string"), "message", sType("string"),
+		"details", sArray(b.of(FieldError{})), "request_id", sType("string")), "details", "request_id"))
+
+	paths := map[string]schema{}
+	for _, route := range apiRoutes(routes, base) {
+		method, p, _ := strings.Cut(route, " ")
+		op, ok := ops[route]
+		if !ok {
+			op.summary = "Undocumented"
+		}
+		o := schema{"summary": op.summary, "operationId": operationID(method, p)}
+		if op.tag != "" {
+			o["tags"] = []string{op.tag}
+		}
+		if op.public {
+			o["security"] = []any{}
+		}
+		var params []schema
+		for _, m := range pathParamRE.FindAllStringSubmatch(p, -1) {
+			s := schema{"type": "integer", "minimum": 1}
+			if m[1] == "ip" {
+				s = schema{"type": "string", "description": "IPv4 or IPv6 address"}
+			}
+			params = append(params, schema{"name": m[1], "in": "path", "required": true, "schema": s})
+		}
+		for _, q := range op.query {
+			s := sType(q.typ)
+			if q.enum != nil {
+				s["enum"] = q.enum
+			}
+			params = append(params, schema{"name": q.name, "in": "query", "description": q.desc, "schema": s})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.body != nil {
+			ct := op.bodyType
+			if ct == "" {
+				ct = "application/json"
+			}
+			o["requestBody"] = schema{"content": schema{ct: schema{"schema": op.body}}}
+		}
+		st := op.status
+		if st == 0 {
+			st = http.StatusOK
+		}
+		resp := schema{"description": http.StatusText(st)}
+		content := schema{}
+		if op.resp != nil {
+			content["application/json"] = schema{"schema": op.resp}
+		}
+		if op.respType != "" {
+			content[op.respType] = schema{"schema": sType("string")}
+		}
+		if len(content) > 0 {
+			resp["content"] = content
+		}
+		o["responses"] = schema{
+			fmt.Sprint(st): resp,
+			"default":      schema{"description": "Error", "content": schema{"application/json": schema{"schema": errResp}}},
+		}
+		if paths[p] == nil {
+			paths[p] = schema{}
+		}
+		paths[p][strings.ToLower(method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": schema{
+			"title":       "GoPieNg",
+			"description": "IP address management. Errors are the Error schema with a stable code; see the README.",
+			"version":     "2",
+		},
+		"servers":  []schema{{"url": base}},
+		"security": []schema{{"bearer": []string{}}},
+		"paths":    paths,
+		"components": schema{
+			"schemas":         b.schemas,
+			"securitySchemes": schema{"bearer": schema{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}},
+		},
+	}
+}
+
+// operationId from the method and path, e.g. getNetworksIdHosts
+func operationID(method, p string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(p, func(r rune) bool { return !('a' <= r && r <= 'z' || '0' <= r && r <= '9') }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// UndocumentedRoutes lists the routes under base that apiOperations
+// doesn't describe, for the server to complain about at startup
+func UndocumentedRoutes(routes chi.Routes, base string) []string {
+	ops := apiOperations(&apiSpec{schemas: map[string]schema{}})
+	var out []string
+	for _, route := range apiRoutes(routes, base) {
+		if _, ok := ops[route]; !ok {
+			out = append(out, route)
+		}
+	}
+	return out
+}
+
+// OpenAPIHandler serves the OpenAPI document of the routes under base
+func OpenAPIHandler(routes chi.Routes, base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := json.Marshal(OpenAPI(routes, base))
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
@@ -0,0 +1,404 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/auth"
+	"github.com/yellowman/GoPieNg/internal/middleware"
+)
+
+const apiBase = "/api/pieng"
+
+// The API as cmd/server mounts it over db with api behind the token
+// check: login, ping and the OpenAPI document are public, /me is not
+func testRouter(db *sql.DB, api http.Handler, jwtm *auth.Manager) *chi.Mux {
+	r := chi.NewRouter()
+	r.Route(apiBase, func(pub chi.Router) {
+		pub.Post("/auth/login", auth.MakeLoginHandler(db, jwtm))
+		pub.Get("/openapi.json", OpenAPIHandler(r, apiBase))
+		pub.Get("/ping", PingHandler(db))
+		pub.Group(func(priv chi.Router) {
+			priv.Use(middleware.JWT(jwtm))
+			priv.Get("/me", auth.MeHandler(db, jwtm))
+			priv.Mount("/", api)
+		})
+	})
+	return r
+}
+
+// conform reports where v, decoded from JSON, doesn't match schema s of
+// doc. Objects whose schema lists properties may not carry others, so
+// fields added to a response without documenting them fail, and must
+// carry the required ones, so fields dropped from it fail too. trimmed
+// is for a v2 response cut down by the fields param: the resources,
+// which are components, then need none of their properties.
+func conform(doc, s map[string]any, v any, at string, trimmed bool) error {
+	if ref, ok := s["$ref"].(string); ok {
+		schemas, _ := doc["components"].(map[string]any)["schemas"].(map[string]any)
+		def, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: no schema %s", at, ref)
+		}
+		if trimmed {
+			def = maps.Clone(def)
+			delete(def, "required")
+		}
+		return conform(doc, def, v, at, trimmed)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alts, ok := s[key].([]any)
+		if !ok {
+			continue
+		}
+		matched := 0
+		for _, alt := range alts {
+			if conform(doc, alt.(map[string]any), v, at, trimmed) == nil {
+				matched++
+			}
+		}
+		if matched == 0 || key == "oneOf" && matched > 1 {
+			return fmt.Errorf("%s: %d of the %s schemas match %s", at, matched, key, jsonType(v))
+		}
+		return nil
+	}
+	if t, ok := s["type"]; ok && !hasType(t, v) {
+		return fmt.Errorf("%s: %s is not %v", at, jsonType(v), t)
+	}
+	if enum, ok := s["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		required, _ := s["required"].([]any)
+		for _, k := range required {
+			if _, ok := v[k.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at, k)
+			}
+		}
+		props, listed := s["properties"].(map[string]any)
+		extra, _ := s["additionalProperties"].(map[string]any)
+		for k, pv := range v {
+			ps, ok := props[k].(map[string]any)
+			switch {
+			case ok:
+			case extra != nil:
+				ps = extra
+			case listed:
+				return fmt.Errorf("%s: undocumented property %q", at, k)
+			default:
+				continue
+			}
+			if err := conform(doc, ps, pv, at+"."+k, trimmed); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, it := range v {
+				if err := conform(doc, items, it, fmt.Sprintf("%s[%d]", at, i), trimmed); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The object at keys under v, or nil
+func lookup(v any, keys ...string) map[string]any {
+	for _, k := range keys {
+		m, _ := v.(map[string]any)
+		v = m[k]
+	}
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Whether v is of type t, a type name or a list of them
+func hasType(t, v any) bool {
+	types, ok := t.([]any)
+	if !ok {
+		types = []any{t}
+	}
+	got := jsonType(v)
+	return slices.Contains(types, any(got)) || got == "integer" && slices.Contains(types, any("number"))
+}
+
+// Every operation the router serves answers its documented status with a
+// body matching its documented schema. On SQLite the router serves the
+// core API and the server's own routes; TestOpenAPIPostgresRoutes covers
+// the rest as far as it can without PostgreSQL.
+func TestOpenAPIConformance(t *testing.T) {
+	d := testSQLite(t)
+	s := d.Store
+	jwtm := auth.NewManager([]byte("test secret"))
+	ids := map[string]int64{}
+	create := func(name string, n Network) {
+		id, err := s.CreateNetwork(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	under := func(parent string) sql.NullInt64 { return sql.NullInt64{Int64: ids[parent], Valid: true} }
+	create("root", Network{AddressRange: "10.0.0.0/16", Subdivide: true})
+	create("sub", Network{Parent: under("root"), AddressRange: "10.0.1.0/24"})
+	create("net1", Network{Parent: under("root"), AddressRange: "10.0.9.0/24"})
+	create("net2", Network{Parent: under("root"), AddressRange: "10.0.10.0/24"})
+	for _, a := range []string{"10.0.1.5", "10.0.1.7", "10.0.1.8"} {
+		if err := s.CreateHost(Host{Address: a, NetworkID: ids["sub"], Description: "host"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"admin", "user1", "user2"} {
+		id, err := s.CreateUser(name, auth.MakeRFC2307SSHA("secret123"), []string{"reader"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	token, err := jwtm.Sign(ids["admin"], []string{"administrator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := testRouter(d.DB, d.Handler(jwtm), jwtm)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, apiBase+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	// The route serving a request, as the document names it
+	route := func(method, path string) string {
+		rctx := chi.NewRouteContext()
+		u, _ := url.Parse(apiBase + path)
+		if !r.Match(rctx, method, u.Path) {
+			return ""
+		}
+		p := strings.ReplaceAll(rctx.RoutePattern(), "/*/", "/")
+		return method + " " + strings.TrimPrefix(p, apiBase)
+	}
+
+	rec := send("GET", "/openapi.json", "")
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	if routes := UndocumentedRoutes(r, apiBase); len(routes) > 0 {
+		t.Errorf("undocumented routes: %v", routes)
+	}
+
+	steps := []struct{ method, path, body string }{
+		{"GET", "/openapi.json", ""},
+		{"POST", "/auth/login", `{"username":"admin","password":"secret123"}`},
+		{"GET", "/me", ""},
+		{"GET", "/ping", ""},
+		{"GET", "/networks", ""},
+		{"GET", "/networks?parent_id={root}&q=10.0", ""},
+		{"GET", "/networks/{root}", ""},
+		{"PATCH", "/networks/{sub}", `{"description":"lab","gateway":"10.0.1.1"}`},
+		{"POST", "/networks/{root}/allocate-subnet", `{"mask":24,"description":"v1"}`},
+		{"GET", "/networks/{root}/available-subnets?mask=24", ""},
+		{"GET", "/networks/{sub}/hosts", ""},
+		{"GET", "/networks/{sub}/hosts/all", ""},
+		{"POST", "/networks/{sub}/hosts", `{"address":"10.0.1.6","description":"db","hostname":"db.example.com","mac":"00:11:22:33:44:55"}`},
+		{"POST", "/networks/{sub}/allocate-host", `{"description":"web"}`},
+		{"DELETE", "/hosts/10.0.1.7", ""},
+		{"DELETE", "/networks/{net1}", ""},
+		{"GET", "/search?q=10.0.1&mode=hosts", ""},
+		{"GET", "/search?q=10.0&mode=networks", ""},
+		{"GET", "/logs?limit=10", ""},
+		{"GET", "/users", ""},
+		{"POST", "/users", `{"username":"new","password":"secret123","roles":["reader"]}`},
+		{"PATCH", "/users/{user1}", `{"status":0}`},
+		{"DELETE", "/users/{user1}", ""},
+		{"GET", "/roles", ""},
+
+		{"GET", "/v2/networks?parent_id={root}&q=10.0&sort=-address_range&limit=2", ""},
+		{"GET", "/v2/networks/{root}?fields=id,address_range", ""},
+		{"PATCH", "/v2/networks/{sub}?fields=id,owner", `{"owner":"ops"}`},
+		{"DELETE", "/v2/networks/{net2}", ""},
+		{"POST", "/v2/networks/{root}/allocate-subnet", `{"cidr":"10.0.20.0/24","subdivide":true}`},
+		{"GET", "/v2/networks/{sub}/hosts?sort=address&limit=1", ""},
+		{"POST", "/v2/networks/{sub}/hosts", `{"address":"10.0.1.9","mac":"00:11:22:33:44:56"}`},
+		{"POST", "/v2/networks/{sub}/allocate-host", `{}`},
+		{"GET", "/v2/hosts/10.0.1.5", ""},
+		{"PATCH", "/v2/hosts/10.0.1.5?fields=address,hostname", `{"hostname":"web.example.com"}`},
+		{"DELETE", "/v2/hosts/10.0.1.8", ""},
+		{"GET", "/v2/search?q=10.0.1&type=hosts", ""},
+		{"GET", "/v2/search?q=10.0&type=networks&sort=-address_range", ""},
+		{"GET", "/v2/changes?limit=5", ""},
+		{"GET", "/v2/users?sort=-username", ""},
+		{"POST", "/v2/users", `{"username":"other","password":"secret123"}`},
+		{"GET", "/v2/users/{admin}", ""},
+		{"PATCH", "/v2/users/{user2}", `{"roles":["editor"]}`},
+		{"DELETE", "/v2/users/{user2}", ""},
+		{"GET", "/v2/roles", ""},
+	}
+	covered := map[string]bool{}
+	for _, st := range steps {
+		path := st.path
+		for name, id := range ids {
+			path = strings.ReplaceAll(path, "{"+name+"}", itoa(id))
+		}
+		name := st.method + " " + path
+		served := route(st.method, path)
+		covered[served] = true
+		rec := send(st.method, path, st.body)
+		op := lookup(doc, "paths", strings.TrimPrefix(served, st.method+" "), strings.ToLower(st.method))
+		if op == nil {
+			t.Errorf("%s: served by %q, which is not documented", name, served)
+			continue
+		}
+
+		u, _ := url.Parse(path)
+		var params []string
+		documented, _ := op["parameters"].([]any)
+		for _, param := range documented {
+			params = append(params, param.(map[string]any)["name"].(string))
+		}
+		for q := range u.Query() {
+			if !slices.Contains(params, q) {
+				t.Errorf("%s: query param %s is not documented", name, q)
+			}
+		}
+		if st.body != "" {
+			var body any
+			json.Unmarshal([]byte(st.body), &body)
+			rb, _ := op["requestBody"].(map[string]any)
+			bs, ok := rb["content"].(map[string]any)["application/json"].(map[string]any)
+			if !ok {
+				t.Errorf("%s: sends a body, but none is documented", name)
+			} else if err := conform(doc, bs["schema"].(map[string]any), body, "request", false); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+
+		var status string
+		var resp map[string]any
+		for code, r := range op["responses"].(map[string]any) {
+			if code != "default" {
+				status, resp = code, r.(map[string]any)
+			}
+		}
+		if got := fmt.Sprint(rec.Code); got != status {
+			t.Errorf("%s: status %s, documented %s\n%s", name, got, status, rec.Body)
+			continue
+		}
+		content, _ := resp["content"].(map[string]any)
+		js, ok := content["application/json"].(map[string]any)
+		if !ok {
+			if rec.Body.Len() > 0 {
+				t.Errorf("%s: undocumented body %s", name, rec.Body)
+			}
+			continue
+		}
+		var body any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if err := conform(doc, js["schema"].(map[string]any), body, "response", u.Query().Has("fields")); err != nil {
+			t.Errorf("%s: %v\n%s", name, err, rec.Body)
+		}
+	}
+
+	for p, methods := range doc["paths"].(map[string]any) {
+		for method := range methods.(map[string]any) {
+			if route := strings.ToUpper(method) + " " + p; !covered[route] {
+				t.Errorf("%s is documented but not tested", route)
+			}
+		}
+	}
+}
+
+// The error envelope of every failure matches the documented Error
+func TestOpenAPIErrors(t *testing.T) {
+	s := NewMemStore()
+	jwtm := auth.NewManager([]byte("test secret"))
+	r := testRouter(nil, StoreAPI(s), jwtm)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", apiBase+"/openapi.json", nil))
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	errSchema := map[string]any{"$ref": "#/components/schemas/Error"}
+
+	token, _ := jwtm.Sign(1, []string{"reader"})
+	for _, tt := range []struct {
+		method, path, body, token string
+		status                    int
+	}{
+		{"GET", "/v2/networks", "", "", http.StatusUnauthorized},
+		{"GET", "/v2/networks/999", "", token, http.StatusNotFound},
+		{"GET", "/v2/networks?limit=0", "", token, http.StatusBadRequest},
+		{"POST", "/v2/networks/1/allocate-host", `{}`, token, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tt.method, apiBase+tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var body any
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+		if err := conform(doc, errSchema, body, "error", false); err != nil {
+			t.Errorf("%s %s: %v\n%s", tt.method, tt.path, err, rec.Body)
+		}
+	}
+}
+
+// Every route of the PostgreSQL API is documented and every documented
+// operation is served. Only the routes SQLite serves too are called, by
+// TestOpenAPIConformance: the others query PostgreSQL, so whether they
+// answer as documented is not tested here.
+func TestOpenAPIPostgresRoutes(t *testing.T) {
+	jwtm := auth.NewManager([]byte("test secret"))
+	r := testRouter(nil, API(nil, jwtm), jwtm)
+	if routes := UndocumentedRoutes(r, apiBase); len(routes) > 0 {
+		t.Errorf("undocumented routes: %v", routes)
+	}
+	served := apiRoutes(r, apiBase)
+	for route := range apiOperations(&apiSpec{schemas: map[string]schema{}}) {
+		if !slices.Contains(served, route) {
+			t.Errorf("%s is documented but not served", route)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/auth"
+	"github.com/yellowman/GoPieNg/internal/dhcp"
+	"github.com/yellowman/GoPieNg/internal/dns"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// The writes behind both API versions. Each checks its request, makes the
+// change through the Store and logs it; handlers decode the body, check
+// roles and shape the answer, and pass errors to writeError.
+
+// errAdminOnly refuses fields only administrators may set
+var errAdminOnly = errors.New("forbidden: admin only")
+
+// Name what wasn't found, e.g. "network not found"; other errors pass
+func notFound(what string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%s %w", what, ErrNotFound)
+	}
+	return err
+}
+
+// Turn a duplicate into an EXISTS conflict with msg; other errors pass
+func existsAs(err error, msg string) error {
+	if errors.Is(err, ErrExists) {
+		return &ConflictError{Code: apierr.Exists, Msg: msg}
+	}
+	return err
+}
+
+// networkPatch is the body of PATCH /networks/{id}
+type networkPatch struct {
+	Description *string  `json:"description"`
+	Owner       *string  `json:"owner"`
+	Account     *string  `json:"account"`
+	Subdivide   *bool    `json:"subdivide"`
+	Service     *int64   `json:"service"`
+	Gateway     *string  `json:"gateway"`
+	DHCPPools   *string  `json:"dhcp_pools"`
+	Discover    *bool    `json:"discover"`
+	StaleDays   nullInt  `json:"stale_days"`
+	ValidMasks  *[]int16 `json:"valid_masks"`
+}
+
+// Apply p to network id and return the network as it now is; changed is
+// false when p sets nothing
+func patchNetwork(s Store, id int64, p networkPatch, admin bool, username string) (n Network, changed bool, err error) {
+	// subdivide is a structural change, and discovery sends traffic
+	// from the server, so these and valid_masks are admin-only
+	if (p.Subdivide != nil || p.Discover != nil || p.ValidMasks != nil) && !admin {
+		return n, false, errAdminOnly
+	}
+	if n, err = s.Network(id); err != nil {
+		return n, false, notFound("network", err)
+	}
+	u := NetworkUpdate{Description: p.Description, Owner: p.Owner, Account: p.Account,
+		Subdivide: p.Subdivide, Service: p.Service, Discover: p.Discover, ValidMasks: p.ValidMasks}
+	var invalid ValidationError
+	if v := p.Gateway; v != nil {
+		// Gateway must be an address inside the network; empty clears it
+		gw := *v
+		if gw != "" {
+			if gw = checkIP(&invalid, "gateway", gw); gw != "" && !ipam.ContainsStr(n.AddressRange, ipam.HostCIDR(gw)) {
+				invalid.Add("gateway", "must be an address inside %s", n.AddressRange)
+			}
+		}
+		u.Gateway = &gw
+	}
+	if v := p.DHCPPools; v != nil {
+		pools, err := dhcp.ParsePools(*v, n.AddressRange)
+		if err != nil {
+			invalid.Add("dhcp_pools", "%v", err)
+		}
+		formatted := dhcp.FormatPools(pools)
+		u.DHCPPools = &formatted
+	}
+	if p.StaleDays.Set {
+		// null clears the threshold so the parent's applies
+		if p.StaleDays.Bad || p.StaleDays.Valid && p.StaleDays.Int64 < 1 {
+			invalid.Add("stale_days", "must be a positive number of days or null")
+		}
+		u.StaleDays = &sql.NullInt64{Int64: p.StaleDays.Int64, Valid: p.StaleDays.Valid}
+	}
+	if p.ValidMasks != nil {
+		for _, m := range *p.ValidMasks {
+			checkSubnetMask(&invalid, "valid_masks", int(m), n.AddressRange)
+		}
+	}
+	if err := invalid.Err(); err != nil {
+		return n, false, err
+	}
+	if u == (NetworkUpdate{}) {
+		return n, false, nil
+	}
+	if err := s.UpdateNetwork(id, u); err != nil {
+		return n, false, existsAs(err, "network already exists")
+	}
+	s.LogChange(n.AddressRange, fmt.Sprintf("updated by %s", username), username)
+	n, err = s.Network(id)
+	return n, true, err
+}
+
+// Delete network id and return what it was
+func deleteNetwork(s Store, id int64, username string) (Network, error) {
+	n, err := s.Network(id)
+	if err != nil {
+		return n, notFound("network", err)
+	}
+	if err := s.DeleteNetwork(id); err != nil {
+		return n, notFound("network", err)
+	}
+	s.LogChange(n.AddressRange, fmt.Sprintf("deleted by %s", username), username)
+	return n, nil
+}
+
+// hostRequest is the body of POST /networks/{id}/hosts; Update changes
+// an existing host instead of adding one
+type hostRequest struct {
+	Address     string  `json:"address"`
+	Description string  `json:"description"`
+	Hostname    *string `json:"hostname"`
+	MAC         *string `json:"mac"`
+	Update      bool    `json:"update"`
+}
+
+// Add a host to network id, or update it, and return it as it now is
+func putHost(s Store, ddns dnsQueue, id int64, req hostRequest, username string) (Host, error) {
+	var invalid ValidationError
+	req.Address = checkIP(&invalid, "address", req.Address)
+	// MAC is optional too; used for DHCP reservations
+	var mac sql.NullString
+	if req.MAC != nil && *req.MAC != "" {
+		// ParseMAC also takes EUI-64 and InfiniBand addresses, which
+		// don't fit the macaddr column
+		if hw, err := net.ParseMAC(*req.MAC); err != nil || len(hw) != 6 {
+			invalid.Add("mac", "%q is not a MAC address", *req.MAC)
+		} else {
+			mac = sql.NullString{String: hw.String(), Valid: true}
+		}
+	}
+	// Hostname is optional; an empty string clears it
+	var hostname sql.NullString
+	if req.Hostname != nil && *req.Hostname != "" {
+		if !dns.ValidHostname(*req.Hostname) {
+			invalid.Add("hostname", "%q is not a valid hostname", *req.Hostname)
+		}
+		hostname = sql.NullString{String: strings.TrimSuffix(*req.Hostname, "."), Valid: true}
+	}
+	if err := invalid.Err(); err != nil {
+		return Host{}, err
+	}
+	n, err := s.Network(id)
+	if err != nil {
+		return Host{}, notFound("network", err)
+	}
+	if !ipam.ContainsStr(n.AddressRange, ipam.HostCIDR(req.Address)) {
+		msg := fmt.Sprintf("%s is outside %s", req.Address, n.AddressRange)
+		return Host{}, &ConflictError{Code: apierr.OutsideNetwork, Msg: msg, Field: "address"}
+	}
+
+	if req.Update {
+		// Update existing host description (and hostname and MAC if given)
+		u := HostUpdate{Description: req.Description}
+		if req.Hostname != nil {
+			u.Hostname = &hostname
+		}
+		if req.MAC != nil {
+			u.MAC = &mac
+		}
+		old, err := s.Host(req.Address)
+		if err != nil {
+			return Host{}, notFound("host", err)
+		}
+		if err := s.UpdateHost(req.Address, u); err != nil {
+			return Host{}, notFound("host", err)
+		}
+		if u.Hostname != nil && u.Hostname.String != old.Hostname.String {
+			ddns.queue("delete", req.Address, old.Hostname.String)
+			ddns.queue("add", req.Address, u.Hostname.String)
+		}
+		s.LogChange(ipam.HostCIDR(req.Address), fmt.Sprintf("host updated: %s by %s", req.Description, username), username)
+	} else {
+		// Insert new host - fail if exists
+		h := Host{Address: req.Address, NetworkID: id, Description: req.Description, Hostname: hostname, MAC: mac}
+		if err := s.CreateHost(h); err != nil {
+			return Host{}, existsAs(err, "IP already exists")
+		}
+		ddns.queue("add", req.Address, hostname.String)
+		s.LogChange(ipam.HostCIDR(req.Address), fmt.Sprintf("host added: %s by %s", req.Description, username), username)
+	}
+	return s.Host(req.Address)
+}
+
+// Delete the host at address and return what it was
+func deleteHost(s Store, ddns dnsQueue, address, username string) (Host, error) {
+	h, err := s.Host(address)
+	if err != nil {
+		return h, notFound("host", err)
+	}
+	if err := s.DeleteHost(address); err != nil {
+		return h, err
+	}
+	ddns.queue("delete", address, h.Hostname.String)
+	s.LogChange(ipam.HostCIDR(h.Address), fmt.Sprintf("host deleted by %s", username), username)
+	return h, nil
+}
+
+// hostAllocation is the body of POST /networks/{id}/allocate-host
+type hostAllocation struct {
+	Description string `json:"description"`
+}
+
+// Allocate the next free address in network id
+func allocateHost(s Store, id int64, desc, username string) (Host, error) {
+	if desc == "" {
+		desc = "auto"
+	}
+	n, err := s.Network(id)
+	if err != nil {
+		return Host{}, notFound("network", err)
+	}
+	hosts, err := s.Hosts(id)
+	if err != nil {
+		return Host{}, err
+	}
+	used := map[string]bool{}
+	for _, h := range hosts {
+		used[h.Address] = true
+	}
+
+	a := ipam.NextFreeHostStr(n.AddressRange, used)
+	if a == "" {
+		return Host{}, &ConflictError{Code: apierr.NoSpace, Msg: "no free host"}
+	}
+	// A duplicate means another user allocated it first
+	if err := s.CreateHost(Host{Address: a, NetworkID: id, Description: desc}); err != nil {
+		return Host{}, existsAs(err, "address already allocated, please retry")
+	}
+	s.LogChange(ipam.HostCIDR(a), fmt.Sprintf("host allocated: %s by %s", desc, username), username)
+	return s.Host(a)
+}
+
+// subnetRequest is the body of POST /networks/{id}/allocate-subnet: a
+// mask to take the first free subnet of that size, or a cidr
+type subnetRequest struct {
+	Mask        int    `json:"mask"`
+	Cidr        string `json:"cidr"`
+	Description string `json:"description"`
+	Subdivide   bool   `json:"subdivide"`
+	Force       bool   `json:"force"` // admin only: allow a mask outside valid_masks
+}
+
+// Allocate a subnet of network id
+func allocateSubnet(s Store, id int64, req subnetRequest, admin bool, username string) (Network, error) {
+	if req.Force && !admin {
+		return Network{}, errAdminOnly
+	}
+	desc := req.Description
+	if desc == "" {
+		desc = "auto"
+	}
+
+	parent, err := s.Network(id)
+	if err != nil {
+		return Network{}, notFound("network", err)
+	}
+	var invalid ValidationError
+	field, mask := "mask", req.Mask
+	switch {
+	case req.Cidr != "":
+		field = "cidr"
+		if req.Cidr = checkCIDR(&invalid, "cidr", req.Cidr); req.Cidr != "" {
+			mask = ipam.GetMask(req.Cidr)
+		}
+	case req.Mask == 0:
+		invalid.Add("mask", "mask or cidr required")
+	default:
+		checkSubnetMask(&invalid, "mask", req.Mask, parent.AddressRange)
+	}
+	if err := invalid.Err(); err != nil {
+		return Network{}, err
+	}
+	// Sizes are held to the parent's valid_masks unless an admin forces it
+	overridden := !checkValidMask(&invalid, field, mask, parent)
+	if err := invalid.Err(); err != nil && !req.Force {
+		return Network{}, err
+	}
+	children, err := childRanges(s, id)
+	if err != nil {
+		return Network{}, err
+	}
+
+	var cand string
+	if req.Cidr != "" {
+		// Check if requested CIDR is within parent
+		if !ipam.ContainsStr(parent.AddressRange, req.Cidr) || req.Cidr == parent.AddressRange {
+			msg := fmt.Sprintf("%s is not within %s", req.Cidr, parent.AddressRange)
+			return Network{}, &ConflictError{Code: apierr.OutsideNetwork, Msg: msg, Field: "cidr"}
+		}
+		// Specific CIDR requested - verify it's available
+		for _, child := range children {
+			if ipam.OverlapStr(req.Cidr, child) {
+				return Network{}, &ConflictError{Code: apierr.Overlap, Msg: "subnet overlaps with existing allocation", Field: "cidr"}
+			}
+		}
+		cand = req.Cidr
+	} else {
+		// Legacy: auto-allocate by mask
+		var allocErr error
+		cand, allocErr = ipam.NextFreeSubnetStr(parent.AddressRange, children, req.Mask)
+		if allocErr != nil {
+			return Network{}, &ConflictError{Code: apierr.NoSpace, Msg: allocErr.Error()}
+		}
+	}
+
+	// A duplicate means another user allocated it first
+	nid, err := s.CreateNetwork(Network{
+		Parent:       sql.NullInt64{Int64: id, Valid: true},
+		AddressRange: cand,
+		Description:  sql.NullString{String: desc, Valid: true},
+		Subdivide:    req.Subdivide,
+	})
+	if err != nil {
+		return Network{}, existsAs(err, "subnet already allocated, please retry")
+	}
+	action := "assigned"
+	if req.Subdivide {
+		action = "allocated for subdivision"
+	}
+	s.LogChange(cand, fmt.Sprintf("subnet %s: %s by %s", action, desc, username), username)
+	if overridden {
+		s.LogChange(cand, fmt.Sprintf("valid_masks of %s (%s) overridden by %s", parent.AddressRange, formatMasks(allowedMasks(parent)), username), username)
+	}
+	return s.Network(nid)
+}
+
+// userRequest is the body of POST /users
+type userRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+func createUser(s Store, req userRequest) (User, error) {
+	var invalid ValidationError
+	if req.Username == "" {
+		invalid.Add("username", "required")
+	}
+	if req.Password == "" {
+		invalid.Add("password", "required")
+	}
+	if err := checkRoles(&invalid, s, req.Roles); err != nil {
+		return User{}, err
+	}
+	if err := invalid.Err(); err != nil {
+		return User{}, err
+	}
+	id, err := s.CreateUser(req.Username, auth.MakeRFC2307SSHA(req.Password), req.Roles)
+	if err != nil {
+		return User{}, existsAs(err, "username already exists")
+	}
+	return s.User(id)
+}
+
+// userPatch is the body of PATCH /users/{id}
+type userPatch struct {
+	Password string   `json:"password"`
+	Status   *int     `json:"status"`
+	Roles    []string `json:"roles"`
+}
+
+// Change user id. Anyone may change their own password; status and
+// roles are only changed by administrators.
+func patchUser(s Store, id int64, p userPatch, admin bool) (User, error) {
+	var invalid ValidationError
+	if p.Status != nil && *p.Status != 0 && *p.Status != 1 {
+		invalid.Add("status", "must be 0 (disabled) or 1 (active)")
+	}
+	if err := checkRoles(&invalid, s, p.Roles); err != nil {
+		return User{}, err
+	}
+	if err := invalid.Err(); err != nil {
+		return User{}, err
+	}
+
+	var u UserUpdate
+	if p.Password != "" {
+		hash := auth.MakeRFC2307SSHA(p.Password)
+		u.Password = &hash
+	}
+	if admin {
+		u.Status, u.Roles = p.Status, p.Roles
+	}
+	if err := s.UpdateUser(id, u); err != nil {
+		return User{}, notFound("user", err)
+	}
+	return s.User(id)
+}
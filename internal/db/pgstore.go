@@ -0,0 +1,423 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// pgStore is the Store on PostgreSQL
+type pgStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore returns the Store for a PostgreSQL database
+func NewPostgresStore(db *sql.DB) Store {
+	return &pgStore{db}
+}
+
+// Map a failed write onto the Store errors
+func pgWriteError(err error) error {
+	if conflict := constraintConflict(err); conflict != nil {
+		return conflict
+	}
+	if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "unique") {
+		return ErrExists
+	}
+	return err
+}
+
+func (s *pgStore) queryNetworks(query string, args ...any) ([]Network, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Network{}
+	for rows.Next() {
+		n, err := scanNetwork(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+func (s *pgStore) Networks(parent int64, q string) ([]Network, error) {
+	where := "parent IS NULL"
+	args := []any{}
+	if parent != 0 {
+		where = "parent=$1"
+		args = append(args, parent)
+	}
+	if q != "" {
+		args = append(args, q)
+		p := fmt.Sprintf("'%%'||$%d||'%%'", len(args))
+		where += " AND (address_range::text ILIKE " + p + " OR coalesce(description,'') ILIKE " + p + " OR coalesce(owner,'') ILIKE " + p + ")"
+	}
+	return s.queryNetworks(`SELECT `+networkColumns+` FROM networks WHERE `+where+` ORDER BY address_range`, args...)
+}
+
+func (s *pgStore) SearchNetworks(q string, limit int) ([]Network, error) {
+	return s.queryNetworks(`SELECT `+networkColumns+` FROM networks
+		WHERE address_range::text ILIKE $1
+		   OR description ILIKE $1
+		   OR owner ILIKE $1
+		   OR account = $2
+		ORDER BY address_range
+		LIMIT $3`, "%"+q+"%", q, limit)
+}
+
+func (s *pgStore) Network(id int64) (Network, error) {
+	n, err := scanNetwork(s.db.QueryRow(`SELECT `+networkColumns+` FROM networks WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return n, ErrNotFound
+	}
+	return n, err
+}
+
+func (s *pgStore) CreateNetwork(n Network) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(`INSERT INTO networks(parent,address_range,description,subdivide) VALUES($1,$2::cidr,$3,$4) RETURNING id`,
+		n.Parent, n.AddressRange, n.Description, n.Subdivide).Scan(&id)
+	if err != nil {
+		return 0, pgWriteError(err)
+	}
+	return id, nil
+}
+
+func (s *pgStore) UpdateNetwork(id int64, u NetworkUpdate) error {
+	fields := []string{}
+	vals := []any{}
+	set := func(col string, v any) {
+		vals = append(vals, v)
+		fields = append(fields, fmt.Sprintf(col, len(vals)))
+	}
+	if u.Description != nil {
+		set("description=$%d", *u.Description)
+	}
+	if u.Owner != nil {
+		set("owner=$%d", *u.Owner)
+	}
+	if u.Account != nil {
+		set("account=$%d", *u.Account)
+	}
+	if u.Subdivide != nil {
+		set("subdivide=$%d", *u.Subdivide)
+	}
+	if u.Service != nil {
+		set("service=$%d", *u.Service)
+	}
+	if u.Gateway != nil {
+		set("gateway=$%d::inet", sql.NullString{String: *u.Gateway, Valid: *u.Gateway != ""})
+	}
+	if u.DHCPPools != nil {
+		set("dhcp_pools=$%d", sql.NullString{String: *u.DHCPPools, Valid: *u.DHCPPools != ""})
+	}
+	if u.Discover != nil {
+		set("discover=$%d", *u.Discover)
+	}
+	if u.StaleDays != nil {
+		set("stale_days=$%d", *u.StaleDays)
+	}
+	if u.ValidMasks != nil {
+		set("valid_masks=$%d::smallint[]", ipam.FormatSmallIntArray(*u.ValidMasks))
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	vals = append(vals, id)
+	res, err := s.db.Exec(fmt.Sprintf("UPDATE networks SET %s WHERE id=$%d", strings.Join(fields, ","), len(vals)), vals...)
+	if err != nil {
+		return pgWriteError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) DeleteNetwork(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM networks WHERE id=$1`, id)
+	if isForeignKeyViolation(err) {
+		return errNetworkInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) queryHosts(query string, args ...any) ([]Host, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Host{}
+	for rows.Next() {
+		var h Host
+		if err := rows.Scan(&h.Address, &h.NetworkID, &h.Description, &h.Hostname, &h.MAC, &h.LastSeen); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+const hostColumns = `host(h.address), h.network, h.description, h.hostname, h.mac::text, d.last_seen`
+
+func (s *pgStore) Hosts(network int64) ([]Host, error) {
+	return s.queryHosts(`SELECT `+hostColumns+`
+		FROM hosts h LEFT JOIN discovery d ON d.address = h.address
+		WHERE h.network=$1 ORDER BY h.address`, network)
+}
+
+func (s *pgStore) SearchHosts(q string, limit int) ([]Host, error) {
+	return s.queryHosts(`SELECT `+hostColumns+`
+		FROM hosts h LEFT JOIN discovery d ON d.address = h.address
+		WHERE host(h.address) ILIKE $1
+		   OR h.description ILIKE $1
+		   OR h.hostname ILIKE $1
+		ORDER BY h.address
+		LIMIT $2`, "%"+q+"%", limit)
+}
+
+func (s *pgStore) Host(address string) (Host, error) {
+	hosts, err := s.queryHosts(`SELECT `+hostColumns+`
+		FROM hosts h LEFT JOIN discovery d ON d.address = h.address
+		WHERE h.address=$1::inet`, address)
+	if err != nil {
+		return Host{}, err
+	}
+	if len(hosts) == 0 {
+		return Host{}, ErrNotFound
+	}
+	return hosts[0], nil
+}
+
+func (s *pgStore) CreateHost(h Host) error {
+	_, err := s.db.Exec(`INSERT INTO hosts(address,network,description,hostname,mac) VALUES($1::inet,$2,$3,$4,$5::macaddr)`,
+		h.Address, h.NetworkID, h.Description, h.Hostname, h.MAC)
+	if err != nil {
+		return pgWriteError(err)
+	}
+	return nil
+}
+
+func (s *pgStore) UpdateHost(address string, u HostUpdate) error {
+	fields := []string{"description=$2"}
+	vals := []any{address, u.Description}
+	if u.Hostname != nil {
+		vals = append(vals, *u.Hostname)
+		fields = append(fields, fmt.Sprintf("hostname=$%d", len(vals)))
+	}
+	if u.MAC != nil {
+		vals = append(vals, *u.MAC)
+		fields = append(fields, fmt.Sprintf("mac=$%d::macaddr", len(vals)))
+	}
+	res, err := s.db.Exec(`UPDATE hosts SET `+strings.Join(fields, ",")+` WHERE address=$1::inet`, vals...)
+	if err != nil {
+		return pgWriteError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) DeleteHost(address string) error {
+	res, err := s.db.Exec(`DELETE FROM hosts WHERE address=$1::inet`, address)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) queryUsers(where string, args ...any) ([]User, error) {
+	rows, err := s.db.Query(`SELECT u.id, u.username, u.password, u.status,
+			COALESCE(array_agg(r.name) FILTER (WHERE r.name IS NOT NULL), '{}')
+		FROM users u LEFT JOIN user_roles ur ON ur."user"=u.id LEFT JOIN roles r ON r.id=ur.role
+		`+where+` GROUP BY u.id ORDER BY u.username`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		var u User
+		var roles string
+		if err := rows.Scan(&u.ID, &u.Username, &u.Password, &u.Status, &roles); err != nil {
+			return nil, err
+		}
+		u.Roles = []string{}
+		if roles = strings.Trim(roles, "{}"); roles != "" {
+			u.Roles = strings.Split(roles, ",")
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (s *pgStore) Users() ([]User, error) {
+	return s.queryUsers("")
+}
+
+func (s *pgStore) User(id int64) (User, error) {
+	users, err := s.queryUsers(`WHERE u.id=$1`, id)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+// Unknown role names are skipped
+func setRoles(db queryExecer, id int64, roles []string) error {
+	for _, role := range roles {
+		var rid int64
+		err := db.QueryRow(`SELECT id FROM roles WHERE name=$1`, role).Scan(&rid)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`INSERT INTO user_roles("user", role) VALUES($1, $2) ON CONFLICT DO NOTHING`, id, rid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pgStore) CreateUser(username, password string, roles []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var id int64
+	if err := tx.QueryRow(`INSERT INTO users(username, password, status) VALUES($1, $2, 1) RETURNING id`, username, password).Scan(&id); err != nil {
+		return 0, pgWriteError(err)
+	}
+	if err := setRoles(tx, id, roles); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// The SQL of UpdateUser and DeleteUser also runs on SQLite
+func (s *pgStore) UpdateUser(id int64, u UserUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM users WHERE id=$1`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if u.Password != nil {
+		if _, err := tx.Exec(`UPDATE users SET password=$1 WHERE id=$2`, *u.Password, id); err != nil {
+			return err
+		}
+	}
+	if u.Status != nil {
+		if _, err := tx.Exec(`UPDATE users SET status=$1 WHERE id=$2`, *u.Status, id); err != nil {
+			return err
+		}
+	}
+	if u.Roles != nil {
+		if _, err := tx.Exec(`DELETE FROM user_roles WHERE "user"=$1`, id); err != nil {
+			return err
+		}
+		if err := setRoles(tx, id, u.Roles); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) DeleteUser(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Clear changelog references (preserve audit history with NULL user)
+	if _, err := tx.Exec(`UPDATE changelog SET "user"=NULL WHERE "user"=$1`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE "user"=$1`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) Roles() ([]Role, error) {
+	rows, err := s.db.Query(`SELECT id, name FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Role{}
+	for rows.Next() {
+		var r Role
+		if err := rows.Scan(&r.ID, &r.Name); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *pgStore) LogChange(prefix, action, username string) error {
+	logChange(s.db, prefix, action, username)
+	return nil
+}
+
+// change_time is the session's local time without a zone; AT TIME ZONE
+// gives it one so the scanned time is the right instant
+func (s *pgStore) Changes(before int64, limit int) ([]Change, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, c.change_time AT TIME ZONE current_setting('TimeZone'), c.prefix::text, c.change, coalesce(u.username, '')
+		FROM changelog c
+		LEFT JOIN users u ON c."user" = u.id
+		WHERE $1::bigint = 0 OR c.id < $1
+		ORDER BY c.id DESC LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.ID, &c.Time, &c.Prefix, &c.Change, &c.User); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/importer"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+	"github.com/yellowman/GoPieNg/internal/routercfg"
+)
+
+// StaleNetwork is a leaf network that no configured interface uses
+type StaleNetwork struct {
+	ID          int64  `json:"id"`
+	CIDR        string `json:"cidr"`
+	Description string `json:"description,omitempty"`
+}
+
+// ConfigReport compares interface addresses from device configs with IPAM
+type ConfigReport struct {
+	Interfaces      []routercfg.Interface `json:"interfaces"`
+	MissingNetworks []routercfg.Interface `json:"missing_networks"`
+	MissingHosts    []routercfg.Interface `json:"missing_hosts"`
+	StaleNetworks   []StaleNetwork        `json:"stale_networks"`
+	Import          ImportResult          `json:"import"` // creating the missing records
+	Failed          []ImportRowResult     `json:"failed"` // missing records that can't be created
+}
+
+// CompareConfigs reports interface subnets and addresses missing from
+// IPAM, and leaf networks under rootID (0 for all) that no interface
+// overlaps. The missing records are run through ImportRows, each on its
+// own, so opts.Commit creates those that fit and Failed lists the rest;
+// otherwise the report shows the dry run.
+func CompareConfigs(db *sql.DB, ifaces []routercfg.Interface, rootID int64, opts ImportOptions) (ConfigReport, error) {
+	rep := ConfigReport{
+		Interfaces:      ifaces,
+		MissingNetworks: []routercfg.Interface{},
+		MissingHosts:    []routercfg.Interface{},
+		StaleNetworks:   []StaleNetwork{},
+		Failed:          []ImportRowResult{},
+	}
+	if rep.Interfaces == nil {
+		rep.Interfaces = []routercfg.Interface{}
+	}
+	all, err := SubtreeNetworks(db, 0)
+	if err != nil {
+		return rep, err
+	}
+	known := map[string]bool{}
+	for _, n := range all {
+		known[n.AddressRange] = true
+	}
+
+	var rows []importer.Row
+	seen := map[string]bool{}
+	for _, i := range ifaces {
+		desc := strings.TrimSpace(i.Device + " " + i.Name)
+		if !i.HostRoute() && !known[i.Prefix] && !seen[i.Prefix] {
+			seen[i.Prefix] = true
+			rep.MissingNetworks = append(rep.MissingNetworks, i)
+			rows = append(rows, importer.Row{Line: len(rows) + 1, Source: desc, Type: "network", CIDR: i.Prefix, Description: desc})
+		}
+		if i.Address == "" || seen[i.Address] {
+			continue
+		}
+		seen[i.Address] = true
+		var n int64
+		err := db.QueryRow(`SELECT network FROM hosts WHERE address=$1::inet`, i.Address).Scan(&n)
+		if err == sql.ErrNoRows {
+			rep.MissingHosts = append(rep.MissingHosts, i)
+			rows = append(rows, importer.Row{Line: len(rows) + 1, Source: desc, Type: "host", Address: i.Address, Description: desc})
+		} else if err != nil {
+			return rep, err
+		}
+	}
+
+	scope := all
+	if rootID != 0 {
+		if scope, err = SubtreeNetworks(db, rootID); err != nil {
+			return rep, err
+		}
+	}
+	for _, n := range scope {
+		if n.Subdivide {
+			continue
+		}
+		used := false
+		for _, i := range ifaces {
+			if !i.HostRoute() && ipam.OverlapStr(n.AddressRange, i.Prefix) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			rep.StaleNetworks = append(rep.StaleNetworks, StaleNetwork{ID: n.ID, CIDR: n.AddressRange, Description: n.Description.String})
+		}
+	}
+
+	// One interface that doesn't fit, e.g. inside a network that isn't
+	// subdivided, shouldn't hold back the rest
+	opts.Partial = true
+	if rep.Import, err = ImportRows(db, rows, opts); err != nil {
+		return rep, err
+	}
+	for _, row := range rep.Import.Rows {
+		if row.Status == "conflict" {
+			rep.Failed = append(rep.Failed, row)
+		}
+	}
+	return rep, nil
+}
+
+func routerConfigRoutes(r chi.Router, db *sql.DB) {
+	// Compare device configs with IPAM (body: one config, or multipart with one
+	// file per part; query params: format=ios|junos|openbsd, name, root, commit)
+	r.Post("/import/router-configs", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		opts := ImportOptions{AllowTopLevel: isAdmin(r), Username: getUsername(r, db)}
+		var invalid ValidationError
+		opts.Commit = queryBool(&invalid, r, "commit")
+		root := queryID(&invalid, r, "root")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if opts.Commit && !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<20)
+
+		var ifaces []routercfg.Interface
+		parse := func(body io.Reader, filename string) error {
+			found, err := routercfg.Parse(body, q.Get("format"), filename)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			ifaces = append(ifaces, found...)
+			return nil
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			mr, err := r.MultipartReader()
+			if err != nil {
+				apierr.Write(w, r, apierr.BadRequest, err.Error())
+				return
+			}
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					apierr.Write(w, r, apierr.BadRequest, err.Error())
+					return
+				}
+				if err := parse(part, part.FileName()); err != nil {
+					apierr.Write(w, r, apierr.BadRequest, err.Error())
+					return
+				}
+			}
+		} else if err := parse(r.Body, q.Get("name")); err != nil {
+			apierr.Write(w, r, apierr.BadRequest, err.Error())
+			return
+		}
+
+		rep, err := CompareConfigs(db, ifaces, root, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rep)
+	})
+}
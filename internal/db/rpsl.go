@@ -0,0 +1,113 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/rpsl"
+)
+
+// Load the RPSL object template from PIENG_RPSL_TEMPLATE, if set.
+// Read once at startup since the daemon may chroot afterwards.
+func loadRPSLTemplate() *rpsl.Template {
+	text := rpsl.DefaultTemplate
+	if path := os.Getenv("PIENG_RPSL_TEMPLATE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("rpsl: %v, using default template", err)
+		} else {
+			text = string(b)
+		}
+	}
+	t, err := rpsl.ParseTemplate(text)
+	if err != nil {
+		log.Printf("rpsl: bad template: %v, using default", err)
+		t, _ = rpsl.ParseTemplate(rpsl.DefaultTemplate)
+	}
+	return t
+}
+
+// Build RPSL objects for the leaf networks below root that meet the thresholds
+func rpslObjects(db *sql.DB, tmpl *rpsl.Template, rootID int64, opts rpsl.Options) ([]rpsl.Object, error) {
+	nets, err := SubtreeNetworks(db, rootID)
+	if err != nil {
+		return nil, err
+	}
+	out := []rpsl.Object{}
+	for _, n := range nets {
+		if n.Subdivide || !opts.Eligible(n.AddressRange) {
+			continue
+		}
+		obj, err := tmpl.Build(rpsl.Assignment{
+			ID:          n.ID,
+			Prefix:      n.AddressRange,
+			Description: n.Description.String,
+			Owner:       n.Owner.String,
+			Account:     n.Account.String,
+		}, opts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
+
+// Read export options from query params
+func rpslOptions(r *http.Request) (int64, rpsl.Options, error) {
+	q := r.URL.Query()
+	var invalid ValidationError
+	root := queryID(&invalid, r, "root")
+	opts := rpsl.Options{
+		Maintainer: q.Get("mnt"),
+		Source:     q.Get("source"),
+		Country:    q.Get("country"),
+	}
+	opts.MaxMask4 = queryInt(&invalid, r, "max_mask4", 0, 0, 32)
+	opts.MaxMask6 = queryInt(&invalid, r, "max_mask6", 0, 0, 128)
+	return root, opts, invalid.Err()
+}
+
+func rpslRoutes(r chi.Router, db *sql.DB) {
+	tmpl := loadRPSLTemplate()
+
+	// Registry export of leaf assignments as inetnum/inet6num objects
+	r.Get("/export/rpsl", func(w http.ResponseWriter, r *http.Request) {
+		root, opts, err := rpslOptions(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		objs, err := rpslObjects(db, tmpl, root, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(rpsl.Format(objs)))
+	})
+
+	// Diff the current export against a previously exported file (request body)
+	r.Post("/export/rpsl/diff", func(w http.ResponseWriter, r *http.Request) {
+		root, opts, err := rpslOptions(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		prev, err := rpsl.Parse(http.MaxBytesReader(w, r.Body, 32<<20))
+		if err != nil {
+			apierr.Write(w, r, apierr.BadRequest, "previous export: "+err.Error())
+			return
+		}
+		objs, err := rpslObjects(db, tmpl, root, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, rpsl.Diff(prev, objs))
+	})
+}
@@ -0,0 +1,514 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// sqliteStore is the Store on SQLite. Prefixes and addresses are kept as
+// normalized binary (see encodeIP); containment, overlap and searches
+// over addresses are done in Go.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore returns the Store for a SQLite database opened with the
+// sqlite3 driver
+func NewSQLiteStore(db *sql.DB) Store {
+	return &sqliteStore{db}
+}
+
+// Encode an address as its family byte (4 or 6) followed by the 4 or 16
+// address bytes, so byte order sorts IPv4 first and then by address
+func encodeIP(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return append([]byte{4}, v4...)
+	}
+	return append([]byte{6}, ip.To16()...)
+}
+
+func decodeIP(b []byte) net.IP {
+	switch {
+	case len(b) == 1+net.IPv4len && b[0] == 4:
+		return net.IP(b[1:])
+	case len(b) == 1+net.IPv6len && b[0] == 6:
+		return net.IP(b[1:])
+	}
+	return nil
+}
+
+func encodeAddr(address string) ([]byte, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	return encodeIP(ip), nil
+}
+
+func encodePrefix(cidr string) ([]byte, int, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid cidr %q", cidr)
+	}
+	ones, _ := ipnet.Mask.Size()
+	return encodeIP(ipnet.IP), ones, nil
+}
+
+func decodePrefix(b []byte, masklen int) string {
+	ip := decodeIP(b)
+	if ip == nil {
+		return ""
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(masklen, len(ip)*8)}).String()
+}
+
+// Map a failed write onto the Store errors
+func sqliteWriteError(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && (se.ExtendedCode == sqlite3.ErrConstraintUnique || se.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return ErrExists
+	}
+	return err
+}
+
+const sqliteNetworkColumns = `id, parent, prefix, masklen, description, subdivide, valid_masks, owner, account, service, gateway, dhcp_pools, discover, last_swept`
+
+func scanSQLiteNetwork(row interface{ Scan(...any) error }) (Network, error) {
+	var n Network
+	var prefix, gateway []byte
+	var masklen int
+	var vm sql.NullString
+	if err := row.Scan(&n.ID, &n.Parent, &prefix, &masklen, &n.Description, &n.Subdivide, &vm, &n.Owner, &n.Account, &n.Service, &gateway, &n.DHCPPools, &n.Discover, &n.LastSwept); err != nil {
+		return n, err
+	}
+	n.AddressRange = decodePrefix(prefix, masklen)
+	if vm.Valid {
+		n.ValidMasks = ipam.ParseSmallIntArray(vm.String)
+	}
+	if ip := decodeIP(gateway); ip != nil {
+		n.Gateway = sql.NullString{String: ip.String(), Valid: true}
+	}
+	return n, nil
+}
+
+// Networks matching where, ordered by address, then filtered by match
+func (s *sqliteStore) queryNetworks(match func(Network) bool, limit int, where string, args ...any) ([]Network, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteNetworkColumns+` FROM networks `+where+` ORDER BY prefix, masklen`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Network{}
+	for rows.Next() {
+		n, err := scanSQLiteNetwork(rows)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match(n) {
+			out = append(out, n)
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Networks(parent int64, q string) ([]Network, error) {
+	var match func(Network) bool
+	if q != "" {
+		match = func(n Network) bool {
+			return containsFold(n.AddressRange, q) || containsFold(n.Description.String, q) || containsFold(n.Owner.String, q)
+		}
+	}
+	if parent == 0 {
+		return s.queryNetworks(match, 0, `WHERE parent IS NULL`)
+	}
+	return s.queryNetworks(match, 0, `WHERE parent=$1`, parent)
+}
+
+func (s *sqliteStore) SearchNetworks(q string, limit int) ([]Network, error) {
+	return s.queryNetworks(func(n Network) bool {
+		return containsFold(n.AddressRange, q) || containsFold(n.Description.String, q) ||
+			containsFold(n.Owner.String, q) || n.Account.String == q
+	}, limit, ``)
+}
+
+func (s *sqliteStore) Network(id int64) (Network, error) {
+	n, err := scanSQLiteNetwork(s.db.QueryRow(`SELECT `+sqliteNetworkColumns+` FROM networks WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return n, ErrNotFound
+	}
+	return n, err
+}
+
+// The database is opened with immediate transactions, so the checks and
+// the insert can't race another writer
+func (s *sqliteStore) CreateNetwork(n Network) (int64, error) {
+	prefix, masklen, err := encodePrefix(n.AddressRange)
+	if err != nil {
+		return 0, err
+	}
+	cidr := decodePrefix(prefix, masklen)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var parent string
+	where, args := `WHERE parent IS NULL`, []any{}
+	if n.Parent.Valid {
+		var pp []byte
+		var pm int
+		if err := tx.QueryRow(`SELECT prefix, masklen FROM networks WHERE id=$1`, n.Parent.Int64).Scan(&pp, &pm); err != nil {
+			if err == sql.ErrNoRows {
+				return 0, ErrNotFound
+			}
+			return 0, err
+		}
+		parent = decodePrefix(pp, pm)
+		where, args = `WHERE parent=$1`, []any{n.Parent.Int64}
+	}
+	rows, err := tx.Query(`SELECT prefix, masklen FROM networks `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	var siblings []string
+	for rows.Next() {
+		var sp []byte
+		var sm int
+		if err := rows.Scan(&sp, &sm); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		siblings = append(siblings, decodePrefix(sp, sm))
+	}
+	rows.Close()
+	if err := placeNetwork(cidr, parent, siblings); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO networks(parent, prefix, masklen, description, subdivide) VALUES($1, $2, $3, $4, $5)`,
+		n.Parent, prefix, masklen, n.Description, n.Subdivide)
+	if err != nil {
+		return 0, sqliteWriteError(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *sqliteStore) UpdateNetwork(id int64, u NetworkUpdate) error {
+	fields := []string{}
+	vals := []any{}
+	set := func(col string, v any) {
+		vals = append(vals, v)
+		fields = append(fields, fmt.Sprintf("%s=$%d", col, len(vals)))
+	}
+	if u.Description != nil {
+		set("description", *u.Description)
+	}
+	if u.Owner != nil {
+		set("owner", *u.Owner)
+	}
+	if u.Account != nil {
+		set("account", *u.Account)
+	}
+	if u.Subdivide != nil {
+		set("subdivide", *u.Subdivide)
+	}
+	if u.Service != nil {
+		set("service", *u.Service)
+	}
+	if u.Gateway != nil {
+		var gw any // NULL clears it
+		if *u.Gateway != "" {
+			b, err := encodeAddr(*u.Gateway)
+			if err != nil {
+				return err
+			}
+			gw = b
+		}
+		set("gateway", gw)
+	}
+	if u.DHCPPools != nil {
+		set("dhcp_pools", sql.NullString{String: *u.DHCPPools, Valid: *u.DHCPPools != ""})
+	}
+	if u.Discover != nil {
+		set("discover", *u.Discover)
+	}
+	if u.StaleDays != nil {
+		set("stale_days", *u.StaleDays)
+	}
+	if u.ValidMasks != nil {
+		set("valid_masks", ipam.FormatSmallIntArray(*u.ValidMasks))
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	vals = append(vals, id)
+	res, err := s.db.Exec(fmt.Sprintf("UPDATE networks SET %s WHERE id=$%d", strings.Join(fields, ","), len(vals)), vals...)
+	if err != nil {
+		return sqliteWriteError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// The foreign keys refuse to delete a network still in use
+func (s *sqliteStore) DeleteNetwork(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM networks WHERE id=$1`, id)
+	var se sqlite3.Error
+	if errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return errNetworkInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) queryHosts(match func(Host) bool, limit int, where string, args ...any) ([]Host, error) {
+	rows, err := s.db.Query(`SELECT address, network, description, hostname, mac FROM hosts `+where+` ORDER BY address`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Host{}
+	for rows.Next() {
+		var h Host
+		var addr []byte
+		if err := rows.Scan(&addr, &h.NetworkID, &h.Description, &h.Hostname, &h.MAC); err != nil {
+			return nil, err
+		}
+		h.Address = decodeIP(addr).String()
+		if match == nil || match(h) {
+			out = append(out, h)
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Hosts(network int64) ([]Host, error) {
+	return s.queryHosts(nil, 0, `WHERE network=$1`, network)
+}
+
+func (s *sqliteStore) SearchHosts(q string, limit int) ([]Host, error) {
+	return s.queryHosts(func(h Host) bool {
+		return containsFold(h.Address, q) || containsFold(h.Description, q) || containsFold(h.Hostname.String, q)
+	}, limit, ``)
+}
+
+func (s *sqliteStore) Host(address string) (Host, error) {
+	addr, err := encodeAddr(address)
+	if err != nil {
+		return Host{}, ErrNotFound
+	}
+	hosts, err := s.queryHosts(nil, 0, `WHERE address=$1`, addr)
+	if err != nil {
+		return Host{}, err
+	}
+	if len(hosts) == 0 {
+		return Host{}, ErrNotFound
+	}
+	return hosts[0], nil
+}
+
+func (s *sqliteStore) CreateHost(h Host) error {
+	addr, err := encodeAddr(h.Address)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var prefix []byte
+	var masklen int
+	if err := tx.QueryRow(`SELECT prefix, masklen FROM networks WHERE id=$1`, h.NetworkID).Scan(&prefix, &masklen); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := placeHost(decodeIP(addr).String(), decodePrefix(prefix, masklen)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO hosts(address, network, description, hostname, mac) VALUES($1, $2, $3, $4, $5)`,
+		addr, h.NetworkID, h.Description, h.Hostname, h.MAC); err != nil {
+		return sqliteWriteError(err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) UpdateHost(address string, u HostUpdate) error {
+	addr, err := encodeAddr(address)
+	if err != nil {
+		return err
+	}
+	// SQLite numbers $ parameters in the order they appear, so the
+	// address comes last
+	fields := []string{"description=$1"}
+	vals := []any{u.Description}
+	if u.Hostname != nil {
+		vals = append(vals, *u.Hostname)
+		fields = append(fields, fmt.Sprintf("hostname=$%d", len(vals)))
+	}
+	if u.MAC != nil {
+		vals = append(vals, *u.MAC)
+		fields = append(fields, fmt.Sprintf("mac=$%d", len(vals)))
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	vals = append(vals, addr)
+	res, err := tx.Exec(`UPDATE hosts SET `+strings.Join(fields, ",")+fmt.Sprintf(` WHERE address=$%d`, len(vals)), vals...)
+	if err != nil {
+		return sqliteWriteError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteHost(address string) error {
+	addr, err := encodeAddr(address)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM hosts WHERE address=$1`, addr)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) queryUsers(where string, args ...any) ([]User, error) {
+	rows, err := s.db.Query(`SELECT u.id, u.username, u.password, u.status, coalesce(group_concat(r.name), '')
+		FROM users u LEFT JOIN user_roles ur ON ur."user"=u.id LEFT JOIN roles r ON r.id=ur.role
+		`+where+` GROUP BY u.id ORDER BY u.username`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		var u User
+		var roles string
+		if err := rows.Scan(&u.ID, &u.Username, &u.Password, &u.Status, &roles); err != nil {
+			return nil, err
+		}
+		u.Roles = []string{}
+		if roles != "" {
+			u.Roles = strings.Split(roles, ",")
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Users() ([]User, error) {
+	return s.queryUsers("")
+}
+
+func (s *sqliteStore) User(id int64) (User, error) {
+	users, err := s.queryUsers(`WHERE u.id=$1`, id)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (s *sqliteStore) CreateUser(username, password string, roles []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO users(username, password, status) VALUES($1, $2, 1)`, username, password)
+	if err != nil {
+		return 0, sqliteWriteError(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := setRoles(tx, id, roles); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// The SQL for these is the same on both databases
+func (s *sqliteStore) UpdateUser(id int64, u UserUpdate) error {
+	return (&pgStore{s.db}).UpdateUser(id, u)
+}
+
+func (s *sqliteStore) DeleteUser(id int64) error {
+	return (&pgStore{s.db}).DeleteUser(id)
+}
+
+func (s *sqliteStore) Roles() ([]Role, error) {
+	return (&pgStore{s.db}).Roles()
+}
+
+// Unknown users are not logged, as with logChange
+func (s *sqliteStore) LogChange(prefix, action, username string) error {
+	var userID int64
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE username=$1`, username).Scan(&userID); err != nil {
+		return nil
+	}
+	_, err := s.db.Exec(`INSERT INTO changelog(prefix, change, "user") VALUES($1, $2, $3)`, prefix, action, userID)
+	return err
+}
+
+func (s *sqliteStore) Changes(before int64, limit int) ([]Change, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, c.change_time, c.prefix, c.change, coalesce(u.username, '')
+		FROM changelog c
+		LEFT JOIN users u ON c."user" = u.id
+		WHERE $1 = 0 OR c.id < $1
+		ORDER BY c.id DESC LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.ID, &c.Time, &c.Prefix, &c.Change, &c.User); err != nil {
+			return nil, err
+		}
+		// CURRENT_TIMESTAMP is UTC
+		c.Time = c.Time.UTC()
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
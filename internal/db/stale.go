@@ -0,0 +1,396 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+)
+
+// Stale report: hosts and leaf networks are scored 0-100 from how long
+// ago they were last seen (discovery sweeps, neighbor tables, DHCP
+// leases), how long ago they last changed, whether a DHCP network has a
+// lease for them, and whether they still carry the "auto" description
+// that allocate-host and allocate-subnet leave behind. A component that
+// has no data behind it (say, a network that is never swept) is left out
+// rather than counted as stale.
+
+// Component weights; a missing component's weight is left out of the total
+var staleWeights = map[string]float64{"seen": 0.5, "changed": 0.25, "lease": 0.15, "description": 0.1}
+
+// StaleItem is one scored host or leaf network
+type StaleItem struct {
+	Kind        string     `json:"kind"` // host or network
+	Address     string     `json:"address"`
+	Network     int64      `json:"network"`
+	Description string     `json:"description"`
+	Threshold   int        `json:"threshold_days"`
+	LastSeen    *time.Time `json:"last_seen"`
+	LastChange  *time.Time `json:"last_change"`
+	Review      *time.Time `json:"review"`
+	Score       int        `json:"score"`
+	Reasons     []string   `json:"reasons"`
+}
+
+// StaleOptions select what the report covers
+type StaleOptions struct {
+	Root     int64  // subtree to report on, 0 for everything
+	Days     int    // threshold for networks without stale_days
+	MinScore int    // leave out items scoring less
+	Kind     string // "hosts", "networks" or "" for both
+	Review   string // "only" or "exclude" items marked for review, "" for all
+}
+
+// Facts gathered for one item; ages are in days, negative when unknown
+type staleFacts struct {
+	seenAge, changeAge float64
+	observed           bool // something could have seen it
+	leaseData, leased  bool // the network has imported leases; one covers it
+	description        string
+	empty              bool // network with no hosts
+}
+
+func scoreStale(f staleFacts, threshold int) (int, []string) {
+	var total, weight float64
+	var reasons []string
+	age := func(days float64) float64 { return math.Min(days/float64(threshold), 1) }
+	if f.observed {
+		weight += staleWeights["seen"]
+		if f.seenAge < 0 {
+			total += staleWeights["seen"]
+			reasons = append(reasons, "never seen")
+		} else {
+			total += staleWeights["seen"] * age(f.seenAge)
+			if f.seenAge >= float64(threshold) {
+				reasons = append(reasons, fmt.Sprintf("not seen for %d days", int(f.seenAge)))
+			}
+		}
+	}
+	weight += staleWeights["changed"]
+	if f.changeAge < 0 {
+		total += staleWeights["changed"]
+		reasons = append(reasons, "no changes logged")
+	} else {
+		total += staleWeights["changed"] * age(f.changeAge)
+		if f.changeAge >= float64(threshold) {
+			reasons = append(reasons, fmt.Sprintf("unchanged for %d days", int(f.changeAge)))
+		}
+	}
+	if f.leaseData {
+		weight += staleWeights["lease"]
+		if !f.leased {
+			total += staleWeights["lease"]
+			reasons = append(reasons, "no DHCP lease")
+		}
+	}
+	weight += staleWeights["description"]
+	switch d := strings.TrimSpace(f.description); {
+	case d == "" || strings.EqualFold(d, "auto"):
+		total += staleWeights["description"]
+		reasons = append(reasons, fmt.Sprintf("description %q", d))
+	case f.empty:
+		total += staleWeights["description"]
+		reasons = append(reasons, "no hosts")
+	}
+	if reasons == nil {
+		reasons = []string{}
+	}
+	return int(math.Round(100 * total / weight)), reasons
+}
+
+func nullDays(v sql.NullFloat64) float64 {
+	if !v.Valid {
+		return -1
+	}
+	return v.Float64
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Items in the subtree below opts.Root; $1 is the root id
+const staleScope = `($1 = 0 OR n.address_range <<= (SELECT address_range FROM networks WHERE id = $1))`
+
+// Threshold for a network: stale_days of its nearest ancestor that sets one
+const staleThreshold = `(SELECT t.stale_days FROM networks t WHERE t.address_range >>= n.address_range
+	AND t.stale_days IS NOT NULL ORDER BY masklen(t.address_range) DESC LIMIT 1)`
+
+// StaleReport scores hosts and leaf networks and returns those at or
+// above opts.MinScore, most stale first
+func StaleReport(db *sql.DB, opts StaleOptions) ([]StaleItem, error) {
+	out := []StaleItem{}
+	review := map[string]string{
+		"only":    ` AND %s.review IS NOT NULL`,
+		"exclude": ` AND %s.review IS NULL`,
+	}[opts.Review]
+
+	if opts.Kind != "networks" {
+		filter := ""
+		if review != "" {
+			filter = fmt.Sprintf(review, "h")
+		}
+		rows, err := db.Query(`
+			SELECT host(h.address), h.network, h.description, `+staleThreshold+`,
+				GREATEST(d.last_seen, nb.last_seen, CASE WHEN l.active THEN l.imported END),
+				c.last_change, h.review,
+				n.last_swept IS NOT NULL OR nb.last_seen IS NOT NULL OR l.address IS NOT NULL
+					OR EXISTS(SELECT 1 FROM neighbors x WHERE x.address << n.address_range),
+				EXISTS(SELECT 1 FROM dhcp_leases x WHERE x.address << n.address_range),
+				coalesce(l.active AND (l.ends IS NULL OR l.ends > NOW()), false)
+			FROM hosts h JOIN networks n ON n.id = h.network
+			LEFT JOIN discovery d ON d.address = h.address
+			LEFT JOIN (SELECT address, max(last_seen) AS last_seen FROM neighbors GROUP BY address) nb ON nb.address = h.address
+			LEFT JOIN dhcp_leases l ON l.address = h.address
+			LEFT JOIN (SELECT prefix, max(change_time) AS last_change FROM changelog
+				WHERE masklen(prefix) = CASE family(prefix) WHEN 4 THEN 32 ELSE 128 END GROUP BY 1) c
+				ON c.prefix = set_masklen(h.address, CASE family(h.address) WHEN 4 THEN 32 ELSE 128 END)
+			WHERE `+staleScope+filter, opts.Root)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var it StaleItem
+			var f staleFacts
+			var threshold sql.NullInt64
+			var seen, changed, rev sql.NullTime
+			if err := rows.Scan(&it.Address, &it.Network, &it.Description, &threshold, &seen, &changed, &rev,
+				&f.observed, &f.leaseData, &f.leased); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			it.Kind = "host"
+			out = append(out, finishStale(it, f, threshold, seen, changed, rev, opts))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Kind != "hosts" {
+		filter := ""
+		if review != "" {
+			filter = fmt.Sprintf(review, "n")
+		}
+		rows, err := db.Query(`
+			SELECT n.address_range::text, n.id, coalesce(n.description, ''), `+staleThreshold+`,
+				GREATEST(
+					(SELECT max(last_seen) FROM discovery x WHERE x.network = n.id),
+					(SELECT max(last_seen) FROM neighbors x WHERE x.address << n.address_range),
+					(SELECT max(imported) FROM dhcp_leases x WHERE x.address << n.address_range AND x.active)),
+				(SELECT max(change_time) FROM changelog c WHERE c.prefix <<= n.address_range), n.review,
+				n.last_swept IS NOT NULL OR EXISTS(SELECT 1 FROM neighbors x WHERE x.address << n.address_range),
+				n.dhcp_pools IS NOT NULL OR EXISTS(SELECT 1 FROM dhcp_leases x WHERE x.address << n.address_range),
+				EXISTS(SELECT 1 FROM dhcp_leases x WHERE x.address << n.address_range AND x.active AND (x.ends IS NULL OR x.ends > NOW())),
+				NOT EXISTS(SELECT 1 FROM hosts x WHERE x.network = n.id)
+			FROM networks n
+			WHERE NOT n.subdivide AND `+staleScope+filter, opts.Root)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var it StaleItem
+			var f staleFacts
+			var threshold sql.NullInt64
+			var seen, changed, rev sql.NullTime
+			if err := rows.Scan(&it.Address, &it.Network, &it.Description, &threshold, &seen, &changed, &rev,
+				&f.observed, &f.leaseData, &f.leased, &f.empty); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			it.Kind = "network"
+			out = append(out, finishStale(it, f, threshold, seen, changed, rev, opts))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	kept := out[:0]
+	for _, it := range out {
+		if it.Score >= opts.MinScore {
+			kept = append(kept, it)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Score > kept[j].Score })
+	return kept, nil
+}
+
+func finishStale(it StaleItem, f staleFacts, threshold sql.NullInt64, seen, changed, rev sql.NullTime, opts StaleOptions) StaleItem {
+	it.Threshold = opts.Days
+	if threshold.Valid && threshold.Int64 > 0 {
+		it.Threshold = int(threshold.Int64)
+	}
+	it.LastSeen, it.LastChange, it.Review = timePtr(seen), timePtr(changed), timePtr(rev)
+	now := time.Now()
+	f.seenAge, f.changeAge = -1, -1
+	if seen.Valid {
+		f.seenAge = math.Max(now.Sub(seen.Time).Hours()/24, 0)
+	}
+	if changed.Valid {
+		f.changeAge = math.Max(now.Sub(changed.Time).Hours()/24, 0)
+	}
+	f.description = it.Description
+	it.Score, it.Reasons = scoreStale(f, it.Threshold)
+	return it
+}
+
+func writeStaleCSV(w http.ResponseWriter, items []StaleItem) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="gopieng-stale.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "address", "network", "description", "score", "threshold_days", "last_seen", "last_change", "review", "reasons"})
+	stamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, it := range items {
+		cw.Write([]string{it.Kind, it.Address, strconv.FormatInt(it.Network, 10), it.Description, strconv.Itoa(it.Score),
+			strconv.Itoa(it.Threshold), stamp(it.LastSeen), stamp(it.LastChange), stamp(it.Review), strings.Join(it.Reasons, "; ")})
+	}
+	cw.Flush()
+}
+
+func staleOptions(r *http.Request) (StaleOptions, error) {
+	q := r.URL.Query()
+	var invalid ValidationError
+	opts := StaleOptions{Days: staleDays(&invalid, r), Kind: q.Get("kind"), Review: q.Get("review")}
+	opts.Root = queryID(&invalid, r, "root")
+	opts.MinScore = queryInt(&invalid, r, "min_score", 50, 0, 100)
+	if opts.Kind != "" && opts.Kind != "hosts" && opts.Kind != "networks" {
+		invalid.Add("kind", "must be hosts or networks")
+	}
+	if opts.Review != "" && opts.Review != "only" && opts.Review != "exclude" {
+		invalid.Add("review", "must be only or exclude")
+	}
+	return opts, invalid.Err()
+}
+
+// staleReview is the body of POST /reports/stale/review: the items to
+// mark, or all those the report's query params select
+type staleReview struct {
+	Hosts    []string `json:"hosts"`
+	Networks []int64  `json:"networks"`
+	All      bool     `json:"all"`
+	Clear    bool     `json:"clear"`
+}
+
+func staleRoutes(r chi.Router, db *sql.DB) {
+	// Hosts and leaf networks ranked by staleness
+	// (query params: root, days, min_score, kind=hosts|networks, review=only|exclude, format=json|csv)
+	r.Get("/reports/stale", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := staleOptions(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		items, err := StaleReport(db, opts)
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			writeJSON(w, map[string]any{"days": opts.Days, "min_score": opts.MinScore, "items": items})
+		case "csv":
+			writeStaleCSV(w, items)
+		default:
+			apierr.Write(w, r, apierr.BadRequest, "format must be json or csv")
+		}
+	})
+
+	// Mark hosts and networks for review, or clear the mark. With "all" the
+	// report is run with the same query params and every item in it is marked.
+	r.Post("/reports/stale/review", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		var req staleReview
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var invalid ValidationError
+		for i, a := range req.Hosts {
+			req.Hosts[i] = checkIP(&invalid, "hosts", a)
+		}
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if req.All {
+			opts, err := staleOptions(r)
+			if err != nil {
+				writeRequestError(w, r, err)
+				return
+			}
+			items, err := StaleReport(db, opts)
+			if err != nil {
+				apierr.InternalError(w, r, err)
+				return
+			}
+			for _, it := range items {
+				if it.Kind == "host" {
+					req.Hosts = append(req.Hosts, it.Address)
+				} else {
+					req.Networks = append(req.Networks, it.Network)
+				}
+			}
+		}
+		// Marks live in the review columns only: a changelog entry would
+		// count as a change, making the item look fresh to this report
+		// and moving zone serials and forward-record ETags
+		set := "NOW()"
+		if req.Clear {
+			set = "NULL"
+		}
+		marked := 0
+		tx, err := db.Begin()
+		if err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+		for _, a := range req.Hosts {
+			res, err := tx.Exec(`UPDATE hosts SET review=`+set+` WHERE address=$1::inet`, a)
+			if err != nil {
+				apierr.InternalError(w, r, err)
+				return
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				marked++
+			}
+		}
+		for _, id := range req.Networks {
+			res, err := tx.Exec(`UPDATE networks SET review=`+set+` WHERE id=$1`, id)
+			if err != nil {
+				apierr.InternalError(w, r, err)
+				return
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				marked++
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			apierr.InternalError(w, r, err)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok", "marked": marked})
+	})
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScoreStale(t *testing.T) {
+	tests := []struct {
+		name      string
+		facts     staleFacts
+		threshold int
+		score     int
+		reasons   []string
+	}{
+		{
+			name:      "fresh",
+			facts:     staleFacts{observed: true, seenAge: 0, changeAge: 0, leaseData: true, leased: true, description: "web"},
+			threshold: 90, score: 0, reasons: []string{},
+		},
+		{
+			name:      "nothing known",
+			facts:     staleFacts{observed: true, seenAge: -1, changeAge: -1, leaseData: true, description: "auto"},
+			threshold: 90, score: 100,
+			reasons: []string{"never seen", "no changes logged", "no DHCP lease", `description "auto"`},
+		},
+		{
+			name:      "never observable",
+			facts:     staleFacts{changeAge: 45, description: "web"},
+			threshold: 90, score: 36, reasons: []string{}, // 0.25*0.5 / (0.25+0.1)
+		},
+		{
+			name:      "long unseen",
+			facts:     staleFacts{observed: true, seenAge: 180, changeAge: 10, description: " Auto "},
+			threshold: 90, score: 74, // (0.5 + 0.25*10/90 + 0.1) / 0.85
+			reasons: []string{"not seen for 180 days", `description "Auto"`},
+		},
+		{
+			name:      "empty network at the threshold",
+			facts:     staleFacts{changeAge: 90, description: "lab", empty: true},
+			threshold: 90, score: 100, reasons: []string{"unchanged for 90 days", "no hosts"},
+		},
+		{
+			name:      "no description",
+			facts:     staleFacts{changeAge: 0},
+			threshold: 90, score: 29, reasons: []string{`description ""`}, // 0.1 / 0.35
+		},
+		{
+			name:      "just under the threshold",
+			facts:     staleFacts{observed: true, seenAge: 29.9, changeAge: 0, leaseData: true, leased: true, description: "x"},
+			threshold: 30, score: 50, reasons: []string{},
+		},
+		{
+			name:      "leased without lease data",
+			facts:     staleFacts{observed: true, seenAge: 0, changeAge: 0, leased: false, description: "x"},
+			threshold: 30, score: 0, reasons: []string{},
+		},
+	}
+	for _, tt := range tests {
+		score, reasons := scoreStale(tt.facts, tt.threshold)
+		if score != tt.score || !reflect.DeepEqual(reasons, tt.reasons) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, score, reasons, tt.score, tt.reasons)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// Store is the storage behind the core API: the networks tree, hosts,
+// users and the change log. The handlers in api.go only talk to a Store,
+// so they run the same against Postgres and the in-memory store.
+type Store interface {
+	// Networks lists the children of parent (0 for the roots) whose
+	// range, description or owner contains q, ordered by address
+	Networks(parent int64, q string) ([]Network, error)
+	// SearchNetworks matches range, description or owner loosely and
+	// account exactly
+	SearchNetworks(q string, limit int) ([]Network, error)
+	Network(id int64) (Network, error)
+	CreateNetwork(n Network) (int64, error)
+	UpdateNetwork(id int64, u NetworkUpdate) error
+	// DeleteNetwork refuses a network with subnets or hosts with
+	// errNetworkInUse
+	DeleteNetwork(id int64) error
+
+	// Hosts lists the hosts of a network ordered by address, with the
+	// time discovery last saw each
+	Hosts(network int64) ([]Host, error)
+	SearchHosts(q string, limit int) ([]Host, error)
+	Host(address string) (Host, error)
+	CreateHost(h Host) error
+	// UpdateHost and DeleteHost return ErrNotFound for an address that
+	// isn't a host
+	UpdateHost(address string, u HostUpdate) error
+	DeleteHost(address string) error
+
+	Users() ([]User, error)
+	User(id int64) (User, error)
+	CreateUser(username, password string, roles []string) (int64, error)
+	// UpdateUser and DeleteUser return ErrNotFound for an unknown id.
+	// DeleteUser keeps the user's changes in the log without a user.
+	UpdateUser(id int64, u UserUpdate) error
+	DeleteUser(id int64) error
+	Roles() ([]Role, error)
+
+	// LogChange records action against prefix as username; unknown
+	// users are not logged
+	LogChange(prefix, action, username string) error
+	// Changes lists up to limit entries newest first, from those older
+	// than the entry with ID before (0 for the newest)
+	Changes(before int64, limit int) ([]Change, error)
+}
+
+// Errors returned by a Store
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+// ConflictError is a write refused because it would break the tree:
+// overlapping siblings (apierr.Overlap), or a network outside its parent
+// or a host outside its network (apierr.OutsideNetwork). Handlers also
+// use it for taken names and exhausted networks. Field names the request
+// field at fault, if any.
+type ConflictError struct{ Code, Msg, Field string }
+
+func (e *ConflictError) Error() string { return e.Msg }
+
+// errNetworkInUse refuses to delete a network that still has subnets or
+// hosts, as the foreign keys do
+var errNetworkInUse = &ConflictError{Code: apierr.Conflict, Msg: "network has subnets or hosts"}
+
+// Stores that keep the tree in Go check new rows with placeNetwork and
+// placeHost, matching the rules the Postgres schema enforces.
+
+// placeNetwork checks cidr against its parent's range ("" for a root)
+// and the ranges of its siblings
+func placeNetwork(cidr, parent string, siblings []string) error {
+	if parent != "" && (!sameFamily(parent, cidr) || !ipam.ContainsStr(parent, cidr) || parent == cidr) {
+		return &ConflictError{Code: apierr.OutsideNetwork, Msg: fmt.Sprintf("network %s is not inside its parent %s", cidr, parent)}
+	}
+	for _, o := range siblings {
+		if sameFamily(o, cidr) && ipam.OverlapStr(o, cidr) {
+			return &ConflictError{Code: apierr.Overlap, Msg: "network overlaps a sibling: " + o}
+		}
+	}
+	return nil
+}
+
+// placeHost checks that address lies inside its network's range
+func placeHost(address, network string) error {
+	if !sameFamily(network, ipam.HostCIDR(address)) || !ipam.ContainsStr(network, ipam.HostCIDR(address)) {
+		return &ConflictError{Code: apierr.OutsideNetwork, Msg: fmt.Sprintf("host %s is not inside its network %s", address, network)}
+	}
+	return nil
+}
+
+// NetworkUpdate holds the fields of a network to change; nil leaves a
+// field alone. An empty Gateway or DHCPPools clears it, as does a
+// StaleDays that is not Valid.
+type NetworkUpdate struct {
+	Description, Owner, Account *string
+	Subdivide, Discover         *bool
+	Service                     *int64
+	Gateway, DHCPPools          *string
+	StaleDays                   *sql.NullInt64
+	ValidMasks                  *[]int16
+}
+
+// HostUpdate holds the fields of a host to change. Description is always
+// set; a nil Hostname or MAC is left alone and an invalid one cleared.
+type HostUpdate struct {
+	Description   string
+	Hostname, MAC *sql.NullString
+}
+
+type User struct {
+	ID       int64
+	Username string
+	Password string
+	Status   int
+	Roles    []string
+}
+
+// UserUpdate holds the fields of a user to change; nil leaves a field
+// alone. Password is already hashed.
+type UserUpdate struct {
+	Password *string
+	Status   *int
+	Roles    []string
+}
+
+type Role struct {
+	ID   int64
+	Name string
+}
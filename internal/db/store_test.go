@@ -0,0 +1,147 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/yellowman/GoPieNg/internal/migrate"
+)
+
+// A migrated SQLite database in a temporary file
+func testSQLite(t *testing.T) *DB {
+	t.Helper()
+	d, err := Open("sqlite:" + filepath.Join(t.TempDir(), "pieng.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if _, err := migrate.Up(d.DB, migrate.For(d.Driver), 0); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// The stores the tests run against that need no server: MemStore and a
+// migrated SQLite file
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	return map[string]Store{"mem": NewMemStore(), "sqlite": testSQLite(t).Store}
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			root, err := s.CreateNetwork(Network{AddressRange: "10.0.0.0/16", Subdivide: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub, err := s.CreateNetwork(Network{Parent: sql.NullInt64{Int64: root, Valid: true}, AddressRange: "10.0.1.0/24"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateHost(Host{Address: "10.0.1.5", NetworkID: sub, Description: "web"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateHost(Host{Address: "10.0.1.5", NetworkID: sub}); !errors.Is(err, ErrExists) {
+				t.Errorf("duplicate host: %v", err)
+			}
+
+			// Hostname and MAC are set together with the description
+			hostname := &sql.NullString{String: "web.example.com", Valid: true}
+			mac := &sql.NullString{String: "00:11:22:33:44:55", Valid: true}
+			if err := s.UpdateHost("10.0.1.5", HostUpdate{Description: "www", Hostname: hostname, MAC: mac}); err != nil {
+				t.Fatal(err)
+			}
+			h, err := s.Host("10.0.1.5")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Description != "www" || h.Hostname != *hostname || h.MAC != *mac {
+				t.Errorf("updated host %+v", h)
+			}
+			// Absent fields are kept
+			if err := s.UpdateHost("10.0.1.5", HostUpdate{Description: "web"}); err != nil {
+				t.Fatal(err)
+			}
+			if h, _ := s.Host("10.0.1.5"); h.Description != "web" || h.Hostname != *hostname {
+				t.Errorf("partly updated host %+v", h)
+			}
+			if err := s.UpdateHost("10.0.1.6", HostUpdate{Description: "x"}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("update of a missing host: %v", err)
+			}
+
+			// A network with subnets or hosts can't be deleted
+			for _, id := range []int64{root, sub} {
+				if err := s.DeleteNetwork(id); err != errNetworkInUse {
+					t.Errorf("delete network %d in use: %v", id, err)
+				}
+			}
+			if err := s.DeleteNetwork(9999); !errors.Is(err, ErrNotFound) {
+				t.Errorf("delete of a missing network: %v", err)
+			}
+
+			if err := s.DeleteHost("10.0.1.5"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteHost("10.0.1.5"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second delete of a host: %v", err)
+			}
+			if err := s.DeleteHost("not-an-address"); err == nil {
+				t.Error("delete of a bad address succeeded")
+			}
+			if err := s.DeleteNetwork(sub); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteNetwork(root); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Network(root); !errors.Is(err, ErrNotFound) {
+				t.Errorf("deleted network: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			id, err := s.CreateUser("alice", "secret", []string{"editor", "no-such-role"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u, err := s.User(id); err != nil || len(u.Roles) != 1 || u.Roles[0] != "editor" {
+				t.Errorf("created user %+v, %v", u, err)
+			}
+			status := 0
+			if err := s.UpdateUser(id, UserUpdate{Status: &status, Roles: []string{"reader"}}); err != nil {
+				t.Fatal(err)
+			}
+			if u, _ := s.User(id); u.Status != 0 || len(u.Roles) != 1 || u.Roles[0] != "reader" {
+				t.Errorf("updated user %+v", u)
+			}
+			if err := s.UpdateUser(9999, UserUpdate{Status: &status}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("update of a missing user: %v", err)
+			}
+
+			// The user's changes stay in the log after the user is gone
+			if err := s.LogChange("10.0.0.0/16", "network added", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteUser(id); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteUser(id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second delete of a user: %v", err)
+			}
+			changes, err := s.Changes(0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 1 || changes[0].Change != "network added" || changes[0].User != "" {
+				t.Errorf("changes after the delete: %+v", changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+const networkColumns = `id, parent, address_range::text, description, subdivide, valid_masks, owner, account, service, host(gateway), dhcp_pools, discover, last_swept`
+
+// Scan a networks row selected with networkColumns
+func scanNetwork(row interface{ Scan(...any) error }) (Network, error) {
+	var n Network
+	var vm sql.NullString
+	if err := row.Scan(&n.ID, &n.Parent, &n.AddressRange, &n.Description, &n.Subdivide, &vm, &n.Owner, &n.Account, &n.Service, &n.Gateway, &n.DHCPPools, &n.Discover, &n.LastSwept); err != nil {
+		return n, err
+	}
+	if vm.Valid {
+		n.ValidMasks = ipam.ParseSmallIntArray(vm.String)
+	}
+	return n, nil
+}
+
+// SubtreeNetworks walks the networks tree below rootID (inclusive) and
+// returns every network ordered by address. A rootID of 0 returns the
+// whole tree.
+func SubtreeNetworks(db *sql.DB, rootID int64) ([]Network, error) {
+	var rows *sql.Rows
+	var err error
+	if rootID == 0 {
+		rows, err = db.Query(`SELECT ` + networkColumns + ` FROM networks ORDER BY address_range`)
+	} else {
+		rows, err = db.Query(`
+			WITH RECURSIVE tree AS (
+				SELECT id FROM networks WHERE id = $1
+				UNION ALL
+				SELECT n.id FROM networks n JOIN tree t ON n.parent = t.id
+			)
+			SELECT `+networkColumns+` FROM networks
+			WHERE id IN (SELECT id FROM tree)
+			ORDER BY address_range`, rootID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Network
+	for rows.Next() {
+		n, err := scanNetwork(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// SubtreeHosts returns the hosts in the networks below rootID (inclusive),
+// or every host for a rootID of 0, ordered by network and address
+func SubtreeHosts(db *sql.DB, rootID int64) ([]Host, error) {
+	var rows *sql.Rows
+	var err error
+	if rootID == 0 {
+		rows, err = db.Query(`SELECT host(address), network, description, hostname, mac::text FROM hosts ORDER BY network, address`)
+	} else {
+		rows, err = db.Query(`
+			WITH RECURSIVE tree AS (
+				SELECT id FROM networks WHERE id = $1
+				UNION ALL
+				SELECT n.id FROM networks n JOIN tree t ON n.parent = t.id
+			)
+			SELECT host(address), network, description, hostname, mac::text FROM hosts
+			WHERE network IN (SELECT id FROM tree)
+			ORDER BY network, address`, rootID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Host
+	for rows.Next() {
+		var h Host
+		if err := rows.Scan(&h.Address, &h.NetworkID, &h.Description, &h.Hostname, &h.MAC); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,875 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+)
+
+// Version 2 of the core API, served under /v2. Resources are typed
+// structs whose missing values are null rather than zero or "". One
+// resource is answered as {"data": {...}} and a list as
+// {"data": [...], "next_cursor": "..."}; lists take sort, limit and
+// cursor, and everything takes fields to select what is returned.
+
+// Network as served by v2
+type v2Network struct {
+	ID           int64      `json:"id"`
+	Parent       *int64     `json:"parent"`
+	AddressRange string     `json:"address_range"`
+	Description  *string    `json:"description"`
+	Owner        *string    `json:"owner"`
+	Account      *string    `json:"account"`
+	Service      *int64     `json:"service"`
+	Subdivide    bool       `json:"subdivide"`
+	ValidMasks   []int16    `json:"valid_masks"`
+	Gateway      *string    `json:"gateway"`
+	DHCPPools    *string    `json:"dhcp_pools"`
+	Discover     bool       `json:"discover"`
+	LastSwept    *time.Time `json:"last_swept"`
+}
+
+// Host as served by v2
+type v2Host struct {
+	Address     string     `json:"address"`
+	Network     int64      `json:"network"`
+	Description string     `json:"description"`
+	Hostname    *string    `json:"hostname"`
+	MAC         *string    `json:"mac"`
+	LastSeen    *time.Time `json:"last_seen"`
+}
+
+// User as served by v2; the password is never returned
+type v2User struct {
+	ID       int64    `json:"id"`
+	Username string   `json:"username"`
+	Status   int      `json:"status"`
+	Roles    []string `json:"roles"`
+}
+
+// Change log entry as served by v2
+type v2Change struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Prefix string    `json:"prefix"`
+	Action string    `json:"action"`
+	User   string    `json:"user"`
+}
+
+// Body of POST /v2/networks/{id}/hosts
+type v2HostCreate struct {
+	Address     string  `json:"address"`
+	Description string  `json:"description"`
+	Hostname    *string `json:"hostname"`
+	MAC         *string `json:"mac"`
+}
+
+// Body of PATCH /v2/hosts/{ip}; absent fields are kept
+type v2HostPatch struct {
+	Description *string `json:"description"`
+	Hostname    *string `json:"hostname"`
+	MAC         *string `json:"mac"`
+}
+
+type v2Role struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullInt64(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func toV2Network(n Network) v2Network {
+	masks := n.ValidMasks
+	if masks == nil {
+		masks = []int16{}
+	}
+	return v2Network{
+		ID: n.ID, Parent: nullInt64(n.Parent), AddressRange: n.AddressRange,
+		Description: nullString(n.Description), Owner: nullString(n.Owner), Account: nullString(n.Account),
+		Service: nullInt64(n.Service), Subdivide: n.Subdivide, ValidMasks: masks,
+		Gateway: nullString(n.Gateway), DHCPPools: nullString(n.DHCPPools),
+		Discover: n.Discover, LastSwept: nullTimePtr(n.LastSwept),
+	}
+}
+
+func toV2Host(h Host) v2Host {
+	return v2Host{Address: h.Address, Network: h.NetworkID, Description: h.Description,
+		Hostname: nullString(h.Hostname), MAC: nullString(h.MAC), LastSeen: nullTimePtr(h.LastSeen)}
+}
+
+func toV2User(u User) v2User {
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return v2User{ID: u.ID, Username: u.Username, Status: u.Status, Roles: roles}
+}
+
+func toV2Change(c Change) v2Change {
+	return v2Change{ID: c.ID, Time: c.Time, Prefix: c.Prefix, Action: formatChangeLog(c.Change, c.User), User: c.User}
+}
+
+func convert[T, U any](items []T, f func(T) U) []U {
+	out := make([]U, len(items))
+	for i, it := range items {
+		out[i] = f(it)
+	}
+	return out
+}
+
+// Sort keys: each renders a value so that keys compare as strings in
+// the value's order
+
+// Addresses and prefixes sort by family, then address, then length
+func addrKey(s string) string {
+	ip, bits := net.ParseIP(s), 128
+	if ip == nil {
+		var n *net.IPNet
+		var err error
+		if ip, n, err = net.ParseCIDR(s); err != nil {
+			return s
+		}
+		bits, _ = n.Mask.Size()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if bits == 128 {
+			bits = 32
+		}
+		return fmt.Sprintf("4%x/%03d", []byte(v4), bits)
+	}
+	return fmt.Sprintf("6%x/%03d", []byte(ip.To16()), bits)
+}
+
+func idKey(id int64) string { return fmt.Sprintf("%020d", id) }
+
+func textKey(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.ToLower(*s)
+}
+
+func timeKey(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000")
+}
+
+// A list's sortable columns and the key that breaks ties, which must be
+// unique so a cursor finds its place
+type v2Columns[T any] struct {
+	sorts map[string]func(T) string
+	tie   func(T) string
+}
+
+// The sortable columns by name
+func (c v2Columns[T]) names() []string {
+	out := make([]string, 0, len(c.sorts))
+	for name := range c.sorts {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+var v2NetworkColumns = v2Columns[v2Network]{
+	sorts: map[string]func(v2Network) string{
+		"address_range": func(n v2Network) string { return addrKey(n.AddressRange) },
+		"id":            func(n v2Network) string { return idKey(n.ID) },
+		"description":   func(n v2Network) string { return textKey(n.Description) },
+		"owner":         func(n v2Network) string { return textKey(n.Owner) },
+		"account":       func(n v2Network) string { return textKey(n.Account) },
+	},
+	tie: func(n v2Network) string { return idKey(n.ID) },
+}
+
+var v2HostColumns = v2Columns[v2Host]{
+	sorts: map[string]func(v2Host) string{
+		"address":     func(h v2Host) string { return addrKey(h.Address) },
+		"description": func(h v2Host) string { return textKey(&h.Description) },
+		"hostname":    func(h v2Host) string { return textKey(h.Hostname) },
+		"mac":         func(h v2Host) string { return textKey(h.MAC) },
+		"last_seen":   func(h v2Host) string { return timeKey(h.LastSeen) },
+	},
+	tie: func(h v2Host) string { return addrKey(h.Address) },
+}
+
+var v2UserColumns = v2Columns[v2User]{
+	sorts: map[string]func(v2User) string{
+		"username": func(u v2User) string { return strings.ToLower(u.Username) },
+		"id":       func(u v2User) string { return idKey(u.ID) },
+	},
+	tie: func(u v2User) string { return idKey(u.ID) },
+}
+
+var v2RoleColumns = v2Columns[v2Role]{
+	sorts: map[string]func(v2Role) string{
+		"name": func(r v2Role) string { return r.Name },
+		"id":   func(r v2Role) string { return idKey(r.ID) },
+	},
+	tie: func(r v2Role) string { return idKey(r.ID) },
+}
+
+// v2Cursor marks where a page ended: the sort it was taken with and the
+// keys of its last item
+type v2Cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	Tie  string `json:"t"`
+}
+
+func (c v2Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// v2Query is how a request wants a list: sorted by Sort (a column with a
+// leading - for descending), Limit items after the cursor, with Fields
+type v2Query struct {
+	Sort   string
+	Limit  int
+	Fields []string
+	After  *v2Cursor
+}
+
+// Read sort, limit, cursor and fields. Sorting is by def unless the
+// request names one of sorts.
+func parseV2Query[T any](r *http.Request, def string, sorts []string) (v2Query, error) {
+	var invalid ValidationError
+	q := v2Query{Sort: r.URL.Query().Get("sort")}
+	if q.Sort == "" {
+		q.Sort = def
+	}
+	if q.Sort != def && !slices.Contains(sorts, strings.TrimPrefix(q.Sort, "-")) {
+		if len(sorts) == 0 {
+			invalid.Add("sort", "this list is only sorted by %s", def)
+		} else {
+			invalid.Add("sort", "must be one of %s, with a leading - for descending", strings.Join(sorts, ", "))
+		}
+	}
+	q.Limit = queryInt(&invalid, r, "limit", 100, 1, 1000)
+	q.Fields = parseFields[T](&invalid, r)
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		var c v2Cursor
+		if b, err := base64.RawURLEncoding.DecodeString(v); err != nil || json.Unmarshal(b, &c) != nil {
+			invalid.Add("cursor", "not a cursor from this API")
+		} else if c.Sort != q.Sort {
+			invalid.Add("cursor", "was returned for sort=%s", c.Sort)
+		}
+		q.After = &c
+	}
+	return q, invalid.Err()
+}
+
+// The fields param, checked against T's JSON names
+func parseFields[T any](v *ValidationError, r *http.Request) []string {
+	s := r.URL.Query().Get("fields")
+	if s == "" {
+		return nil
+	}
+	names := jsonNames(reflect.TypeFor[T]())
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); !slices.Contains(names, f) {
+			v.Add("fields", "unknown field %q; fields are %s", f, strings.Join(names, ", "))
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func jsonNames(t reflect.Type) []string {
+	var out []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		out = append(out, name)
+	}
+	return out
+}
+
+// Sort items as q asks and return the page after its cursor, with the
+// cursor for the next page or "" after the last. items is the whole list
+// as the Store returned it, so every page reads all of it; only
+// /v2/changes has the Store page for it.
+func pageOf[T any](items []T, q v2Query, cols v2Columns[T]) ([]T, string) {
+	col := strings.TrimPrefix(q.Sort, "-")
+	desc := col != q.Sort
+	key := cols.sorts[col]
+	cmp := func(ak, at, bk, bt string) int {
+		c := strings.Compare(ak, bk)
+		if c == 0 {
+			c = strings.Compare(at, bt)
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+	slices.SortStableFunc(items, func(a, b T) int { return cmp(key(a), cols.tie(a), key(b), cols.tie(b)) })
+	start := 0
+	if q.After != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return cmp(key(items[i]), cols.tie(items[i]), q.After.Key, q.After.Tie) > 0
+		})
+	}
+	end := min(start+q.Limit, len(items))
+	page := items[start:end]
+	if end == len(items) {
+		return page, ""
+	}
+	last := page[len(page)-1]
+	return page, v2Cursor{Sort: q.Sort, Key: key(last), Tie: cols.tie(last)}.String()
+}
+
+// Only the selected fields of v, or all of v when none are selected
+func selectFields(v any, fields []string) any {
+	if len(fields) == 0 {
+		return v
+	}
+	b, _ := json.Marshal(v)
+	var all map[string]json.RawMessage
+	json.Unmarshal(b, &all)
+	out := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		out[f] = all[f]
+	}
+	return out
+}
+
+func writeV2(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// The fields param of a request answered with one T. Handlers check it
+// before changing anything, so a bad param can't fail a write that was done.
+func queryFields[T any](r *http.Request) ([]string, error) {
+	var invalid ValidationError
+	fields := parseFields[T](&invalid, r)
+	return fields, invalid.Err()
+}
+
+// Answer one resource, with only the selected fields
+func writeV2One(w http.ResponseWriter, status int, v any, fields []string) {
+	writeV2(w, status, map[string]any{"data": selectFields(v, fields)})
+}
+
+// The envelope of a page of a list
+func v2List[T any](page []T, next string, fields []string) map[string]any {
+	data := make([]any, len(page))
+	for i, it := range page {
+		data[i] = selectFields(it, fields)
+	}
+	var cursor *string
+	if next != "" {
+		cursor = &next
+	}
+	return map[string]any{"data": data, "next_cursor": cursor}
+}
+
+// Answer a page of a list
+func writeV2List[T any](w http.ResponseWriter, page []T, next string, fields []string) {
+	writeV2(w, http.StatusOK, v2List(page, next, fields))
+}
+
+// Sort, page and answer a whole list
+func writeV2Page[T any](w http.ResponseWriter, r *http.Request, items []T, def string, cols v2Columns[T]) {
+	q, err := parseV2Query[T](r, def, cols.names())
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	page, next := pageOf(items, q, cols)
+	writeV2List(w, page, next, q.Fields)
+}
+
+// Searches stop at v2SearchLimit matches
+const v2SearchLimit = 1000
+
+// Sort, page and answer search results, fetched with one more than
+// v2SearchLimit. Sorting and paging only cover the matches kept, so
+// truncated tells the client to narrow the search.
+func writeV2Search[T any](w http.ResponseWriter, r *http.Request, items []T, def string, cols v2Columns[T]) {
+	q, err := parseV2Query[T](r, def, cols.names())
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	truncated := len(items) > v2SearchLimit
+	page, next := pageOf(items[:min(len(items), v2SearchLimit)], q, cols)
+	out := v2List(page, next, q.Fields)
+	out["truncated"] = truncated
+	writeV2(w, http.StatusOK, out)
+}
+
+// The ip path parameter as a canonical address
+func pathIP(r *http.Request) (string, error) {
+	var invalid ValidationError
+	ip := checkIP(&invalid, "ip", chi.URLParam(r, "ip"))
+	return ip, invalid.Err()
+}
+
+func v2Routes(r chi.Router, s Store, ddns dnsQueue) {
+	// Children of parent_id, or the roots without it (query params:
+	// parent_id, q, sort, limit, cursor, fields)
+	r.Get("/networks", func(w http.ResponseWriter, r *http.Request) {
+		var invalid ValidationError
+		parent := queryID(&invalid, r, "parent_id")
+		if err := invalid.Err(); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		nets, err := s.Networks(parent, r.URL.Query().Get("q"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2Page(w, r, convert(nets, toV2Network), "address_range", v2NetworkColumns)
+	})
+
+	r.Get("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Network](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		n, err := s.Network(id)
+		if err != nil {
+			writeError(w, r, notFound("network", err))
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2Network(n), fields)
+	})
+
+	r.Patch("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Network](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req networkPatch
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		n, _, err := patchNetwork(s, id, req, isAdmin(r), requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2Network(n), fields)
+	})
+
+	r.Delete("/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := deleteNetwork(s, id, requestUsername(r, s)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Post("/networks/{id}/allocate-subnet", func(w http.ResponseWriter, r *http.Request) {
+		if !isCreator(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Network](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req subnetRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		n, err := allocateSubnet(s, id, req, isAdmin(r), requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusCreated, toV2Network(n), fields)
+	})
+
+	r.Get("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := s.Network(id); err != nil {
+			writeError(w, r, notFound("network", err))
+			return
+		}
+		hosts, err := s.Hosts(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2Page(w, r, convert(hosts, toV2Host), "address", v2HostColumns)
+	})
+
+	r.Post("/networks/{id}/hosts", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Host](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req v2HostCreate
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		h, err := putHost(s, ddns, id, hostRequest{Address: req.Address, Description: req.Description,
+			Hostname: req.Hostname, MAC: req.MAC}, requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusCreated, toV2Host(h), fields)
+	})
+
+	r.Post("/networks/{id}/allocate-host", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Host](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req hostAllocation
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		h, err := allocateHost(s, id, req.Description, requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusCreated, toV2Host(h), fields)
+	})
+
+	r.Get("/hosts/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip, err := pathIP(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Host](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		h, err := s.Host(ip)
+		if err != nil {
+			writeError(w, r, notFound("host", err))
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2Host(h), fields)
+	})
+
+	// Change a host's description, hostname or MAC; absent fields are kept
+	r.Patch("/hosts/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		ip, err := pathIP(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		fields, err := queryFields[v2Host](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req v2HostPatch
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		h, err := s.Host(ip)
+		if err != nil {
+			writeError(w, r, notFound("host", err))
+			return
+		}
+		desc := h.Description
+		if req.Description != nil {
+			desc = *req.Description
+		}
+		h, err = putHost(s, ddns, h.NetworkID, hostRequest{Address: ip, Description: desc,
+			Hostname: req.Hostname, MAC: req.MAC, Update: true}, requestUsername(r, s))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2Host(h), fields)
+	})
+
+	r.Delete("/hosts/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		if !isEditor(r) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		ip, err := pathIP(r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if _, err := deleteHost(s, ddns, ip, requestUsername(r, s)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Networks or hosts matching q anywhere in the tree, up to
+	// v2SearchLimit (query params: q, type=networks|hosts, sort, limit,
+	// cursor, fields)
+	r.Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			writeRequestError(w, r, invalidField("q", "required"))
+			return
+		}
+		switch r.URL.Query().Get("type") {
+		case "", "hosts":
+			hosts, err := s.SearchHosts(q, v2SearchLimit+1)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeV2Search(w, r, convert(hosts, toV2Host), "address", v2HostColumns)
+		case "networks":
+			nets, err := s.SearchNetworks(q, v2SearchLimit+1)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeV2Search(w, r, convert(nets, toV2Network), "address_range", v2NetworkColumns)
+		default:
+			writeRequestError(w, r, invalidField("type", "must be hosts or networks"))
+		}
+	})
+
+	// The change log, newest first (query params: limit, cursor, fields)
+	r.Get("/changes", func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseV2Query[v2Change](r, "-id", nil)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var before int64
+		if q.After != nil {
+			if before, err = strconv.ParseInt(q.After.Tie, 10, 64); err != nil {
+				writeRequestError(w, r, invalidField("cursor", "not a cursor from this API"))
+				return
+			}
+		}
+		changes, err := s.Changes(before, q.Limit+1)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		next := ""
+		if len(changes) > q.Limit {
+			changes = changes[:q.Limit]
+			last := changes[len(changes)-1]
+			next = v2Cursor{Sort: q.Sort, Key: idKey(last.ID), Tie: strconv.FormatInt(last.ID, 10)}.String()
+		}
+		writeV2List(w, convert(changes, toV2Change), next, q.Fields)
+	})
+
+	r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		users, err := s.Users()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2Page(w, r, convert(users, toV2User), "username", v2UserColumns)
+	})
+
+	r.Post("/users", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		fields, err := queryFields[v2User](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req userRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		u, err := createUser(s, req)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusCreated, toV2User(u), fields)
+	})
+
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if !isAdmin(r) && !isSelf(r, id) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		fields, err := queryFields[v2User](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		u, err := s.User(id)
+		if err != nil {
+			writeError(w, r, notFound("user", err))
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2User(u), fields)
+	})
+
+	r.Patch("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if !isAdmin(r) && !isSelf(r, id) {
+			apierr.Write(w, r, apierr.Forbidden, "forbidden")
+			return
+		}
+		fields, err := queryFields[v2User](r)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		var req userPatch
+		if err := decodeJSON(r, &req); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		u, err := patchUser(s, id, req, isAdmin(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2One(w, http.StatusOK, toV2User(u), fields)
+	})
+
+	r.Delete("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			apierr.Write(w, r, apierr.Forbidden, "admin required")
+			return
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if err := s.DeleteUser(id); err != nil {
+			writeError(w, r, notFound("user", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/roles", func(w http.ResponseWriter, r *http.Request) {
+		roles, err := s.Roles()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeV2Page(w, r, convert(roles, func(r Role) v2Role { return v2Role{r.ID, r.Name} }), "name", v2RoleColumns)
+	})
+}
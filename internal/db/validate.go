@@ -0,0 +1,268 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// FieldError is one rejected request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists the fields a request got wrong; it is answered as
+// INVALID with the fields as details
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Add rejects a field
+func (e *ValidationError) Add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// Err returns e if a field was rejected, otherwise nil
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func invalidField(field, format string, args ...any) error {
+	e := &ValidationError{}
+	e.Add(field, format, args...)
+	return e
+}
+
+// Path parameter that must be a positive ID
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, name), 10, 64)
+	if err != nil || id < 1 {
+		return 0, invalidField(name, "must be a positive integer")
+	}
+	return id, nil
+}
+
+// Optional network ID query parameter such as root; 0 when absent, which
+// is also accepted as meaning none
+func queryID(v *ValidationError, r *http.Request, name string) int64 {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return 0
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		v.Add(name, "must be a network ID")
+	}
+	return id
+}
+
+// Optional integer query parameter in [min, max]; def when absent
+func queryInt(v *ValidationError, r *http.Request, name string, def, min, max int) int {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		v.Add(name, "must be an integer from %d to %d", min, max)
+		return def
+	}
+	return n
+}
+
+// Optional true/false query parameter; false when absent
+func queryBool(v *ValidationError, r *http.Request, name string) bool {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.Add(name, "must be true or false")
+	}
+	return b
+}
+
+// Read a JSON object body into dst. Malformed JSON is a plain error;
+// unknown fields and values of the wrong type are rejected by name. An
+// empty body leaves dst alone, for endpoints whose fields are all optional.
+func decodeJSON(r *http.Request, dst any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err == io.EOF {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return invalidField(typeErr.Field, "must be %s", describeKind(typeErr.Type))
+	case err != nil && strings.HasPrefix(err.Error(), "json: unknown field "):
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return invalidField(name, "unknown field")
+	case err != nil:
+		return fmt.Errorf("malformed JSON body: %v", err)
+	}
+	if dec.More() {
+		return errors.New("malformed JSON body: more than one value")
+	}
+	return nil
+}
+
+// Integer body field that may be null: Set says whether it was present
+// at all, Valid whether it was an integer and Bad whether it was
+// something else. Bad is left for the handler to reject, as the decoder
+// doesn't name the field for errors from here.
+type nullInt struct {
+	Set, Valid, Bad bool
+	Int64           int64
+}
+
+func (n *nullInt) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		return nil
+	}
+	n.Valid = json.Unmarshal(b, &n.Int64) == nil
+	n.Bad = !n.Valid
+	return nil
+}
+
+func describeKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list of " + strings.TrimPrefix(describeKind(t.Elem()), "a ")
+	case reflect.Pointer:
+		return describeKind(t.Elem())
+	}
+	return "a " + t.String()
+}
+
+// Canonical form of an IP address field, or "" after rejecting it
+func checkIP(v *ValidationError, field, s string) string {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		v.Add(field, "%q is not an IP address", s)
+		return ""
+	}
+	return ip.String()
+}
+
+// Canonical form of a CIDR field, or "" after rejecting it. Host bits
+// must be zero so 10.0.0.1/24 isn't silently taken as 10.0.0.0/24.
+func checkCIDR(v *ValidationError, field, s string) string {
+	ip, n, err := net.ParseCIDR(strings.TrimSpace(s))
+	if err != nil {
+		v.Add(field, "%q is not a CIDR prefix", s)
+		return ""
+	}
+	if !ip.Equal(n.IP) {
+		v.Add(field, "%q has host bits set; the prefix is %s", s, n)
+		return ""
+	}
+	return n.String()
+}
+
+// Check a prefix length for a subnet of cidr: longer than cidr's and no
+// longer than the family allows. Returns false after rejecting it.
+func checkSubnetMask(v *ValidationError, field string, mask int, cidr string) bool {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		v.Add(field, "parent %q is not a CIDR prefix", cidr)
+		return false
+	}
+	pm, bits := n.Mask.Size()
+	if mask <= pm || mask > bits {
+		v.Add(field, "must be from %d to %d for a subnet of %s", pm+1, bits, cidr)
+		return false
+	}
+	return true
+}
+
+// Masks subnets of n may be allocated at: its valid_masks, or without
+// them the eight below its own, as the UI offers
+func allowedMasks(n Network) []int16 {
+	if len(n.ValidMasks) > 0 {
+		return n.ValidMasks
+	}
+	_, p, err := net.ParseCIDR(n.AddressRange)
+	if err != nil {
+		return nil
+	}
+	pm, bits := p.Mask.Size()
+	var out []int16
+	for m := pm + 1; m <= pm+8 && m <= bits; m++ {
+		out = append(out, int16(m))
+	}
+	return out
+}
+
+// Check a mask against the masks n allows subnets at
+func checkValidMask(v *ValidationError, field string, mask int, n Network) bool {
+	allowed := allowedMasks(n)
+	for _, m := range allowed {
+		if int(m) == mask {
+			return true
+		}
+	}
+	v.Add(field, "/%d is not a valid mask for %s (valid: %s)", mask, n.AddressRange, formatMasks(allowed))
+	return false
+}
+
+func formatMasks(masks []int16) string {
+	parts := make([]string, len(masks))
+	for i, m := range masks {
+		parts[i] = "/" + strconv.Itoa(int(m))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Reject role names the store doesn't know. The error is from the store.
+func checkRoles(v *ValidationError, s Store, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	known, err := s.Roles()
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, r := range known {
+		names[r.Name] = true
+	}
+	for _, r := range roles {
+		if !names[r] {
+			v.Add("roles", "unknown role %q", r)
+		}
+	}
+	return nil
+}
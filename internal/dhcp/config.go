@@ -0,0 +1,218 @@
+// Package dhcp exports ISC dhcpd and Kea configuration for IPAM networks
+// and reads their lease files back.
+package dhcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Pool is an inclusive dynamic address range
+type Pool struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (p Pool) String() string { return p.Start + "-" + p.End }
+
+// ParsePools reads "start-end" ranges separated by commas, checking
+// that each lies within cidr
+func ParsePools(s, cidr string) ([]Pool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	var out []Pool
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		// IPv6 addresses contain no '-', so the first one splits the range
+		a, b, ok := strings.Cut(part, "-")
+		start, end := net.ParseIP(strings.TrimSpace(a)), net.ParseIP(strings.TrimSpace(b))
+		if !ok || start == nil || end == nil {
+			return nil, fmt.Errorf("bad pool %q, want start-end", part)
+		}
+		if !n.Contains(start) || !n.Contains(end) {
+			return nil, fmt.Errorf("pool %q outside %s", part, cidr)
+		}
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, fmt.Errorf("pool %q ends before it starts", part)
+		}
+		out = append(out, Pool{Start: start.String(), End: end.String()})
+	}
+	return out, nil
+}
+
+// FormatPools is the inverse of ParsePools
+func FormatPools(pools []Pool) string {
+	parts := make([]string, len(pools))
+	for i, p := range pools {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Reservation is a static host assignment
+type Reservation struct {
+	Address  string
+	MAC      string
+	Hostname string
+}
+
+// Subnet is everything the exporters need about one leaf network
+type Subnet struct {
+	ID           int64
+	CIDR         string
+	Description  string
+	Gateway      string
+	Pools        []Pool
+	DNS          []string
+	Domain       string
+	Reservations []Reservation
+}
+
+func (s Subnet) ipv6() bool {
+	_, n, err := net.ParseCIDR(s.CIDR)
+	return err == nil && n.IP.To4() == nil
+}
+
+var hostLabelBad = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+// Name used for a host declaration: the first hostname label, or one built from the address
+func reservationName(r Reservation) string {
+	if r.Hostname != "" {
+		label, _, _ := strings.Cut(r.Hostname, ".")
+		return label
+	}
+	return "host-" + hostLabelBad.ReplaceAllString(r.Address, "-")
+}
+
+// ISC renders an ISC dhcpd subnet (or subnet6) declaration followed by
+// host declarations for the reservations
+func ISC(s Subnet) (string, error) {
+	_, n, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return "", err
+	}
+	v6 := s.ipv6()
+	var b strings.Builder
+	if s.Description != "" {
+		fmt.Fprintf(&b, "# %s\n", strings.ReplaceAll(s.Description, "\n", " "))
+	}
+	if v6 {
+		fmt.Fprintf(&b, "subnet6 %s {\n", n)
+		for _, p := range s.Pools {
+			fmt.Fprintf(&b, "\trange6 %s %s;\n", p.Start, p.End)
+		}
+		if len(s.DNS) > 0 {
+			fmt.Fprintf(&b, "\toption dhcp6.name-servers %s;\n", strings.Join(s.DNS, ", "))
+		}
+		if s.Domain != "" {
+			fmt.Fprintf(&b, "\toption dhcp6.domain-search %q;\n", s.Domain)
+		}
+	} else {
+		fmt.Fprintf(&b, "subnet %s netmask %s {\n", n.IP, net.IP(n.Mask))
+		if s.Gateway != "" {
+			fmt.Fprintf(&b, "\toption routers %s;\n", s.Gateway)
+		}
+		if len(s.DNS) > 0 {
+			fmt.Fprintf(&b, "\toption domain-name-servers %s;\n", strings.Join(s.DNS, ", "))
+		}
+		if s.Domain != "" {
+			fmt.Fprintf(&b, "\toption domain-name %q;\n", s.Domain)
+		}
+		for _, p := range s.Pools {
+			fmt.Fprintf(&b, "\trange %s %s;\n", p.Start, p.End)
+		}
+	}
+	b.WriteString("}\n")
+
+	seen := map[string]int{}
+	for _, r := range s.Reservations {
+		name := reservationName(r)
+		// dhcpd requires unique host declaration names
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		fmt.Fprintf(&b, "\nhost %s {\n\thardware ethernet %s;\n", name, r.MAC)
+		if v6 {
+			fmt.Fprintf(&b, "\tfixed-address6 %s;\n", r.Address)
+		} else {
+			fmt.Fprintf(&b, "\tfixed-address %s;\n", r.Address)
+		}
+		if r.Hostname != "" {
+			fmt.Fprintf(&b, "\toption host-name %q;\n", r.Hostname)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String(), nil
+}
+
+// Kea renders a Kea Dhcp4/Dhcp6 fragment: {"subnet4": [...]} or {"subnet6": [...]}
+func Kea(s Subnet) ([]byte, error) {
+	_, n, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	v6 := s.ipv6()
+	type option struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	}
+	pools := []map[string]string{}
+	for _, p := range s.Pools {
+		pools = append(pools, map[string]string{"pool": p.Start + " - " + p.End})
+	}
+	opts := []option{}
+	if s.Gateway != "" && !v6 {
+		opts = append(opts, option{"routers", s.Gateway})
+	}
+	if len(s.DNS) > 0 {
+		name := "domain-name-servers"
+		if v6 {
+			name = "dns-servers"
+		}
+		opts = append(opts, option{name, strings.Join(s.DNS, ", ")})
+	}
+	if s.Domain != "" {
+		name := "domain-name"
+		if v6 {
+			name = "domain-search"
+		}
+		opts = append(opts, option{name, s.Domain})
+	}
+	res := []map[string]any{}
+	for _, r := range s.Reservations {
+		e := map[string]any{"hw-address": r.MAC}
+		if v6 {
+			e["ip-addresses"] = []string{r.Address}
+		} else {
+			e["ip-address"] = r.Address
+		}
+		if r.Hostname != "" {
+			e["hostname"] = r.Hostname
+		}
+		res = append(res, e)
+	}
+	subnet := map[string]any{
+		"id":           uint32(s.ID), // network IDs are SERIAL, so they fit Kea's 32-bit IDs
+		"subnet":       n.String(),
+		"pools":        pools,
+		"option-data":  opts,
+		"reservations": res,
+	}
+	if s.Description != "" {
+		subnet["user-context"] = map[string]string{"description": s.Description}
+	}
+	key := "subnet4"
+	if v6 {
+		key = "subnet6"
+	}
+	return json.MarshalIndent(map[string]any{key: []any{subnet}}, "", "  ")
+}
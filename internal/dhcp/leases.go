@@ -0,0 +1,241 @@
+package dhcp
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is the latest state of one address in a lease file
+type Lease struct {
+	Address  string     `json:"address"`
+	MAC      string     `json:"mac,omitempty"`
+	Hostname string     `json:"hostname,omitempty"`
+	Ends     *time.Time `json:"ends,omitempty"`
+	Active   bool       `json:"active"`
+}
+
+// ParseLeases reads an ISC dhcpd.leases/dhcpd6.leases file ("isc") or a
+// Kea memfile lease CSV ("kea"). An empty format guesses from the content.
+// Later entries for an address replace earlier ones, as in the files
+// themselves; the result is sorted by address.
+func ParseLeases(r io.Reader, format string) ([]Lease, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		head, _ := br.Peek(512)
+		format = "isc"
+		if strings.HasPrefix(strings.TrimSpace(string(head)), "address,") {
+			format = "kea"
+		}
+	}
+	var leases []Lease
+	var err error
+	switch format {
+	case "isc":
+		leases, err = parseISC(br)
+	case "kea":
+		leases, err = parseKea(br)
+	default:
+		return nil, errors.New("format must be isc or kea")
+	}
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]Lease{}
+	for _, l := range leases {
+		latest[l.Address] = l
+	}
+	out := make([]Lease, 0, len(latest))
+	for _, l := range latest {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := net.ParseIP(out[i].Address), net.ParseIP(out[j].Address)
+		return string(a.To16()) < string(b.To16())
+	})
+	return out, nil
+}
+
+// Split dhcpd.leases into tokens: words, quoted strings, '{', '}' and ';'
+func iscTokens(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var toks []string
+	s := string(data)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '{' || c == '}' || c == ';':
+			toks = append(toks, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n{};\"", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return strings.Trim(s, `"`)
+}
+
+// dhcpd writes times as "<weekday> YYYY/MM/DD HH:MM:SS" in UTC,
+// "epoch <seconds>" (db-time-format local) or "never"
+func iscTime(stmt []string) *time.Time {
+	if len(stmt) == 3 && stmt[1] == "epoch" {
+		if sec, err := strconv.ParseInt(stmt[2], 10, 64); err == nil {
+			t := time.Unix(sec, 0).UTC()
+			return &t
+		}
+	}
+	if len(stmt) >= 4 {
+		if t, err := time.Parse("2006/01/02 15:04:05", stmt[2]+" "+stmt[3]); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func parseISC(r io.Reader) ([]Lease, error) {
+	toks, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var out []Lease
+	var stack []*Lease // open lease/iaaddr blocks (nil for others)
+	var stmt []string
+	for _, t := range toks {
+		switch t {
+		case "{":
+			var l *Lease
+			if len(stmt) == 2 && (stmt[0] == "lease" || stmt[0] == "iaaddr") {
+				if ip := net.ParseIP(stmt[1]); ip != nil {
+					l = &Lease{Address: ip.String(), Active: true}
+				}
+			}
+			stack = append(stack, l)
+			stmt = nil
+		case "}":
+			if len(stack) == 0 {
+				return nil, errors.New("unbalanced '}'")
+			}
+			if l := stack[len(stack)-1]; l != nil {
+				out = append(out, *l)
+			}
+			stack = stack[:len(stack)-1]
+			stmt = nil
+		case ";":
+			var l *Lease
+			if len(stack) > 0 {
+				l = stack[len(stack)-1]
+			}
+			if l != nil && len(stmt) > 0 {
+				switch {
+				case stmt[0] == "ends":
+					l.Ends = iscTime(stmt)
+				case stmt[0] == "binding" && len(stmt) == 3 && stmt[1] == "state":
+					l.Active = stmt[2] == "active"
+				case stmt[0] == "hardware" && len(stmt) == 3:
+					if hw, err := net.ParseMAC(stmt[2]); err == nil {
+						l.MAC = hw.String()
+					}
+				case stmt[0] == "client-hostname" && len(stmt) == 2:
+					l.Hostname = unquote(stmt[1])
+				}
+			}
+			stmt = nil
+		default:
+			stmt = append(stmt, t)
+		}
+	}
+	if len(stack) != 0 {
+		return nil, errors.New("unterminated block")
+	}
+	return out, nil
+}
+
+// Kea memfile CSV; columns are found by header name so both the
+// DHCPv4 and DHCPv6 layouts work
+func parseKea(r io.Reader) ([]Lease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	if _, ok := col["address"]; !ok {
+		return nil, errors.New("kea csv: no address column")
+	}
+	get := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	var out []Lease
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(get(rec, "address"))
+		if ip == nil {
+			return nil, fmt.Errorf("kea csv line %d: bad address", line)
+		}
+		l := Lease{Address: ip.String(), Hostname: strings.TrimSuffix(get(rec, "hostname"), ".")}
+		if hw, err := net.ParseMAC(get(rec, "hwaddr")); err == nil {
+			l.MAC = hw.String()
+		}
+		if exp, err := strconv.ParseInt(get(rec, "expire"), 10, 64); err == nil && exp > 0 {
+			t := time.Unix(exp, 0).UTC()
+			l.Ends = &t
+		}
+		// state 0 is default (leased); 1 declined, 2 expired-reclaimed
+		l.Active = get(rec, "state") == "" || get(rec, "state") == "0"
+		out = append(out, l)
+	}
+	return out, nil
+}
@@ -0,0 +1,108 @@
+package dhcp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(t time.Time) *time.Time { return &t }
+
+var (
+	tenTo8pm = at(time.Date(2024, 1, 10, 20, 0, 0, 0, time.UTC))
+	tenTo9pm = at(time.Date(2024, 1, 10, 21, 0, 0, 0, time.UTC))
+)
+
+func TestParseLeases(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string
+		want   []Lease
+	}{
+		{
+			file: "dhcpd.leases",
+			want: []Lease{
+				{Address: "10.0.0.9", Active: false},
+				{Address: "10.0.0.100", MAC: "00:11:22:33:44:77", Hostname: "laptop-2", Active: true},
+				{Address: "10.0.0.101", MAC: "00:11:22:33:44:66", Ends: tenTo8pm, Active: false},
+			},
+		},
+		{
+			file:   "dhcpd6.leases",
+			format: "isc",
+			want: []Lease{
+				{Address: "2001:db8::1:100", Ends: tenTo8pm, Active: true},
+				{Address: "2001:db8::1:101", Ends: tenTo8pm, Active: false},
+			},
+		},
+		{
+			file: "kea-leases4.csv",
+			want: []Lease{
+				{Address: "10.0.0.100", MAC: "00:11:22:33:44:77", Hostname: "laptop", Ends: tenTo9pm, Active: true},
+				{Address: "10.0.0.101", MAC: "00:11:22:33:44:66", Ends: tenTo8pm, Active: false},
+				{Address: "10.0.0.102", Active: false},
+			},
+		},
+		{
+			file:   "kea-leases6.csv",
+			format: "kea",
+			want: []Lease{
+				{Address: "2001:db8::1:100", MAC: "52:54:00:12:34:56", Hostname: "host6.example.com", Ends: tenTo8pm, Active: true},
+				{Address: "2001:db8::1:101", Ends: tenTo8pm, Active: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := ParseLeases(f, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %s\nwant %s", leaseList(got), leaseList(tt.want))
+			}
+		})
+	}
+}
+
+func leaseList(leases []Lease) string {
+	var parts []string
+	for _, l := range leases {
+		s := l.Address + " " + l.MAC + " " + l.Hostname
+		if l.Ends != nil {
+			s += " " + l.Ends.Format(time.RFC3339)
+		}
+		if l.Active {
+			s += " active"
+		}
+		parts = append(parts, "{"+s+"}")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseLeasesErrors(t *testing.T) {
+	tests := []struct {
+		in, format, err string
+	}{
+		{in: "lease 10.0.0.1 {\n  binding state active;\n", err: "unterminated block"},
+		{in: "}\n", err: "unbalanced '}'"},
+		{in: "lease 10.0.0.1 {\n  client-hostname \"laptop;\n}\n", err: "unterminated string"},
+		{in: "ip,mac\n10.0.0.1,00:11:22:33:44:55\n", format: "kea", err: "kea csv: no address column"},
+		{in: "address,hwaddr\n10.0.0.1,\nnot-an-address,\n", err: "kea csv line 3: bad address"},
+		{in: "", format: "xml", err: "format must be isc or kea"},
+	}
+	for _, tt := range tests {
+		_, err := ParseLeases(strings.NewReader(tt.in), tt.format)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %q", tt.in, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package discovery sweeps networks for addresses that answer.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultPorts are the TCP ports tried when none are configured
+var DefaultPorts = []int{22, 80, 443, 23}
+
+// Options control a sweep
+type Options struct {
+	Ports       []int         // TCP ports to try on each address
+	Concurrency int           // addresses probed at once
+	Timeout     time.Duration // per dial
+}
+
+func (o Options) withDefaults() Options {
+	if len(o.Ports) == 0 {
+		o.Ports = DefaultPorts
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 64
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	return o
+}
+
+// Result is the outcome for one address. Ports lists the ports that
+// accepted a connection; an address that only refused is still Alive.
+type Result struct {
+	Address string `json:"address"`
+	Alive   bool   `json:"alive"`
+	Ports   []int  `json:"ports"`
+}
+
+// Probe dials every port on one address in parallel
+func Probe(ctx context.Context, addr string, opts Options) Result {
+	opts = opts.withDefaults()
+	res := Result{Address: addr, Ports: []int{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	d := net.Dialer{Timeout: opts.Timeout}
+	for _, port := range opts.Ports {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				conn.Close()
+				res.Alive = true
+				res.Ports = append(res.Ports, port)
+			case errors.Is(err, syscall.ECONNREFUSED):
+				// a RST means something is there
+				res.Alive = true
+			}
+		}(port)
+	}
+	wg.Wait()
+	sort.Ints(res.Ports)
+	return res
+}
+
+// Sweep probes addrs with at most opts.Concurrency addresses in flight
+// and calls fn with each result as it completes. fn is not called
+// concurrently. It stops early if ctx is cancelled.
+func Sweep(ctx context.Context, addrs []string, opts Options, fn func(Result)) {
+	opts = opts.withDefaults()
+	jobs := make(chan string)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency && i < len(addrs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				results <- Probe(ctx, a, opts)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, a := range addrs {
+			select {
+			case jobs <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for r := range results {
+		fn(r)
+	}
+}
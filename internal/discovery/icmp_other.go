@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package discovery
+
+import (
+	"context"
+	"net"
+)
+
+// Other systems need raw sockets, and so root, for ICMP
+func ping(ctx context.Context, ip net.IP) (string, error) {
+	return "", ErrUnsupported
+}
@@ -0,0 +1,94 @@
+//go:build linux || darwin
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// ping sends one echo request from a SOCK_DGRAM ICMP socket. The kernel
+// picks the identifier, so replies are matched on source and sequence.
+func ping(ctx context.Context, ip net.IP) (string, error) {
+	family, proto, echo, reply := syscall.AF_INET, syscall.IPPROTO_ICMP, byte(8), byte(0)
+	if ip.To4() == nil {
+		family, proto, echo, reply = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, 128, 129
+	} else {
+		ip = ip.To4()
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+			return "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	seq := uint16(time.Now().UnixNano())
+	msg := []byte{echo, 0, 0, 0, 0, 0, byte(seq >> 8), byte(seq), 'p', 'i', 'e', 'n', 'g'}
+	if family == syscall.AF_INET {
+		// ICMPv6 checksums are filled in by the kernel
+		sum := checksum(msg)
+		msg[2], msg[3] = byte(sum>>8), byte(sum)
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, &net.UDPAddr{IP: ip}); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ErrNoAnswer
+			}
+			return "", err
+		}
+		b := buf[:n]
+		// macOS hands IPv4 replies over with the IP header
+		if runtime.GOOS == "darwin" && family == syscall.AF_INET && n >= 20 && b[0]>>4 == 4 {
+			b = b[int(b[0]&0x0f)*4:]
+		}
+		if len(b) < 8 || b[0] != reply || uint16(b[6])<<8|uint16(b[7]) != seq {
+			continue
+		}
+		if ua, ok := from.(*net.UDPAddr); ok && !ua.IP.Equal(ip) {
+			continue
+		}
+		return fmt.Sprintf("echo reply in %s", time.Since(start).Round(time.Microsecond)), nil
+	}
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,60 @@
+//go:build darwin || netbsd || openbsd
+
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// neighbor walks the routing table's link-layer entries, as arp(8) and
+// ndp(8) do, and looks for a resolved entry for ip
+func neighbor(ip net.IP) (string, error) {
+	family := syscall.AF_INET
+	if ip.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.RouteRIB(syscall.NET_RT_FLAGS, syscall.RTF_LLINFO)
+	if err != nil {
+		return "", err
+	}
+	msgs, err := syscall.ParseRoutingMessage(rib)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range msgs {
+		rm, ok := m.(*syscall.RouteMessage)
+		if !ok {
+			continue
+		}
+		addrs, err := syscall.ParseRoutingSockaddr(rm)
+		if err != nil || len(addrs) < 2 {
+			continue
+		}
+		var dst net.IP
+		switch sa := addrs[0].(type) {
+		case *syscall.SockaddrInet4:
+			if family == syscall.AF_INET {
+				dst = net.IP(sa.Addr[:])
+			}
+		case *syscall.SockaddrInet6:
+			if family == syscall.AF_INET6 {
+				dst = net.IP(sa.Addr[:])
+			}
+		}
+		dl, ok := addrs[1].(*syscall.SockaddrDatalink)
+		if !dst.Equal(ip) || !ok || dl.Alen == 0 {
+			continue
+		}
+		off := int(dl.Nlen)
+		if off+int(dl.Alen) > len(dl.Data) {
+			continue
+		}
+		lladdr := make(net.HardwareAddr, dl.Alen)
+		for i := range lladdr {
+			lladdr[i] = byte(dl.Data[off+i])
+		}
+		return lladdr.String(), nil
+	}
+	return "", ErrNoAnswer
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Neighbor states from linux/neighbour.h
+const (
+	nudIncomplete = 0x01
+	nudReachable  = 0x02
+	nudStale      = 0x04
+	nudDelay      = 0x08
+	nudProbe      = 0x10
+	nudFailed     = 0x20
+	nudPermanent  = 0x80
+
+	ndaDst    = 1
+	ndaLladdr = 2
+)
+
+var nudNames = map[uint16]string{nudReachable: "reachable", nudStale: "stale", nudDelay: "delay", nudProbe: "probe", nudPermanent: "permanent"}
+
+// neighbor dumps the neighbor table over rtnetlink and looks for a
+// resolved entry for ip
+func neighbor(ip net.IP) (string, error) {
+	family := syscall.AF_INET
+	if ip.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return "", err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < 12 {
+			continue
+		}
+		// struct ndmsg: family, pad, pad, ifindex, state, flags, type
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if state&(nudIncomplete|nudFailed) != 0 || nudNames[state] == "" {
+			continue
+		}
+		var dst net.IP
+		var lladdr net.HardwareAddr
+		for b := m.Data[12:]; len(b) >= 4; {
+			l := int(binary.NativeEndian.Uint16(b[0:2]))
+			if l < 4 || l > len(b) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(b[2:4]) {
+			case ndaDst:
+				dst = net.IP(b[4:l])
+			case ndaLladdr:
+				lladdr = net.HardwareAddr(b[4:l])
+			}
+			l = (l + 3) &^ 3
+			if l > len(b) {
+				break
+			}
+			b = b[l:]
+		}
+		if dst.Equal(ip) && len(lladdr) > 0 {
+			return fmt.Sprintf("%s %s", lladdr, nudNames[state]), nil
+		}
+	}
+	return "", ErrNoAnswer
+}
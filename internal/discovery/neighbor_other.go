@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !netbsd && !openbsd
+
+package discovery
+
+import "net"
+
+func neighbor(ip net.IP) (string, error) {
+	return "", ErrUnsupported
+}
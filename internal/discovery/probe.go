@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNoAnswer is returned by a Prober when the address did not answer
+var ErrNoAnswer = errors.New("no answer")
+
+// ErrUnsupported is returned by a Prober that cannot run on this system
+var ErrUnsupported = errors.New("not supported on this system")
+
+// Prober tests whether one address is alive. Probe returns a short
+// description of the answer, ErrNoAnswer, or another error if the probe
+// itself failed.
+type Prober interface {
+	Name() string
+	Probe(ctx context.Context, ip net.IP) (string, error)
+}
+
+// TCPProber dials every port in parallel; a connection that is accepted
+// or refused counts as an answer
+type TCPProber struct {
+	Ports   []int
+	Timeout time.Duration
+}
+
+func (p TCPProber) Name() string { return "tcp" }
+
+func (p TCPProber) Probe(ctx context.Context, ip net.IP) (string, error) {
+	ports := p.Ports
+	if len(ports) == 0 {
+		ports = DefaultPorts
+	}
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout))
+	defer cancel()
+	answers := make(chan string, len(ports))
+	d := net.Dialer{}
+	for _, port := range ports {
+		go func(port int) {
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			switch {
+			case err == nil:
+				conn.Close()
+				answers <- fmt.Sprintf("port %d open", port)
+			case errors.Is(err, syscall.ECONNREFUSED):
+				answers <- fmt.Sprintf("port %d refused", port)
+			default:
+				answers <- ""
+			}
+		}(port)
+	}
+	for range ports {
+		if a := <-answers; a != "" {
+			return a, nil
+		}
+	}
+	return "", ErrNoAnswer
+}
+
+// ICMPProber sends one echo request through an unprivileged datagram
+// socket, which Linux allows for groups in net.ipv4.ping_group_range and
+// macOS allows for everyone
+type ICMPProber struct {
+	Timeout time.Duration
+}
+
+func (p ICMPProber) Name() string { return "icmp" }
+
+func (p ICMPProber) Probe(ctx context.Context, ip net.IP) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout))
+	defer cancel()
+	return ping(ctx, ip)
+}
+
+// NeighborProber looks the address up in the kernel's ARP/NDP table, which
+// only knows about addresses on directly attached networks
+type NeighborProber struct{}
+
+func (NeighborProber) Name() string { return "neighbor" }
+
+func (NeighborProber) Probe(ctx context.Context, ip net.IP) (string, error) {
+	return neighbor(ip)
+}
+
+func orDefault(d time.Duration) time.Duration {
+	if d <= 0 {
+		return time.Second
+	}
+	return d
+}
+
+// ProberNames are the probes NewProbers knows, in the default order
+var ProberNames = []string{"neighbor", "icmp", "tcp"}
+
+// NewProbers builds probers from a comma-separated list of names
+func NewProbers(names string, ports []int, timeout time.Duration) ([]Prober, error) {
+	var out []Prober
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "tcp":
+			out = append(out, TCPProber{Ports: ports, Timeout: timeout})
+		case "icmp":
+			out = append(out, ICMPProber{Timeout: timeout})
+		case "neighbor", "arp", "ndp":
+			out = append(out, NeighborProber{})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown probe %q", name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no probes configured")
+	}
+	return out, nil
+}
+
+// CheckResult is the outcome of Check. Probe and Detail name the first
+// probe that got an answer; Errors has the probes that failed to run.
+type CheckResult struct {
+	Address string            `json:"ip"`
+	Alive   bool              `json:"responds"`
+	Probe   string            `json:"probe,omitempty"`
+	Detail  string            `json:"detail,omitempty"`
+	Latency float64           `json:"latency_ms,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// Check runs every prober in parallel and returns as soon as one answers
+func Check(ctx context.Context, ip net.IP, probers []Prober) CheckResult {
+	res := CheckResult{Address: ip.String()}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type answer struct {
+		name, detail string
+		latency      time.Duration
+		err          error
+	}
+	answers := make(chan answer, len(probers))
+	start := time.Now()
+	for _, p := range probers {
+		go func(p Prober) {
+			detail, err := p.Probe(ctx, ip)
+			answers <- answer{p.Name(), detail, time.Since(start), err}
+		}(p)
+	}
+	for range probers {
+		a := <-answers
+		switch {
+		case a.err == nil:
+			res.Alive = true
+			res.Probe = a.name
+			res.Detail = a.detail
+			res.Latency = float64(a.latency.Microseconds()) / 1000
+			res.Errors = nil
+			return res
+		case !errors.Is(a.err, ErrNoAnswer):
+			if res.Errors == nil {
+				res.Errors = map[string]string{}
+			}
+			res.Errors[a.name] = a.err.Error()
+		}
+	}
+	return res
+}
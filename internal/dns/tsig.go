@@ -0,0 +1,177 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Key is a TSIG (RFC 8945) shared secret
+type Key struct {
+	Name      string // key name as configured on the server
+	Algorithm string // hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512
+	Secret    []byte
+}
+
+// ParseKey builds a key from its base64 secret as found in named.conf
+func ParseKey(name, algorithm, secret string) (*Key, error) {
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("tsig secret: %w", err)
+	}
+	k := &Key{Name: name, Algorithm: strings.ToLower(algorithm), Secret: raw}
+	if _, _, err := k.alg(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *Key) alg() (string, func() hash.Hash, error) {
+	switch strings.TrimSuffix(k.Algorithm, ".") {
+	case "hmac-md5", "hmac-md5.sig-alg.reg.int":
+		return "hmac-md5.sig-alg.reg.int.", md5.New, nil
+	case "hmac-sha1":
+		return "hmac-sha1.", sha1.New, nil
+	case "", "hmac-sha256":
+		return "hmac-sha256.", sha256.New, nil
+	case "hmac-sha512":
+		return "hmac-sha512.", sha512.New, nil
+	}
+	return "", nil, fmt.Errorf("unsupported tsig algorithm %q", k.Algorithm)
+}
+
+const tsigFudge = 300
+
+// TSIG variables covered by the MAC (RFC 8945 section 4.3.3)
+func tsigVariables(keyName, algName string, signed uint64, fudge, rcode uint16, other []byte) ([]byte, error) {
+	b, err := appendName(nil, strings.ToLower(keyName))
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, ClassANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	if b, err = appendName(b, algName); err != nil {
+		return nil, err
+	}
+	b = appendTime48(b, signed)
+	b = binary.BigEndian.AppendUint16(b, fudge)
+	b = binary.BigEndian.AppendUint16(b, rcode)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(other)))
+	return append(b, other...), nil
+}
+
+func appendTime48(b []byte, t uint64) []byte {
+	return append(b, byte(t>>40), byte(t>>32), byte(t>>24), byte(t>>16), byte(t>>8), byte(t))
+}
+
+// sign appends a TSIG record to a complete message and returns the
+// signed message and its MAC (needed to verify the response)
+func (k *Key) sign(msg []byte, now time.Time) ([]byte, []byte, error) {
+	algName, h, err := k.alg()
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := uint64(now.Unix())
+	vars, err := tsigVariables(k.Name, algName, signed, tsigFudge, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(h, k.Secret)
+	mac.Write(msg)
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata, _ := appendName(nil, algName)
+	rdata = appendTime48(rdata, signed)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0], msg[1]) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	out := append([]byte(nil), msg...)
+	out, err = appendRR(out, RR{Name: k.Name, Type: TypeTSIG, Class: ClassANY, Data: rdata})
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, sum, nil
+}
+
+// verify checks the TSIG on a response to a request signed with reqMAC
+func (k *Key) verify(resp []byte, m message, reqMAC []byte, now time.Time) error {
+	if m.tsigOffset == 0 {
+		return errors.New("response is not signed")
+	}
+	rr := m.Additional[len(m.Additional)-1]
+	if !strings.EqualFold(strings.TrimSuffix(rr.Name, "."), strings.TrimSuffix(k.Name, ".")) {
+		return fmt.Errorf("response signed with unknown key %q", rr.Name)
+	}
+	algName, h, err := k.alg()
+	if err != nil {
+		return err
+	}
+	d := rr.Data
+	alg, off, err := readName(d, 0)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(alg, algName) {
+		return fmt.Errorf("response signed with %s", alg)
+	}
+	if off+10 > len(d) {
+		return errShort
+	}
+	signed := uint64(d[off])<<40 | uint64(d[off+1])<<32 | uint64(binary.BigEndian.Uint32(d[off+2:]))
+	fudge := binary.BigEndian.Uint16(d[off+6:])
+	macLen := int(binary.BigEndian.Uint16(d[off+8:]))
+	off += 10
+	if off+macLen+6 > len(d) {
+		return errShort
+	}
+	gotMAC := d[off : off+macLen]
+	off += macLen
+	origID := d[off : off+2]
+	rcode := binary.BigEndian.Uint16(d[off+2:])
+	otherLen := int(binary.BigEndian.Uint16(d[off+4:]))
+	if off+6+otherLen > len(d) {
+		return errShort
+	}
+	other := d[off+6 : off+6+otherLen]
+	if rcode != 0 {
+		return RcodeError(rcode)
+	}
+
+	// MAC covers the request MAC, the response without its TSIG record
+	// (original ID, ARCOUNT less one) and the TSIG variables
+	stripped := append([]byte(nil), resp[:m.tsigOffset]...)
+	copy(stripped[0:2], origID)
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(stripped[10:])-1)
+	vars, err := tsigVariables(k.Name, algName, signed, fudge, rcode, other)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(h, k.Secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC))))
+	mac.Write(reqMAC)
+	mac.Write(stripped)
+	mac.Write(vars)
+	if !hmac.Equal(mac.Sum(nil), gotMAC) {
+		return errors.New("response tsig does not verify")
+	}
+	skew := int64(now.Unix()) - int64(signed)
+	if skew < -int64(fudge) || skew > int64(fudge) {
+		return errors.New("response tsig time outside fudge")
+	}
+	return nil
+}
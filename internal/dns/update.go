@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Dynamic updates (RFC 2136). Each call sends one UPDATE message for a
+// single zone, signed with TSIG when a key is given.
+
+// AddRR adds a record to an RRset
+func AddRR(name string, typ uint16, ttl uint32, data []byte) RR {
+	return RR{Name: name, Type: typ, Class: ClassIN, TTL: ttl, Data: data}
+}
+
+// DeleteRRset removes every record of a type at a name
+func DeleteRRset(name string, typ uint16) RR {
+	return RR{Name: name, Type: typ, Class: ClassANY}
+}
+
+// DeleteRR removes one record from an RRset
+func DeleteRR(name string, typ uint16, data []byte) RR {
+	return RR{Name: name, Type: typ, Class: ClassNONE, Data: data}
+}
+
+// Client sends updates and zone lookups to an authoritative server
+type Client struct {
+	Timeout time.Duration
+}
+
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// Build a message with one question/zone entry and the given records
+// in the update (authority) section
+func buildMessage(id, flags uint16, zone string, qtype uint16, updates []RR) ([]byte, error) {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[8:], uint16(len(updates)))
+	b, err := appendName(b, zone)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, ClassIN)
+	for _, rr := range updates {
+		if b, err = appendRR(b, rr); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add the default DNS port if the server has none
+func serverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
+
+// exchange sends a message over UDP, retrying over TCP if truncated
+func (c *Client) exchange(ctx context.Context, server string, msg []byte) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	var d net.Dialer
+	addr := serverAddr(server)
+
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || buf[0] != msg[0] || buf[1] != msg[1] {
+			continue // not our answer
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break // truncated
+	}
+
+	tc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	tc.SetDeadline(deadline)
+	if _, err := tc.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	var lb [2]byte
+	if _, err := io.ReadFull(tc, lb[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lb[:]))
+	if _, err := io.ReadFull(tc, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Update sends the records as one UPDATE for zone
+func (c *Client) Update(ctx context.Context, server, zone string, updates []RR, key *Key) error {
+	id := newID()
+	msg, err := buildMessage(id, 5<<11, zone, TypeSOA, updates)
+	if err != nil {
+		return err
+	}
+	var reqMAC []byte
+	if key != nil {
+		if msg, reqMAC, err = key.sign(msg, time.Now()); err != nil {
+			return err
+		}
+	}
+	resp, err := c.exchange(ctx, server, msg)
+	if err != nil {
+		return err
+	}
+	m, err := parseMessage(resp)
+	if err != nil {
+		return err
+	}
+	if m.ID != id {
+		return errors.New("response id mismatch")
+	}
+	if key != nil && m.tsigOffset != 0 {
+		if err := key.verify(resp, m, reqMAC, time.Now()); err != nil {
+			return err
+		}
+	}
+	if m.rcode() != 0 {
+		return RcodeError(m.rcode())
+	}
+	if key != nil && m.tsigOffset == 0 {
+		return errors.New("response is not signed")
+	}
+	return nil
+}
+
+// FindZone asks the server which zone holds name by querying its SOA;
+// the owner of the SOA in the answer or authority section is the apex
+func (c *Client) FindZone(ctx context.Context, server, name string) (string, error) {
+	id := newID()
+	msg, err := buildMessage(id, 0, Fqdn(name), TypeSOA, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.exchange(ctx, server, msg)
+	if err != nil {
+		return "", err
+	}
+	m, err := parseMessage(resp)
+	if err != nil {
+		return "", err
+	}
+	if m.rcode() != 0 && m.rcode() != 3 {
+		return "", RcodeError(m.rcode())
+	}
+	for _, sec := range [][]RR{m.Answer, m.Authority} {
+		for _, rr := range sec {
+			if rr.Type == TypeSOA {
+				return strings.ToLower(rr.Name), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: no SOA for %s", server, name)
+}
@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test key: base64 of "secret-key-for-testing"
+const testSecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+
+// An UPDATE adding host.example.com. A 192.0.2.1 to example.com., ID 0x1234
+const testUpdate = "123428000001000000010000" + // header: opcode UPDATE, ZOCOUNT 1, UPCOUNT 1
+	"076578616d706c6503636f6d0000060001" + // zone example.com. SOA IN
+	"04686f7374076578616d706c6503636f6d000001000100000e100004c0000201" // host.example.com. A IN 3600 192.0.2.1
+
+// HMAC-SHA256 of testUpdate and the RFC 8945 section 4.3.3 variables for
+// key update-key., time 1700000000, fudge 300, computed independently
+const testMAC = "3eeb52b1ff705e9523e313e780520707034886103b5f4cfbc78967b82860ee27"
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	k, err := ParseKey("update-key", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestBuildMessage(t *testing.T) {
+	rr := AddRR("host.example.com.", TypeA, 3600, net.ParseIP("192.0.2.1").To4())
+	msg, err := buildMessage(0x1234, 5<<11, "example.com.", TypeSOA, []RR{rr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(msg); got != testUpdate {
+		t.Errorf("message\n got %s\nwant %s", got, testUpdate)
+	}
+}
+
+func TestSign(t *testing.T) {
+	msg, _ := hex.DecodeString(testUpdate)
+	signed, mac, err := testKey(t).sign(msg, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(mac); got != testMAC {
+		t.Errorf("mac\n got %s\nwant %s", got, testMAC)
+	}
+	if !bytes.Equal(signed[12:len(msg)], msg[12:]) {
+		t.Error("signing changed the message body")
+	}
+	m, err := parseMessage(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Additional) != 1 || m.tsigOffset != len(msg) {
+		t.Fatalf("additional %d, tsig at %d", len(m.Additional), m.tsigOffset)
+	}
+	tsig := m.Additional[0]
+	if tsig.Name != "update-key." || tsig.Type != TypeTSIG || tsig.Class != ClassANY {
+		t.Errorf("tsig record %s %d %d", tsig.Name, tsig.Type, tsig.Class)
+	}
+	if !bytes.Contains(tsig.Data, mac) {
+		t.Error("tsig record does not carry the mac")
+	}
+}
+
+// updateServer answers UPDATEs on a local UDP port, checking their TSIG.
+// Responses carry rcode, or an unsigned BADSIG when tsigError is set.
+type updateServer struct {
+	conn      net.PacketConn
+	key       *Key
+	rcode     int
+	tsigError uint16
+	requests  chan message
+}
+
+func startUpdateServer(t *testing.T, key *Key, rcode int, tsigError uint16) *updateServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &updateServer{conn: conn, key: key, rcode: rcode, tsigError: tsigError, requests: make(chan message, 8)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve(t)
+	return s
+}
+
+func (s *updateServer) serve(t *testing.T) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		m, err := parseMessage(req)
+		if err != nil {
+			t.Errorf("server: %v", err)
+			continue
+		}
+		reqMAC, err := s.checkRequest(req, m)
+		if err != nil {
+			t.Errorf("server: %v", err)
+		}
+		s.requests <- m
+		s.conn.WriteTo(s.response(req, m, reqMAC), from)
+	}
+}
+
+// The MAC of a signed request, after checking it
+func (s *updateServer) checkRequest(req []byte, m message) ([]byte, error) {
+	if m.tsigOffset == 0 {
+		return nil, errors.New("request is not signed")
+	}
+	d := m.Additional[len(m.Additional)-1].Data
+	_, off, err := readName(d, 0)
+	if err != nil {
+		return nil, err
+	}
+	signed := uint64(d[off])<<40 | uint64(d[off+1])<<32 | uint64(binary.BigEndian.Uint32(d[off+2:]))
+	macLen := int(binary.BigEndian.Uint16(d[off+8:]))
+	got := d[off+10 : off+10+macLen]
+
+	unsigned := append([]byte(nil), req[:m.tsigOffset]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+	vars, err := tsigVariables(s.key.Name, "hmac-sha256.", signed, tsigFudge, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, s.key.Secret)
+	mac.Write(unsigned)
+	mac.Write(vars)
+	if !hmac.Equal(mac.Sum(nil), got) {
+		return nil, errors.New("request tsig does not verify")
+	}
+	return got, nil
+}
+
+// A response echoing the zone section, signed over the request MAC
+func (s *updateServer) response(req []byte, m message, reqMAC []byte) []byte {
+	_, qend, _ := readName(req, 12)
+	resp := append([]byte(nil), req[:qend+4]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x8000|5<<11|uint16(s.rcode))
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+
+	now := uint64(time.Now().Unix())
+	var sum []byte
+	if s.tsigError == 0 {
+		vars, _ := tsigVariables(s.key.Name, "hmac-sha256.", now, tsigFudge, 0, nil)
+		mac := hmac.New(sha256.New, s.key.Secret)
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC))))
+		mac.Write(reqMAC)
+		mac.Write(resp)
+		mac.Write(vars)
+		sum = mac.Sum(nil)
+	}
+	rdata, _ := appendName(nil, "hmac-sha256.")
+	rdata = appendTime48(rdata, now)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, req[0], req[1])
+	rdata = binary.BigEndian.AppendUint16(rdata, s.tsigError)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	resp, _ = appendRR(resp, RR{Name: s.key.Name, Type: TypeTSIG, Class: ClassANY, Data: rdata})
+	binary.BigEndian.PutUint16(resp[10:], 1)
+	return resp
+}
+
+func TestUpdate(t *testing.T) {
+	key := testKey(t)
+	data, _ := DomainData("host.example.com.")
+	updates := []RR{
+		DeleteRRset("1.2.0.192.in-addr.arpa.", TypePTR),
+		AddRR("1.2.0.192.in-addr.arpa.", TypePTR, 3600, data),
+	}
+	tests := []struct {
+		name      string
+		rcode     int
+		tsigError uint16
+		want      error
+	}{
+		{"noerror", 0, 0, nil},
+		{"refused", 5, 0, RcodeError(5)},
+		{"badsig", 9, 16, RcodeError(16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startUpdateServer(t, key, tt.rcode, tt.tsigError)
+			c := &Client{Timeout: 2 * time.Second}
+			err := c.Update(context.Background(), s.conn.LocalAddr().String(), "2.0.192.in-addr.arpa.", updates, key)
+			if tt.want == nil && err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if tt.want != nil {
+				var rc RcodeError
+				if !errors.As(err, &rc) || rc != tt.want {
+					t.Fatalf("update: %v, want %v", err, tt.want)
+				}
+			}
+
+			m := <-s.requests
+			if op := m.Flags >> 11 & 0xf; op != 5 {
+				t.Errorf("opcode %d", op)
+			}
+			if len(m.Answer) != 0 || len(m.Authority) != 2 {
+				t.Fatalf("prerequisites %d, updates %d", len(m.Answer), len(m.Authority))
+			}
+			del, add := m.Authority[0], m.Authority[1]
+			if del.Name != "1.2.0.192.in-addr.arpa." || del.Type != TypePTR || del.Class != ClassANY || len(del.Data) != 0 {
+				t.Errorf("delete %+v", del)
+			}
+			if add.Type != TypePTR || add.Class != ClassIN || add.TTL != 3600 || !bytes.Equal(add.Data, data) {
+				t.Errorf("add %+v", add)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource record types and classes used by dynamic updates
+const (
+	TypeA    uint16 = 1
+	TypeSOA  uint16 = 6
+	TypePTR  uint16 = 12
+	TypeAAAA uint16 = 28
+	TypeTSIG uint16 = 250
+	TypeANY  uint16 = 255
+
+	ClassIN   uint16 = 1
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Response codes (RFC 1035, RFC 2136, RFC 8945)
+var rcodeNames = map[int]string{
+	0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP",
+	5: "REFUSED", 6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH",
+	10: "NOTZONE", 16: "BADSIG", 17: "BADKEY", 18: "BADTIME",
+}
+
+// RcodeError is a non-zero response code from a server
+type RcodeError int
+
+func (e RcodeError) Error() string {
+	if name, ok := rcodeNames[int(e)]; ok {
+		return "server returned " + name
+	}
+	return fmt.Sprintf("server returned rcode %d", int(e))
+}
+
+// RR is a wire resource record with raw RDATA
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// AddressData returns the record type and RDATA for an address
+func AddressData(ip net.IP) (uint16, []byte) {
+	if v4 := ip.To4(); v4 != nil {
+		return TypeA, []byte(v4)
+	}
+	return TypeAAAA, []byte(ip.To16())
+}
+
+// DomainData returns the RDATA for a record holding a domain name (PTR, NS, CNAME)
+func DomainData(name string) ([]byte, error) {
+	return appendName(nil, name)
+}
+
+// Append a domain name in uncompressed wire format
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("bad label in %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendRR(b []byte, rr RR) ([]byte, error) {
+	b, err := appendName(b, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, rr.Type)
+	b = binary.BigEndian.AppendUint16(b, rr.Class)
+	b = binary.BigEndian.AppendUint32(b, rr.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...), nil
+}
+
+var errShort = errors.New("short message")
+
+// Read a possibly compressed name starting at off; returns the name
+// and the offset just past it in the original position
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return "", 0, errShort
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// message is a parsed DNS message
+type message struct {
+	ID         uint16
+	Flags      uint16
+	Answer     []RR
+	Authority  []RR
+	Additional []RR
+	tsigOffset int // start of a trailing TSIG record, or 0
+}
+
+func (m message) rcode() int { return int(m.Flags & 0xf) }
+
+func parseMessage(msg []byte) (message, error) {
+	var m message
+	if len(msg) < 12 {
+		return m, errShort
+	}
+	m.ID = binary.BigEndian.Uint16(msg[0:])
+	m.Flags = binary.BigEndian.Uint16(msg[2:])
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return m, err
+		}
+		off = next + 4
+	}
+	sections := []*[]RR{&m.Answer, &m.Authority, &m.Additional}
+	for s, sec := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			start := off
+			name, next, err := readName(msg, off)
+			if err != nil {
+				return m, err
+			}
+			off = next
+			if off+10 > len(msg) {
+				return m, errShort
+			}
+			rr := RR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(msg[off:]),
+				Class: binary.BigEndian.Uint16(msg[off+2:]),
+				TTL:   binary.BigEndian.Uint32(msg[off+4:]),
+			}
+			n := int(binary.BigEndian.Uint16(msg[off+8:]))
+			off += 10
+			if off+n > len(msg) {
+				return m, errShort
+			}
+			rr.Data = msg[off : off+n]
+			off += n
+			if s == 2 && i == counts[3]-1 && rr.Type == TypeTSIG {
+				m.tsigOffset = start
+			}
+			*sec = append(*sec, rr)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,363 @@
+// Package dns generates BIND zone data from IPAM hosts and networks
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Record is a single resource record; Name is relative to the zone
+// origin unless it ends with a dot
+type Record struct {
+	Name  string `json:"name"`
+	TTL   int    `json:"ttl,omitempty"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// SOA holds the start of authority fields
+type SOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh int
+	Retry   int
+	Expire  int
+	Minimum int
+}
+
+// Zone is a complete zone file
+type Zone struct {
+	Origin   string
+	TTL      int
+	SOA      SOA
+	NS       []string
+	Records  []Record
+	Comments []string // emitted at the end, e.g. parent delegation records
+}
+
+// String renders the zone in BIND master file format
+func (z Zone) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ORIGIN %s\n", z.Origin)
+	fmt.Fprintf(&b, "$TTL %d\n", z.TTL)
+	fmt.Fprintf(&b, "@\tIN\tSOA\t%s %s (\n", z.SOA.MName, z.SOA.RName)
+	fmt.Fprintf(&b, "\t\t%d\t; serial\n", z.SOA.Serial)
+	fmt.Fprintf(&b, "\t\t%d\t; refresh\n", z.SOA.Refresh)
+	fmt.Fprintf(&b, "\t\t%d\t; retry\n", z.SOA.Retry)
+	fmt.Fprintf(&b, "\t\t%d\t; expire\n", z.SOA.Expire)
+	fmt.Fprintf(&b, "\t\t%d )\t; minimum\n", z.SOA.Minimum)
+	for _, ns := range z.NS {
+		fmt.Fprintf(&b, "@\tIN\tNS\t%s\n", ns)
+	}
+	b.WriteString("\n")
+	for _, r := range z.Records {
+		if r.TTL > 0 {
+			fmt.Fprintf(&b, "%s\t%d\tIN\t%s\t%s\n", r.Name, r.TTL, r.Type, r.Value)
+		} else {
+			fmt.Fprintf(&b, "%s\tIN\t%s\t%s\n", r.Name, r.Type, r.Value)
+		}
+	}
+	if len(z.Comments) > 0 {
+		b.WriteString("\n")
+		for _, c := range z.Comments {
+			fmt.Fprintf(&b, "; %s\n", c)
+		}
+	}
+	return b.String()
+}
+
+// Options are the zone-wide settings shared by generated zones
+type Options struct {
+	NS       []string // nameservers, first one is the SOA MNAME
+	RName    string   // responsible mailbox in DNS form, e.g. hostmaster.example.com.
+	TTL      int
+	Template *NameTemplate // used for hosts without a hostname
+}
+
+// NewZone fills in SOA and NS from options
+func (o Options) NewZone(origin string, serial uint32) (Zone, error) {
+	if len(o.NS) == 0 {
+		return Zone{}, errors.New("at least one nameserver required")
+	}
+	ns := make([]string, len(o.NS))
+	for i, n := range o.NS {
+		ns[i] = Fqdn(n)
+	}
+	rname := o.RName
+	if rname == "" {
+		rname = "hostmaster." + strings.TrimPrefix(ns[0], strings.SplitN(ns[0], ".", 2)[0]+".")
+	}
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = 3600
+	}
+	if serial == 0 {
+		serial = 1
+	}
+	return Zone{
+		Origin: origin,
+		TTL:    ttl,
+		SOA: SOA{
+			MName: ns[0], RName: Fqdn(strings.Replace(rname, "@", ".", 1)), Serial: serial,
+			Refresh: 3600, Retry: 900, Expire: 1209600, Minimum: 300,
+		},
+		NS: ns,
+	}, nil
+}
+
+// Fqdn appends the trailing dot if missing
+func Fqdn(name string) string {
+	if name == "" || strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+var hostnameRe = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.?$`)
+
+// ValidHostname reports whether name is usable as a PTR target or owner name
+func ValidHostname(name string) bool {
+	return len(name) <= 254 && hostnameRe.MatchString(name)
+}
+
+// ValidMailbox reports whether name is usable as an SOA RNAME, in DNS
+// form or with an @ for the first dot
+func ValidMailbox(name string) bool {
+	return ValidHostname(strings.Replace(name, "@", ".", 1))
+}
+
+// NameTemplate builds a hostname for hosts that have none recorded
+type NameTemplate struct{ t *template.Template }
+
+// NameData is what a NameTemplate is executed with
+type NameData struct {
+	Address     string // 192.0.2.5 or 2001:db8::5
+	Dashed      string // 192-0-2-5 or 2001-db8--5
+	Description string // description reduced to a DNS label
+}
+
+// ParseNameTemplate compiles a hostname template such as "{{.Dashed}}.dyn.example.net."
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &NameTemplate{t}, nil
+}
+
+var labelBad = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Name renders the template for an address
+func (nt *NameTemplate) Name(addr, description string) (string, error) {
+	d := NameData{
+		Address:     addr,
+		Dashed:      strings.NewReplacer(".", "-", ":", "-").Replace(addr),
+		Description: strings.Trim(labelBad.ReplaceAllString(strings.ToLower(description), "-"), "-"),
+	}
+	var buf bytes.Buffer
+	if err := nt.t.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(buf.String())
+	if !ValidHostname(name) {
+		return "", fmt.Errorf("template produced invalid hostname %q", name)
+	}
+	return Fqdn(name), nil
+}
+
+// Host is the IPAM data zone generation works from
+type Host struct {
+	Address     string
+	Hostname    string
+	Description string
+}
+
+// HostName returns the recorded hostname or the templated one
+func (o Options) HostName(h Host) (string, error) {
+	if h.Hostname != "" {
+		return Fqdn(h.Hostname), nil
+	}
+	if o.Template == nil {
+		return "", nil
+	}
+	return o.Template.Name(h.Address, h.Description)
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of an address
+func ReverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	ip = ip.To16()
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// reverseLabels returns the reverse zone name covering the first
+// bits of an address, which must be a multiple of 8 (v4) or 4 (v6)
+func reverseLabels(ip net.IP, bits int) string {
+	full := strings.Split(strings.TrimSuffix(ReverseName(ip), "."), ".")
+	// full has one label per octet/nibble followed by the 2 suffix labels
+	per := 8
+	if ip.To4() == nil {
+		per = 4
+	}
+	n := len(full) - 2
+	skip := n - bits/per
+	return strings.Join(full[skip:], ".") + "."
+}
+
+// ReverseZone describes where a network's PTR records live
+type ReverseZone struct {
+	Origin    string
+	Classless bool   // RFC 2317 delegation for an IPv4 network longer than /24
+	Parent    string // for classless zones, the /24 zone that holds the CNAMEs
+}
+
+// ReverseZoneFor works out the reverse zone for a network. Networks must
+// be octet (IPv4) or nibble (IPv6) aligned, except IPv4 networks longer
+// than /24 which use RFC 2317 classless delegation.
+func ReverseZoneFor(n *net.IPNet) (ReverseZone, error) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		if ones > 24 {
+			parent := reverseLabels(n.IP, 24)
+			v4 := n.IP.To4()
+			return ReverseZone{
+				Origin:    fmt.Sprintf("%d-%d.%s", v4[3], ones, parent),
+				Classless: true,
+				Parent:    parent,
+			}, nil
+		}
+		if ones%8 != 0 {
+			return ReverseZone{}, fmt.Errorf("%s is not on an octet boundary; generate zones for its /%d subnets", n, (ones/8+1)*8)
+		}
+		return ReverseZone{Origin: reverseLabels(n.IP, ones)}, nil
+	}
+	if ones%4 != 0 {
+		return ReverseZone{}, fmt.Errorf("%s is not on a nibble boundary; generate zones for its /%d subnets", n, (ones/4+1)*4)
+	}
+	return ReverseZone{Origin: reverseLabels(n.IP, ones)}, nil
+}
+
+// BuildReverse generates the PTR zone for a network from its hosts.
+// Classless zones also list the CNAME and NS records the parent /24
+// zone needs as comments.
+func BuildReverse(cidr string, hosts []Host, serial uint32, opts Options) (Zone, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Zone{}, err
+	}
+	rz, err := ReverseZoneFor(n)
+	if err != nil {
+		return Zone{}, err
+	}
+	z, err := opts.NewZone(rz.Origin, serial)
+	if err != nil {
+		return z, err
+	}
+	for _, h := range hosts {
+		ip := net.ParseIP(h.Address)
+		if ip == nil || !n.Contains(ip) {
+			continue
+		}
+		target, err := opts.HostName(h)
+		if err != nil {
+			return z, fmt.Errorf("%s: %w", h.Address, err)
+		}
+		if target == "" {
+			continue
+		}
+		name := strings.TrimSuffix(ReverseName(ip), "."+rz.Origin)
+		if rz.Classless {
+			name = fmt.Sprint(ip.To4()[3])
+		}
+		z.Records = append(z.Records, Record{Name: name, Type: "PTR", Value: target})
+	}
+	if rz.Classless {
+		z.Comments = append(z.Comments, "Records for the parent zone "+rz.Parent)
+		for _, ns := range z.NS {
+			z.Comments = append(z.Comments, fmt.Sprintf("%s\tIN\tNS\t%s", rz.Origin, ns))
+		}
+		ones, _ := n.Mask.Size()
+		first := int(n.IP.To4()[3])
+		for i := 0; i < 1<<(32-ones); i++ {
+			z.Comments = append(z.Comments, fmt.Sprintf("%d\tIN\tCNAME\t%d.%s", first+i, first+i, rz.Origin))
+		}
+	}
+	return z, nil
+}
+
+// Domain is a group of forward records sharing a parent domain
+type Domain struct {
+	Name    string   `json:"domain"`
+	Records []Record `json:"records"`
+}
+
+// BuildForward groups A/AAAA records for hosts with a recorded FQDN by
+// domain (the hostname minus its first label). Record names are
+// relative to their domain.
+func BuildForward(hosts []Host, ttl int) []Domain {
+	byName := map[string]*Domain{}
+	var order []string
+	for _, h := range hosts {
+		ip := net.ParseIP(h.Address)
+		if ip == nil || h.Hostname == "" {
+			continue
+		}
+		name := strings.TrimSuffix(Fqdn(h.Hostname), ".")
+		label, domain, ok := strings.Cut(name, ".")
+		if !ok {
+			continue
+		}
+		domain = Fqdn(strings.ToLower(domain))
+		d, ok := byName[domain]
+		if !ok {
+			d = &Domain{Name: domain}
+			byName[domain] = d
+			order = append(order, domain)
+		}
+		typ := "A"
+		if ip.To4() == nil {
+			typ = "AAAA"
+		}
+		d.Records = append(d.Records, Record{Name: label, TTL: ttl, Type: typ, Value: ip.String()})
+	}
+	sort.Strings(order)
+	out := make([]Domain, len(order))
+	for i, name := range order {
+		out[i] = *byName[name]
+	}
+	return out
+}
+
+// FormatForward renders domains as BIND fragments, one $ORIGIN per
+// domain, suitable for $INCLUDE from the real zone files
+func FormatForward(domains []Domain) string {
+	var b strings.Builder
+	for i, d := range domains {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "$ORIGIN %s\n", d.Name)
+		for _, r := range d.Records {
+			if r.TTL > 0 {
+				fmt.Fprintf(&b, "%s\t%d\tIN\t%s\t%s\n", r.Name, r.TTL, r.Type, r.Value)
+			} else {
+				fmt.Fprintf(&b, "%s\tIN\t%s\t%s\n", r.Name, r.Type, r.Value)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReverseZoneFor(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want ReverseZone
+		err  string
+	}{
+		{cidr: "10.0.0.0/8", want: ReverseZone{Origin: "10.in-addr.arpa."}},
+		{cidr: "172.16.0.0/16", want: ReverseZone{Origin: "16.172.in-addr.arpa."}},
+		{cidr: "192.0.2.0/24", want: ReverseZone{Origin: "2.0.192.in-addr.arpa."}},
+		{cidr: "0.0.0.0/0", want: ReverseZone{Origin: "in-addr.arpa."}},
+		{cidr: "10.0.0.0/12", err: "10.0.0.0/12 is not on an octet boundary; generate zones for its /16 subnets"},
+		{cidr: "192.0.2.0/23", err: "192.0.2.0/23 is not on an octet boundary; generate zones for its /24 subnets"},
+		{cidr: "192.0.2.64/26", want: ReverseZone{Origin: "64-26.2.0.192.in-addr.arpa.", Classless: true, Parent: "2.0.192.in-addr.arpa."}},
+		{cidr: "192.0.2.5/32", want: ReverseZone{Origin: "5-32.2.0.192.in-addr.arpa.", Classless: true, Parent: "2.0.192.in-addr.arpa."}},
+		{cidr: "2001:db8::/32", want: ReverseZone{Origin: "8.b.d.0.1.0.0.2.ip6.arpa."}},
+		{cidr: "2001:db8::/36", want: ReverseZone{Origin: "0.8.b.d.0.1.0.0.2.ip6.arpa."}},
+		{cidr: "2001:db8:1234::/48", want: ReverseZone{Origin: "4.3.2.1.8.b.d.0.1.0.0.2.ip6.arpa."}},
+		{cidr: "2001:db8::/33", err: "2001:db8::/33 is not on a nibble boundary; generate zones for its /36 subnets"},
+		{cidr: "2001:db8::/126", err: "2001:db8::/126 is not on a nibble boundary; generate zones for its /128 subnets"},
+	}
+	for _, tt := range tests {
+		_, n, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReverseZoneFor(n)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.cidr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.cidr, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.cidr, got, tt.want)
+		}
+	}
+}
+
+func TestBuildReverse(t *testing.T) {
+	opts := Options{NS: []string{"ns1.example.com", "ns2.example.com."}}
+	dyn, err := ParseNameTemplate("{{.Dashed}}.dyn.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byDescription, err := ParseNameTemplate("{{.Description}}.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("octet aligned", func(t *testing.T) {
+		hosts := []Host{
+			{Address: "192.0.2.1", Hostname: "gw.example.com"},
+			{Address: "192.0.2.10", Description: "no name and no template"},
+			{Address: "192.0.2.20", Hostname: "www.example.com."},
+			{Address: "198.51.100.1", Hostname: "outside.example.com"},
+			{Address: "bogus", Hostname: "bogus.example.com"},
+		}
+		z, err := BuildReverse("192.0.2.0/24", hosts, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "$ORIGIN 2.0.192.in-addr.arpa.\n" +
+			"$TTL 3600\n" +
+			"@\tIN\tSOA\tns1.example.com. hostmaster.example.com. (\n" +
+			"\t\t1\t; serial\n" +
+			"\t\t3600\t; refresh\n" +
+			"\t\t900\t; retry\n" +
+			"\t\t1209600\t; expire\n" +
+			"\t\t300 )\t; minimum\n" +
+			"@\tIN\tNS\tns1.example.com.\n" +
+			"@\tIN\tNS\tns2.example.com.\n" +
+			"\n" +
+			"1\tIN\tPTR\tgw.example.com.\n" +
+			"20\tIN\tPTR\twww.example.com.\n"
+		if got := z.String(); got != want {
+			t.Errorf("zone\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("classless", func(t *testing.T) {
+		o := opts
+		o.RName, o.TTL = "dns@example.org", 600
+		hosts := []Host{
+			{Address: "192.0.2.65", Hostname: "a.example.com"},
+			{Address: "192.0.2.66"},
+			{Address: "192.0.2.68", Hostname: "next.example.com"},
+		}
+		z, err := BuildReverse("192.0.2.64/30", hosts, 2024010101, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if z.Origin != "64-30.2.0.192.in-addr.arpa." || z.TTL != 600 ||
+			z.SOA.RName != "dns.example.org." || z.SOA.Serial != 2024010101 {
+			t.Errorf("zone %+v", z)
+		}
+		wantRecords := []Record{{Name: "65", Type: "PTR", Value: "a.example.com."}}
+		if !reflect.DeepEqual(z.Records, wantRecords) {
+			t.Errorf("records %+v, want %+v", z.Records, wantRecords)
+		}
+		wantComments := []string{
+			"Records for the parent zone 2.0.192.in-addr.arpa.",
+			"64-30.2.0.192.in-addr.arpa.\tIN\tNS\tns1.example.com.",
+			"64-30.2.0.192.in-addr.arpa.\tIN\tNS\tns2.example.com.",
+			"64\tIN\tCNAME\t64.64-30.2.0.192.in-addr.arpa.",
+			"65\tIN\tCNAME\t65.64-30.2.0.192.in-addr.arpa.",
+			"66\tIN\tCNAME\t66.64-30.2.0.192.in-addr.arpa.",
+			"67\tIN\tCNAME\t67.64-30.2.0.192.in-addr.arpa.",
+		}
+		if !reflect.DeepEqual(z.Comments, wantComments) {
+			t.Errorf("comments\n%q\nwant\n%q", z.Comments, wantComments)
+		}
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		o := opts
+		o.Template = dyn
+		hosts := []Host{
+			{Address: "2001:db8:0:1::5"},
+			{Address: "2001:db8:0:1:ffff::1", Hostname: "gw.example.com"},
+			{Address: "2001:db8:0:2::1", Hostname: "outside.example.com"},
+		}
+		z, err := BuildReverse("2001:db8:0:1::/64", hosts, 7, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if z.Origin != "1.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." || len(z.Comments) != 0 {
+			t.Errorf("zone %+v", z)
+		}
+		want := []Record{
+			{Name: "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", Type: "PTR", Value: "2001-db8-0-1--5.dyn.example.net."},
+			{Name: "1.0.0.0.0.0.0.0.0.0.0.0.f.f.f.f", Type: "PTR", Value: "gw.example.com."},
+		}
+		if !reflect.DeepEqual(z.Records, want) {
+			t.Errorf("records %+v, want %+v", z.Records, want)
+		}
+	})
+
+	errs := []struct {
+		name  string
+		cidr  string
+		hosts []Host
+		opts  Options
+		err   string
+	}{
+		{name: "no nameservers", cidr: "192.0.2.0/24", err: "at least one nameserver required"},
+		{name: "unaligned", cidr: "192.0.2.0/23", opts: opts, err: "192.0.2.0/23 is not on an octet boundary; generate zones for its /24 subnets"},
+		{name: "bad cidr", cidr: "192.0.2.0", opts: opts, err: "invalid CIDR address: 192.0.2.0"},
+		{
+			name:  "template gives no hostname",
+			cidr:  "2001:db8::/64",
+			hosts: []Host{{Address: "2001:db8::5"}},
+			opts:  Options{NS: opts.NS, Template: byDescription},
+			err:   `2001:db8::5: template produced invalid hostname ".example.net"`,
+		},
+	}
+	for _, tt := range errs {
+		if _, err := BuildReverse(tt.cidr, tt.hosts, 1, tt.opts); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestBuildForward(t *testing.T) {
+	hosts := []Host{
+		{Address: "192.0.2.1", Hostname: "www.example.com"},
+		{Address: "2001:db8::1", Hostname: "mail.Example.COM."},
+		{Address: "192.0.2.2", Hostname: "api.dev.example.com"},
+		{Address: "192.0.2.3", Hostname: "localhost"},
+		{Address: "192.0.2.4"},
+		{Address: "bogus", Hostname: "bogus.example.com"},
+	}
+	got := BuildForward(hosts, 300)
+	want := []Domain{
+		{Name: "dev.example.com.", Records: []Record{{Name: "api", TTL: 300, Type: "A", Value: "192.0.2.2"}}},
+		{Name: "example.com.", Records: []Record{
+			{Name: "www", TTL: 300, Type: "A", Value: "192.0.2.1"},
+			{Name: "mail", TTL: 300, Type: "AAAA", Value: "2001:db8::1"},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	text := "$ORIGIN dev.example.com.\n" +
+		"api\t300\tIN\tA\t192.0.2.2\n" +
+		"\n" +
+		"$ORIGIN example.com.\n" +
+		"www\t300\tIN\tA\t192.0.2.1\n" +
+		"mail\t300\tIN\tAAAA\t2001:db8::1\n"
+	if s := FormatForward(got); s != text {
+		t.Errorf("formatted\n%s\nwant\n%s", s, text)
+	}
+	if s := FormatForward(BuildForward(hosts[:1], 0)); s != "$ORIGIN example.com.\nwww\tIN\tA\t192.0.2.1\n" {
+		t.Errorf("without a TTL\n%s", s)
+	}
+	if got := BuildForward(nil, 300); len(got) != 0 {
+		t.Errorf("no hosts: %+v", got)
+	}
+}
+
+func TestValidMailbox(t *testing.T) {
+	for name, want := range map[string]bool{
+		"hostmaster.example.com.": true,
+		"hostmaster@example.com":  true,
+		"a@b@example.com":         false,
+		"hostmaster example.com":  false,
+		"x.\nexample.com":         false,
+		"":                        false,
+	} {
+		if got := ValidMailbox(name); got != want {
+			t.Errorf("ValidMailbox(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
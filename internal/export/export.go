@@ -0,0 +1,299 @@
+// Package export writes the networks tree, with hosts nested, as JSON,
+// flat CSV or YAML, streaming it as the networks are read.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Host is an exported host record
+type Host struct {
+	Address     string `json:"address"`
+	Description string `json:"description"`
+	Hostname    string `json:"hostname,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+}
+
+// Network is an exported network with its hosts and subnetworks. Parent
+// is the ID of the network it nests under, not part of the document.
+type Network struct {
+	ID          int64      `json:"id"`
+	Parent      int64      `json:"-"`
+	CIDR        string     `json:"cidr"`
+	Description string     `json:"description,omitempty"`
+	Subdivide   bool       `json:"subdivide"`
+	ValidMasks  []int16    `json:"valid_masks,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Account     string     `json:"account,omitempty"`
+	Service     int64      `json:"service,omitempty"`
+	Gateway     string     `json:"gateway,omitempty"`
+	DHCPPools   string     `json:"dhcp_pools,omitempty"`
+	Discover    bool       `json:"discover,omitempty"`
+	Hosts       []Host     `json:"hosts,omitempty"`
+	Children    []*Network `json:"children,omitempty"`
+}
+
+// Writer writes a tree as it is read, one network at a time: a network
+// comes after its parent and before its parent's next sibling, which is
+// address order. Nothing is written until the first network, so a caller
+// can still answer with an error if there is none.
+type Writer struct {
+	format string
+	bw     *bufio.Writer
+	ew     *errWriter
+	cw     *csv.Writer
+	open   []openNetwork // the path from the current root down
+	count  int
+}
+
+type openNetwork struct {
+	id       int64
+	cidr     string
+	indent   string // YAML indent of its "- id:" line
+	children int
+}
+
+// NewWriter starts a document in format "json", "csv" or "yaml"
+func NewWriter(w io.Writer, format string) (*Writer, error) {
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "yaml" {
+		return nil, fmt.Errorf("format must be json, csv or yaml")
+	}
+	bw := bufio.NewWriter(w)
+	ew := &errWriter{w: bw}
+	return &Writer{format: format, bw: bw, ew: ew, cw: csv.NewWriter(ew)}, nil
+}
+
+// Started reports whether anything has been written
+func (w *Writer) Started() bool {
+	return w.count > 0
+}
+
+// Network writes n with its hosts. n.Parent places it in the tree: under
+// the open network with that ID, or as a root if there is none. n.Children
+// is ignored; children are written by their own calls.
+func (w *Writer) Network(n *Network) error {
+	if w.count == 0 {
+		w.begin()
+	}
+	w.count++
+	for len(w.open) > 0 && w.open[len(w.open)-1].id != n.Parent {
+		w.close()
+	}
+	var parent *openNetwork
+	if len(w.open) > 0 {
+		parent = &w.open[len(w.open)-1]
+	}
+	o := openNetwork{id: n.ID, cidr: n.CIDR, indent: "  "}
+	switch w.format {
+	case "json":
+		if parent != nil && parent.children > 0 || parent == nil && w.count > 1 {
+			w.ew.str(",")
+		}
+		w.jsonNetwork(n)
+	case "csv":
+		w.csvNetwork(n, parent)
+	case "yaml":
+		if parent != nil {
+			if parent.children == 0 {
+				fmt.Fprintf(w.ew, "%s  children:\n", parent.indent)
+			}
+			o.indent = parent.indent + "    "
+		}
+		w.yamlNetwork(n, o.indent)
+	}
+	if parent != nil {
+		parent.children++
+	}
+	w.open = append(w.open, o)
+	return w.ew.err
+}
+
+// Close ends the document and flushes it
+func (w *Writer) Close() error {
+	if w.count == 0 {
+		w.begin()
+	}
+	for len(w.open) > 0 {
+		w.close()
+	}
+	switch w.format {
+	case "json":
+		w.ew.str("]}\n")
+	case "csv":
+		w.cw.Flush()
+		w.ew.fail(w.cw.Error())
+	case "yaml":
+		if w.count == 0 {
+			w.ew.str("networks: []\n")
+		}
+	}
+	if w.ew.err != nil {
+		return w.ew.err
+	}
+	return w.bw.Flush()
+}
+
+func (w *Writer) begin() {
+	switch w.format {
+	case "json":
+		w.ew.str(`{"networks":[`)
+	case "csv":
+		w.cw.Write(CSVHeader)
+	}
+}
+
+// Close the innermost open network
+func (w *Writer) close() {
+	w.open = w.open[:len(w.open)-1]
+	if w.format == "json" {
+		w.ew.str("]}")
+	}
+}
+
+// ContentType is the MIME type for a format accepted by NewWriter
+func ContentType(format string) string {
+	switch format {
+	case "csv":
+		return "text/csv; charset=utf-8"
+	case "yaml":
+		return "application/yaml"
+	}
+	return "application/json"
+}
+
+// JSON: the scalar fields, the hosts, then the children array left open
+// for the networks that follow
+func (w *Writer) jsonNetwork(n *Network) {
+	flat := *n
+	flat.Hosts, flat.Children = nil, nil
+	b, err := json.Marshal(flat)
+	if err != nil {
+		w.ew.fail(err)
+		return
+	}
+	w.ew.write(b[:len(b)-1])
+	w.ew.str(`,"hosts":[`)
+	for i, h := range n.Hosts {
+		if i > 0 {
+			w.ew.str(",")
+		}
+		b, err := json.Marshal(h)
+		if err != nil {
+			w.ew.fail(err)
+			return
+		}
+		w.ew.write(b)
+	}
+	w.ew.str(`],"children":[`)
+}
+
+// CSVHeader lists the flat CSV columns. The import reads every one of
+// them back: parent is checked against where each row lands.
+var CSVHeader = []string{"type", "cidr", "address", "parent", "description", "owner", "account", "subdivide", "valid_masks", "service", "gateway", "dhcp_pools", "discover", "hostname", "mac"}
+
+// CSV: one row for the network followed by one per host
+func (w *Writer) csvNetwork(n *Network, parent *openNetwork) {
+	masks := make([]string, len(n.ValidMasks))
+	for i, m := range n.ValidMasks {
+		masks[i] = strconv.Itoa(int(m))
+	}
+	service := ""
+	if n.Service != 0 {
+		service = strconv.FormatInt(n.Service, 10)
+	}
+	parentCIDR := ""
+	if parent != nil {
+		parentCIDR = parent.cidr
+	}
+	w.cw.Write([]string{"network", n.CIDR, "", parentCIDR, n.Description, n.Owner, n.Account,
+		strconv.FormatBool(n.Subdivide), strings.Join(masks, " "), service, n.Gateway, n.DHCPPools,
+		strconv.FormatBool(n.Discover), "", ""})
+	for _, h := range n.Hosts {
+		w.cw.Write([]string{"host", "", h.Address, n.CIDR, h.Description, "", "", "", "", "", "", "", "", h.Hostname, h.MAC})
+	}
+}
+
+// YAML: a block-style document. Strings are emitted as double-quoted
+// scalars, whose escapes are a superset of JSON's.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func (w *Writer) yamlNetwork(n *Network, indent string) {
+	ew := w.ew
+	if w.count == 1 {
+		ew.str("networks:\n")
+	}
+	in := indent + "  "
+	fmt.Fprintf(ew, "%s- id: %d\n", indent, n.ID)
+	fmt.Fprintf(ew, "%scidr: %s\n", in, yamlString(n.CIDR))
+	if n.Description != "" {
+		fmt.Fprintf(ew, "%sdescription: %s\n", in, yamlString(n.Description))
+	}
+	fmt.Fprintf(ew, "%ssubdivide: %t\n", in, n.Subdivide)
+	if len(n.ValidMasks) > 0 {
+		masks := make([]string, len(n.ValidMasks))
+		for i, m := range n.ValidMasks {
+			masks[i] = strconv.Itoa(int(m))
+		}
+		fmt.Fprintf(ew, "%svalid_masks: [%s]\n", in, strings.Join(masks, ", "))
+	}
+	for _, kv := range [][2]string{{"owner", n.Owner}, {"account", n.Account}, {"gateway", n.Gateway}, {"dhcp_pools", n.DHCPPools}} {
+		if kv[1] != "" {
+			fmt.Fprintf(ew, "%s%s: %s\n", in, kv[0], yamlString(kv[1]))
+		}
+	}
+	if n.Service != 0 {
+		fmt.Fprintf(ew, "%sservice: %d\n", in, n.Service)
+	}
+	if n.Discover {
+		fmt.Fprintf(ew, "%sdiscover: true\n", in)
+	}
+	if len(n.Hosts) > 0 {
+		fmt.Fprintf(ew, "%shosts:\n", in)
+		for _, h := range n.Hosts {
+			fmt.Fprintf(ew, "%s  - address: %s\n", in, yamlString(h.Address))
+			fmt.Fprintf(ew, "%s    description: %s\n", in, yamlString(h.Description))
+			if h.Hostname != "" {
+				fmt.Fprintf(ew, "%s    hostname: %s\n", in, yamlString(h.Hostname))
+			}
+			if h.MAC != "" {
+				fmt.Fprintf(ew, "%s    mac: %s\n", in, yamlString(h.MAC))
+			}
+		}
+	}
+}
+
+// errWriter keeps the first write error so the writers above can stay linear
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+func (e *errWriter) write(p []byte) { e.Write(p) }
+func (e *errWriter) str(s string)   { e.Write([]byte(s)) }
+
+func (e *errWriter) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
@@ -0,0 +1,140 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yellowman/GoPieNg/internal/export"
+	"github.com/yellowman/GoPieNg/internal/importer"
+)
+
+// A tree in address order, as the database reads it
+var tree = []*export.Network{
+	{ID: 1, CIDR: "10.0.0.0/8", Description: "corp", Subdivide: true, ValidMasks: []int16{16, 24}},
+	{ID: 2, Parent: 1, CIDR: "10.1.0.0/16", Subdivide: true, Owner: "ops"},
+	{ID: 3, Parent: 2, CIDR: "10.1.1.0/24", Description: "lab", Gateway: "10.1.1.1", DHCPPools: "10.1.1.100-10.1.1.200",
+		Service: 7, Discover: true, Hosts: []export.Host{{Address: "10.1.1.5", Description: "db", Hostname: "db.example.com", MAC: "00:11:22:33:44:55"}}},
+	{ID: 4, Parent: 1, CIDR: "10.2.0.0/16"},
+	{ID: 5, CIDR: "2001:db8::/32", Account: "acct"},
+}
+
+func write(t *testing.T, format string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := export.NewWriter(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range tree {
+		if err := w.Network(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestJSONNesting(t *testing.T) {
+	var doc struct {
+		Networks []struct {
+			CIDR     string `json:"cidr"`
+			Children []struct {
+				CIDR     string `json:"cidr"`
+				Children []struct {
+					CIDR  string        `json:"cidr"`
+					Hosts []export.Host `json:"hosts"`
+				} `json:"children"`
+			} `json:"children"`
+		} `json:"networks"`
+	}
+	out := write(t, "json")
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if len(doc.Networks) != 2 || doc.Networks[1].CIDR != "2001:db8::/32" {
+		t.Fatalf("roots %+v", doc.Networks)
+	}
+	kids := doc.Networks[0].Children
+	if len(kids) != 2 || kids[0].CIDR != "10.1.0.0/16" || kids[1].CIDR != "10.2.0.0/16" {
+		t.Fatalf("children %+v", kids)
+	}
+	if len(kids[0].Children) != 1 || len(kids[0].Children[0].Hosts) != 1 {
+		t.Fatalf("grandchildren %+v", kids[0].Children)
+	}
+}
+
+func TestYAMLNesting(t *testing.T) {
+	want := []string{
+		"networks:",
+		"  - id: 1",
+		"    children:",
+		"      - id: 2",
+		"        children:",
+		"          - id: 3",
+		"            hosts:",
+		"              - address: \"10.1.1.5\"",
+		"      - id: 4",
+		"  - id: 5",
+	}
+	out := write(t, "yaml")
+	var got []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "- ") || strings.HasSuffix(line, ":") {
+			got = append(got, line)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outline\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for format, want := range map[string]string{
+		"json": "{\"networks\":[]}\n",
+		"yaml": "networks: []\n",
+		"csv":  strings.Join(export.CSVHeader, ",") + "\n",
+	} {
+		var buf bytes.Buffer
+		w, _ := export.NewWriter(&buf, format)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want || w.Started() {
+			t.Errorf("%s: %q", format, buf.String())
+		}
+	}
+}
+
+// What the import reads back from an export: the rows of the tree in
+// order, with every exported setting
+func TestRoundTrip(t *testing.T) {
+	want := []importer.Row{
+		{Type: "network", CIDR: "10.0.0.0/8", Description: "corp", Subdivide: true, ValidMasks: []int16{16, 24}},
+		{Type: "network", CIDR: "10.1.0.0/16", Parent: "10.0.0.0/8", Subdivide: true, Owner: "ops"},
+		{Type: "network", CIDR: "10.1.1.0/24", Parent: "10.1.0.0/16", Description: "lab", Gateway: "10.1.1.1",
+			DHCPPools: "10.1.1.100-10.1.1.200", Service: 7, Discover: true},
+		{Type: "host", Address: "10.1.1.5", Parent: "10.1.1.0/24", Description: "db", Hostname: "db.example.com", MAC: "00:11:22:33:44:55"},
+		{Type: "network", CIDR: "10.2.0.0/16", Parent: "10.0.0.0/8"},
+		{Type: "network", CIDR: "2001:db8::/32", Account: "acct"},
+	}
+	for _, format := range []string{"csv", "json"} {
+		rows, err := importer.Parse(strings.NewReader(write(t, format)), "")
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for i := range rows {
+			if err := rows[i].Normalize(); err != nil {
+				t.Errorf("%s: row %d: %v", format, i, err)
+			}
+			rows[i].Line = 0
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("%s: rows\n%+v\nwant\n%+v", format, rows, want)
+		}
+	}
+}
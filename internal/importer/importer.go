@@ -0,0 +1,418 @@
+// Package importer reads networks and hosts from spreadsheets and other
+// IPAM systems into a common row format for the database import.
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Row is one network or host to import. Line is the position in the
+// source (CSV line or JSON array index) and Source names the record in
+// another IPAM, for error reports.
+type Row struct {
+	Line        int    `json:"line"`
+	Source      string `json:"source,omitempty"`
+	Type        string `json:"type"` // "network" or "host"
+	CIDR        string `json:"cidr,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Account     string `json:"account,omitempty"`
+	Subdivide   bool   `json:"subdivide,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+
+	// Network settings, as exported
+	ValidMasks []int16 `json:"valid_masks,omitempty"`
+	Service    int64   `json:"service,omitempty"`
+	Gateway    string  `json:"gateway,omitempty"`
+	DHCPPools  string  `json:"dhcp_pools,omitempty"`
+	Discover   bool    `json:"discover,omitempty"`
+
+	// Parent, when given, is the network the row must land in
+	Parent string `json:"parent,omitempty"`
+}
+
+// Key is the CIDR of a network row or the address of a host row
+func (r Row) Key() string {
+	if r.Type == "network" {
+		return r.CIDR
+	}
+	return r.Address
+}
+
+// Normalize fills in Type from the populated column and canonicalises
+// the CIDR, address and MAC
+func (r *Row) Normalize() error {
+	r.CIDR, r.Address = strings.TrimSpace(r.CIDR), strings.TrimSpace(r.Address)
+	if r.Type == "" {
+		switch {
+		case r.CIDR != "":
+			r.Type = "network"
+		case strings.Contains(r.Address, "/"):
+			r.Type, r.CIDR, r.Address = "network", r.Address, ""
+		case r.Address != "":
+			r.Type = "host"
+		}
+	}
+	switch r.Type {
+	case "network":
+		if r.CIDR == "" {
+			r.CIDR, r.Address = r.Address, ""
+		}
+		ip, n, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return fmt.Errorf("bad cidr %q", r.CIDR)
+		}
+		if !ip.Equal(n.IP) {
+			return fmt.Errorf("%s has host bits set (network is %s)", r.CIDR, n)
+		}
+		r.CIDR = n.String()
+		ones, bits := n.Mask.Size()
+		for _, m := range r.ValidMasks {
+			if int(m) <= ones || int(m) > bits {
+				return fmt.Errorf("valid mask %d must be from %d to %d for %s", m, ones+1, bits, r.CIDR)
+			}
+		}
+		if r.Service < 0 {
+			return fmt.Errorf("bad service %d", r.Service)
+		}
+		if r.Gateway != "" {
+			gw := net.ParseIP(r.Gateway)
+			if gw == nil || !n.Contains(gw) {
+				return fmt.Errorf("gateway %q is not an address in %s", r.Gateway, r.CIDR)
+			}
+			r.Gateway = gw.String()
+		}
+	case "host":
+		if r.Address == "" {
+			r.Address = r.CIDR
+		}
+		// tolerate "192.0.2.1/24" style interface addresses
+		addr, _, _ := strings.Cut(r.Address, "/")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("bad address %q", r.Address)
+		}
+		r.Address, r.CIDR = ip.String(), ""
+		if r.MAC != "" {
+			hw, err := net.ParseMAC(r.MAC)
+			if err != nil || len(hw) != 6 {
+				return fmt.Errorf("bad mac %q", r.MAC)
+			}
+			r.MAC = hw.String()
+		}
+		r.Hostname = strings.TrimSuffix(r.Hostname, ".")
+	default:
+		return errors.New("row needs a cidr or an address")
+	}
+	if r.Parent = strings.TrimSpace(r.Parent); r.Parent != "" {
+		_, p, err := net.ParseCIDR(r.Parent)
+		if err != nil {
+			return fmt.Errorf("bad parent %q", r.Parent)
+		}
+		r.Parent = p.String()
+	}
+	return nil
+}
+
+// Problem is a row that can't be imported and why
+type Problem struct {
+	Row     Row
+	Problem string
+}
+
+// Where a row came from, for reports: its record in another IPAM or its
+// line
+func (r Row) origin() string {
+	if r.Source != "" {
+		return r.Source
+	}
+	return "line " + strconv.Itoa(r.Line)
+}
+
+// Prepare normalizes rows and orders them parents first, marking networks
+// that contain others in the set for subdivision. Rows that don't
+// normalize, or repeat the network or address of an earlier row (as the
+// same prefix in two VRFs does), are returned as problems instead.
+func Prepare(rows []Row) ([]Row, []Problem) {
+	var good []Row
+	var bad []Problem
+	first := map[string]Row{}
+	for _, row := range rows {
+		if err := row.Normalize(); err != nil {
+			bad = append(bad, Problem{Row: row, Problem: err.Error()})
+			continue
+		}
+		if prev, ok := first[row.Key()]; ok {
+			bad = append(bad, Problem{Row: row, Problem: "duplicate of " + prev.origin()})
+			continue
+		}
+		first[row.Key()] = row
+		good = append(good, row)
+	}
+	Sort(good)
+	MarkParents(good)
+	return good, bad
+}
+
+// Sort orders rows so every network comes before anything it contains:
+// networks by prefix length then address, followed by hosts
+func Sort(rows []Row) {
+	key := func(r Row) (int, int, string) {
+		if r.Type != "network" {
+			return 1, 0, sortableIP(r.Address)
+		}
+		ip, n, _ := net.ParseCIDR(r.CIDR)
+		ones, _ := n.Mask.Size()
+		return 0, ones, sortableIP(ip.String())
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a0, a1, a2 := key(rows[i])
+		b0, b1, b2 := key(rows[j])
+		if a0 != b0 {
+			return a0 < b0
+		}
+		if a1 != b1 {
+			return a1 < b1
+		}
+		return a2 < b2
+	})
+}
+
+// MarkParents sets Subdivide on network rows that contain other network
+// rows, since only subdivided networks can hold networks. rows must
+// already be sorted.
+func MarkParents(rows []Row) {
+	for i := range rows {
+		if rows[i].Type != "network" || rows[i].Subdivide {
+			continue
+		}
+		_, n, _ := net.ParseCIDR(rows[i].CIDR)
+		outer, _ := n.Mask.Size()
+		for _, r := range rows[i+1:] {
+			if r.Type != "network" {
+				break // hosts sort last
+			}
+			ip, c, _ := net.ParseCIDR(r.CIDR)
+			if inner, _ := c.Mask.Size(); inner > outer && n.Contains(ip) {
+				rows[i].Subdivide = true
+				break
+			}
+		}
+	}
+}
+
+func sortableIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip.To4() != nil {
+		return "4" + string(ip.To4())
+	}
+	return "6" + string(ip.To16())
+}
+
+// Parse reads CSV or JSON rows. An empty format is guessed: JSON if the
+// body starts with '[' or '{'.
+func Parse(r io.Reader, format string) ([]Row, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		format = "csv"
+		head, _ := br.Peek(512)
+		t := strings.TrimLeft(strings.TrimPrefix(string(head), "\ufeff"), " \t\r\n")
+		if strings.HasPrefix(t, "[") || strings.HasPrefix(t, "{") {
+			format = "json"
+		}
+	}
+	switch format {
+	case "csv":
+		return ParseCSV(br)
+	case "json":
+		return ParseJSON(br)
+	}
+	return nil, errors.New("format must be csv or json")
+}
+
+// A network of a JSON export, with its hosts and subnetworks nested
+type nestedRow struct {
+	Row
+	Hosts    []Row       `json:"hosts"`
+	Children []nestedRow `json:"children"`
+}
+
+// Flatten nested networks, each followed by its hosts and subnetworks
+// under it as their parent
+func flatten(rows []Row, nets []nestedRow, parent string) []Row {
+	for _, n := range nets {
+		n.Row.Type = "network"
+		if parent != "" {
+			n.Row.Parent = parent
+		}
+		rows = append(rows, n.Row)
+		for _, h := range n.Hosts {
+			h.Type, h.Parent = "host", n.CIDR
+			rows = append(rows, h)
+		}
+		rows = flatten(rows, n.Children, n.CIDR)
+	}
+	return rows
+}
+
+// ParseJSON reads an array of rows, or an object with "networks" and
+// "hosts" arrays where networks may nest their hosts and children as the
+// export writes them
+func ParseJSON(r io.Reader) ([]Row, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rows []Row
+	if err := json.Unmarshal(data, &rows); err != nil {
+		var split struct {
+			Networks []nestedRow
+			Hosts    []Row
+		}
+		if err2 := json.Unmarshal(data, &split); err2 != nil {
+			return nil, err
+		}
+		rows = flatten(nil, split.Networks, "")
+		for _, h := range split.Hosts {
+			h.Type = "host"
+			rows = append(rows, h)
+		}
+	}
+	for i := range rows {
+		rows[i].Line = i + 1
+	}
+	return rows, nil
+}
+
+// CSV header names accepted for each field
+var csvColumns = map[string]string{
+	"type":          "type",
+	"kind":          "type",
+	"cidr":          "cidr",
+	"network":       "cidr",
+	"prefix":        "cidr",
+	"address_range": "cidr",
+	"address":       "address",
+	"ip":            "address",
+	"description":   "description",
+	"owner":         "owner",
+	"account":       "account",
+	"subdivide":     "subdivide",
+	"hostname":      "hostname",
+	"mac":           "mac",
+	"parent":        "parent",
+	"valid_masks":   "valid_masks",
+	"service":       "service",
+	"gateway":       "gateway",
+	"dhcp_pools":    "dhcp_pools",
+	"discover":      "discover",
+}
+
+// A yes/no column: true, yes, y, 1 and the like
+func parseBool(v string) bool {
+	b, err := strconv.ParseBool(strings.ToLower(v))
+	if err != nil {
+		b = strings.EqualFold(v, "yes") || strings.EqualFold(v, "y")
+	}
+	return b
+}
+
+// ParseCSV reads rows with a header line naming the columns (type, cidr,
+// address, description, owner, account, subdivide, hostname, mac, and the
+// export's parent, valid_masks, service, gateway, dhcp_pools, discover)
+func ParseCSV(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+	cols := make([]string, len(header))
+	known := 0
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		cols[i] = csvColumns[h]
+		if cols[i] != "" {
+			known++
+		}
+	}
+	if known == 0 {
+		return nil, errors.New("csv header has no known columns")
+	}
+	var rows []Row
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := Row{Line: line}
+		empty := true
+		for i, v := range rec {
+			if i >= len(cols) || v == "" {
+				continue
+			}
+			empty = false
+			switch cols[i] {
+			case "type":
+				row.Type = strings.ToLower(v)
+			case "cidr":
+				row.CIDR = v
+			case "address":
+				row.Address = v
+			case "description":
+				row.Description = v
+			case "owner":
+				row.Owner = v
+			case "account":
+				row.Account = v
+			case "subdivide":
+				row.Subdivide = parseBool(v)
+			case "hostname":
+				row.Hostname = v
+			case "mac":
+				row.MAC = v
+			case "parent":
+				row.Parent = v
+			case "valid_masks":
+				for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' }) {
+					m, err := strconv.ParseInt(f, 10, 16)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: bad valid_masks %q", line, v)
+					}
+					row.ValidMasks = append(row.ValidMasks, int16(m))
+				}
+			case "service":
+				n, err := strconv.ParseInt(v, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad service %q", line, v)
+				}
+				row.Service = n
+			case "gateway":
+				row.Gateway = v
+			case "dhcp_pools":
+				row.DHCPPools = v
+			case "discover":
+				row.Discover = parseBool(v)
+			}
+		}
+		if !empty {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,180 @@
+package importer
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func loadTables(t *testing.T, name string) Tables {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tables, err := ParseTables(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+// placed is a prepared row as the tests compare it
+type placed struct {
+	Key       string
+	Subdivide bool
+	Source    string
+}
+
+type problem struct {
+	Source  string
+	Problem string
+}
+
+func TestPrepareDumps(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		convert  func(Tables, string) ([]Row, error)
+		vrf      string
+		rows     []placed
+		problems []problem
+	}{
+		{
+			name: "netbox", file: "netbox.json", convert: NetBox,
+			rows: []placed{
+				{"10.0.0.0/8", true, "netbox prefix 1"},
+				{"10.1.0.0/16", true, "netbox prefix 2"}, // contains 10.1.2.0/24
+				{"10.1.2.0/24", false, "netbox prefix 3"},
+				{"2001:db8::/32", true, "netbox prefix 6"},
+				{"10.1.2.10", false, "netbox ip-address 1"},
+				{"2001:db8::1", false, "netbox ip-address 3"},
+			},
+			problems: []problem{
+				{"netbox prefix 4", "duplicate of netbox prefix 3"},
+				{"netbox prefix 5", "10.1.3.1/24 has host bits set (network is 10.1.3.0/24)"},
+				{"netbox ip-address 2", "duplicate of netbox ip-address 1"},
+				{"netbox ip-address 4", `bad address "not-an-address"`},
+			},
+		},
+		{
+			name: "netbox global", file: "netbox.json", convert: NetBox, vrf: "global",
+			rows: []placed{
+				{"10.0.0.0/8", true, "netbox prefix 1"},
+				{"10.1.0.0/16", true, "netbox prefix 2"},
+				{"10.1.2.0/24", false, "netbox prefix 3"},
+				{"2001:db8::/32", true, "netbox prefix 6"},
+				{"10.1.2.10", false, "netbox ip-address 1"},
+				{"2001:db8::1", false, "netbox ip-address 3"},
+			},
+			problems: []problem{
+				{"netbox prefix 5", "10.1.3.1/24 has host bits set (network is 10.1.3.0/24)"},
+				{"netbox ip-address 4", `bad address "not-an-address"`},
+			},
+		},
+		{
+			name: "netbox vrf by rd", file: "netbox.json", convert: NetBox, vrf: "65000:1",
+			rows: []placed{
+				{"10.1.2.0/24", false, "netbox prefix 4"},
+				{"10.1.2.10", false, "netbox ip-address 2"},
+			},
+		},
+		{
+			name: "phpipam", file: "phpipam.json", convert: PHPIPAM,
+			rows: []placed{
+				{"192.168.0.0/16", true, "phpipam subnet 1"},
+				{"192.168.1.0/24", false, "phpipam subnet 2"},
+				{"2001:db8::/32", false, "phpipam subnet 4"},
+				{"::/64", false, "phpipam subnet 5"},
+				{"192.168.1.10", false, "phpipam address 1"},
+				{"::1", false, "phpipam address 2"},
+				{"2001:db8::5", false, "phpipam address 3"},
+			},
+			problems: []problem{
+				{"phpipam subnet 6", "duplicate of phpipam subnet 2"},
+				{"phpipam address 4", "duplicate of phpipam address 1"},
+				{"phpipam address 5", `bad mac "00:11:22:33:44:55:66:77"`},
+			},
+		},
+		{
+			name: "phpipam vrf", file: "phpipam.json", convert: PHPIPAM, vrf: "blue",
+			rows: []placed{
+				{"192.168.1.0/24", false, "phpipam subnet 6"},
+				{"192.168.1.10", false, "phpipam address 4"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := tt.convert(loadTables(t, tt.file), tt.vrf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			good, bad := Prepare(rows)
+			var gotRows []placed
+			for _, r := range good {
+				gotRows = append(gotRows, placed{r.Key(), r.Subdivide, r.Source})
+			}
+			var gotProblems []problem
+			for _, p := range bad {
+				gotProblems = append(gotProblems, problem{p.Row.Source, p.Problem})
+			}
+			if !reflect.DeepEqual(gotRows, tt.rows) {
+				t.Errorf("rows\n got %v\nwant %v", gotRows, tt.rows)
+			}
+			if !reflect.DeepEqual(gotProblems, tt.problems) {
+				t.Errorf("problems\n got %v\nwant %v", gotProblems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestDumpFields(t *testing.T) {
+	nb, err := NetBox(loadTables(t, "netbox.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := nb[0]; r.Owner != "Corp" || r.Type != "network" {
+		t.Errorf("netbox prefix 1: %+v", r)
+	}
+	if r := nb[2]; r.Description != "web (VLAN 100 servers)" {
+		t.Errorf("netbox prefix 3 description %q", r.Description)
+	}
+	if r := nb[6]; r.Hostname != "web1.example.com" || r.Description != "web 1" {
+		t.Errorf("netbox ip-address 1: %+v", r)
+	}
+
+	php, err := PHPIPAM(loadTables(t, "phpipam.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := php[1]; r.Description != "switches (VLAN 200 mgmt)" {
+		t.Errorf("phpipam subnet 2 description %q", r.Description)
+	}
+	if r := php[5]; r.Hostname != "sw1.example.com" || r.MAC != "00:11:22:33:44:55" {
+		t.Errorf("phpipam address 1: %+v", r)
+	}
+}
+
+func TestDecimalIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		v6   bool
+		want string
+	}{
+		{"3232235786", false, "192.168.1.10"},
+		{"1", false, "0.0.0.1"},
+		{"1", true, "::1"},
+		{"0", true, "::"},
+		{"42540766411282592856903984951653826561", false, "2001:db8::1"},
+		{"192.0.2.1", true, "192.0.2.1"},
+		{"2001:db8::1", false, "2001:db8::1"},
+		{"junk", false, "junk"},
+	}
+	for _, tt := range tests {
+		if got := decimalIP(tt.in, tt.v6); got != tt.want {
+			t.Errorf("decimalIP(%q, %t) = %q, want %q", tt.in, tt.v6, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package importer
+
+import "strings"
+
+// NetBox maps a NetBox dump to rows. Tables are "prefixes" and
+// "ip-addresses" as returned by /api/ipam/... or exported from the UI,
+// plus "vrfs" and "vlans" to resolve references given only by ID.
+// vrf limits the import to one VRF by name or RD ("global" for prefixes
+// without one), since GoPieNg has a single address space.
+func NetBox(t Tables, vrf string) ([]Row, error) {
+	vrfs, err := t.records("vrfs", "vrf")
+	if err != nil {
+		return nil, err
+	}
+	vlans, err := t.records("vlans", "vlan")
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := t.records("prefixes", "prefix")
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := t.records("ip-addresses", "ip_addresses", "ipaddresses", "addresses")
+	if err != nil {
+		return nil, err
+	}
+
+	vrfName := map[string]string{}
+	for _, v := range vrfs {
+		vrfName[v.id("id")] = v.str("name")
+		if rd := v.str("rd"); rd != "" && strings.EqualFold(rd, vrf) {
+			vrf = v.str("name")
+		}
+	}
+	vlanName := map[string]string{}
+	for _, v := range vlans {
+		vlanName[v.id("id")] = strings.TrimSpace(v.str("vid") + " " + v.str("name"))
+	}
+	// VRF and VLAN columns are objects in the API, names in CSV exports
+	ref := func(r record, key string, names map[string]string) string {
+		switch v := r.get(key).(type) {
+		case map[string]any:
+			if key == "vlan" {
+				return strings.TrimSpace(text(v["vid"]) + " " + text(v["name"]))
+			}
+			return text(v)
+		case float64:
+			return names[r.id(key)]
+		default:
+			return text(v)
+		}
+	}
+
+	var rows []Row
+	for i, p := range prefixes {
+		if !vrfMatch(vrf, ref(p, "vrf", vrfName)) {
+			continue
+		}
+		status := strings.ToLower(p.str("status.value", "status"))
+		rows = append(rows, Row{
+			Line:        i + 1,
+			Source:      "netbox prefix " + p.str("id"),
+			Type:        "network",
+			CIDR:        p.str("prefix"),
+			Description: withVLAN(p.str("description"), ref(p, "vlan", vlanName)),
+			Owner:       p.str("tenant"),
+			Subdivide:   status == "container",
+		})
+	}
+	for i, a := range addresses {
+		if !vrfMatch(vrf, ref(a, "vrf", vrfName)) {
+			continue
+		}
+		rows = append(rows, Row{
+			Line:        i + 1,
+			Source:      "netbox ip-address " + a.str("id"),
+			Type:        "host",
+			Address:     a.str("address"),
+			Description: a.str("description"),
+			Hostname:    a.str("dns_name", "dns name"),
+		})
+	}
+	return rows, nil
+}
@@ -0,0 +1,83 @@
+package importer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PHPIPAM maps phpIPAM's subnets and ipaddresses tables to rows, from a
+// database dump (decimal addresses) or the API (text addresses). The
+// "vlans" and "vrf" tables resolve vlanId and vrfId; vrf filters as for
+// NetBox. Folders, which have no subnet, are skipped.
+func PHPIPAM(t Tables, vrf string) ([]Row, error) {
+	vrfs, err := t.records("vrf", "vrfs")
+	if err != nil {
+		return nil, err
+	}
+	vlans, err := t.records("vlans", "vlan")
+	if err != nil {
+		return nil, err
+	}
+	subnets, err := t.records("subnets")
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := t.records("ipaddresses", "addresses")
+	if err != nil {
+		return nil, err
+	}
+
+	vrfName := map[string]string{}
+	for _, v := range vrfs {
+		vrfName[v.id("vrfid", "id")] = v.str("name")
+		if rd := v.str("rd"); rd != "" && strings.EqualFold(rd, vrf) {
+			vrf = v.str("name")
+		}
+	}
+	vlanName := map[string]string{}
+	for _, v := range vlans {
+		vlanName[v.id("vlanid", "id")] = strings.TrimSpace(v.str("number") + " " + v.str("name"))
+	}
+
+	var rows []Row
+	subnetVRF := map[string]string{}
+	subnetV6 := map[string]bool{}
+	for i, s := range subnets {
+		vrfID := s.id("vrfid")
+		subnetVRF[s.id("id")] = vrfID
+		subnet, mask := s.str("subnet"), s.str("mask")
+		if s.str("isfolder") == "1" || subnet == "" || mask == "" {
+			continue
+		}
+		// An IPv4 subnet has a mask of at most 32, so a longer one makes
+		// a small number such as 0 or 1 the start of an IPv6 subnet
+		bits, _ := strconv.Atoi(mask)
+		addr := decimalIP(subnet, bits > 32)
+		subnetV6[s.id("id")] = strings.Contains(addr, ":")
+		if !vrfMatch(vrf, vrfName[vrfID]) {
+			continue
+		}
+		rows = append(rows, Row{
+			Line:        i + 1,
+			Source:      "phpipam subnet " + s.str("id"),
+			Type:        "network",
+			CIDR:        addr + "/" + mask,
+			Description: withVLAN(s.str("description"), vlanName[s.id("vlanid")]),
+		})
+	}
+	for i, a := range addresses {
+		if !vrfMatch(vrf, vrfName[subnetVRF[a.id("subnetid")]]) {
+			continue
+		}
+		rows = append(rows, Row{
+			Line:        i + 1,
+			Source:      "phpipam address " + a.str("id"),
+			Type:        "host",
+			Address:     decimalIP(a.str("ip_addr", "ip"), subnetV6[a.id("subnetid")]),
+			Description: a.str("description"),
+			Hostname:    a.str("hostname", "dns_name"),
+			MAC:         a.str("mac"),
+		})
+	}
+	return rows, nil
+}
@@ -0,0 +1,205 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Tables holds the raw dump of another IPAM, one entry per table
+// (e.g. "prefixes", "ip-addresses"). Each value is a JSON array, a REST
+// API page with a "results" array, or CSV with a header line.
+type Tables map[string][]byte
+
+// ParseTables splits a single JSON object of table name to rows
+func ParseTables(r io.Reader) (Tables, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	t := Tables{}
+	for name, v := range raw {
+		t[name] = v
+	}
+	return t, nil
+}
+
+// Rows of the first table present under any of names
+func (t Tables) records(names ...string) ([]record, error) {
+	for _, name := range names {
+		if data, ok := t[name]; ok {
+			recs, err := decodeRecords(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			return recs, nil
+		}
+	}
+	return nil, nil
+}
+
+// record is one row of a dumped table with lower-cased keys
+type record map[string]any
+
+func decodeRecords(data []byte) ([]record, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		var list []map[string]any
+		if trimmed[0] == '{' {
+			var page struct {
+				Results []map[string]any `json:"results"`
+			}
+			if err := json.Unmarshal(trimmed, &page); err != nil {
+				return nil, err
+			}
+			list = page.Results
+		} else if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+		out := make([]record, len(list))
+		for i, m := range list {
+			out[i] = lowerKeys(m)
+		}
+		return out, nil
+	}
+	cr := csv.NewReader(bytes.NewReader(trimmed))
+	cr.FieldsPerRecord = -1
+	all, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+	var out []record
+	for _, rec := range all[1:] {
+		m := record{}
+		for i, h := range all[0] {
+			if i < len(rec) && rec[i] != "" {
+				m[strings.ToLower(strings.TrimSpace(h))] = rec[i]
+			}
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func lowerKeys(m map[string]any) record {
+	out := record{}
+	for k, v := range m {
+		if sub, ok := v.(map[string]any); ok {
+			v = map[string]any(lowerKeys(sub))
+		}
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// get returns the first non-empty value for the keys, each of which may
+// be a dotted path into nested objects ("vrf.name")
+func (r record) get(keys ...string) any {
+	for _, k := range keys {
+		var v any = map[string]any(r)
+		for _, part := range strings.Split(k, ".") {
+			m, ok := v.(map[string]any)
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[part]
+		}
+		if v != nil && v != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+// str renders a value as text; nested objects (NetBox's brief
+// representations) are reduced to their name, value or label
+func (r record) str(keys ...string) string {
+	return text(r.get(keys...))
+}
+
+func text(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case map[string]any:
+		for _, k := range []string{"name", "value", "label", "display"} {
+			if s := text(t[k]); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// id returns a reference as its numeric ID, whether given as a number,
+// a string or an object with an "id"
+func (r record) id(keys ...string) string {
+	v := r.get(keys...)
+	if m, ok := v.(map[string]any); ok {
+		v = m["id"]
+	}
+	s := text(v)
+	if s == "0" {
+		return ""
+	}
+	return s
+}
+
+// decimalIP converts phpIPAM's decimal address storage to text; values
+// that are already addresses are returned as they are. The number alone
+// doesn't tell the family, since ::1 is stored as 1: v6 says the subnet
+// or row is IPv6, and only larger values are IPv6 regardless.
+func decimalIP(s string, v6 bool) string {
+	if net.ParseIP(s) != nil {
+		return s
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return s
+	}
+	if n.BitLen() <= 32 && !v6 {
+		b := make([]byte, 4)
+		return net.IP(n.FillBytes(b)).String()
+	}
+	b := make([]byte, 16)
+	return net.IP(n.FillBytes(b)).String()
+}
+
+// vrfMatch reports whether a row in VRF name (empty for the global
+// table) passes the filter: "" keeps everything, "global" only rows
+// without a VRF
+func vrfMatch(filter, name string) bool {
+	switch filter {
+	case "":
+		return true
+	case "global":
+		return name == ""
+	}
+	return strings.EqualFold(filter, name)
+}
+
+func withVLAN(desc, vlan string) string {
+	if vlan == "" {
+		return desc
+	}
+	if desc == "" {
+		return "VLAN " + vlan
+	}
+	return desc + " (VLAN " + vlan + ")"
+}
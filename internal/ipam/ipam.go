@@ -186,3 +186,19 @@ func AvailableSubnetsStr(parent string, children []string, mask int) []string {
 	}
 	return out
 }
+
+// FirstLastStr returns the first and last addresses covered by a CIDR
+func FirstLastStr(cidr string) (string, string) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil { return "", "" }
+	first, last := firstAndLast(n)
+	return first.String(), last.String()
+}
+
+// HostCIDR turns a bare address into a single-host CIDR (/32 or /128)
+func HostCIDR(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil { return "" }
+	if ip.To4() != nil { return ip.String() + "/32" }
+	return ip.String() + "/128"
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"github.com/yellowman/GoPieNg/internal/apierr"
 	"github.com/yellowman/GoPieNg/internal/auth"
 )
 
@@ -14,11 +15,11 @@ func JWT(jwtm *auth.Manager) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
 			authz := r.Header.Get("Authorization")
-			if authz == "" { http.Error(w, "missing token", 401); return }
+			if authz == "" { apierr.Write(w, r, apierr.Unauthorized, "missing token"); return }
 			parts := strings.SplitN(authz, " ", 2)
-			if len(parts) != 2 { http.Error(w, "bad token", 401); return }
+			if len(parts) != 2 { apierr.Write(w, r, apierr.Unauthorized, "bad token"); return }
 			claims, err := jwtm.Parse(parts[1])
-			if err != nil { http.Error(w, "invalid token", 401); return }
+			if err != nil { apierr.Write(w, r, apierr.Unauthorized, "invalid token"); return }
 			ctx := context.WithValue(r.Context(), ClaimsKey, claims)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
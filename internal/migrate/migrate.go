@@ -0,0 +1,275 @@
+// Package migrate applies the versioned schema migrations embedded in
+// the binary and records them in the schema_migrations table.
+package migrate
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// Migration is one schema version. Files are named
+// NNNN_name.up.sql and NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) String() string { return fmt.Sprintf("%04d_%s", m.Version, m.Name) }
+
+// Load reads the migrations in dir of fsys, ordered by version. Every
+// version needs an up file; a missing down file makes it irreversible.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		base := e.Name()
+		stem, up := strings.CutSuffix(base, ".up.sql")
+		if !up {
+			var down bool
+			if stem, down = strings.CutSuffix(base, ".down.sql"); !down {
+				continue
+			}
+		}
+		num, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", base)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, base))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if up {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up file", m)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Postgres returns the migrations for the PostgreSQL schema
+func Postgres() []Migration { return embedded("postgres") }
+
+// SQLite returns the migrations for the SQLite schema
+func SQLite() []Migration { return embedded("sqlite") }
+
+// For returns the migrations for a database/sql driver name
+func For(driver string) []Migration {
+	if driver == "sqlite3" {
+		return SQLite()
+	}
+	return Postgres()
+}
+
+func embedded(dir string) []Migration {
+	migs, err := Load(files, dir)
+	if err != nil {
+		panic(err) // the embedded files are part of the build
+	}
+	return migs
+}
+
+// Latest is the newest version in migs, or 0
+func Latest(migs []Migration) int {
+	if len(migs) == 0 {
+		return 0
+	}
+	return migs[len(migs)-1].Version
+}
+
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// hasTable reports whether schema_migrations exists without creating
+// it. SQLite lists its tables in sqlite_master; PostgreSQL, where that
+// query fails, is asked through information_schema.
+func hasTable(db *sql.DB) (bool, error) {
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&n); err == nil {
+		return n > 0, nil
+	}
+	err := db.QueryRow(`SELECT count(*) FROM information_schema.tables
+		WHERE table_name = 'schema_migrations' AND table_schema = ANY(current_schemas(false))`).Scan(&n)
+	return n > 0, err
+}
+
+// Applied returns the applied versions and when they were applied. A
+// database without a schema_migrations table, such as one set up before
+// migrations existed, reads as version 0. Applied never writes, so it
+// works for a read-only user; Up and Down create the table.
+func Applied(db *sql.DB) (map[int]time.Time, error) {
+	out := map[int]time.Time{}
+	if ok, err := hasTable(db); err != nil || !ok {
+		return out, err
+	}
+	rows, err := db.Query(`SELECT version, applied FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var t time.Time
+		if err := rows.Scan(&v, &t); err != nil {
+			return nil, err
+		}
+		out[v] = t
+	}
+	return out, rows.Err()
+}
+
+// Status is one migration and when it was applied, if it was
+type Status struct {
+	Migration
+	Applied *time.Time
+}
+
+// List reports every migration with its applied time
+func List(db *sql.DB, migs []Migration) ([]Status, error) {
+	applied, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, len(migs))
+	for i, m := range migs {
+		out[i].Migration = m
+		if t, ok := applied[m.Version]; ok {
+			out[i].Applied = &t
+		}
+	}
+	return out, nil
+}
+
+func run(db *sql.DB, m Migration, script string, record string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	// versions are ints and names come from our own file names
+	if _, err := tx.Exec(record); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	return tx.Commit()
+}
+
+// Up applies the pending migrations up to and including target (0 for
+// all), each in its own transaction, and returns the ones applied
+func Up(db *sql.DB, migs []Migration, target int) ([]Migration, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range migs {
+		if _, ok := applied[m.Version]; ok || (target > 0 && m.Version > target) {
+			continue
+		}
+		record := fmt.Sprintf(`INSERT INTO schema_migrations(version, name) VALUES(%d, '%s')`, m.Version, strings.ReplaceAll(m.Name, "'", "''"))
+		if err := run(db, m, m.Up, record); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down reverts the newest steps applied migrations and returns them
+func Down(db *sql.DB, migs []Migration, steps int) ([]Migration, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(migs) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migs[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("%s cannot be reverted", m)
+		}
+		if err := run(db, m, m.Down, fmt.Sprintf(`DELETE FROM schema_migrations WHERE version = %d`, m.Version)); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// OutOfDateError is returned by Check when migrations are pending
+type OutOfDateError struct {
+	Pending []Migration
+}
+
+func (e *OutOfDateError) Error() string {
+	names := make([]string, len(e.Pending))
+	for i, m := range e.Pending {
+		names[i] = m.String()
+	}
+	return "database schema is out of date; pending migrations: " + strings.Join(names, ", ")
+}
+
+// Check returns an *OutOfDateError if any migration has not been applied
+func Check(db *sql.DB, migs []Migration) error {
+	applied, err := Applied(db)
+	if err != nil {
+		return err
+	}
+	var pending []Migration
+	for _, m := range migs {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) > 0 {
+		return &OutOfDateError{Pending: pending}
+	}
+	return nil
+}
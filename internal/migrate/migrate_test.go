@@ -0,0 +1,84 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "pieng.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB) bool {
+	t.Helper()
+	ok, err := hasTable(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestCheckWithoutTable(t *testing.T) {
+	db := openSQLite(t)
+	migs := SQLite()
+
+	err := Check(db, migs)
+	var out *OutOfDateError
+	if !errors.As(err, &out) || len(out.Pending) != len(migs) {
+		t.Fatalf("Check = %v, want every migration pending", err)
+	}
+	list, err := List(db, migs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range list {
+		if st.Applied != nil {
+			t.Errorf("%s applied at %v, want pending", st.Migration, st.Applied)
+		}
+	}
+	if tableExists(t, db) {
+		t.Fatal("Check and List created schema_migrations")
+	}
+
+	// a read-only connection can still be checked
+	if _, err := db.Exec(`PRAGMA query_only = ON`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(db, migs); !errors.As(err, &out) {
+		t.Fatalf("read-only Check = %v, want an *OutOfDateError", err)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	db := openSQLite(t)
+	migs := SQLite()
+
+	done, err := Up(db, migs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(migs) || !tableExists(t, db) {
+		t.Fatalf("Up applied %d of %d migrations", len(done), len(migs))
+	}
+	if err := Check(db, migs); err != nil {
+		t.Fatalf("Check after Up = %v", err)
+	}
+	if done, err = Down(db, migs, 1); err != nil || len(done) != 1 {
+		t.Fatalf("Down = %v, %v", done, err)
+	}
+	err = Check(db, migs)
+	var out *OutOfDateError
+	if !errors.As(err, &out) || len(out.Pending) != 1 || out.Pending[0].Version != Latest(migs) {
+		t.Fatalf("Check after Down = %v, want the newest migration pending", err)
+	}
+}
@@ -0,0 +1,67 @@
+-- Tables from the original PieNg. Everything is created only if missing,
+-- so a database set up from an older schema.sql can be brought under
+-- migrations by running "gopieng migrate up".
+
+CREATE TABLE IF NOT EXISTS networks (
+    id SERIAL PRIMARY KEY,
+    parent INTEGER REFERENCES networks(id),
+    address_range CIDR NOT NULL,
+    description TEXT,
+    subdivide BOOLEAN NOT NULL,
+    valid_masks SMALLINT[],
+    owner VARCHAR(255),
+    account VARCHAR(32),
+    service INTEGER,
+    CONSTRAINT networks_address_range_key UNIQUE (address_range)
+);
+
+CREATE INDEX IF NOT EXISTS idx_networks_parent ON networks(parent);
+CREATE INDEX IF NOT EXISTS idx_networks_address ON networks USING GIST (address_range inet_ops);
+
+CREATE TABLE IF NOT EXISTS hosts (
+    address INET PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id),
+    description TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_hosts_network ON hosts(network);
+
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(32) UNIQUE NOT NULL,
+    password TEXT NOT NULL,
+    email TEXT,
+    status INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    "user" INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role INTEGER REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY ("user", role)
+);
+
+CREATE TABLE IF NOT EXISTS changelog (
+    id SERIAL PRIMARY KEY,
+    "user" INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    change_time TIMESTAMP NOT NULL DEFAULT NOW(),
+    prefix INET NOT NULL,
+    change TEXT NOT NULL
+);
+
+-- PieNg made the user NOT NULL without ON DELETE, which blocks deleting users
+ALTER TABLE changelog ALTER COLUMN "user" DROP NOT NULL;
+ALTER TABLE changelog DROP CONSTRAINT IF EXISTS changelog_user_fkey;
+ALTER TABLE changelog ADD CONSTRAINT changelog_user_fkey
+    FOREIGN KEY ("user") REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_changelog_time ON changelog(change_time DESC);
+
+INSERT INTO roles (name) VALUES ('administrator') ON CONFLICT DO NOTHING;
+INSERT INTO roles (name) VALUES ('creator') ON CONFLICT DO NOTHING;
+INSERT INTO roles (name) VALUES ('editor') ON CONFLICT DO NOTHING;
+INSERT INTO roles (name) VALUES ('reader') ON CONFLICT DO NOTHING;
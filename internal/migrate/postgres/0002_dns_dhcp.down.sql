@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS dns_update_queue;
+DROP TABLE IF EXISTS dns_update_targets;
+ALTER TABLE networks DROP COLUMN IF EXISTS dhcp_pools;
+ALTER TABLE networks DROP COLUMN IF EXISTS gateway;
+ALTER TABLE hosts DROP COLUMN IF EXISTS mac;
+ALTER TABLE hosts DROP COLUMN IF EXISTS hostname;
@@ -0,0 +1,33 @@
+-- Hostnames for zone generation, MACs and pools for DHCP, and the
+-- dynamic DNS update targets and queue
+
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS hostname VARCHAR(255);
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS mac MACADDR;
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS gateway INET;
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS dhcp_pools TEXT;
+
+CREATE TABLE IF NOT EXISTS dns_update_targets (
+    id SERIAL PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    server VARCHAR(255) NOT NULL,
+    forward BOOLEAN NOT NULL DEFAULT TRUE,
+    reverse BOOLEAN NOT NULL DEFAULT TRUE,
+    forward_zone VARCHAR(255),
+    reverse_zone VARCHAR(255),
+    key_name VARCHAR(255),
+    key_algorithm VARCHAR(32) NOT NULL DEFAULT 'hmac-sha256',
+    key_secret TEXT,
+    ttl INTEGER NOT NULL DEFAULT 3600
+);
+
+CREATE TABLE IF NOT EXISTS dns_update_queue (
+    id SERIAL PRIMARY KEY,
+    target INTEGER NOT NULL REFERENCES dns_update_targets(id) ON DELETE CASCADE,
+    action VARCHAR(8) NOT NULL,
+    address INET NOT NULL,
+    hostname VARCHAR(255) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created TIMESTAMP NOT NULL DEFAULT NOW(),
+    next_attempt TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS discovery;
+ALTER TABLE networks DROP COLUMN IF EXISTS last_swept;
+ALTER TABLE networks DROP COLUMN IF EXISTS discover;
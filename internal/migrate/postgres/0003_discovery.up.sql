@@ -0,0 +1,14 @@
+-- Scheduled discovery sweeps
+
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS discover BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS last_swept TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS discovery (
+    address INET PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    first_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+    ports INTEGER[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS idx_discovery_network ON discovery(network);
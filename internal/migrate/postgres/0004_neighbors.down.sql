@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS mac_locations;
+DROP TABLE IF EXISTS neighbors;
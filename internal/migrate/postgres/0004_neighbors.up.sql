@@ -0,0 +1,23 @@
+-- Uploaded ARP/NDP neighbor tables and switch MAC address tables
+
+CREATE TABLE IF NOT EXISTS neighbors (
+    address INET NOT NULL,
+    mac MACADDR NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    interface TEXT NOT NULL DEFAULT '',
+    first_seen TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL,
+    PRIMARY KEY (address, mac, device)
+);
+
+CREATE INDEX IF NOT EXISTS idx_neighbors_mac ON neighbors(mac);
+
+CREATE TABLE IF NOT EXISTS mac_locations (
+    mac MACADDR NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    port TEXT NOT NULL,
+    vlan INTEGER NOT NULL DEFAULT 0,
+    first_seen TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL,
+    PRIMARY KEY (mac, device, port, vlan)
+);
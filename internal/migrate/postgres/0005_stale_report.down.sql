@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS dhcp_leases;
+ALTER TABLE hosts DROP COLUMN IF EXISTS review;
+ALTER TABLE networks DROP COLUMN IF EXISTS review;
+ALTER TABLE networks DROP COLUMN IF EXISTS stale_days;
@@ -0,0 +1,15 @@
+-- Per-subtree thresholds and review marks for the stale report, and the
+-- imported DHCP leases it reads
+
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS stale_days INTEGER;
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS review TIMESTAMP;
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS review TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS dhcp_leases (
+    address INET PRIMARY KEY,
+    mac MACADDR,
+    hostname VARCHAR(255),
+    ends TIMESTAMP,
+    active BOOLEAN NOT NULL,
+    imported TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS hosts_containment ON hosts;
+DROP FUNCTION IF EXISTS hosts_check_containment();
+DROP TRIGGER IF EXISTS networks_containment ON networks;
+DROP FUNCTION IF EXISTS networks_check_containment();
+ALTER TABLE networks DROP CONSTRAINT IF EXISTS networks_siblings_no_overlap;
@@ -0,0 +1,51 @@
+-- Containment and overlap rules, enforced here so that hand-written SQL
+-- and racing requests can't break the tree: siblings (roots count as
+-- siblings of each other) never overlap, a network lies strictly inside
+-- its parent, and a host lies inside its network. Violations raise
+-- exclusion_violation (23P01) or check_violation (23514), which the API
+-- answers with 409. Run "gopieng check" on an existing database first;
+-- this migration fails if the data already breaks the rules.
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+DO $$ BEGIN
+    ALTER TABLE networks ADD CONSTRAINT networks_siblings_no_overlap
+        EXCLUDE USING gist ((coalesce(parent, 0)) WITH =, address_range inet_ops WITH &&);
+EXCEPTION WHEN duplicate_table OR duplicate_object THEN NULL;
+END $$;
+
+CREATE OR REPLACE FUNCTION networks_check_containment() RETURNS trigger AS $$
+BEGIN
+    IF NEW.parent IS NOT NULL AND NOT EXISTS (
+        SELECT 1 FROM networks WHERE id = NEW.parent AND address_range >> NEW.address_range) THEN
+        RAISE EXCEPTION 'network % is not inside its parent', NEW.address_range
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'networks_within_parent';
+    END IF;
+    IF TG_OP = 'UPDATE' AND NEW.address_range <> OLD.address_range THEN
+        IF EXISTS (SELECT 1 FROM networks WHERE parent = NEW.id AND NOT NEW.address_range >> address_range) THEN
+            RAISE EXCEPTION 'children of network % would fall outside %', NEW.id, NEW.address_range
+                USING ERRCODE = 'check_violation', CONSTRAINT = 'networks_within_parent';
+        END IF;
+        IF EXISTS (SELECT 1 FROM hosts WHERE network = NEW.id AND NOT NEW.address_range >>= address) THEN
+            RAISE EXCEPTION 'hosts of network % would fall outside %', NEW.id, NEW.address_range
+                USING ERRCODE = 'check_violation', CONSTRAINT = 'hosts_within_network';
+        END IF;
+    END IF;
+    RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS networks_containment ON networks;
+CREATE TRIGGER networks_containment BEFORE INSERT OR UPDATE OF parent, address_range ON networks
+    FOR EACH ROW EXECUTE FUNCTION networks_check_containment();
+
+CREATE OR REPLACE FUNCTION hosts_check_containment() RETURNS trigger AS $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM networks WHERE id = NEW.network AND address_range >>= NEW.address) THEN
+        RAISE EXCEPTION 'host % is not inside network %', host(NEW.address), NEW.network
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'hosts_within_network';
+    END IF;
+    RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS hosts_containment ON hosts;
+CREATE TRIGGER hosts_containment BEFORE INSERT OR UPDATE OF address, network ON hosts
+    FOR EACH ROW EXECUTE FUNCTION hosts_check_containment();
@@ -0,0 +1,2 @@
+-- Nothing to undo: the /128 prefixes are what the code logs now.
+SELECT 1;
@@ -0,0 +1,6 @@
+-- IPv6 host changes used to be logged as address/32, which neither
+-- matches the host's /128 nor lies inside its network. Networks are
+-- logged without host bits, so an address with bits right of a /32 mask
+-- is a host.
+UPDATE changelog SET prefix = set_masklen(prefix, 128)
+WHERE family(prefix) = 6 AND masklen(prefix) = 32 AND host(prefix) <> host(network(prefix));
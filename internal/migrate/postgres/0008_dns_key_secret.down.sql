@@ -0,0 +1,2 @@
+-- PUBLIC has no privileges on new tables, so there is nothing to grant back.
+COMMENT ON COLUMN dns_update_targets.key_secret IS NULL;
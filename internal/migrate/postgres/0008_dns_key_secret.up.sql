@@ -0,0 +1,10 @@
+-- TSIG secrets are kept as entered (base64, as in named.conf) because
+-- the update worker signs with them, and the API never returns them.
+-- Only the table owner, the role GoPieNg runs as, may read them; give
+-- other roles the columns they need, e.g.
+--   GRANT SELECT (id, network, server, forward, reverse, forward_zone,
+--                 reverse_zone, key_name, key_algorithm, ttl)
+--   ON dns_update_targets TO reporting;
+REVOKE ALL ON dns_update_targets FROM PUBLIC;
+COMMENT ON COLUMN dns_update_targets.key_secret IS
+    'TSIG secret in base64, stored in plain text; readable only by the application role';
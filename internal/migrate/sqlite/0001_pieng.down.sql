@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS changelog;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS hosts;
+DROP TABLE IF EXISTS networks;
@@ -0,0 +1,71 @@
+-- Core tables for the SQLite backend. Prefixes and addresses are stored
+-- as normalized binary: a family byte (4 or 6) followed by the 4 or 16
+-- address bytes, so ORDER BY prefix, masklen sorts like PostgreSQL's
+-- inet. Containment and overlap are checked in Go, not by the schema.
+
+CREATE TABLE IF NOT EXISTS networks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    parent INTEGER REFERENCES networks(id),
+    prefix BLOB NOT NULL,
+    masklen INTEGER NOT NULL,
+    description TEXT,
+    subdivide BOOLEAN NOT NULL,
+    valid_masks TEXT,                -- "{24,28}" as PostgreSQL prints smallint[]
+    owner VARCHAR(255),
+    account VARCHAR(32),
+    service INTEGER,
+    gateway BLOB,
+    dhcp_pools TEXT,
+    discover BOOLEAN NOT NULL DEFAULT 0,
+    last_swept TIMESTAMP,
+    stale_days INTEGER,
+    review TIMESTAMP,
+    UNIQUE (prefix, masklen)
+);
+
+CREATE INDEX IF NOT EXISTS idx_networks_parent ON networks(parent);
+
+CREATE TABLE IF NOT EXISTS hosts (
+    address BLOB PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id),
+    description TEXT NOT NULL,
+    hostname VARCHAR(255),
+    mac VARCHAR(17),
+    review TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_hosts_network ON hosts(network);
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(32) UNIQUE NOT NULL,
+    password TEXT NOT NULL,
+    email TEXT,
+    status INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    "user" INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role INTEGER REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY ("user", role)
+);
+
+CREATE TABLE IF NOT EXISTS changelog (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    change_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    prefix TEXT NOT NULL,
+    change TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_changelog_time ON changelog(change_time DESC);
+
+INSERT OR IGNORE INTO roles (name) VALUES ('administrator');
+INSERT OR IGNORE INTO roles (name) VALUES ('creator');
+INSERT OR IGNORE INTO roles (name) VALUES ('editor');
+INSERT OR IGNORE INTO roles (name) VALUES ('reader');
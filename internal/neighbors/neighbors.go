@@ -0,0 +1,260 @@
+// Package neighbors parses ARP/NDP neighbor tables and switch MAC
+// address tables.
+package neighbors
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Entry is one line of a neighbor table (Address set) or a switch MAC
+// table (Port and VLAN set)
+type Entry struct {
+	Address   string `json:"address,omitempty"`
+	MAC       string `json:"mac"`
+	Interface string `json:"interface,omitempty"`
+	Port      string `json:"port,omitempty"`
+	VLAN      int    `json:"vlan,omitempty"`
+}
+
+// Formats lists the accepted format names. arp, ndp and ip all read the
+// same way, so one upload can mix arp -an, ndp -an and ip neigh output.
+var Formats = []string{"arp", "ndp", "ip", "snmp", "mac-table"}
+
+// Parse reads a neighbor or MAC table. An empty format guesses from the
+// content: a CSV header naming ipNetToMedia or ipNetToPhysical columns is
+// snmp, a "Mac Address Table" or "Vlan" header is mac-table, anything
+// else is read as arp/ndp/ip neigh output. Incomplete and failed entries
+// are skipped.
+func Parse(r io.Reader, format string) ([]Entry, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		head, _ := br.Peek(1024)
+		format = guess(string(head))
+	}
+	switch format {
+	case "arp", "ndp", "ip":
+		return parseNeighbors(br)
+	case "snmp":
+		return parseSNMP(br)
+	case "mac-table":
+		return parseMACTable(br)
+	}
+	return nil, fmt.Errorf("format must be one of %s", strings.Join(Formats, ", "))
+}
+
+func guess(head string) string {
+	lower := strings.ToLower(head)
+	first, _, _ := strings.Cut(lower, "\n")
+	switch {
+	case strings.Contains(first, ",") && (strings.Contains(first, "ipnettomedia") || strings.Contains(first, "ipnettophysical")):
+		return "snmp"
+	case strings.Contains(lower, "mac address table") || strings.HasPrefix(strings.TrimSpace(first), "vlan"):
+		return "mac-table"
+	}
+	return "arp"
+}
+
+// ParseMAC accepts the usual notations plus the ones routers print:
+// unpadded octets (0:1b:2:...), Cisco dotted (001b.0203.0405), SNMP
+// hex strings (0x001b02030405, "00 1b 02 03 04 05"). It returns the
+// canonical colon form.
+func ParseMAC(s string) (string, error) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if hw, err := net.ParseMAC(s); err == nil && len(hw) == 6 {
+		return hw.String(), nil
+	}
+	raw := strings.TrimPrefix(strings.ToLower(s), "0x")
+	for _, sep := range []string{":", "-", " "} {
+		if parts := strings.Split(raw, sep); len(parts) == 6 {
+			for i, p := range parts {
+				if len(p) == 1 {
+					parts[i] = "0" + p
+				}
+			}
+			raw = strings.Join(parts, "")
+			break
+		}
+	}
+	b, err := hex.DecodeString(raw)
+	if err != nil || len(b) != 6 {
+		return "", fmt.Errorf("bad MAC address %q", s)
+	}
+	return net.HardwareAddr(b).String(), nil
+}
+
+// parseIP strips the decorations arp and ndp put around addresses:
+// "(192.0.2.1)" and a "%em0" zone
+func parseIP(s string) net.IP {
+	s = strings.Trim(s, "()")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// One entry per line, in any of these layouts:
+//
+//	OpenBSD arp -an:  192.0.2.1 00:1b:02:03:04:05 em0 19m58s
+//	OpenBSD ndp -an:  fe80::1%em0 00:1b:02:03:04:05 em0 23h59m S R
+//	BSD/Linux arp:    ? (192.0.2.1) at 0:1b:2:3:4:5 on en0 [ethernet]
+//	ip neigh:         192.0.2.1 dev eth0 lladdr 00:1b:02:03:04:05 REACHABLE
+func parseNeighbors(r io.Reader) ([]Entry, error) {
+	var out []Entry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		var e Entry
+		for i := 0; i < len(f); i++ {
+			switch {
+			case e.Address == "" && parseIP(f[i]) != nil:
+				e.Address = parseIP(f[i]).String()
+			case e.Address != "" && e.MAC == "":
+				if mac, err := ParseMAC(f[i]); err == nil {
+					e.MAC = mac
+					// BSD layout: the interface follows the address
+					if i+1 < len(f) && f[i-1] != "lladdr" && f[i-1] != "at" {
+						e.Interface = f[i+1]
+					}
+				}
+			}
+			if (f[i] == "on" || f[i] == "dev") && i+1 < len(f) {
+				e.Interface = f[i+1]
+			}
+		}
+		if e.Address == "" || e.MAC == "" {
+			continue // headers, (incomplete), FAILED
+		}
+		out = append(out, e)
+	}
+	return out, sc.Err()
+}
+
+// Columns of ipNetToMediaTable and ipNetToPhysicalTable by the end of
+// their object names, and the plain names also accepted
+var (
+	snmpObjects = []struct{ suffix, key string }{
+		{"nettomedianetaddress", "address"}, {"nettophysicalnetaddress", "address"},
+		{"nettomediaphysaddress", "mac"}, {"nettophysicalphysaddress", "mac"},
+		{"nettomediaifindex", "interface"}, {"nettophysicalifindex", "interface"},
+		{"nettomediatype", "type"}, {"nettophysicaltype", "type"},
+	}
+	snmpPlain = []string{"address", "mac", "interface", "type"}
+)
+
+// SNMP walks of ipNetToMediaTable (RFC 1213) or ipNetToPhysicalTable
+// (RFC 4293) exported as CSV. Columns are found by object name with or
+// without a module prefix, so "ipNetToMediaPhysAddress" and
+// "IP-MIB::ipNetToPhysicalPhysAddress" both work; plain "address",
+// "mac", "interface" and "type" columns do too.
+func parseSNMP(r io.Reader) ([]Entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{}
+	add := func(key string, i int) {
+		if _, seen := col[key]; !seen {
+			col[key] = i
+		}
+	}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		for _, o := range snmpObjects {
+			if strings.HasSuffix(h, o.suffix) {
+				add(o.key, i)
+			}
+		}
+		for _, name := range snmpPlain {
+			if h == name {
+				add(name, i)
+			}
+		}
+	}
+	if _, ok := col["address"]; !ok {
+		return nil, errors.New("snmp csv: no address column")
+	}
+	if _, ok := col["mac"]; !ok {
+		return nil, errors.New("snmp csv: no physical address column")
+	}
+	get := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	var out []Entry
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// type 2 is invalid(2) in both tables
+		if t := get(rec, "type"); t == "2" || strings.HasPrefix(t, "invalid") {
+			continue
+		}
+		ip := parseIP(get(rec, "address"))
+		if ip == nil {
+			return nil, fmt.Errorf("snmp csv line %d: bad address", line)
+		}
+		mac, err := ParseMAC(get(rec, "mac"))
+		if err != nil {
+			continue // incomplete entries have an empty physical address
+		}
+		out = append(out, Entry{Address: ip.String(), MAC: mac, Interface: get(rec, "interface")})
+	}
+	return out, nil
+}
+
+// Switch MAC address tables, one entry per line with an optional VLAN
+// before the MAC and the port last:
+//
+//	Cisco:   10    001b.0203.0405    DYNAMIC     Gi1/0/1
+//	OpenBSD: 00:1b:02:03:04:05 em1 1 flags=0<>
+//
+// OpenBSD's ifconfig bridge output has the port right after the MAC.
+// Entries on the CPU or a router interface are skipped.
+func parseMACTable(r io.Reader) ([]Entry, error) {
+	var out []Entry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		for i, tok := range f {
+			mac, err := ParseMAC(tok)
+			if err != nil {
+				continue
+			}
+			e := Entry{MAC: mac}
+			if i > 0 {
+				if v, err := strconv.Atoi(f[i-1]); err == nil && v >= 1 && v <= 4094 {
+					e.VLAN = v
+				}
+			}
+			switch {
+			case i+1 < len(f) && strings.Contains(f[len(f)-1], "flags="):
+				e.Port = f[i+1]
+			case i+1 < len(f):
+				e.Port = f[len(f)-1]
+			}
+			if e.Port != "" && !strings.EqualFold(e.Port, "cpu") && !strings.EqualFold(e.Port, "router") {
+				out = append(out, e)
+			}
+			break
+		}
+	}
+	return out, sc.Err()
+}
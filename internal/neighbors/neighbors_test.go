@@ -0,0 +1,165 @@
+package neighbors
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	mac1 = "00:1b:02:03:04:05"
+	mac2 = "52:54:00:aa:bb:cc"
+	mac3 = "00:1b:02:03:04:06"
+)
+
+func TestParseMAC(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"00:1b:02:03:04:05", mac1},
+		{"00-1B-02-03-04-05", mac1},
+		{"0:1b:2:3:4:5", mac1},
+		{"0-1b-2-3-4-5", mac1},
+		{"001b.0203.0405", mac1},
+		{"0x001b02030405", mac1},
+		{"001B02030405", mac1},
+		{`"00 1b 02 03 04 05"`, mac1},
+		{" 0 1b 2 3 4 5 ", mac1},
+		{"(incomplete)", ""},
+		{"00:1b:02:03:04", ""},
+		{"00:1b:02:03:04:05:06:07", ""},
+		{"0x001b0203040", ""},
+		{"zz:1b:02:03:04:05", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := ParseMAC(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseMAC(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMAC(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string // empty to guess
+		want   []Entry
+	}{
+		{
+			file: "openbsd-arp.txt",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "em0"},
+				{Address: "192.0.2.20", MAC: mac2, Interface: "em0"},
+			},
+		},
+		{
+			file: "openbsd-ndp.txt",
+			want: []Entry{
+				{Address: "2001:db8::1", MAC: mac1, Interface: "em0"},
+				{Address: "fe80::21b:2ff:fe03:405", MAC: mac1, Interface: "em0"},
+				{Address: "2001:db8::20", MAC: mac2, Interface: "em0"},
+			},
+		},
+		{
+			file:   "bsd-arp.txt",
+			format: "arp",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "en0"},
+				{Address: "192.0.2.254", MAC: mac2, Interface: "en0"},
+				{Address: "198.51.100.7", MAC: mac3, Interface: "eth1"},
+			},
+		},
+		{
+			file:   "ip-neigh.txt",
+			format: "ip",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "eth0"},
+				{Address: "2001:db8::1", MAC: mac1, Interface: "eth0"},
+				{Address: "fe80::21b:2ff:fe03:405", MAC: mac1, Interface: "eth0"},
+			},
+		},
+		{
+			file: "ipNetToMediaTable.csv",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "2"},
+				{Address: "192.0.2.20", MAC: mac2, Interface: "2"},
+				{Address: "198.51.100.1", MAC: mac3, Interface: "3"},
+			},
+		},
+		{
+			file: "ipNetToPhysicalTable.csv",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "2"},
+				{Address: "2001:db8::1", MAC: mac1, Interface: "2"},
+				{Address: "fe80::21b:2ff:fe03:405", MAC: mac1, Interface: "2"},
+				{Address: "2001:db8::20", MAC: mac2, Interface: "2"},
+			},
+		},
+		{
+			file:   "plain.csv",
+			format: "snmp",
+			want: []Entry{
+				{Address: "192.0.2.1", MAC: mac1, Interface: "vlan10"},
+				{Address: "2001:db8::1", MAC: mac1, Interface: "vlan10"},
+			},
+		},
+		{
+			file: "cisco-mac-table.txt",
+			want: []Entry{
+				{MAC: mac1, VLAN: 10, Port: "Gi1/0/1"},
+				{MAC: mac2, VLAN: 10, Port: "Gi1/0/2"},
+				{MAC: mac3, VLAN: 20, Port: "Po1"},
+			},
+		},
+		{
+			file:   "openbsd-bridge.txt",
+			format: "mac-table",
+			want: []Entry{
+				{MAC: mac1, Port: "em1"},
+				{MAC: mac2, Port: "vether0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := Parse(f, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in, format, err string
+	}{
+		{in: "ipNetToMediaPhysAddress,ipNetToMediaIfIndex\n", err: "snmp csv: no address column"},
+		{in: "IP-MIB::ipNetToPhysicalNetAddress,IP-MIB::ipNetToPhysicalNetAddressType\n", err: "snmp csv: no physical address column"},
+		{in: "address,mac\n192.0.2.1,00:1b:02:03:04:05\nnot-an-address,00:1b:02:03:04:05\n", format: "snmp", err: "snmp csv line 3: bad address"},
+		{in: "", format: "lldp", err: "format must be one of arp, ndp, ip, snmp, mac-table"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.in), tt.format)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %q", tt.in, err, tt.err)
+		}
+	}
+}
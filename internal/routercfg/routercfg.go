@@ -0,0 +1,263 @@
+// Package routercfg extracts interface addresses from router and host
+// configuration: Cisco IOS, Junos "display set" output and OpenBSD
+// hostname.if(5) files.
+package routercfg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Interface is one address configured on an interface
+type Interface struct {
+	Device    string `json:"device,omitempty"`
+	Name      string `json:"interface"`
+	Address   string `json:"address,omitempty"` // empty for prefix-only (EUI-64) config
+	Prefix    string `json:"prefix"`
+	Secondary bool   `json:"secondary,omitempty"`
+}
+
+// HostRoute reports a /32 or /128, e.g. a loopback, which has no subnet
+func (i Interface) HostRoute() bool {
+	_, n, err := net.ParseCIDR(i.Prefix)
+	if err != nil {
+		return false
+	}
+	ones, bits := n.Mask.Size()
+	return ones == bits
+}
+
+// Detect guesses the format from the file name and content: "openbsd"
+// for hostname.* files, "junos" for set commands, otherwise "ios"
+func Detect(filename string, head []byte) string {
+	if strings.HasPrefix(path.Base(filename), "hostname.") {
+		return "openbsd"
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(head)))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		if strings.HasPrefix(line, "set ") {
+			return "junos"
+		}
+		break
+	}
+	return "ios"
+}
+
+// Parse reads one configuration file. filename is used to detect the
+// format when it is empty and, for OpenBSD, to name the interface.
+func Parse(r io.Reader, format, filename string) ([]Interface, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		head, _ := br.Peek(4096)
+		format = Detect(filename, head)
+	}
+	switch format {
+	case "ios":
+		return parseIOS(br)
+	case "junos":
+		return parseJunos(br)
+	case "openbsd":
+		ifname := strings.TrimPrefix(path.Base(filename), "hostname.")
+		if ifname == "" || ifname == path.Base(filename) {
+			return nil, errors.New("openbsd: file must be named hostname.<interface>")
+		}
+		return parseOpenBSD(br, ifname)
+	}
+	return nil, errors.New("format must be ios, junos or openbsd")
+}
+
+func makeInterface(name, addr string, ones, bits int) (Interface, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || ones < 0 || ones > bits {
+		return Interface{}, fmt.Errorf("%s: bad address %s/%d", name, addr, ones)
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	return Interface{Name: name, Address: ip.String(), Prefix: n.String()}, nil
+}
+
+func fromCIDR(name, cidr string) (Interface, error) {
+	ip, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Interface{}, fmt.Errorf("%s: bad address %s", name, cidr)
+	}
+	return Interface{Name: name, Address: ip.String(), Prefix: n.String()}, nil
+}
+
+// Dotted (255.255.255.0) or hex (0xffffff00) netmask to a prefix length
+func maskLen(s string) (int, bool) {
+	var m net.IPMask
+	if strings.HasPrefix(s, "0x") {
+		v, err := strconv.ParseUint(s[2:], 16, 32)
+		if err != nil {
+			return 0, false
+		}
+		m = net.IPv4Mask(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	} else if ip := net.ParseIP(s).To4(); ip != nil {
+		m = net.IPMask(ip)
+	} else {
+		return 0, false
+	}
+	ones, bits := m.Size()
+	return ones, bits == 32
+}
+
+func linkLocal(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLinkLocalUnicast()
+}
+
+func parseIOS(r io.Reader) ([]Interface, error) {
+	var out []Interface
+	var device, ifname string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		f := strings.Fields(line)
+		if len(f) == 0 || f[0] == "!" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if !indented {
+			ifname = ""
+			switch {
+			case f[0] == "hostname" && len(f) == 2:
+				device = f[1]
+			case f[0] == "interface" && len(f) >= 2:
+				ifname = f[1]
+			}
+			continue
+		}
+		if ifname == "" || len(f) < 3 {
+			continue
+		}
+		switch {
+		case f[0] == "ip" && f[1] == "address" && len(f) >= 4:
+			ones, ok := maskLen(f[3])
+			if !ok {
+				continue // "ip address dhcp", "negotiated"
+			}
+			i, err := makeInterface(ifname, f[2], ones, 32)
+			if err != nil {
+				return nil, err
+			}
+			i.Secondary = len(f) > 4 && f[4] == "secondary"
+			out = append(out, i)
+		case f[0] == "ipv6" && f[1] == "address" && strings.Contains(f[2], "/"):
+			i, err := fromCIDR(ifname, f[2])
+			if err != nil {
+				return nil, err
+			}
+			if len(f) > 3 && f[3] == "eui-64" {
+				i.Address = "" // host part comes from the MAC
+			}
+			if !linkLocal(i.Address) {
+				out = append(out, i)
+			}
+		}
+	}
+	for i := range out {
+		out[i].Device = device
+	}
+	return out, sc.Err()
+}
+
+func parseJunos(r io.Reader) ([]Interface, error) {
+	var out []Interface
+	var device string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 2 || f[0] != "set" {
+			continue
+		}
+		// logical-systems and groups prefix the usual statements
+		for len(f) > 3 && (f[1] == "logical-systems" || f[1] == "groups") {
+			f = append([]string{"set"}, f[3:]...)
+		}
+		if len(f) == 4 && f[1] == "system" && f[2] == "host-name" {
+			device = f[3]
+			continue
+		}
+		// set interfaces <if> unit <n> family inet|inet6 address <a/p> ...
+		if len(f) < 9 || f[1] != "interfaces" || f[3] != "unit" || f[5] != "family" || f[7] != "address" {
+			continue
+		}
+		if f[6] != "inet" && f[6] != "inet6" {
+			continue
+		}
+		i, err := fromCIDR(f[2]+"."+f[4], f[8])
+		if err != nil {
+			return nil, err
+		}
+		if len(f) > 9 && f[9] == "eui-64" {
+			i.Address = "" // host part comes from the MAC
+		}
+		if !linkLocal(i.Address) {
+			out = append(out, i)
+		}
+	}
+	for i := range out {
+		out[i].Device = device
+	}
+	return out, sc.Err()
+}
+
+func parseOpenBSD(r io.Reader, ifname string) ([]Interface, error) {
+	var out []Interface
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if c := strings.IndexByte(line, '#'); c >= 0 {
+			line = line[:c]
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 || (f[0] != "inet" && f[0] != "inet6") {
+			continue
+		}
+		v6 := f[0] == "inet6"
+		f = f[1:]
+		if f[0] == "alias" {
+			f = f[1:]
+		}
+		if len(f) == 0 {
+			continue
+		}
+		var i Interface
+		var err error
+		switch {
+		case strings.Contains(f[0], "/"):
+			i, err = fromCIDR(ifname, f[0])
+		case v6 && len(f) >= 2:
+			ones, perr := strconv.Atoi(f[1])
+			if perr != nil {
+				continue
+			}
+			i, err = makeInterface(ifname, f[0], ones, 128)
+		case !v6 && len(f) >= 2:
+			ones, ok := maskLen(f[1])
+			if !ok {
+				continue
+			}
+			i, err = makeInterface(ifname, f[0], ones, 32)
+		default:
+			continue // "inet6 autoconf", "inet autoconf"
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !linkLocal(i.Address) {
+			out = append(out, i)
+		}
+	}
+	return out, sc.Err()
+}
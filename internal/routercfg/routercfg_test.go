@@ -0,0 +1,106 @@
+package routercfg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string // detected from the file
+		want   []Interface
+	}{
+		{
+			file:   "ios.cfg",
+			format: "ios",
+			want: []Interface{
+				{Device: "edge1", Name: "Loopback0", Address: "10.255.0.1", Prefix: "10.255.0.1/32"},
+				{Device: "edge1", Name: "Loopback0", Address: "2001:db8:ffff::1", Prefix: "2001:db8:ffff::1/128"},
+				{Device: "edge1", Name: "GigabitEthernet0/0", Address: "192.0.2.2", Prefix: "192.0.2.0/30"},
+				{Device: "edge1", Name: "GigabitEthernet0/0", Address: "198.51.100.1", Prefix: "198.51.100.0/24", Secondary: true},
+				{Device: "edge1", Name: "GigabitEthernet0/0", Address: "2001:db8:1::2", Prefix: "2001:db8:1::/64"},
+				{Device: "edge1", Name: "GigabitEthernet0/0", Prefix: "2001:db8:2::/64"},
+			},
+		},
+		{
+			file:   "junos.set",
+			format: "junos",
+			want: []Interface{
+				{Device: "core1", Name: "fxp0.0", Address: "172.16.0.10", Prefix: "172.16.0.0/24"},
+				{Device: "core1", Name: "ge-0/0/0.0", Address: "192.0.2.6", Prefix: "192.0.2.4/30"},
+				{Device: "core1", Name: "ge-0/0/0.0", Address: "2001:db8:10::2", Prefix: "2001:db8:10::/64"},
+				{Device: "core1", Name: "ge-0/0/1.100", Address: "10.1.0.1", Prefix: "10.1.0.0/24"},
+				{Device: "core1", Name: "ge-0/0/1.100", Address: "10.1.1.1", Prefix: "10.1.1.0/24"},
+				{Device: "core1", Name: "ge-0/0/1.100", Prefix: "2001:db8:11::/64"},
+				{Device: "core1", Name: "lo0.0", Address: "10.255.0.2", Prefix: "10.255.0.2/32"},
+				{Device: "core1", Name: "ge-0/0/2.5", Address: "203.0.113.1", Prefix: "203.0.113.0/29"},
+			},
+		},
+		{
+			file:   "hostname.em0",
+			format: "openbsd",
+			want: []Interface{
+				{Name: "em0", Address: "192.0.2.10", Prefix: "192.0.2.0/24"},
+				{Name: "em0", Address: "192.0.2.11", Prefix: "192.0.2.11/32"},
+				{Name: "em0", Address: "198.51.100.1", Prefix: "198.51.100.0/24"},
+				{Name: "em0", Address: "2001:db8::10", Prefix: "2001:db8::/64"},
+				{Name: "em0", Address: "2001:db8::11", Prefix: "2001:db8::/64"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			name := filepath.Join("testdata", tt.file)
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Detect(name, data); got != tt.format {
+				t.Errorf("detected %q, want %q", got, tt.format)
+			}
+			got, err := Parse(strings.NewReader(string(data)), "", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in, format, filename, err string
+	}{
+		{in: "inet 192.0.2.1/24\n", format: "openbsd", filename: "em0.conf", err: "openbsd: file must be named hostname.<interface>"},
+		{in: "", format: "eos", err: "format must be ios, junos or openbsd"},
+		{in: "interface Gi0/0\n ip address 192.0.2.300 255.255.255.0\n", format: "ios", err: "Gi0/0: bad address 192.0.2.300/24"},
+		{in: "set interfaces ge-0/0/0 unit 0 family inet address 192.0.2.1/33\n", err: "ge-0/0/0.0: bad address 192.0.2.1/33"},
+		{in: "inet6 2001:db8::1 129\n", filename: "/etc/hostname.vio0", err: "vio0: bad address 2001:db8::1/129"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.in), tt.format, tt.filename)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %q", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestHostRoute(t *testing.T) {
+	for prefix, want := range map[string]bool{
+		"10.255.0.1/32":   true,
+		"2001:db8::1/128": true,
+		"192.0.2.0/31":    false,
+		"2001:db8::/64":   false,
+		"not-a-prefix":    false,
+	} {
+		if got := (Interface{Prefix: prefix}).HostRoute(); got != want {
+			t.Errorf("HostRoute(%s) = %v, want %v", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package rpsl builds, parses and compares RPSL inetnum/inet6num objects
+// for publishing assignments to a regional internet registry.
+package rpsl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/yellowman/GoPieNg/internal/ipam"
+)
+
+// Attr is a single "name: value" line of an object
+type Attr struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Object is an RPSL object; the first attribute names its class
+type Object struct {
+	Attrs []Attr `json:"attributes"`
+}
+
+// Class returns the object class (inetnum, inet6num, ...)
+func (o Object) Class() string {
+	if len(o.Attrs) == 0 {
+		return ""
+	}
+	return o.Attrs[0].Name
+}
+
+// Get returns the first value of the named attribute
+func (o Object) Get(name string) string {
+	for _, a := range o.Attrs {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Key identifies an object across exports: class plus normalized primary key
+func (o Object) Key() string {
+	if len(o.Attrs) == 0 {
+		return ""
+	}
+	v := strings.ToLower(strings.Join(strings.Fields(o.Attrs[0].Value), ""))
+	return o.Class() + ":" + v
+}
+
+// String renders the object with values aligned at column 16
+func (o Object) String() string {
+	var b strings.Builder
+	for _, a := range o.Attrs {
+		fmt.Fprintf(&b, "%-16s%s\n", a.Name+":", a.Value)
+	}
+	return b.String()
+}
+
+// Format renders objects separated by blank lines
+func Format(objs []Object) string {
+	parts := make([]string, len(objs))
+	for i, o := range objs {
+		parts[i] = o.String()
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Parse reads RPSL text. Objects are separated by blank lines, lines
+// starting with '%' or '#' are comments and lines starting with
+// whitespace or '+' continue the previous attribute.
+func Parse(r io.Reader) ([]Object, error) {
+	var out []Object
+	var cur Object
+	flush := func() {
+		if len(cur.Attrs) > 0 {
+			out = append(out, cur)
+		}
+		cur = Object{}
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		s := strings.TrimRight(sc.Text(), " \t\r")
+		switch {
+		case s == "":
+			flush()
+		case s[0] == '%' || s[0] == '#':
+			continue
+		case s[0] == ' ' || s[0] == '\t' || s[0] == '+':
+			if len(cur.Attrs) == 0 {
+				return nil, fmt.Errorf("line %d: continuation without attribute", line)
+			}
+			last := &cur.Attrs[len(cur.Attrs)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(s[1:]))
+		default:
+			i := strings.IndexByte(s, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("line %d: expected attribute", line)
+			}
+			cur.Attrs = append(cur.Attrs, Attr{
+				Name:  strings.ToLower(strings.TrimSpace(s[:i])),
+				Value: strings.TrimSpace(s[i+1:]),
+			})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return out, nil
+}
+
+// Assignment is the IPAM data an object is built from
+type Assignment struct {
+	ID          int64
+	Prefix      string
+	Description string
+	Owner       string
+	Account     string
+}
+
+// Options controls which assignments are published and how
+type Options struct {
+	MaxMask4   int    // publish IPv4 assignments of this size or larger (default /29)
+	MaxMask6   int    // publish IPv6 assignments of this size or larger (default /48)
+	Maintainer string // mnt-by
+	Source     string // source
+	Country    string // country
+}
+
+// TemplateData is what an object template is executed with
+type TemplateData struct {
+	Assignment
+	Class   string // inetnum or inet6num
+	Range   string // "first - last" for IPv4, CIDR for IPv6
+	Netname string
+	IPv6    bool
+	Options
+}
+
+// DefaultTemplate produces a minimal RIPE-style assignment object.
+// Attributes that render empty and blank lines are dropped.
+const DefaultTemplate = `{{.Class}}: {{.Range}}
+netname: {{.Netname}}
+descr: {{.Description}}
+descr: {{.Owner}}
+country: {{.Country}}
+{{with .Account}}remarks: account {{.}}{{end}}
+status: {{if .IPv6}}ASSIGNED{{else}}ASSIGNED PA{{end}}
+mnt-by: {{.Maintainer}}
+source: {{.Source}}
+`
+
+// Template renders assignments into objects
+type Template struct{ t *template.Template }
+
+// ParseTemplate compiles an object template (see DefaultTemplate)
+func ParseTemplate(text string) (*Template, error) {
+	t, err := template.New("rpsl").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{t}, nil
+}
+
+var netnameBad = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// Netname derives a registry netname from account, owner or description
+func Netname(a Assignment) string {
+	src := a.Account
+	if src == "" {
+		src = a.Owner
+	}
+	if src == "" {
+		src = a.Description
+	}
+	name := strings.Trim(netnameBad.ReplaceAllString(strings.ToUpper(src), "-"), "-")
+	if name == "" {
+		name = fmt.Sprintf("NET-%d", a.ID)
+	}
+	if len(name) > 80 {
+		name = strings.TrimRight(name[:80], "-")
+	}
+	return name
+}
+
+// Eligible reports whether an assignment meets the size thresholds
+func (o Options) Eligible(prefix string) bool {
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	if n.IP.To4() != nil {
+		max := o.MaxMask4
+		if max == 0 {
+			max = 29
+		}
+		return ones <= max
+	}
+	max := o.MaxMask6
+	if max == 0 {
+		max = 48
+	}
+	return ones <= max
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func oneLine(s string) string { return lineBreaks.Replace(s) }
+
+// Build renders one assignment into an object
+func (t *Template) Build(a Assignment, opts Options) (Object, error) {
+	_, n, err := net.ParseCIDR(a.Prefix)
+	if err != nil {
+		return Object{}, err
+	}
+	// A line break in a value would start a new attribute when the
+	// output is parsed back, so values are kept to one line
+	a.Description, a.Owner, a.Account = oneLine(a.Description), oneLine(a.Owner), oneLine(a.Account)
+	opts.Maintainer, opts.Source, opts.Country = oneLine(opts.Maintainer), oneLine(opts.Source), oneLine(opts.Country)
+	d := TemplateData{Assignment: a, Netname: Netname(a), Options: opts}
+	if n.IP.To4() != nil {
+		first, last := ipam.FirstLastStr(a.Prefix)
+		d.Class, d.Range = "inetnum", first+" - "+last
+	} else {
+		d.Class, d.Range, d.IPv6 = "inet6num", n.String(), true
+	}
+	var buf bytes.Buffer
+	if err := t.t.Execute(&buf, d); err != nil {
+		return Object{}, err
+	}
+	// Blank lines would split the object; conditionals often leave them behind
+	var lines []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	objs, err := Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return Object{}, fmt.Errorf("template output: %w", err)
+	}
+	if len(objs) != 1 {
+		return Object{}, fmt.Errorf("template produced %d objects, want 1", len(objs))
+	}
+	// Drop attributes the template left empty
+	obj := Object{}
+	for _, attr := range objs[0].Attrs {
+		if attr.Value != "" {
+			obj.Attrs = append(obj.Attrs, attr)
+		}
+	}
+	return obj, nil
+}
+
+// Change is an object present in both exports with different contents
+type Change struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// DiffResult lists what a new export adds, removes and changes
+type DiffResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []Change `json:"changed"`
+}
+
+// Diff compares a previous export against the current one by object key
+func Diff(old, cur []Object) DiffResult {
+	res := DiffResult{Added: []string{}, Removed: []string{}, Changed: []Change{}}
+	prev := map[string]Object{}
+	for _, o := range old {
+		prev[o.Key()] = o
+	}
+	seen := map[string]bool{}
+	for _, o := range cur {
+		k := o.Key()
+		seen[k] = true
+		p, ok := prev[k]
+		if !ok {
+			res.Added = append(res.Added, o.String())
+		} else if p.String() != o.String() {
+			res.Changed = append(res.Changed, Change{Key: k, Old: p.String(), New: o.String()})
+		}
+	}
+	var gone []string
+	for k := range prev {
+		if !seen[k] {
+			gone = append(gone, k)
+		}
+	}
+	sort.Strings(gone)
+	for _, k := range gone {
+		res.Removed = append(res.Removed, prev[k].String())
+	}
+	return res
+}
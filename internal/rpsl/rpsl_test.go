@@ -0,0 +1,275 @@
+package rpsl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Object
+		err  string
+	}{
+		{
+			name: "objects and comments",
+			in: `% RIPE database
+inetnum:        192.0.2.0 - 192.0.2.255
+NetName:        EXAMPLE
+# a comment inside an object
+source:         TEST
+
+
+inet6num:       2001:db8::/48
+netname:        EXAMPLE6
+`,
+			want: []Object{
+				{Attrs: []Attr{{"inetnum", "192.0.2.0 - 192.0.2.255"}, {"netname", "EXAMPLE"}, {"source", "TEST"}}},
+				{Attrs: []Attr{{"inet6num", "2001:db8::/48"}, {"netname", "EXAMPLE6"}}},
+			},
+		},
+		{
+			name: "continuations",
+			in: "inetnum: 192.0.2.0 - 192.0.2.255\r\n" +
+				"descr:   first\r\n" +
+				"         second\r\n" +
+				"\tthird\r\n" +
+				"+ fourth\r\n" +
+				"+\r\n" +
+				"source:  TEST\r\n",
+			want: []Object{
+				{Attrs: []Attr{{"inetnum", "192.0.2.0 - 192.0.2.255"}, {"descr", "first second third fourth"}, {"source", "TEST"}}},
+			},
+		},
+		{name: "empty", in: "% nothing\n\n", want: nil},
+		{name: "leading continuation", in: " descr: x\n", err: "line 1: continuation without attribute"},
+		{name: "no colon", in: "inetnum: 192.0.2.0/24\nnetname\n", err: "line 2: expected attribute"},
+		{name: "no name", in: ": value\n", err: "line 1: expected attribute"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.in))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	opts := Options{Maintainer: "EXAMPLE-MNT", Source: "TEST", Country: "NL"}
+	tests := []struct {
+		name     string
+		template string
+		a        Assignment
+		opts     Options
+		want     []Attr
+		err      string
+	}{
+		{
+			name: "ipv4",
+			a:    Assignment{ID: 7, Prefix: "192.0.2.0/24", Description: "Office", Owner: "Example BV", Account: "acme-1"},
+			opts: opts,
+			want: []Attr{
+				{"inetnum", "192.0.2.0 - 192.0.2.255"},
+				{"netname", "ACME-1"},
+				{"descr", "Office"},
+				{"descr", "Example BV"},
+				{"country", "NL"},
+				{"remarks", "account acme-1"},
+				{"status", "ASSIGNED PA"},
+				{"mnt-by", "EXAMPLE-MNT"},
+				{"source", "TEST"},
+			},
+		},
+		{
+			name: "ipv6 drops empty attributes",
+			a:    Assignment{ID: 8, Prefix: "2001:db8::/48", Description: "Lab"},
+			opts: opts,
+			want: []Attr{
+				{"inet6num", "2001:db8::/48"},
+				{"netname", "LAB"},
+				{"descr", "Lab"},
+				{"country", "NL"},
+				{"status", "ASSIGNED"},
+				{"mnt-by", "EXAMPLE-MNT"},
+				{"source", "TEST"},
+			},
+		},
+		{
+			name: "line breaks in values",
+			a: Assignment{ID: 9, Prefix: "192.0.2.0/28",
+				Description: "Office\nmnt-by: EVIL-MNT", Owner: "Example\r\nBV", Account: "a\rb"},
+			opts: Options{Maintainer: "EXAMPLE-MNT\nsource: EVIL", Source: "TEST", Country: "NL"},
+			want: []Attr{
+				{"inetnum", "192.0.2.0 - 192.0.2.15"},
+				{"netname", "A-B"},
+				{"descr", "Office mnt-by: EVIL-MNT"},
+				{"descr", "Example BV"},
+				{"country", "NL"},
+				{"remarks", "account a b"},
+				{"status", "ASSIGNED PA"},
+				{"mnt-by", "EXAMPLE-MNT source: EVIL"},
+				{"source", "TEST"},
+			},
+		},
+		{
+			name:     "custom template",
+			template: "{{.Class}}: {{.Range}}\n{{if .IPv6}}remarks: v6{{end}}\nnetname: {{.Netname}}\n",
+			a:        Assignment{ID: 10, Prefix: "192.0.2.0/24"},
+			want:     []Attr{{"inetnum", "192.0.2.0 - 192.0.2.255"}, {"netname", "NET-10"}},
+		},
+		{
+			name:     "only comments",
+			template: "% {{.Class}}: {{.Range}}\n",
+			a:        Assignment{ID: 11, Prefix: "192.0.2.0/24"},
+			err:      "template produced 0 objects, want 1",
+		},
+		{
+			name:     "unparseable output",
+			template: "{{.Class}}: {{.Range}}\n{{.Netname}}\n",
+			a:        Assignment{ID: 12, Prefix: "192.0.2.0/24"},
+			err:      "template output: line 2: expected attribute",
+		},
+		{name: "bad prefix", a: Assignment{Prefix: "192.0.2.0"}, err: "invalid CIDR address: 192.0.2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := tt.template
+			if text == "" {
+				text = DefaultTemplate
+			}
+			tmpl, err := ParseTemplate(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj, err := tmpl.Build(tt.a, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(obj.Attrs, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", obj, Object{Attrs: tt.want})
+			}
+		})
+	}
+}
+
+func TestNetname(t *testing.T) {
+	long := strings.Repeat("ab-", 30)
+	tests := []struct {
+		a    Assignment
+		want string
+	}{
+		{Assignment{ID: 1, Account: "acme 1", Owner: "Owner", Description: "Desc"}, "ACME-1"},
+		{Assignment{ID: 2, Owner: "Example B.V.", Description: "Desc"}, "EXAMPLE-B-V"},
+		{Assignment{ID: 3, Description: "  office / lab  "}, "OFFICE-LAB"},
+		{Assignment{ID: 4, Description: "ünï"}, "N"},
+		{Assignment{ID: 5, Description: "éü / ïö"}, "NET-5"},
+		{Assignment{ID: 6}, "NET-6"},
+		{Assignment{ID: 7, Account: long}, strings.TrimRight(strings.ToUpper(long)[:80], "-")},
+	}
+	for _, tt := range tests {
+		if got := Netname(tt.a); got != tt.want {
+			t.Errorf("Netname(%+v) = %q, want %q", tt.a, got, tt.want)
+		}
+		if got := Netname(tt.a); len(got) > 80 || strings.HasSuffix(got, "-") {
+			t.Errorf("Netname(%+v) = %q", tt.a, got)
+		}
+	}
+}
+
+func TestEligible(t *testing.T) {
+	tests := []struct {
+		opts   Options
+		prefix string
+		want   bool
+	}{
+		{Options{}, "192.0.2.0/29", true},
+		{Options{}, "192.0.2.0/24", true},
+		{Options{}, "192.0.2.0/30", false},
+		{Options{}, "2001:db8::/48", true},
+		{Options{}, "2001:db8::/56", false},
+		{Options{MaxMask4: 24}, "192.0.2.0/25", false},
+		{Options{MaxMask4: 24}, "192.0.2.0/24", true},
+		{Options{MaxMask6: 64}, "2001:db8::/64", true},
+		{Options{MaxMask6: 64}, "2001:db8::/65", false},
+		{Options{MaxMask4: 32}, "192.0.2.1/32", true},
+		{Options{}, "192.0.2.1", false},
+		{Options{}, "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.Eligible(tt.prefix); got != tt.want {
+			t.Errorf("%+v.Eligible(%q) = %v, want %v", tt.opts, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	obj := func(key, netname string) Object {
+		return Object{Attrs: []Attr{{"inetnum", key}, {"netname", netname}}}
+	}
+	a := obj("192.0.2.0 - 192.0.2.255", "A")
+	b := obj("198.51.100.0 - 198.51.100.255", "B")
+	c := obj("203.0.113.0 - 203.0.113.255", "C")
+	b2 := obj("198.51.100.0   -   198.51.100.255", "B2")
+	v6 := Object{Attrs: []Attr{{"inet6num", "2001:DB8::/48"}, {"netname", "V6"}}}
+	v6lower := Object{Attrs: []Attr{{"inet6num", "2001:db8::/48"}, {"netname", "V6"}}}
+
+	tests := []struct {
+		name     string
+		old, cur []Object
+		want     DiffResult
+	}{
+		{
+			name: "nothing",
+			want: DiffResult{Added: []string{}, Removed: []string{}, Changed: []Change{}},
+		},
+		{
+			name: "added removed changed",
+			old:  []Object{c, a, b},
+			cur:  []Object{b2, obj("10.0.0.0 - 10.0.0.255", "D"), v6},
+			want: DiffResult{
+				Added:   []string{obj("10.0.0.0 - 10.0.0.255", "D").String(), v6.String()},
+				Removed: []string{a.String(), c.String()},
+				Changed: []Change{{Key: "inetnum:198.51.100.0-198.51.100.255", Old: b.String(), New: b2.String()}},
+			},
+		},
+		{
+			name: "keys ignore case and spacing",
+			old:  []Object{v6, a},
+			cur:  []Object{v6lower, obj("192.0.2.0-192.0.2.255", "A")},
+			want: DiffResult{
+				Added:   []string{},
+				Removed: []string{},
+				Changed: []Change{
+					{Key: "inet6num:2001:db8::/48", Old: v6.String(), New: v6lower.String()},
+					{Key: "inetnum:192.0.2.0-192.0.2.255", Old: a.String(), New: obj("192.0.2.0-192.0.2.255", "A").String()},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.old, tt.cur); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type one[T any] struct {
+	Data T `json:"data"`
+}
+
+type list[T any] struct {
+	Data       []T     `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+func (o ListOptions) values() url.Values {
+	q := url.Values{}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	return q
+}
+
+func get[T any](ctx context.Context, c *Client, path string) (*T, error) {
+	var out one[T]
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &out, false); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+func getPage[T any](ctx context.Context, c *Client, path string, q url.Values) (*Page[T], error) {
+	var out list[T]
+	if err := c.do(ctx, http.MethodGet, path, q, nil, &out, false); err != nil {
+		return nil, err
+	}
+	p := &Page[T]{Items: out.Data}
+	if out.NextCursor != nil {
+		p.NextCursor = *out.NextCursor
+	}
+	return p, nil
+}
+
+func write[T any](ctx context.Context, c *Client, method, path string, in any, race bool) (*T, error) {
+	var out one[T]
+	if err := c.do(ctx, method, path, nil, in, &out, race); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+func networkPath(id int64) string { return "/v2/networks/" + strconv.FormatInt(id, 10) }
+
+func hostPath(ip string) string { return "/v2/hosts/" + url.PathEscape(ip) }
+
+func userPath(id int64) string { return "/v2/users/" + strconv.FormatInt(id, 10) }
+
+// ListNetworks lists the children of parent, or the top-level networks
+// when parent is 0; q, when set, keeps only those matching it
+func (c *Client) ListNetworks(ctx context.Context, parent int64, q string, opts ListOptions) (*Page[Network], error) {
+	v := opts.values()
+	if parent != 0 {
+		v.Set("parent_id", strconv.FormatInt(parent, 10))
+	}
+	if q != "" {
+		v.Set("q", q)
+	}
+	return getPage[Network](ctx, c, "/v2/networks", v)
+}
+
+func (c *Client) GetNetwork(ctx context.Context, id int64) (*Network, error) {
+	return get[Network](ctx, c, networkPath(id))
+}
+
+func (c *Client) UpdateNetwork(ctx context.Context, id int64, u NetworkUpdate) (*Network, error) {
+	return write[Network](ctx, c, http.MethodPatch, networkPath(id), u, false)
+}
+
+// DeleteNetwork deletes a network that has no subnets
+func (c *Client) DeleteNetwork(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, networkPath(id), nil, nil, nil, false)
+}
+
+// AllocateSubnet allocates a subnet of parent and returns it
+func (c *Client) AllocateSubnet(ctx context.Context, parent int64, req SubnetRequest) (*Network, error) {
+	// A chosen CIDR that overlaps won't stop overlapping, so only
+	// allocations by mask are retried
+	return write[Network](ctx, c, http.MethodPost, networkPath(parent)+"/allocate-subnet", req, req.CIDR == "")
+}
+
+func (c *Client) ListHosts(ctx context.Context, network int64, opts ListOptions) (*Page[Host], error) {
+	return getPage[Host](ctx, c, networkPath(network)+"/hosts", opts.values())
+}
+
+func (c *Client) GetHost(ctx context.Context, ip string) (*Host, error) {
+	return get[Host](ctx, c, hostPath(ip))
+}
+
+// AddHost records a host at the address in h, which must be free
+func (c *Client) AddHost(ctx context.Context, network int64, h NewHost) (*Host, error) {
+	return write[Host](ctx, c, http.MethodPost, networkPath(network)+"/hosts", h, false)
+}
+
+// AllocateHost records a host at the next free address of network
+func (c *Client) AllocateHost(ctx context.Context, network int64, description string) (*Host, error) {
+	body := map[string]string{"description": description}
+	return write[Host](ctx, c, http.MethodPost, networkPath(network)+"/allocate-host", body, true)
+}
+
+func (c *Client) UpdateHost(ctx context.Context, ip string, u HostUpdate) (*Host, error) {
+	return write[Host](ctx, c, http.MethodPatch, hostPath(ip), u, false)
+}
+
+func (c *Client) DeleteHost(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, hostPath(ip), nil, nil, nil, false)
+}
+
+// SearchHosts finds hosts matching q anywhere in the tree, up to 1000
+func (c *Client) SearchHosts(ctx context.Context, q string, opts ListOptions) (*Page[Host], error) {
+	v := opts.values()
+	v.Set("q", q)
+	v.Set("type", "hosts")
+	return getPage[Host](ctx, c, "/v2/search", v)
+}
+
+// SearchNetworks finds networks matching q anywhere in the tree, up to
+// 1000
+func (c *Client) SearchNetworks(ctx context.Context, q string, opts ListOptions) (*Page[Network], error) {
+	v := opts.values()
+	v.Set("q", q)
+	v.Set("type", "networks")
+	return getPage[Network](ctx, c, "/v2/search", v)
+}
+
+// ListChanges lists the change log, newest first; opts.Sort is ignored
+func (c *Client) ListChanges(ctx context.Context, opts ListOptions) (*Page[Change], error) {
+	opts.Sort = ""
+	return getPage[Change](ctx, c, "/v2/changes", opts.values())
+}
+
+func (c *Client) ListUsers(ctx context.Context, opts ListOptions) (*Page[User], error) {
+	return getPage[User](ctx, c, "/v2/users", opts.values())
+}
+
+func (c *Client) GetUser(ctx context.Context, id int64) (*User, error) {
+	return get[User](ctx, c, userPath(id))
+}
+
+func (c *Client) CreateUser(ctx context.Context, u NewUser) (*User, error) {
+	return write[User](ctx, c, http.MethodPost, "/v2/users", u, false)
+}
+
+func (c *Client) UpdateUser(ctx context.Context, id int64, u UserUpdate) (*User, error) {
+	return write[User](ctx, c, http.MethodPatch, userPath(id), u, false)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, userPath(id), nil, nil, nil, false)
+}
+
+func (c *Client) ListRoles(ctx context.Context, opts ListOptions) (*Page[Role], error) {
+	return getPage[Role](ctx, c, "/v2/roles", opts.values())
+}
@@ -0,0 +1,285 @@
+// Package client is a Go client for the GoPieNg REST API. It speaks the
+// typed /v2 API:
+//
+//	c := client.New("https://ipam.example.com/api/pieng",
+//		client.WithCredentials("provisioner", os.Getenv("PIENG_PASSWORD")))
+//	subnet, err := c.AllocateSubnet(ctx, 12, client.SubnetRequest{Mask: 24, Description: "lab"})
+//
+// Requests refused with 429 are retried after the server's Retry-After.
+// Allocations that lose a race to another client (EXISTS, or OVERLAP
+// when allocating by mask) are retried, as the next attempt picks the
+// next free address or subnet. Errors from the API are *Error.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes, as in the API's error envelope
+const (
+	CodeBadRequest     = "BAD_REQUEST"
+	CodeInvalid        = "INVALID"
+	CodeUnauthorized   = "UNAUTHORIZED"
+	CodeUserDisabled   = "USER_DISABLED"
+	CodeForbidden      = "FORBIDDEN"
+	CodeNotFound       = "NOT_FOUND"
+	CodeExists         = "EXISTS"
+	CodeOverlap        = "OVERLAP"
+	CodeOutsideNetwork = "OUTSIDE_NETWORK"
+	CodeNoSpace        = "NO_SPACE"
+	CodeConflict       = "CONFLICT"
+	CodeRateLimited    = "RATE_LIMITED"
+	CodeInternal       = "INTERNAL"
+)
+
+// Error is an error answered by the API
+type Error struct {
+	StatusCode int          `json:"-"`
+	Code       string       `json:"code"`
+	Message    string       `json:"message"`
+	Details    []FieldError `json:"details,omitempty"`
+	RequestID  string       `json:"request_id,omitempty"`
+}
+
+// FieldError is one rejected request field of an INVALID error
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("gopieng: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("gopieng: %s: %s", e.Code, e.Message)
+}
+
+// IsCode reports whether err is an API error with code
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// Client calls one GoPieNg server. It is safe for concurrent use.
+type Client struct {
+	base     string
+	http     *http.Client
+	attempts int
+	backoff  time.Duration
+
+	mu                 sync.Mutex
+	token              string
+	username, password string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithToken authenticates with a token from an earlier login
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithCredentials logs in on the first request, and again when the
+// token is refused, e.g. after it expires
+func WithCredentials(username, password string) Option {
+	return func(c *Client) { c.username, c.password = username, password }
+}
+
+// WithRetries makes at most attempts tries of a retryable request,
+// waiting backoff, then twice as long, and so on between them unless the
+// server says how long with Retry-After. The default is 4 tries from
+// 250ms; 1 disables retries.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(c *Client) { c.attempts, c.backoff = max(attempts, 1), backoff }
+}
+
+// New returns a client for the API at base, the URL the API is served
+// under, e.g. https://ipam.example.com/api/pieng
+func New(base string, opts ...Option) *Client {
+	c := &Client{base: strings.TrimSuffix(base, "/"), http: http.DefaultClient, attempts: 4, backoff: 250 * time.Millisecond}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token is the token requests are sent with, "" before logging in
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Login exchanges a username and password for a token, which the client
+// then sends with every request
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var out struct {
+		Token string `json:"token"`
+	}
+	body := map[string]string{"username": username, "password": password}
+	if err := c.send(ctx, http.MethodPost, "/auth/login", nil, body, &out, false, false); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = out.Token
+	c.mu.Unlock()
+	return nil
+}
+
+// The token for a request, logging in first with the credentials if
+// there is none yet
+func (c *Client) auth(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, username, password := c.token, c.username, c.password
+	c.mu.Unlock()
+	if token != "" || username == "" {
+		return token, nil
+	}
+	if err := c.Login(ctx, username, password); err != nil {
+		return "", err
+	}
+	return c.Token(), nil
+}
+
+// Drop a refused token if it can be replaced by logging in again
+func (c *Client) reauth(refused string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.username == "" {
+		return false
+	}
+	if c.token == refused {
+		c.token = ""
+	}
+	return true
+}
+
+// Send an authenticated request; race marks allocations, which are
+// retried when another client took the address or subnet first
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any, race bool) error {
+	return c.send(ctx, method, path, query, in, out, true, race)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, in, out any, authed, race bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	relogged := false
+	for attempt := 1; ; attempt++ {
+		var token string
+		if authed {
+			var err error
+			if token, err = c.auth(ctx); err != nil {
+				return err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil || resp.StatusCode == http.StatusNoContent {
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+		apiErr := readError(resp)
+		switch {
+		case apiErr.StatusCode == http.StatusUnauthorized && authed && !relogged && c.reauth(token):
+			relogged = true
+			attempt--
+			continue
+		case attempt < c.attempts && retryable(apiErr, race):
+			if err := sleep(ctx, c.delay(attempt, resp)); err != nil {
+				return err
+			}
+			continue
+		}
+		return apiErr
+	}
+}
+
+func retryable(e *Error, race bool) bool {
+	return e.Code == CodeRateLimited || (race && (e.Code == CodeExists || e.Code == CodeOverlap))
+}
+
+// How long to wait before another try: Retry-After when the server sent
+// it, otherwise the backoff doubled per try with some jitter
+func (c *Client) delay(attempt int, resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	d := c.backoff << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// The error envelope of resp, or the status and start of the body when
+// something else answered, e.g. a proxy
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &Error{}
+	if json.Unmarshal(b, e) != nil || e.Code == "" {
+		e = &Error{Message: strings.TrimSpace(string(b))}
+		if len(e.Message) > 200 {
+			e.Message = e.Message[:200]
+		}
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	e.StatusCode = resp.StatusCode
+	return e
+}
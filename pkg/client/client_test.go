@@ -0,0 +1,308 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yellowman/GoPieNg/internal/apierr"
+	"github.com/yellowman/GoPieNg/internal/auth"
+	"github.com/yellowman/GoPieNg/internal/db"
+	"github.com/yellowman/GoPieNg/internal/middleware"
+	"github.com/yellowman/GoPieNg/internal/migrate"
+	"github.com/yellowman/GoPieNg/pkg/client"
+)
+
+// testServer is the API as the server mounts it over a SQLite file,
+// with an administrator "admin" (password "secret123") and a network
+// 10.0.0.0/16 open for subdivision. Requests to a route can be made to
+// fail first.
+type testServer struct {
+	*httptest.Server
+	root int64
+
+	mu     sync.Mutex
+	faults map[string][]http.HandlerFunc // by "METHOD /path" under the base
+	hits   map[string]int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	d, err := db.Open("sqlite:" + filepath.Join(t.TempDir(), "pieng.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if _, err := migrate.Up(d.DB, migrate.For(d.Driver), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Store.CreateUser("admin", auth.MakeRFC2307SSHA("secret123"), []string{"administrator"}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := d.Store.CreateNetwork(db.Network{AddressRange: "10.0.0.0/16", Subdivide: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtm := auth.NewManager([]byte("test secret"))
+	r := chi.NewRouter()
+	r.Route("/api/pieng", func(api chi.Router) {
+		api.Post("/auth/login", auth.MakeLoginHandler(d.DB, jwtm))
+		api.Group(func(priv chi.Router) {
+			priv.Use(middleware.JWT(jwtm))
+			priv.Mount("/", d.Handler(jwtm))
+		})
+	})
+	s := &testServer{root: root, faults: map[string][]http.HandlerFunc{}, hits: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := req.Method + " " + strings.TrimPrefix(req.URL.Path, "/api/pieng")
+		s.mu.Lock()
+		s.hits[route]++
+		var fault http.HandlerFunc
+		if f := s.faults[route]; len(f) > 0 {
+			fault, s.faults[route] = f[0], f[1:]
+		}
+		s.mu.Unlock()
+		if fault != nil {
+			fault(w, req)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) URL() string { return s.Server.URL + "/api/pieng" }
+
+// Answer the next requests to route with faults, one each
+func (s *testServer) fail(route string, faults ...http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[route] = append(s.faults[route], faults...)
+}
+
+// Requests made to route so far
+func (s *testServer) count(route string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[route]
+}
+
+// An API error, with a Retry-After when retryAfter isn't empty
+func apiError(code, retryAfter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		apierr.Write(w, r, code, "injected")
+	}
+}
+
+func networkRoute(id int64) string {
+	return "GET /v2/networks/" + itoa(id)
+}
+
+func itoa(n int64) string { return strconv.FormatInt(n, 10) }
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	c := client.New(s.URL(), client.WithCredentials("admin", "secret123"))
+	if c.Token() != "" {
+		t.Fatal("token before the first request")
+	}
+	for range 2 {
+		n, err := c.GetNetwork(ctx, s.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.AddressRange != "10.0.0.0/16" {
+			t.Errorf("network %+v", n)
+		}
+	}
+	if got := s.count("POST /auth/login"); got != 1 || c.Token() == "" {
+		t.Errorf("%d logins, token %q", got, c.Token())
+	}
+
+	bad := client.New(s.URL(), client.WithCredentials("admin", "wrong"))
+	_, err := bad.GetNetwork(ctx, s.root)
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized || e.Code != client.CodeUnauthorized {
+		t.Errorf("bad password: %v", err)
+	}
+	if got := s.count("POST /auth/login"); got != 2 {
+		t.Errorf("%d logins after a refused one, want 2", got)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	route := networkRoute(s.root)
+
+	// A refused token is replaced by logging in again
+	c := client.New(s.URL(), client.WithToken("stale"), client.WithCredentials("admin", "secret123"))
+	if _, err := c.GetNetwork(ctx, s.root); err != nil {
+		t.Fatal(err)
+	}
+	if s.count("POST /auth/login") != 1 || s.count(route) != 2 || c.Token() == "stale" {
+		t.Errorf("%d logins, %d requests, token %q", s.count("POST /auth/login"), s.count(route), c.Token())
+	}
+
+	// but only once per request
+	s.fail(route, apiError(apierr.Unauthorized, ""), apiError(apierr.Unauthorized, ""))
+	if _, err := c.GetNetwork(ctx, s.root); !client.IsCode(err, client.CodeUnauthorized) {
+		t.Errorf("refused twice: %v", err)
+	}
+	if got := s.count("POST /auth/login"); got != 2 {
+		t.Errorf("%d logins, want 2", got)
+	}
+
+	// Without credentials a refused token is the answer
+	tokenOnly := client.New(s.URL(), client.WithToken("stale"))
+	if _, err := tokenOnly.GetNetwork(ctx, s.root); !client.IsCode(err, client.CodeUnauthorized) {
+		t.Errorf("stale token: %v", err)
+	}
+	if got := s.count("POST /auth/login"); got != 2 {
+		t.Errorf("%d logins without credentials, want 2", got)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	route := networkRoute(s.root)
+
+	// Retry-After is waited instead of the backoff
+	c := client.New(s.URL(), client.WithCredentials("admin", "secret123"), client.WithRetries(2, time.Hour))
+	s.fail(route, apiError(apierr.RateLimited, "1"))
+	start := time.Now()
+	if _, err := c.GetNetwork(ctx, s.root); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, want Retry-After's 1s", d)
+	}
+	if got := s.count(route); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+
+	// The last refusal is the answer
+	s.fail(route, apiError(apierr.RateLimited, "0"), apiError(apierr.RateLimited, "0"))
+	_, err := c.GetNetwork(ctx, s.root)
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusTooManyRequests || e.Code != client.CodeRateLimited {
+		t.Errorf("rate limited twice: %v", err)
+	}
+	if got := s.count(route); got != 4 {
+		t.Errorf("%d requests, want 4", got)
+	}
+}
+
+func TestAllocationRetry(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	c := client.New(s.URL(), client.WithCredentials("admin", "secret123"), client.WithRetries(3, time.Millisecond))
+	subnets := "POST /v2/networks/" + itoa(s.root) + "/allocate-subnet"
+
+	// Losing a race by mask is retried
+	s.fail(subnets, apiError(apierr.Overlap, ""), apiError(apierr.Exists, ""))
+	n, err := c.AllocateSubnet(ctx, s.root, client.SubnetRequest{Mask: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.AddressRange != "10.0.0.0/24" || s.count(subnets) != 3 {
+		t.Errorf("allocated %s in %d requests", n.AddressRange, s.count(subnets))
+	}
+
+	// A chosen CIDR is not
+	s.fail(subnets, apiError(apierr.Overlap, ""))
+	if _, err := c.AllocateSubnet(ctx, s.root, client.SubnetRequest{CIDR: "10.0.8.0/24"}); !client.IsCode(err, client.CodeOverlap) {
+		t.Errorf("injected overlap: %v", err)
+	}
+	if _, err := c.AllocateSubnet(ctx, s.root, client.SubnetRequest{CIDR: "10.0.0.0/23"}); !client.IsCode(err, client.CodeOverlap) {
+		t.Errorf("overlap: %v", err)
+	}
+	if got := s.count(subnets); got != 5 {
+		t.Errorf("%d requests, want 5", got)
+	}
+
+	// Nor are other conflicts
+	if _, err := c.AllocateSubnet(ctx, s.root, client.SubnetRequest{CIDR: "10.9.0.0/24"}); !client.IsCode(err, client.CodeOutsideNetwork) {
+		t.Errorf("outside: %v", err)
+	}
+	if got := s.count(subnets); got != 6 {
+		t.Errorf("%d requests, want 6", got)
+	}
+
+	hosts := "POST /v2/networks/" + itoa(n.ID) + "/allocate-host"
+	s.fail(hosts, apiError(apierr.Exists, ""))
+	h, err := c.AllocateHost(ctx, n.ID, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Address != "10.0.0.1" || s.count(hosts) != 2 {
+		t.Errorf("allocated %s in %d requests", h.Address, s.count(hosts))
+	}
+}
+
+func TestCancelDuringBackoff(t *testing.T) {
+	s := newTestServer(t)
+	c := client.New(s.URL(), client.WithCredentials("admin", "secret123"))
+	if _, err := c.GetNetwork(context.Background(), s.root); err != nil {
+		t.Fatal(err)
+	}
+
+	s.fail(networkRoute(s.root), apiError(apierr.RateLimited, "60"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.GetNetwork(ctx, s.root)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	c := client.New(s.URL(), client.WithCredentials("admin", "secret123"))
+
+	_, err := c.GetNetwork(ctx, 9999)
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusNotFound || e.Code != client.CodeNotFound || e.Message == "" {
+		t.Errorf("missing network: %#v", err)
+	}
+
+	_, err = c.AllocateSubnet(ctx, s.root, client.SubnetRequest{Mask: 8})
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadRequest || e.Code != client.CodeInvalid ||
+		len(e.Details) != 1 || e.Details[0].Field != "mask" {
+		t.Errorf("bad mask: %#v", err)
+	}
+
+	// Something other than the API answering
+	s.fail(networkRoute(s.root), func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	})
+	_, err = c.GetNetwork(ctx, s.root)
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadGateway || e.Code != "" || e.Message != "upstream unavailable" {
+		t.Errorf("proxy error: %#v", err)
+	}
+	if want := "gopieng: 502 upstream unavailable"; err.Error() != want {
+		t.Errorf("proxy error %q, want %q", err, want)
+	}
+}
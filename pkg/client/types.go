@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Resources as the v2 API serves them. Pointers are fields that may be
+// null.
+
+type Network struct {
+	ID           int64      `json:"id"`
+	Parent       *int64     `json:"parent"`
+	AddressRange string     `json:"address_range"`
+	Description  *string    `json:"description"`
+	Owner        *string    `json:"owner"`
+	Account      *string    `json:"account"`
+	Service      *int64     `json:"service"`
+	Subdivide    bool       `json:"subdivide"`
+	ValidMasks   []int      `json:"valid_masks"`
+	Gateway      *string    `json:"gateway"`
+	DHCPPools    *string    `json:"dhcp_pools"`
+	Discover     bool       `json:"discover"`
+	LastSwept    *time.Time `json:"last_swept"`
+}
+
+type Host struct {
+	Address     string     `json:"address"`
+	Network     int64      `json:"network"`
+	Description string     `json:"description"`
+	Hostname    *string    `json:"hostname"`
+	MAC         *string    `json:"mac"`
+	LastSeen    *time.Time `json:"last_seen"`
+}
+
+type User struct {
+	ID       int64    `json:"id"`
+	Username string   `json:"username"`
+	Status   int      `json:"status"` // 1 active, 0 disabled
+	Roles    []string `json:"roles"`
+}
+
+type Role struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// Change is a change log entry
+type Change struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Prefix string    `json:"prefix"`
+	Action string    `json:"action"`
+	User   string    `json:"user"`
+}
+
+// Page is one page of a list. Pass NextCursor as ListOptions.Cursor,
+// with the same Sort, for the next; it is "" on the last page.
+type Page[T any] struct {
+	Items      []T
+	NextCursor string
+}
+
+// ListOptions pages and orders a list. Sort is a column, with a leading
+// - for descending; the server's default order and page size of 100 are
+// used when left empty.
+type ListOptions struct {
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// Ptr returns a pointer to v, for the optional fields of updates
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// NetworkUpdate changes the fields that are set. Subdivide, Discover and
+// ValidMasks may only be changed by administrators; an empty ValidMasks
+// clears them. ClearStaleDays drops the network's stale_days.
+type NetworkUpdate struct {
+	Description    *string `json:"description,omitempty"`
+	Owner          *string `json:"owner,omitempty"`
+	Account        *string `json:"account,omitempty"`
+	Subdivide      *bool   `json:"subdivide,omitempty"`
+	Service        *int64  `json:"service,omitempty"`
+	Gateway        *string `json:"gateway,omitempty"`
+	DHCPPools      *string `json:"dhcp_pools,omitempty"`
+	Discover       *bool   `json:"discover,omitempty"`
+	StaleDays      *int    `json:"stale_days,omitempty"`
+	ClearStaleDays bool    `json:"-"`
+	ValidMasks     *[]int  `json:"valid_masks,omitempty"`
+}
+
+func (u NetworkUpdate) MarshalJSON() ([]byte, error) {
+	type plain NetworkUpdate
+	if !u.ClearStaleDays {
+		return json.Marshal(plain(u))
+	}
+	return json.Marshal(struct {
+		plain
+		StaleDays *int `json:"stale_days"`
+	}{plain: plain(u)})
+}
+
+// SubnetRequest allocates a subnet: the first free one of Mask bits, or
+// CIDR. Force lets an administrator allocate a size outside the parent's
+// valid masks.
+type SubnetRequest struct {
+	Mask        int    `json:"mask,omitempty"`
+	CIDR        string `json:"cidr,omitempty"`
+	Description string `json:"description,omitempty"`
+	Subdivide   bool   `json:"subdivide,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+}
+
+// NewHost records a host at a chosen address
+type NewHost struct {
+	Address     string  `json:"address"`
+	Description string  `json:"description"`
+	Hostname    *string `json:"hostname,omitempty"`
+	MAC         *string `json:"mac,omitempty"`
+}
+
+// HostUpdate changes the fields that are set
+type HostUpdate struct {
+	Description *string `json:"description,omitempty"`
+	Hostname    *string `json:"hostname,omitempty"`
+	MAC         *string `json:"mac,omitempty"`
+}
+
+type NewUser struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+// UserUpdate changes the fields that are set. Users may change their own
+// password; Status and Roles are only changed by administrators.
+type UserUpdate struct {
+	Password string   `json:"password,omitempty"`
+	Status   *int     `json:"status,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+}
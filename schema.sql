@@ -1,5 +1,9 @@
 -- pieng database schema
 -- PostgreSQL 12+
+--
+-- Reference copy of the schema with every migration applied. Databases
+-- are created and upgraded with "gopieng migrate up", which runs the
+-- versioned files in internal/migrate/postgres; keep the two in step.
 
 -- Networks table: hierarchical IP address blocks
 CREATE TABLE IF NOT EXISTS networks (
@@ -12,6 +16,12 @@ CREATE TABLE IF NOT EXISTS networks (
     owner VARCHAR(255),
     account VARCHAR(32),
     service INTEGER,
+    gateway INET,                    -- default router handed out by DHCP
+    dhcp_pools TEXT,                 -- dynamic ranges: "start-end,start-end"
+    discover BOOLEAN NOT NULL DEFAULT FALSE, -- sweep this leaf network on a schedule
+    last_swept TIMESTAMP,
+    stale_days INTEGER,              -- stale report threshold for this subtree
+    review TIMESTAMP,                -- marked for review by the stale report
     CONSTRAINT networks_address_range_key UNIQUE (address_range)
 );
 
@@ -25,12 +35,66 @@ CREATE INDEX IF NOT EXISTS idx_networks_address ON networks USING GIST (address_
 CREATE TABLE IF NOT EXISTS hosts (
     address INET PRIMARY KEY,
     network INTEGER NOT NULL REFERENCES networks(id),
-    description TEXT NOT NULL
+    description TEXT NOT NULL,
+    hostname VARCHAR(255),           -- FQDN for DNS zone generation
+    mac MACADDR,                     -- for DHCP reservations
+    review TIMESTAMP                 -- marked for review by the stale report
 );
 
 -- Index for fast network lookups
 CREATE INDEX IF NOT EXISTS idx_hosts_network ON hosts(network);
 
+-- Containment and overlap rules, enforced here so that hand-written SQL
+-- and racing requests can't break the tree: siblings (roots count as
+-- siblings of each other) never overlap, a network lies strictly inside
+-- its parent, and a host lies inside its network. Violations raise
+-- exclusion_violation (23P01) or check_violation (23514), which the API
+-- answers with 409. Run "gopieng check" on an existing database first.
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+DO $$ BEGIN
+    ALTER TABLE networks ADD CONSTRAINT networks_siblings_no_overlap
+        EXCLUDE USING gist ((coalesce(parent, 0)) WITH =, address_range inet_ops WITH &&);
+EXCEPTION WHEN duplicate_table OR duplicate_object THEN NULL;
+END $$;
+
+CREATE OR REPLACE FUNCTION networks_check_containment() RETURNS trigger AS $$
+BEGIN
+    IF NEW.parent IS NOT NULL AND NOT EXISTS (
+        SELECT 1 FROM networks WHERE id = NEW.parent AND address_range >> NEW.address_range) THEN
+        RAISE EXCEPTION 'network % is not inside its parent', NEW.address_range
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'networks_within_parent';
+    END IF;
+    IF TG_OP = 'UPDATE' AND NEW.address_range <> OLD.address_range THEN
+        IF EXISTS (SELECT 1 FROM networks WHERE parent = NEW.id AND NOT NEW.address_range >> address_range) THEN
+            RAISE EXCEPTION 'children of network % would fall outside %', NEW.id, NEW.address_range
+                USING ERRCODE = 'check_violation', CONSTRAINT = 'networks_within_parent';
+        END IF;
+        IF EXISTS (SELECT 1 FROM hosts WHERE network = NEW.id AND NOT NEW.address_range >>= address) THEN
+            RAISE EXCEPTION 'hosts of network % would fall outside %', NEW.id, NEW.address_range
+                USING ERRCODE = 'check_violation', CONSTRAINT = 'hosts_within_network';
+        END IF;
+    END IF;
+    RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS networks_containment ON networks;
+CREATE TRIGGER networks_containment BEFORE INSERT OR UPDATE OF parent, address_range ON networks
+    FOR EACH ROW EXECUTE FUNCTION networks_check_containment();
+
+CREATE OR REPLACE FUNCTION hosts_check_containment() RETURNS trigger AS $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM networks WHERE id = NEW.network AND address_range >>= NEW.address) THEN
+        RAISE EXCEPTION 'host % is not inside network %', host(NEW.address), NEW.network
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'hosts_within_network';
+    END IF;
+    RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS hosts_containment ON hosts;
+CREATE TRIGGER hosts_containment BEFORE INSERT OR UPDATE OF address, network ON hosts
+    FOR EACH ROW EXECUTE FUNCTION hosts_check_containment();
+
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
@@ -66,6 +130,82 @@ CREATE TABLE IF NOT EXISTS changelog (
 -- Index for recent changes
 CREATE INDEX IF NOT EXISTS idx_changelog_time ON changelog(change_time DESC);
 
+-- Dynamic DNS (RFC 2136) servers. A target applies to its network and
+-- everything below it; the most specific configured network wins.
+CREATE TABLE IF NOT EXISTS dns_update_targets (
+    id SERIAL PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    server VARCHAR(255) NOT NULL,            -- host or host:port
+    forward BOOLEAN NOT NULL DEFAULT TRUE,   -- send A/AAAA updates
+    reverse BOOLEAN NOT NULL DEFAULT TRUE,   -- send PTR updates
+    forward_zone VARCHAR(255),               -- NULL = ask the server for the SOA
+    reverse_zone VARCHAR(255),
+    key_name VARCHAR(255),                   -- TSIG key; NULL = unsigned updates
+    key_algorithm VARCHAR(32) NOT NULL DEFAULT 'hmac-sha256',
+    key_secret TEXT,                         -- base64, as in named.conf
+    ttl INTEGER NOT NULL DEFAULT 3600
+);
+
+-- Pending dynamic DNS updates, retried with backoff until sent
+CREATE TABLE IF NOT EXISTS dns_update_queue (
+    id SERIAL PRIMARY KEY,
+    target INTEGER NOT NULL REFERENCES dns_update_targets(id) ON DELETE CASCADE,
+    action VARCHAR(8) NOT NULL,              -- add or delete
+    address INET NOT NULL,
+    hostname VARCHAR(255) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created TIMESTAMP NOT NULL DEFAULT NOW(),
+    next_attempt TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Discovery sweep results: addresses that answered and the TCP ports
+-- that accepted a connection on the latest sweep
+CREATE TABLE IF NOT EXISTS discovery (
+    address INET PRIMARY KEY,
+    network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    first_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+    ports INTEGER[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS idx_discovery_network ON discovery(network);
+
+-- Latest state of each address in imported DHCP lease files
+CREATE TABLE IF NOT EXISTS dhcp_leases (
+    address INET PRIMARY KEY,
+    mac MACADDR,
+    hostname VARCHAR(255),
+    ends TIMESTAMP,
+    active BOOLEAN NOT NULL,
+    imported TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- IP to MAC observations from uploaded ARP/NDP tables; device is the
+-- router or host the table was taken from
+CREATE TABLE IF NOT EXISTS neighbors (
+    address INET NOT NULL,
+    mac MACADDR NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    interface TEXT NOT NULL DEFAULT '',
+    first_seen TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL,
+    PRIMARY KEY (address, mac, device)
+);
+
+CREATE INDEX IF NOT EXISTS idx_neighbors_mac ON neighbors(mac);
+
+-- Switch ports MACs were learned on, from uploaded MAC address tables
+CREATE TABLE IF NOT EXISTS mac_locations (
+    mac MACADDR NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    port TEXT NOT NULL,
+    vlan INTEGER NOT NULL DEFAULT 0,
+    first_seen TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL,
+    PRIMARY KEY (mac, device, port, vlan)
+);
+
 -- Default roles (matching original PieNg)
 INSERT INTO roles (name) VALUES ('administrator') ON CONFLICT DO NOTHING;
 INSERT INTO roles (name) VALUES ('creator') ON CONFLICT DO NOTHING;
@@ -83,14 +223,21 @@ INSERT INTO roles (name) VALUES ('reader') ON CONFLICT DO NOTHING;
 -- ON CONFLICT DO NOTHING;
 
 -- ============================================
--- Migration notes for existing databases
+-- Applied migrations
 -- ============================================
 
--- If upgrading from an older schema, run this to allow user deletion:
--- ALTER TABLE changelog ALTER COLUMN "user" DROP NOT NULL;
--- ALTER TABLE changelog DROP CONSTRAINT IF EXISTS changelog_user_fkey;
--- ALTER TABLE changelog ADD CONSTRAINT changelog_user_fkey 
---     FOREIGN KEY ("user") REFERENCES users(id) ON DELETE SET NULL;
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Loading this file by hand leaves the database at the latest version
+INSERT INTO schema_migrations (version, name) VALUES
+    (1, 'pieng'), (2, 'dns_dhcp'), (3, 'discovery'),
+    (4, 'neighbors'), (5, 'stale_report'), (6, 'constraints'),
+    (7, 'changelog_v6_hosts')
+ON CONFLICT DO NOTHING;
 
 -- ============================================
 -- Useful queries
@@ -8,7 +8,7 @@ export const auth = {
       headers:{'Content-Type':'application/json'},
       body: JSON.stringify({ username, password })
     })
-    if (!r.ok) throw new Error(await r.text() || r.statusText)
+    if (!r.ok) throw await apiError(r)
     return r.json()
   },
   token(){ return localStorage.getItem('pieng_token') || '' },
@@ -23,16 +23,29 @@ function authed(opts = {}){
   return { ...opts, headers: h }
 }
 
+// Error from the JSON envelope {code, message, details, request_id}, falling
+// back to the body text for responses that don't come from the API
+async function apiError(r){
+  const text = await r.text().catch(()=> '')
+  let body = null
+  try { body = JSON.parse(text) } catch {}
+  const err = new Error((body && body.message) || text || r.statusText)
+  err.status = r.status
+  err.code = body && body.code
+  err.details = body && body.details
+  err.requestId = body && body.request_id
+  return err
+}
+
 async function _fetch(url, opts = {}){
   // Prevent browser caching of API responses
   opts.cache = 'no-store'
   const r = await fetch(url, opts)
   if (!r.ok) {
-    const msg = await r.text().catch(()=> '')
     if (r.status === 401) {
       try { localStorage.removeItem('pieng_token') } catch {}
     }
-    throw new Error(msg || r.statusText)
+    throw await apiError(r)
   }
   // Always try to parse as JSON first
   const text = await r.text()